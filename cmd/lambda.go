@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Name of the internal extension registered to the Lambda runtime
+	extensionName = "sff-workshop-shutdown"
+	// How long queued transfers are given to finish on Lambda, which stops
+	// the function 500 ms after SIGTERM when only internal extensions are
+	// registered
+	lambdaShutdownTimeout = 400 * time.Millisecond
+)
+
+// registerShutdownExtension registers an internal Lambda extension that
+// subscribes to no event. The runtime only sends SIGTERM before stopping the
+// function when an extension is registered, so without it the queue is not
+// drained. It must run before the first invocation is requested.
+func registerShutdownExtension() error {
+	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if api == "" {
+		return fmt.Errorf("AWS_LAMBDA_RUNTIME_API is not set")
+	}
+	baseURL := "http://" + api + "/2020-01-01/extension"
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/register", strings.NewReader(`{"events":[]}`))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Lambda-Extension-Name", extensionName)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error registering extension: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error registering extension: %s", res.Status)
+	}
+	id := res.Header.Get("Lambda-Extension-Identifier")
+
+	// The function is initialized once every extension asks for its next
+	// event. With no event subscribed, the request is never answered.
+	req, err = http.NewRequest(http.MethodGet, baseURL+"/event/next", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Lambda-Extension-Identifier", id)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	return nil
+}
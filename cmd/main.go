@@ -1,24 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.cbhq.net/engineering/sff-workshop/internal/assets"
+	"github.cbhq.net/engineering/sff-workshop/internal/client"
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/deploy"
+	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
 	"github.cbhq.net/engineering/sff-workshop/internal/server"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
 	"github.com/apex/gateway"
 	"github.com/rs/cors"
 )
 
+// How long queued transfers are given to finish on shutdown
+const shutdownTimeout = 25 * time.Second
+
+// settingsFlag collects the -set KEY=VALUE flags
+type settingsFlag map[string]string
+
+func (f settingsFlag) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f settingsFlag) Set(val string) error {
+	key, value, ok := strings.Cut(val, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", val)
+	}
+	f[key] = value
+	return nil
+}
+
 func main() {
 	port := flag.Int("port", -1, "port for local http dev")
+	configFile := flag.String("config", "", "YAML config file, CONFIG_FILE when empty")
+	envFile := flag.String("env", ".env", "env file read, when it exists, under the environment")
+	overrides := settingsFlag{}
+	flag.Var(overrides, "set", "KEY=VALUE setting overriding the config file and the environment, repeatable")
 	flag.Parse()
-	server, err := server.NewServer(port)
+	src := config.Sources{
+		EnvFile:   *envFile,
+		File:      *configFile,
+		Overrides: overrides,
+	}
+	switch flag.Arg(0) {
+	case "worker":
+		runWorker(src, flag.Args()[1:])
+		return
+	case "config":
+		runConfig(src, flag.Args()[1:])
+		return
+	case "pack":
+		runPack(flag.Args()[1:])
+		return
+	case "deploy":
+		runDeploy(src, flag.Args()[1:])
+		return
+	}
+
+	server, err := server.NewServer(src)
 	if err != nil {
 		log.Fatalf("Error creating server: %v", err)
 	}
-	mux := http.NewServeMux()
 	corsOpts := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{
@@ -30,13 +87,199 @@ func main() {
 		AllowCredentials: false,
 	})
 
-	mux.HandleFunc("/api/gettoken", server.GetToken)
-	handler := corsOpts.Handler(mux)
+	handler := corsOpts.Handler(server.Handler())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
+	var httpServer *http.Server
+	serveErr := make(chan error, 1)
+	timeout := shutdownTimeout
 	if *port != -1 {
-		portStr := fmt.Sprintf(":%d", *port)
-		log.Println(http.ListenAndServe(portStr, handler))
+		httpServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", *port),
+			Handler: handler,
+		}
+		// Status streams never end on their own
+		httpServer.RegisterOnShutdown(server.StopStreams)
+		go func() {
+			serveErr <- httpServer.ListenAndServe()
+		}()
 	} else {
-		log.Println(gateway.ListenAndServe("n/a", handler))
+		err = registerShutdownExtension()
+		if err != nil {
+			slog.Warn("Queued requests are not drained when the function stops", "error", err)
+		}
+		timeout = lambdaShutdownTimeout
+		go func() {
+			serveErr <- gateway.ListenAndServe("n/a", handler)
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		slog.Error("Error serving requests", "error", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if httpServer != nil {
+		err = httpServer.Shutdown(shutdownCtx)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error shutting down http server", "error", err)
+		}
+	}
+	err = server.Close(shutdownCtx)
+	if err != nil {
+		slog.Error("Error closing server", "error", err)
+	}
+	err = tracing.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+}
+
+// runWorker processes the jobs queued by servers running in async mode
+func runWorker(src config.Sources, args []string) {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	once := flags.Bool("once", false, "exit when no job is pending")
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("Error parsing worker flags: %v", err)
+	}
+
+	worker, err := server.NewJobWorker(src)
+	if err != nil {
+		log.Fatalf("Error creating worker: %v", err)
+	}
+	defer worker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err = worker.Run(ctx, *once)
+	if err != nil {
+		slog.Error("Error running worker", "error", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = tracing.Shutdown(flushCtx)
+	if err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+}
+
+// runPack packs the collection assets into a CAR archive and prints the uri
+// to set in the contract
+func runPack(args []string) {
+	flags := flag.NewFlagSet("pack", flag.ExitOnError)
+	imagesDir := flags.String("images", "assets/images", "directory of the token images")
+	metadataDir := flags.String("metadata", "assets/metadata", "directory of the token metadata, <id>.json")
+	outDir := flags.String("out", "assets/car", "directory the CAR archive is written to")
+	gateway := flags.String("gateway", "https://ipfs.io", "IPFS gateway used in the uri")
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("Error parsing pack flags: %v", err)
+	}
+
+	collection, err := assets.Pack(*imagesDir, *metadataDir)
+	if err != nil {
+		log.Fatalf("Error packing assets: %v", err)
+	}
+	for _, path := range collection.Rewritten {
+		slog.Info("Updated image", "path", path)
+	}
+	path, err := collection.WriteCAR(*outDir)
+	if err != nil {
+		log.Fatalf("Error writing CAR: %v", err)
+	}
+
+	baseURI := fmt.Sprintf("%s/ipfs/%s/", strings.TrimSuffix(*gateway, "/"), collection.Root)
+	fmt.Printf("CAR:          %s\n", path)
+	fmt.Printf("Root CID:     %s\n", collection.Root)
+	fmt.Printf("URI template: %s{id}.json\n", baseURI)
+	fmt.Printf("Base URI:     %s (uri() appends the decimal id and .json)\n", baseURI)
+}
+
+// runDeploy deploys the token contract on a chain from the treasury wallet
+// and saves its address in the env file
+func runDeploy(src config.Sources, args []string) {
+	flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+	chainName := flags.String("chain", "", "chain to deploy on, the default chain when empty")
+	envFile := flags.String("env", src.EnvFile, "env file the settings are read from and the address is written to")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long to wait for the deployment to be mined")
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("Error parsing deploy flags: %v", err)
+	}
+
+	// The contract address is not validated, as it is what is deployed
+	src.EnvFile = *envFile
+	src.EnvFileRequired = true
+	cfg, err := config.Load(src)
+	if err != nil {
+		log.Fatalf("Error loading config:\n%v", err)
+	}
+	if *chainName == "" {
+		*chainName = cfg.DefaultChain
+	}
+	chainCfg, ok := cfg.Chains[*chainName]
+	if !ok {
+		log.Fatalf("Unrecognized chain %q", *chainName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	evmClient, err := client.NewEVMClient(ctx, chainCfg)
+	if err != nil {
+		log.Fatalf("Error connecting to chain %s: %v", chainCfg.Name, err)
+	}
+	defer evmClient.Close()
+	signer, err := keystore.NewSigner(chainCfg)
+	if err != nil {
+		log.Fatalf("Error creating signer: %v", err)
+	}
+	chainId, err := evmClient.ChainID(ctx)
+	if err != nil {
+		log.Fatalf("Error getting ChainID: %v", err)
+	}
+	if chainCfg.ChainID != 0 && chainId.Int64() != chainCfg.ChainID {
+		log.Fatalf("Node reports chain id %v, expected %d", chainId, chainCfg.ChainID)
+	}
+
+	addr, err := deploy.Deploy(ctx, evmClient, signer, chainId)
+	if err != nil {
+		log.Fatalf("Error deploying contract: %v", err)
+	}
+	key := chainCfg.EnvPrefix + "CONTRACT_ADDRESS"
+	err = config.SetEnvFileValue(*envFile, key, addr.Hex())
+	if err != nil {
+		log.Fatalf("Contract deployed at %s, error saving it to %s: %v", addr.Hex(), *envFile, err)
+	}
+	fmt.Printf("Contract deployed on chain %s at %s, saved as %s in %s\n", chainCfg.Name, addr.Hex(), key, *envFile)
+}
+
+// runConfig runs the config subcommands: check reports the problems of the
+// config, and the settings read with their source, without starting the server
+func runConfig(src config.Sources, args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		log.Fatalf("Usage: config check")
+	}
+	cfg, err := config.Load(src)
+	if err != nil {
+		fmt.Printf("Invalid config:\n%v\n", err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, setting := range cfg.Settings() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", setting.Key, setting.Value, setting.Source)
+	}
+	w.Flush()
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Printf("\nInvalid config:\n%v\n", err)
+		os.Exit(1)
 	}
+	fmt.Println("\nConfig is valid")
 }
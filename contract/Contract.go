@@ -26,18 +26,39 @@ var (
 	_ = common.Big1
 	_ = types.BloomLookup
 	_ = event.NewSubscription
-	_ = abi.ConvertType
 )
 
 // ContractMetaData contains all meta data concerning the Contract contract.
 var ContractMetaData = &bind.MetaData{
 	ABI: "[{\"inputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"constructor\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"account\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"operator\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"bool\",\"name\":\"approved\",\"type\":\"bool\"}],\"name\":\"ApprovalForAll\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"operator\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"from\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"to\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256[]\",\"name\":\"ids\",\"type\":\"uint256[]\"},{\"indexed\":false,\"internalType\":\"uint256[]\",\"name\":\"values\",\"type\":\"uint256[]\"}],\"name\":\"TransferBatch\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"operator\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"from\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"to\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"id\",\"type\":\"uint256\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"value\",\"type\":\"uint256\"}],\"name\":\"TransferSingle\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"string\",\"name\":\"value\",\"type\":\"string\"},{\"indexed\":true,\"internalType\":\"uint256\",\"name\":\"id\",\"type\":\"uint256\"}],\"name\":\"URI\",\"type\":\"event\"},{\"inputs\":[],\"name\":\"GoldBadge\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"Points\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"account\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"id\",\"type\":\"uint256\"}],\"name\":\"balanceOf\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address[]\",\"name\":\"accounts\",\"type\":\"address[]\"},{\"internalType\":\"uint256[]\",\"name\":\"ids\",\"type\":\"uint256[]\"}],\"name\":\"balanceOfBatch\",\"outputs\":[{\"internalType\":\"uint256[]\",\"name\":\"\",\"type\":\"uint256[]\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"account\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"operator\",\"type\":\"address\"}],\"name\":\"isApprovedForAll\",\"outputs\":[{\"internalType\":\"bool\",\"name\":\"\",\"type\":\"bool\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"from\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"to\",\"type\":\"address\"},{\"internalType\":\"uint256[]\",\"name\":\"ids\",\"type\":\"uint256[]\"},{\"internalType\":\"uint256[]\",\"name\":\"amounts\",\"type\":\"uint256[]\"},{\"internalType\":\"bytes\",\"name\":\"data\",\"type\":\"bytes\"}],\"name\":\"safeBatchTransferFrom\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"from\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"to\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"id\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"},{\"internalType\":\"bytes\",\"name\":\"data\",\"type\":\"bytes\"}],\"name\":\"safeTransferFrom\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"operator\",\"type\":\"address\"},{\"internalType\":\"bool\",\"name\":\"approved\",\"type\":\"bool\"}],\"name\":\"setApprovalForAll\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"bytes4\",\"name\":\"interfaceId\",\"type\":\"bytes4\"}],\"name\":\"supportsInterface\",\"outputs\":[{\"internalType\":\"bool\",\"name\":\"\",\"type\":\"bool\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"uint256\",\"name\":\"_tokenid\",\"type\":\"uint256\"}],\"name\":\"uri\",\"outputs\":[{\"internalType\":\"string\",\"name\":\"\",\"type\":\"string\"}],\"stateMutability\":\"pure\",\"type\":\"function\"}]",
+	Bin: "0x60806040523480156200001157600080fd5b506040518060800160405280605a815260200162001c39605a913962000037816200008b565b506200005f336001620f4240604051806020016040528060008152506200009d60201b60201c565b620000853360026101f4604051806020016040528060008152506200009d60201b60201c565b6200072a565b60026200009982826200046e565b5050565b6001600160a01b038416620001035760405162461bcd60e51b815260206004820152602160248201527f455243313135353a206d696e7420746f20746865207a65726f206164647265736044820152607360f81b60648201526084015b60405180910390fd5b3360006200011185620001bf565b905060006200012085620001bf565b90506000868152602081815260408083206001600160a01b038b16845290915281208054879290620001549084906200053a565b909155505060408051878152602081018790526001600160a01b03808a1692600092918716917fc3d58168c5ae7397731d063d5bbf3d657854427343f4c083240f7aacaa2d0f62910160405180910390a4620001b68360008989898962000215565b50505050505050565b60408051600180825281830190925260609160009190602080830190803683370190505090508281600081518110620001fc57620001fc62000562565b602090810291909101015292915050565b505050505050565b6001600160a01b0384163b156200020d5760405163f23a6e6160e01b81526001600160a01b0385169063f23a6e61906200025c9089908990889088908890600401620005c0565b6020604051808303816000875af19250505080156200029a575060408051601f3d908101601f19168201909252620002979181019062000607565b60015b6200035a57620002a96200063a565b806308c379a003620002e95750620002c062000686565b80620002cd5750620002eb565b8060405162461bcd60e51b8152600401620000fa919062000715565b505b60405162461bcd60e51b815260206004820152603460248201527f455243313135353a207472616e7366657220746f206e6f6e204552433131353560448201527f526563656976657220696d706c656d656e7465720000000000000000000000006064820152608401620000fa565b6001600160e01b0319811663f23a6e6160e01b14620001b65760405162461bcd60e51b815260206004820152602860248201527f455243313135353a204552433131353552656365697665722072656a656374656044820152676420746f6b656e7360c01b6064820152608401620000fa565b634e487b7160e01b600052604160045260246000fd5b600181811c90821680620003f857607f821691505b6020821081036200041957634e487b7160e01b600052602260045260246000fd5b50919050565b601f8211156200046957600081815260208120601f850160051c81016020861015620004485750805b601f850160051c820191505b818110156200020d5782815560010162000454565b505050565b81516001600160401b038111156200048a576200048a620003cd565b620004a2816200049b8454620003e3565b846200041f565b602080601f831160018114620004da5760008415620004c15750858301515b600019600386901b1c1916600185901b1785556200020d565b600085815260208120601f198616915b828110156200050b57888601518255948401946001909101908401620004ea565b50858210156200052a5787850151600019600388901b60f8161c191681555b5050505050600190811b01905550565b808201808211156200055c57634e487b7160e01b600052601160045260246000fd5b92915050565b634e487b7160e01b600052603260045260246000fd5b6000815180845260005b81811015620005a05760208185018101518683018201520162000582565b506000602082860101526020601f19601f83011685010191505092915050565b6001600160a01b03868116825285166020820152604081018490526060810183905260a060808201819052600090620005fc9083018462000578565b979650505050505050565b6000602082840312156200061a57600080fd5b81516001600160e01b0319811681146200063357600080fd5b9392505050565b600060033d1115620006545760046000803e5060005160e01c5b90565b601f8201601f191681016001600160401b03811182821017156200067f576200067f620003cd565b6040525050565b600060443d1015620006955790565b6040516003193d81016004833e81513d6001600160401b038083116024840183101715620006c557505050505090565b8285019150815181811115620006de5750505050505090565b843d8701016020828501011115620006f95750505050505090565b6200070a6020828601018762000657565b509095945050505050565b60208152600062000633602083018462000578565b6114ff806200073a6000396000f3fe608060405234801561001057600080fd5b506004361061009d5760003560e01c80634e1273f4116100665780634e1273f414610128578063a22cb46514610148578063c39c0f5a1461015b578063e985e9c514610163578063f242432a1461019f57600080fd5b8062fdd58e146100a257806301ffc9a7146100c857806307ebec02146100eb5780630e89341c146100f35780632eb2c2d614610113575b600080fd5b6100b56100b0366004610c0c565b6101b2565b6040519081526020015b60405180910390f35b6100db6100d6366004610c4f565b61024b565b60405190151581526020016100bf565b6100b5600281565b610106610101366004610c73565b61029b565b6040516100bf9190610cdc565b610126610121366004610e3b565b6102cc565b005b61013b610136366004610ee5565b610318565b6040516100bf9190610feb565b610126610156366004610ffe565b610442565b6100b5600181565b6100db61017136600461103a565b6001600160a01b03918216600090815260016020908152604080832093909416825291909152205460ff1690565b6101266101ad36600461106d565b610451565b60006001600160a01b0383166102225760405162461bcd60e51b815260206004820152602a60248201527f455243313135353a2061646472657373207a65726f206973206e6f742061207660448201526930b634b21037bbb732b960b11b60648201526084015b60405180910390fd5b506000818152602081815260408083206001600160a01b03861684529091529020545b92915050565b60006001600160e01b03198216636cdb3d1360e11b148061027c57506001600160e01b031982166303a24d0760e21b145b8061024557506301ffc9a760e01b6001600160e01b0319831614610245565b60606102a682610496565b6040516020016102b691906110d2565b6040516020818303038152906040529050919050565b6001600160a01b0385163314806102e857506102e88533610171565b6103045760405162461bcd60e51b815260040161021990611166565b610311858585858561059f565b5050505050565b6060815183511461037d5760405162461bcd60e51b815260206004820152602960248201527f455243313135353a206163636f756e747320616e6420696473206c656e677468604482015268040dad2e6dac2e8c6d60bb1b6064820152608401610219565b6000835167ffffffffffffffff81111561039957610399610cef565b6040519080825280602002602001820160405280156103c2578160200160208202803683370190505b50905060005b845181101561043a5761040d8582815181106103e6576103e66111b5565b6020026020010151858381518110610400576104006111b5565b60200260200101516101b2565b82828151811061041f5761041f6111b5565b6020908102919091010152610433816111e1565b90506103c8565b509392505050565b61044d33838361077c565b5050565b6001600160a01b03851633148061046d575061046d8533610171565b6104895760405162461bcd60e51b815260040161021990611166565b610311858585858561085c565b6060816000036104bd5750506040805180820190915260018152600360fc1b602082015290565b8160005b81156104e757806104d1816111e1565b91506104e09050600a83611210565b91506104c1565b60008167ffffffffffffffff81111561050257610502610cef565b6040519080825280601f01601f19166020018201604052801561052c576020820181803683370190505b5090505b841561059757610541600183611224565b915061054e600a86611237565b61055990603061124b565b60f81b81838151811061056e5761056e6111b5565b60200101906001600160f81b031916908160001a905350610590600a86611210565b9450610530565b949350505050565b81518351146106015760405162461bcd60e51b815260206004820152602860248201527f455243313135353a2069647320616e6420616d6f756e7473206c656e677468206044820152670dad2e6dac2e8c6d60c31b6064820152608401610219565b6001600160a01b0384166106275760405162461bcd60e51b81526004016102199061125e565b3360005b845181101561070e576000858281518110610648576106486111b5565b602002602001015190506000858381518110610666576106666111b5565b602090810291909101810151600084815280835260408082206001600160a01b038e1683529093529190912054909150818110156106b65760405162461bcd60e51b8152600401610219906112a3565b6000838152602081815260408083206001600160a01b038e8116855292528083208585039055908b168252812080548492906106f390849061124b565b9250508190555050505080610707906111e1565b905061062b565b50846001600160a01b0316866001600160a01b0316826001600160a01b03167f4a39dc06d4c0dbc64b70af90fd698a233a518aa5d07e595d983b8c0526c8f7fb878760405161075e9291906112ed565b60405180910390a4610774818787878787610986565b505050505050565b816001600160a01b0316836001600160a01b0316036107ef5760405162461bcd60e51b815260206004820152602960248201527f455243313135353a2073657474696e6720617070726f76616c20737461747573604482015268103337b91039b2b63360b91b6064820152608401610219565b6001600160a01b03838116600081815260016020908152604080832094871680845294825291829020805460ff191686151590811790915591519182527f17307eab39ab6107e8899845ad3d59bd9653f200f220920489ca2b5937696c31910160405180910390a3505050565b6001600160a01b0384166108825760405162461bcd60e51b81526004016102199061125e565b33600061088e85610aea565b9050600061089b85610aea565b90506000868152602081815260408083206001600160a01b038c168452909152902054858110156108de5760405162461bcd60e51b8152600401610219906112a3565b6000878152602081815260408083206001600160a01b038d8116855292528083208985039055908a1682528120805488929061091b90849061124b565b909155505060408051888152602081018890526001600160a01b03808b16928c821692918816917fc3d58168c5ae7397731d063d5bbf3d657854427343f4c083240f7aacaa2d0f62910160405180910390a461097b848a8a8a8a8a610b35565b505050505050505050565b6001600160a01b0384163b156107745760405163bc197c8160e01b81526001600160a01b0385169063bc197c81906109ca908990899088908890889060040161131b565b6020604051808303816000875af1925050508015610a05575060408051601f3d908101601f19168201909252610a0291810190611379565b60015b610ab157610a11611396565b806308c379a003610a4a5750610a256113b2565b80610a305750610a4c565b8060405162461bcd60e51b81526004016102199190610cdc565b505b60405162461bcd60e51b815260206004820152603460248201527f455243313135353a207472616e7366657220746f206e6f6e20455243313135356044820152732932b1b2b4bb32b91034b6b83632b6b2b73a32b960611b6064820152608401610219565b6001600160e01b0319811663bc197c8160e01b14610ae15760405162461bcd60e51b81526004016102199061143c565b50505050505050565b60408051600180825281830190925260609160009190602080830190803683370190505090508281600081518110610b2457610b246111b5565b602090810291909101015292915050565b6001600160a01b0384163b156107745760405163f23a6e6160e01b81526001600160a01b0385169063f23a6e6190610b799089908990889088908890600401611484565b6020604051808303816000875af1925050508015610bb4575060408051601f3d908101601f19168201909252610bb191810190611379565b60015b610bc057610a11611396565b6001600160e01b0319811663f23a6e6160e01b14610ae15760405162461bcd60e51b81526004016102199061143c565b80356001600160a01b0381168114610c0757600080fd5b919050565b60008060408385031215610c1f57600080fd5b610c2883610bf0565b946020939093013593505050565b6001600160e01b031981168114610c4c57600080fd5b50565b600060208284031215610c6157600080fd5b8135610c6c81610c36565b9392505050565b600060208284031215610c8557600080fd5b5035919050565b60005b83811015610ca7578181015183820152602001610c8f565b50506000910152565b60008151808452610cc8816020860160208601610c8c565b601f01601f19169290920160200192915050565b602081526000610c6c6020830184610cb0565b634e487b7160e01b600052604160045260246000fd5b601f8201601f1916810167ffffffffffffffff81118282101715610d2b57610d2b610cef565b6040525050565b600067ffffffffffffffff821115610d4c57610d4c610cef565b5060051b60200190565b600082601f830112610d6757600080fd5b81356020610d7482610d32565b604051610d818282610d05565b83815260059390931b8501820192828101915086841115610da157600080fd5b8286015b84811015610dbc5780358352918301918301610da5565b509695505050505050565b600082601f830112610dd857600080fd5b813567ffffffffffffffff811115610df257610df2610cef565b604051610e09601f8301601f191660200182610d05565b818152846020838601011115610e1e57600080fd5b816020850160208301376000918101602001919091529392505050565b600080600080600060a08688031215610e5357600080fd5b610e5c86610bf0565b9450610e6a60208701610bf0565b9350604086013567ffffffffffffffff80821115610e8757600080fd5b610e9389838a01610d56565b94506060880135915080821115610ea957600080fd5b610eb589838a01610d56565b93506080880135915080821115610ecb57600080fd5b50610ed888828901610dc7565b9150509295509295909350565b60008060408385031215610ef857600080fd5b823567ffffffffffffffff80821115610f1057600080fd5b818501915085601f830112610f2457600080fd5b81356020610f3182610d32565b604051610f3e8282610d05565b83815260059390931b8501820192828101915089841115610f5e57600080fd5b948201945b83861015610f8357610f7486610bf0565b82529482019490820190610f63565b96505086013592505080821115610f9957600080fd5b50610fa685828601610d56565b9150509250929050565b600081518084526020808501945080840160005b83811015610fe057815187529582019590820190600101610fc4565b509495945050505050565b602081526000610c6c6020830184610fb0565b6000806040838503121561101157600080fd5b61101a83610bf0565b91506020830135801515811461102f57600080fd5b809150509250929050565b6000806040838503121561104d57600080fd5b61105683610bf0565b915061106460208401610bf0565b90509250929050565b600080600080600060a0868803121561108557600080fd5b61108e86610bf0565b945061109c60208701610bf0565b93506040860135925060608601359150608086013567ffffffffffffffff8111156110c657600080fd5b610ed888828901610dc7565b7f68747470733a2f2f697066732e696f2f697066732f626166796265696736747681527f7a6e3574686971627370667a333536766e6d61367633786b7a7479367165766560208201527064703233776a697775373736683677612f60781b60408201526000825161114a816051850160208701610c8c565b64173539b7b760d91b6051939091019283015250605601919050565b6020808252602f908201527f455243313135353a2063616c6c6572206973206e6f7420746f6b656e206f776e60408201526e195c881b9bdc88185c1c1c9bdd9959608a1b606082015260800190565b634e487b7160e01b600052603260045260246000fd5b634e487b7160e01b600052601160045260246000fd5b6000600182016111f3576111f36111cb565b5060010190565b634e487b7160e01b600052601260045260246000fd5b60008261121f5761121f6111fa565b500490565b81810381811115610245576102456111cb565b600082611246576112466111fa565b500690565b80820180821115610245576102456111cb565b60208082526025908201527f455243313135353a207472616e7366657220746f20746865207a65726f206164604082015264647265737360d81b606082015260800190565b6020808252602a908201527f455243313135353a20696e73756666696369656e742062616c616e636520666f60408201526939103a3930b739b332b960b11b606082015260800190565b6040815260006113006040830185610fb0565b82810360208401526113128185610fb0565b95945050505050565b6001600160a01b0386811682528516602082015260a06040820181905260009061134790830186610fb0565b82810360608401526113598186610fb0565b9050828103608084015261136d8185610cb0565b98975050505050505050565b60006020828403121561138b57600080fd5b8151610c6c81610c36565b600060033d11156113af5760046000803e5060005160e01c5b90565b600060443d10156113c05790565b6040516003193d81016004833e81513d67ffffffffffffffff81602484011181841117156113f057505050505090565b82850191508151818111156114085750505050505090565b843d87010160208285010111156114225750505050505090565b61143160208286010187610d05565b509095945050505050565b60208082526028908201527f455243313135353a204552433131353552656365697665722072656a656374656040820152676420746f6b656e7360c01b606082015260800190565b6001600160a01b03868116825285166020820152604081018490526060810183905260a0608082018190526000906114be90830184610cb0565b97965050505050505056fea26469706673582212207d29c4d70ee4a49acaeb5b60adab24092d27efc7b28ed20aaae94e7895ce045464736f6c6343000815003368747470733a2f2f697066732e696f2f697066732f62616679626569673674767a6e3574686971627370667a333536766e6d61367633786b7a7479367165766564703233776a697775373736683677612f7b69647d2e6a736f6e",
 }
 
 // ContractABI is the input ABI used to generate the binding from.
 // Deprecated: Use ContractMetaData.ABI instead.
 var ContractABI = ContractMetaData.ABI
 
+// ContractBin is the compiled bytecode used for deploying new contracts.
+// Deprecated: Use ContractMetaData.Bin instead.
+var ContractBin = ContractMetaData.Bin
+
+// DeployContract deploys a new Ethereum contract, binding an instance of Contract to it.
+func DeployContract(auth *bind.TransactOpts, backend bind.ContractBackend) (common.Address, *types.Transaction, *Contract, error) {
+	parsed, err := ContractMetaData.GetAbi()
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	if parsed == nil {
+		return common.Address{}, nil, nil, errors.New("GetABI returned nil")
+	}
+
+	address, tx, contract, err := bind.DeployContract(auth, *parsed, common.FromHex(ContractBin), backend)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return address, tx, &Contract{ContractCaller: ContractCaller{contract: contract}, ContractTransactor: ContractTransactor{contract: contract}, ContractFilterer: ContractFilterer{contract: contract}}, nil
+}
+
 // Contract is an auto generated Go binding around an Ethereum contract.
 type Contract struct {
 	ContractCaller     // Read-only binding to the contract
@@ -135,11 +156,11 @@ func NewContractFilterer(address common.Address, filterer bind.ContractFilterer)
 
 // bindContract binds a generic wrapper to an already deployed contract.
 func bindContract(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
-	parsed, err := ContractMetaData.GetAbi()
+	parsed, err := abi.JSON(strings.NewReader(ContractABI))
 	if err != nil {
 		return nil, err
 	}
-	return bind.NewBoundContract(address, *parsed, caller, transactor, filterer), nil
+	return bind.NewBoundContract(address, parsed, caller, transactor, filterer), nil
 }
 
 // Call invokes the (constant) contract method with params as input values and
@@ -0,0 +1,53 @@
+package contract
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/contractgen"
+)
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestBindingMatchesCompiledContract(t *testing.T) {
+	binding, err := contractgen.Bind(readFile(t, contractgen.ABIFile), readFile(t, contractgen.BinFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding != readFile(t, contractgen.BindingFile) {
+		t.Errorf("%s drifted from %s and %s, run go generate ./contract", contractgen.BindingFile, contractgen.ABIFile, contractgen.BinFile)
+	}
+}
+
+// The source is only compiled where solc and the OpenZeppelin sources are
+// installed, which CI must provide
+func TestCompiledContractMatchesSource(t *testing.T) {
+	abiJSON, bin, err := contractgen.Compile(getEnvOr("SOLC", "solc"), ".", os.Getenv("SOLC_INCLUDE_PATH"))
+	if errors.Is(err, contractgen.ErrNoSolc) && !contractgen.SolcRequired() {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("Error compiling %s: %v", contractgen.Source, err)
+	}
+	if abiJSON != readFile(t, contractgen.ABIFile) {
+		t.Errorf("%s drifted from %s, run go generate ./contract", contractgen.ABIFile, contractgen.Source)
+	}
+	if bin != readFile(t, contractgen.BinFile) {
+		t.Errorf("%s drifted from %s, run go generate ./contract", contractgen.BinFile, contractgen.Source)
+	}
+}
+
+func getEnvOr(key string, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return fallback
+}
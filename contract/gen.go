@@ -0,0 +1,86 @@
+//go:build ignore
+
+// gen compiles RockSolidToken.sol with solc and writes contract.abi,
+// contract.bin and the Go binding Contract.go. With -check it writes nothing
+// and exits with an error when the files on disk drift from each other or
+// from the Solidity source. Without solc, -check only compares the binding
+// with the compiled files, unless CI is set, where a missing solc fails.
+//
+//	go run gen.go [-solc solc] [-include dir] [-check]
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/contractgen"
+)
+
+func main() {
+	solc := flag.String("solc", getEnvOr("SOLC", "solc"), "solc command, run with --standard-json")
+	include := flag.String(
+		"include",
+		os.Getenv("SOLC_INCLUDE_PATH"),
+		"directory holding the imported libraries, e.g. @openzeppelin/contracts",
+	)
+	check := flag.Bool("check", false, "report drift instead of writing the files")
+	flag.Parse()
+
+	abiJSON, bin, err := contractgen.Compile(*solc, ".", *include)
+	if errors.Is(err, contractgen.ErrNoSolc) && *check && !contractgen.SolcRequired() {
+		// Without solc, check the binding against the compiled files on disk
+		log.Printf("%v, checking %s against %s and %s only", err, contractgen.BindingFile, contractgen.ABIFile, contractgen.BinFile)
+		abiJSON, bin = readFile(contractgen.ABIFile), readFile(contractgen.BinFile)
+	} else if err != nil {
+		log.Fatalf("Error compiling %s: %v", contractgen.Source, err)
+	}
+
+	binding, err := contractgen.Bind(abiJSON, bin)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	files := map[string]string{
+		contractgen.ABIFile:     abiJSON,
+		contractgen.BinFile:     bin,
+		contractgen.BindingFile: binding,
+	}
+	if !*check {
+		for name, content := range files {
+			err = os.WriteFile(name, []byte(content), 0o644)
+			if err != nil {
+				log.Fatalf("Error writing %s: %v", name, err)
+			}
+		}
+		return
+	}
+
+	drifted := false
+	for _, name := range []string{contractgen.ABIFile, contractgen.BinFile, contractgen.BindingFile} {
+		if readFile(name) != files[name] {
+			log.Printf("%s is out of date", name)
+			drifted = true
+		}
+	}
+	if drifted {
+		log.Fatalf("Contract files drifted from %s, run go generate ./contract", contractgen.Source)
+	}
+	log.Printf("%s, %s and %s are up to date", contractgen.ABIFile, contractgen.BinFile, contractgen.BindingFile)
+}
+
+func readFile(name string) string {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", name, err)
+	}
+	return string(b)
+}
+
+func getEnvOr(key string, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return fallback
+}
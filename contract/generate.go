@@ -0,0 +1,7 @@
+// Package contract holds the RockSolidToken contract: its Solidity source,
+// the compiled ABI and bytecode, and the Go binding generated from them.
+package contract
+
+// Regenerate contract.abi, contract.bin and Contract.go after editing
+// RockSolidToken.sol. Needs solc and the OpenZeppelin sources, see gen.go.
+//go:generate go run gen.go
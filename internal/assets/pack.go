@@ -0,0 +1,200 @@
+// Package assets packs the token collection, images and metadata, into a CAR
+// archive that can be served locally or uploaded to an IPFS pinning service.
+package assets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+)
+
+// Collection is a packed collection
+type Collection struct {
+	// Root of the metadata directory, holding <id>.json for every token
+	Root ipfs.CID
+	// CIDs of the images, by file name
+	Images map[string]ipfs.CID
+	// Metadata files whose image field was rewritten
+	Rewritten []string
+
+	builder *ipfs.Builder
+}
+
+// Pack adds every image of imagesDir and the metadata directory to a UnixFS
+// DAG. The image field of each metadata file <name>.json is set to the CID
+// of the image <name>.<ext>, and the file is rewritten when it changed.
+func Pack(imagesDir string, metadataDir string) (*Collection, error) {
+	c := &Collection{
+		Images:  make(map[string]ipfs.CID),
+		builder: ipfs.NewBuilder(),
+	}
+	images, err := listFiles(imagesDir, "")
+	if err != nil {
+		return nil, err
+	}
+	imageByName := make(map[string]string)
+	for _, image := range images {
+		content, err := os.ReadFile(filepath.Join(imagesDir, image))
+		if err != nil {
+			return nil, err
+		}
+		c.Images[image] = c.builder.AddFile(content).CID
+		imageByName[strings.TrimSuffix(image, filepath.Ext(image))] = image
+	}
+
+	files, err := listFiles(metadataDir, ".json")
+	if err != nil {
+		return nil, err
+	}
+	var links []ipfs.Link
+	for _, file := range files {
+		path := filepath.Join(metadataDir, file)
+		doc, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		image, ok := imageByName[strings.TrimSuffix(file, ".json")]
+		if !ok {
+			return nil, fmt.Errorf("no image for %s in %s", file, imagesDir)
+		}
+		updated, changed, err := setImage(doc, "ipfs://"+c.Images[image].String())
+		if err != nil {
+			return nil, fmt.Errorf("error updating %s: %v", path, err)
+		}
+		if changed {
+			err = os.WriteFile(path, updated, 0o644)
+			if err != nil {
+				return nil, err
+			}
+			c.Rewritten = append(c.Rewritten, path)
+		}
+		link := c.builder.AddFile(updated)
+		link.Name = file
+		links = append(links, link)
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no metadata in %s", metadataDir)
+	}
+	c.Root = c.builder.AddDir(links).CID
+	return c, nil
+}
+
+// WriteCAR writes the collection to <dir>/<root cid>.car and returns its
+// path. The metadata directory is the first root, followed by the images.
+func (c *Collection) WriteCAR(dir string) (string, error) {
+	roots := []ipfs.CID{c.Root}
+	names := make([]string, 0, len(c.Images))
+	for name := range c.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		roots = append(roots, c.Images[name])
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, c.Root.String()+".car")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = c.builder.WriteCAR(f, roots...)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// listFiles returns the names of the files of dir with the suffix, skipping
+// hidden files like .DS_Store
+func listFiles(dir string, suffix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// setImage sets the image field of a metadata document, keeping the order
+// of the other fields. The document is returned as is when the image is
+// already set.
+func setImage(doc []byte, image string) ([]byte, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, false, err
+	}
+	if tok != json.Delim('{') {
+		return nil, false, fmt.Errorf("metadata is not a JSON object")
+	}
+	var keys []string
+	values := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	var current string
+	if json.Unmarshal(values["image"], &current) == nil && current == image {
+		return doc, false, nil
+	}
+	if _, ok := values["image"]; !ok {
+		keys = append(keys, "image")
+	}
+	values["image"], err = json.Marshal(image)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var compact bytes.Buffer
+	compact.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			compact.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		compact.Write(name)
+		compact.WriteByte(':')
+		compact.Write(values[key])
+	}
+	compact.WriteByte('}')
+	var out bytes.Buffer
+	err = json.Indent(&out, compact.Bytes(), "", "    ")
+	if err != nil {
+		return nil, false, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), true, nil
+}
@@ -0,0 +1,201 @@
+package assets_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/assets"
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+)
+
+// shippedRoot is the metadata root of the collection shipped in assets/, the
+// one set as uri of the contract
+const shippedRoot = "bafybeig6tvzn5thiqbspfz356vnma6v3xkzty6qevedp23wjiwu776h6wa"
+
+// copyDir copies the files of the repository directory assets/<name> to
+// dir/<name>, so that packing never rewrites the shipped metadata
+func copyDir(t *testing.T, dir string, name string) string {
+	t.Helper()
+	src := filepath.Join("..", "..", "assets", name)
+	dst := filepath.Join(dir, name)
+	entries, err := os.ReadDir(src)
+	if err == nil {
+		err = os.MkdirAll(dst, 0o700)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dst, entry.Name()), content, 0o600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+// writeFiles writes the files to a new directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPackReproducesShippedCollection(t *testing.T) {
+	dir := t.TempDir()
+	c, err := assets.Pack(copyDir(t, dir, "images"), copyDir(t, dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Root.String() != shippedRoot {
+		t.Errorf("root = %s, want %s", c.Root, shippedRoot)
+	}
+	if len(c.Rewritten) != 0 {
+		t.Errorf("rewritten %v, want the shipped metadata unchanged", c.Rewritten)
+	}
+
+	path, err := c.WriteCAR(filepath.Join(dir, "car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != shippedRoot+".car" {
+		t.Errorf("CAR written to %s, want %s.car", path, shippedRoot)
+	}
+	got, err := ipfs.OpenCAR(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Roots) != 1+len(c.Images) || got.Roots[0].String() != shippedRoot || got.Roots[1].String() != c.Images["1.png"].String() {
+		t.Errorf("roots = %v, want the metadata root followed by the images", got.Roots)
+	}
+
+	// The shipped archive holds the metadata directory, without the images
+	shipped, err := ipfs.OpenCAR(filepath.Join("..", "..", "assets", "car", shippedRoot+".car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRoot, _ := got.Get(c.Root)
+	shippedRootBlock, ok := shipped.Get(c.Root)
+	if !ok || !bytes.Equal(gotRoot, shippedRootBlock) {
+		t.Errorf("metadata directory differs from the shipped one")
+	}
+	for _, name := range []string{"1.json", "2.json"} {
+		want, err := shipped.Resolve(c.Root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cid, err := got.Resolve(c.Root, name)
+		if err != nil || cid.String() != want.String() {
+			t.Errorf("Resolve(%s) = %s, %v, want %s", name, cid, err, want)
+		}
+		doc, err := got.ReadFile(cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantDoc, err := shipped.ReadFile(want)
+		if err != nil || !bytes.Equal(doc, wantDoc) {
+			t.Errorf("%s = %s, want the shipped document", name, doc)
+		}
+	}
+	for name, cid := range c.Images {
+		if _, err := got.ReadFile(cid); err != nil {
+			t.Errorf("image %s not in the archive: %v", name, err)
+		}
+	}
+}
+
+func TestPackRewritesImageField(t *testing.T) {
+	images := writeFiles(t, map[string]string{
+		"1.png":     "points",
+		"2.png":     "gold badge",
+		".DS_Store": "skipped",
+	})
+	metadataDir := writeFiles(t, map[string]string{
+		"1.json": `{"name":"Point","image":"ipfs://old","edition":1}`,
+		"2.json": `{"name":"Gold Badge"}`,
+	})
+	c, err := assets.Pack(images, metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Images) != 2 || len(c.Rewritten) != 2 {
+		t.Fatalf("packed %d images and rewrote %v, want 2 of each", len(c.Images), c.Rewritten)
+	}
+
+	for _, test := range []struct {
+		file, image string
+		keys        []string
+	}{
+		{"1.json", "1.png", []string{"name", "image", "edition"}},
+		{"2.json", "2.png", []string{"name", "image"}},
+	} {
+		doc, err := os.ReadFile(filepath.Join(metadataDir, test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		err = json.Unmarshal(doc, &m)
+		if err != nil {
+			t.Fatalf("%s is not JSON after rewriting: %v", test.file, err)
+		}
+		if want := "ipfs://" + c.Images[test.image].String(); m["image"] != want {
+			t.Errorf("%s image = %v, want %s", test.file, m["image"], want)
+		}
+		// The other fields keep their order
+		last := -1
+		for _, key := range test.keys {
+			i := strings.Index(string(doc), `"`+key+`"`)
+			if i < last {
+				t.Errorf("%s = %s, want the keys in the order %v", test.file, doc, test.keys)
+			}
+			last = i
+		}
+	}
+
+	// Packing again leaves the files and the root as they are
+	again, err := assets.Pack(images, metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Rewritten) != 0 || again.Root.String() != c.Root.String() {
+		t.Errorf("second pack rewrote %v with root %s, want nothing rewritten and root %s", again.Rewritten, again.Root, c.Root)
+	}
+}
+
+func TestPackRejectsInvalidCollections(t *testing.T) {
+	images := writeFiles(t, map[string]string{"1.png": "points"})
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"no metadata", map[string]string{"README.md": "no json"}},
+		{"no image", map[string]string{"1.json": `{}`, "2.json": `{}`}},
+		{"not JSON", map[string]string{"1.json": `points`}},
+		{"not an object", map[string]string{"1.json": `["points"]`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := assets.Pack(images, writeFiles(t, test.metadata))
+			if err == nil {
+				t.Error("Pack accepted an invalid collection")
+			}
+		})
+	}
+	_, err := assets.Pack(filepath.Join(t.TempDir(), "missing"), writeFiles(t, map[string]string{"1.json": `{}`}))
+	if err == nil {
+		t.Error("Pack accepted a missing images directory")
+	}
+}
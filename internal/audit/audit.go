@@ -0,0 +1,89 @@
+// Package audit records the actions taken through the admin API, to a file
+// of JSON lines when configured and to the logs.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of entries kept in memory for the audit endpoint
+const recentEntries = 1000
+
+// Entry is one admin action
+type Entry struct {
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	// Outcome of the action, such as the hash of a cancel transaction
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Log appends entries to a file, when path is set, and keeps the recent ones
+type Log struct {
+	mu     sync.Mutex
+	path   string
+	recent []Entry
+}
+
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// Record stores the entry. Failing to write it to the file is returned so
+// the action can be reported as not audited.
+func (l *Log) Record(entry Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slog.Info(
+		"Admin action",
+		"audit", true,
+		"actor", entry.Actor,
+		"action", entry.Action,
+		"params", entry.Params,
+		"error", entry.Error,
+	)
+	l.recent = append(l.recent, entry)
+	if len(l.recent) > recentEntries {
+		l.recent = l.recent[len(l.recent)-recentEntries:]
+	}
+	if l.path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %v", err)
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("error writing audit log: %v", err)
+	}
+	return f.Sync()
+}
+
+// Recent returns up to limit of the latest entries, newest first
+func (l *Log) Recent(limit int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > len(l.recent) {
+		limit = len(l.recent)
+	}
+	entries := make([]Entry, 0, limit)
+	for i := len(l.recent) - 1; i >= len(l.recent)-limit; i-- {
+		entries = append(entries, l.recent[i])
+	}
+	return entries
+}
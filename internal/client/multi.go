@@ -0,0 +1,400 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	healthCheckInterval = 15 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+	// Nodes more than maxBlockLag blocks behind the highest node are only
+	// used when no up-to-date node is available
+	maxBlockLag = 3
+	// Number of nodes a signed transaction is broadcast to
+	broadcastFanout = 3
+)
+
+type endpoint struct {
+	name   string
+	client *ethclient.Client
+
+	mu          sync.RWMutex
+	healthy     bool
+	blockNumber uint64
+	latency     time.Duration
+}
+
+// MultiClient spreads calls over several nodes of the same chain. Reads go
+// to the healthiest node and are retried on the next one on failure, while
+// transactions are broadcast to several nodes.
+//
+// Every call is routed on its own, so consecutive calls can be answered by
+// nodes up to maxBlockLag blocks apart, or further apart when no up-to-date
+// node is left: a block read as the head may be unknown to the node answering
+// the next call. Operations made of several calls that must see the same
+// chain use Pin.
+type MultiClient struct {
+	endpoints []*endpoint
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewMultiClient dials every node URL and starts health checking them
+func NewMultiClient(ctx context.Context, nodeURLs []string) (*MultiClient, error) {
+	m := &MultiClient{
+		stop: make(chan struct{}),
+	}
+	for _, nodeURL := range nodeURLs {
+		client, err := ethclient.DialContext(ctx, nodeURL)
+		if err != nil {
+			slog.Warn("Error dialing node", "node", endpointName(nodeURL), "error", err)
+			continue
+		}
+		m.endpoints = append(m.endpoints, &endpoint{
+			name:   endpointName(nodeURL),
+			client: client,
+		})
+	}
+	if len(m.endpoints) == 0 {
+		return nil, fmt.Errorf("could not dial any of %d nodes", len(nodeURLs))
+	}
+
+	m.checkHealth(ctx)
+	m.wg.Add(1)
+	go m.healthCheckLoop()
+
+	return m, nil
+}
+
+// endpointName strips the credentials from a node URL so it can be logged
+func endpointName(nodeURL string) string {
+	u, err := url.Parse(nodeURL)
+	if err != nil {
+		return "invalid url"
+	}
+	return u.Host
+}
+
+func (m *MultiClient) healthCheckLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.checkHealth(context.Background())
+		}
+	}
+}
+
+// checkHealth measures the block height and latency of every node
+func (m *MultiClient) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range m.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			blockNumber, err := e.client.BlockNumber(checkCtx)
+			latency := time.Since(start)
+
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			if err != nil {
+				if e.healthy {
+					slog.Warn("Node is unhealthy", "node", e.name, "error", err)
+				}
+				e.healthy = false
+				return
+			}
+			if !e.healthy {
+				slog.Info("Node is healthy", "node", e.name, "block", blockNumber)
+			}
+			e.healthy = true
+			e.blockNumber = blockNumber
+			e.latency = latency
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (e *endpoint) markUnhealthy(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.healthy {
+		slog.Warn("Node is unhealthy", "node", e.name, "error", err)
+	}
+	e.healthy = false
+}
+
+// ranked returns the nodes from healthiest to least healthy: up-to-date
+// nodes first, then lagging nodes, then failing nodes, each by latency
+func (m *MultiClient) ranked() []*endpoint {
+	type rank struct {
+		e       *endpoint
+		tier    int
+		latency time.Duration
+	}
+	var bestBlock uint64
+	ranks := make([]rank, len(m.endpoints))
+	blocks := make([]uint64, len(m.endpoints))
+	for i, e := range m.endpoints {
+		e.mu.RLock()
+		ranks[i] = rank{e: e, latency: e.latency}
+		if !e.healthy {
+			ranks[i].tier = 2
+		}
+		blocks[i] = e.blockNumber
+		e.mu.RUnlock()
+		if ranks[i].tier == 0 && blocks[i] > bestBlock {
+			bestBlock = blocks[i]
+		}
+	}
+	for i := range ranks {
+		if ranks[i].tier == 0 && blocks[i]+maxBlockLag < bestBlock {
+			ranks[i].tier = 1
+		}
+	}
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].tier != ranks[j].tier {
+			return ranks[i].tier < ranks[j].tier
+		}
+		return ranks[i].latency < ranks[j].latency
+	})
+
+	endpoints := make([]*endpoint, len(ranks))
+	for i, r := range ranks {
+		endpoints[i] = r.e
+	}
+	return endpoints
+}
+
+// nodeFailure reports whether a call failed because of the node rather than
+// the call: the node could not be reached, timed out or answered with a
+// server error. Errors answered by the node, such as a reverted call, a
+// nonce too low or insufficient funds, would be the same on another node.
+func nodeFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError || httpErr.StatusCode == http.StatusRequestTimeout
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// call runs an idempotent call on the healthiest node, moving on to the next
+// node when it fails
+func call[T any](ctx context.Context, m *MultiClient, fn func(*ethclient.Client) (T, error)) (T, error) {
+	var res T
+	var err error
+	for _, e := range m.ranked() {
+		res, err = fn(e.client)
+		if err == nil || !nodeFailure(ctx, err) {
+			return res, err
+		}
+		e.markUnhealthy(err)
+	}
+	return res, err
+}
+
+// Pin returns a client sending every call to the node currently ranked
+// healthiest, so a sequence of calls sees a single chain. The pinned client
+// does not fail over: a failing node fails the sequence, which is retried
+// with a new pinned client. It shares the connection of the MultiClient and
+// closing it does nothing.
+func (m *MultiClient) Pin() EVMClient {
+	return pinnedClient{m.ranked()[0].client}
+}
+
+type pinnedClient struct {
+	*ethclient.Client
+}
+
+func (pinnedClient) Close() {}
+
+func (m *MultiClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return call(ctx, m, func(c *ethclient.Client) (*big.Int, error) {
+		return c.ChainID(ctx)
+	})
+}
+
+func (m *MultiClient) BlockNumber(ctx context.Context) (uint64, error) {
+	return call(ctx, m, func(c *ethclient.Client) (uint64, error) {
+		return c.BlockNumber(ctx)
+	})
+}
+
+func (m *MultiClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return call(ctx, m, func(c *ethclient.Client) (*types.Header, error) {
+		return c.HeaderByNumber(ctx, number)
+	})
+}
+
+func (m *MultiClient) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	return call(ctx, m, func(c *ethclient.Client) ([]byte, error) {
+		return c.CodeAt(ctx, account, blockNumber)
+	})
+}
+
+func (m *MultiClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return call(ctx, m, func(c *ethclient.Client) (*types.Receipt, error) {
+		return c.TransactionReceipt(ctx, txHash)
+	})
+}
+
+func (m *MultiClient) TransactionByHash(ctx context.Context, txHash common.Hash) (*types.Transaction, bool, error) {
+	type result struct {
+		tx        *types.Transaction
+		isPending bool
+	}
+	res, err := call(ctx, m, func(c *ethclient.Client) (result, error) {
+		tx, isPending, err := c.TransactionByHash(ctx, txHash)
+		return result{tx, isPending}, err
+	})
+	return res.tx, res.isPending, err
+}
+
+func (m *MultiClient) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return call(ctx, m, func(c *ethclient.Client) ([]byte, error) {
+		return c.PendingCodeAt(ctx, account)
+	})
+}
+
+func (m *MultiClient) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	return call(ctx, m, func(c *ethclient.Client) (*big.Int, error) {
+		return c.BalanceAt(ctx, account, blockNumber)
+	})
+}
+
+func (m *MultiClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return call(ctx, m, func(c *ethclient.Client) (uint64, error) {
+		return c.NonceAt(ctx, account, blockNumber)
+	})
+}
+
+func (m *MultiClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return call(ctx, m, func(c *ethclient.Client) (uint64, error) {
+		return c.PendingNonceAt(ctx, account)
+	})
+}
+
+func (m *MultiClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return call(ctx, m, func(c *ethclient.Client) ([]byte, error) {
+		return c.CallContract(ctx, msg, blockNumber)
+	})
+}
+
+func (m *MultiClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return call(ctx, m, func(c *ethclient.Client) (*big.Int, error) {
+		return c.SuggestGasPrice(ctx)
+	})
+}
+
+func (m *MultiClient) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return call(ctx, m, func(c *ethclient.Client) (*big.Int, error) {
+		return c.SuggestGasTipCap(ctx)
+	})
+}
+
+func (m *MultiClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	return call(ctx, m, func(c *ethclient.Client) (uint64, error) {
+		return c.EstimateGas(ctx, msg)
+	})
+}
+
+func (m *MultiClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	return call(ctx, m, func(c *ethclient.Client) ([]types.Log, error) {
+		return c.FilterLogs(ctx, q)
+	})
+}
+
+// SubscribeFilterLogs subscribes on the healthiest node that supports
+// subscriptions. The subscription is not moved if that node fails later.
+func (m *MultiClient) SubscribeFilterLogs(
+	ctx context.Context,
+	q ethereum.FilterQuery,
+	ch chan<- types.Log,
+) (ethereum.Subscription, error) {
+	var err error
+	for _, e := range m.ranked() {
+		var sub ethereum.Subscription
+		sub, err = e.client.SubscribeFilterLogs(ctx, q, ch)
+		switch {
+		case err == nil:
+			return sub, nil
+		case errors.Is(err, rpc.ErrNotificationsUnsupported):
+			// Nodes served over HTTP cannot notify, which is no failure
+		case nodeFailure(ctx, err):
+			e.markUnhealthy(err)
+		default:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// SendTransaction broadcasts the signed transaction to the healthiest nodes
+// and succeeds when one of them accepts it, once they all answered
+func (m *MultiClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	endpoints := m.ranked()
+	if len(endpoints) > broadcastFanout {
+		endpoints = endpoints[:broadcastFanout]
+	}
+
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			errs[i] = e.client.SendTransaction(ctx, tx)
+			if errs[i] != nil {
+				slog.Warn("Node rejected transaction", "node", e.name, "tx_hash", tx.Hash().Hex(), "error", errs[i])
+			}
+		}(i, e)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errs[0]
+}
+
+// Close stops the health checks and closes every node connection
+func (m *MultiClient) Close() {
+	close(m.stop)
+	m.wg.Wait()
+	for _, e := range m.endpoints {
+		e.client.Close()
+	}
+}
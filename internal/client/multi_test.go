@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// fakeNode answers eth_blockNumber with block 100, and the other methods
+// with the JSON-RPC error or HTTP status it is set to
+type fakeNode struct {
+	status  atomic.Int64
+	errMsg  atomic.Value
+	balance atomic.Int64
+	calls   atomic.Int64
+}
+
+func newFakeNode(t *testing.T) (*fakeNode, *httptest.Server) {
+	n := &fakeNode{}
+	n.status.Store(http.StatusOK)
+	n.errMsg.Store("")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method == "eth_blockNumber" {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":"0x64"}`, req.ID)
+			return
+		}
+		n.calls.Add(1)
+		if status := int(n.status.Load()); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if msg := n.errMsg.Load().(string); msg != "" {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32000,"message":%q}}`, req.ID, msg)
+			return
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":"0x%x"}`, req.ID, n.balance.Load())
+	}))
+	t.Cleanup(srv.Close)
+	return n, srv
+}
+
+func (m *MultiClient) healthyCount() int {
+	count := 0
+	for _, e := range m.endpoints {
+		e.mu.RLock()
+		if e.healthy {
+			count++
+		}
+		e.mu.RUnlock()
+	}
+	return count
+}
+
+func TestMultiClientKeepsNodeOnCallError(t *testing.T) {
+	ctx := context.Background()
+	first, firstSrv := newFakeNode(t)
+	second, secondSrv := newFakeNode(t)
+	m, err := NewMultiClient(ctx, []string{firstSrv.URL, secondSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	first.errMsg.Store("insufficient funds for gas * price + value")
+	second.errMsg.Store("insufficient funds for gas * price + value")
+
+	_, err = m.BalanceAt(ctx, common.Address{}, nil)
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("BalanceAt error = %v, want the node's JSON-RPC error", err)
+	}
+	if calls := first.calls.Load() + second.calls.Load(); calls != 1 {
+		t.Errorf("nodes called %d times, want 1", calls)
+	}
+	if healthy := m.healthyCount(); healthy != 2 {
+		t.Errorf("%d healthy nodes, want 2", healthy)
+	}
+}
+
+func TestMultiClientFailsOverOnServerError(t *testing.T) {
+	ctx := context.Background()
+	first, firstSrv := newFakeNode(t)
+	second, secondSrv := newFakeNode(t)
+	m, err := NewMultiClient(ctx, []string{firstSrv.URL, secondSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// The node tried first fails, the other one answers
+	failing, answering := first, second
+	if m.ranked()[0].name != endpointName(firstSrv.URL) {
+		failing, answering = second, first
+	}
+	failing.status.Store(http.StatusBadGateway)
+	answering.balance.Store(42)
+
+	balance, err := m.BalanceAt(ctx, common.Address{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Int64() != 42 {
+		t.Errorf("balance = %v, want 42 from the second node", balance)
+	}
+	if healthy := m.healthyCount(); healthy != 1 {
+		t.Errorf("%d healthy nodes, want 1", healthy)
+	}
+}
+
+func TestMultiClientPinSticksToOneNode(t *testing.T) {
+	ctx := context.Background()
+	first, firstSrv := newFakeNode(t)
+	second, secondSrv := newFakeNode(t)
+	m, err := NewMultiClient(ctx, []string{firstSrv.URL, secondSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pinnedNode, otherNode := first, second
+	if m.ranked()[0].name != endpointName(firstSrv.URL) {
+		pinnedNode, otherNode = second, first
+	}
+	pinnedNode.balance.Store(1)
+	otherNode.balance.Store(2)
+
+	pinned := m.Pin()
+	// Closing the pinned client leaves the shared connection open
+	pinned.Close()
+	for j := 0; j < 3; j++ {
+		nonce, err := pinned.NonceAt(ctx, common.Address{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nonce != 1 {
+			t.Fatalf("nonce = %d, want 1 from the pinned node", nonce)
+		}
+	}
+
+	// The pinned client does not fail over, the MultiClient does
+	pinnedNode.status.Store(http.StatusBadGateway)
+	_, err = pinned.NonceAt(ctx, common.Address{}, nil)
+	if err == nil {
+		t.Error("NonceAt on the pinned client succeeded on a failing node")
+	}
+	nonce, err := m.NonceAt(ctx, common.Address{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 2 {
+		t.Errorf("nonce = %d, want 2 from the other node", nonce)
+	}
+}
+
+func TestNodeFailure(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"server error", context.Background(), rpc.HTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"request timeout", context.Background(), rpc.HTTPError{StatusCode: http.StatusRequestTimeout}, true},
+		{"client error", context.Background(), rpc.HTTPError{StatusCode: http.StatusUnauthorized}, false},
+		{"timeout", context.Background(), fmt.Errorf("post: %w", context.DeadlineExceeded), true},
+		{"caller gone", cancelled, context.Canceled, false},
+		{"no subscriptions", context.Background(), rpc.ErrNotificationsUnsupported, false},
+		{"nonce too low", context.Background(), errors.New("nonce too low"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := nodeFailure(test.ctx, test.err); got != test.want {
+				t.Errorf("nodeFailure(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
@@ -3,18 +3,72 @@ package client
 import (
 	"context"
 	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
 
 	"github.cbhq.net/engineering/sff-workshop/internal/config"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
-// NewEVMClient returns an EVM client that uses a CoinbaseCloud Node
-func NewEVMClient(ctx context.Context, cfg *config.Config) (*ethclient.Client, error) {
-	client, err := ethclient.DialContext(
-		ctx,
-		fmt.Sprintf("https://%s:%s@%s", cfg.Username, cfg.Password, cfg.NodeURI),
-	)
+// EVMClient is the part of the node API used by the transaction handler and
+// the contract bindings. It is implemented by both ethclient.Client and
+// MultiClient.
+type EVMClient interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	ChainID(ctx context.Context) (*big.Int, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	Close()
+}
+
+// Pinner is implemented by the clients spreading calls over several nodes
+type Pinner interface {
+	// Pin returns a client sending every call to the same node
+	Pin() EVMClient
+}
+
+// NewEVMClient returns an EVM client connected to the nodes of the given
+// chain. Several node URIs are served by a MultiClient.
+func NewEVMClient(ctx context.Context, cfg *config.ChainConfig) (EVMClient, error) {
+	if len(cfg.NodeURIs) == 0 {
+		return nil, fmt.Errorf("chain %s: no node uri configured", cfg.Name)
+	}
+	nodeURLs := make([]string, len(cfg.NodeURIs))
+	for i, uri := range cfg.NodeURIs {
+		nodeURL, err := nodeURL(uri, cfg.Username, cfg.Password)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %v", cfg.Name, err)
+		}
+		nodeURLs[i] = nodeURL
+	}
+	if len(nodeURLs) > 1 {
+		return NewMultiClient(ctx, nodeURLs)
+	}
+
+	client, err := ethclient.DialContext(ctx, nodeURLs[0])
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
 
-	return client, err
+// nodeURL defaults the scheme to https and adds the basic auth credentials
+// used by CoinbaseCloud Nodes when a username is set
+func nodeURL(uri string, username string, password string) (string, error) {
+	if !strings.Contains(uri, "://") {
+		uri = "https://" + uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid node uri: %v", err)
+	}
+	if username != "" {
+		u.User = url.UserPassword(username, password)
+	}
+	return u.String(), nil
 }
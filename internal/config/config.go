@@ -1,56 +1,314 @@
 package config
 
 import (
-	"os"
-	"strconv"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	FeeStrategyLegacy  = "legacy"
+	FeeStrategyEIP1559 = "eip1559"
+
+	defaultChainName          = "default"
+	defaultGasPriceMultiplier = 1.5
+
+	DefaultRPCTimeout  = 10 * time.Second
+	DefaultSendTimeout = 30 * time.Second
+	// Netlify functions are stopped after 10 seconds, so answer before that
+	DefaultResponseWait = 8 * time.Second
+
+	DefaultWorkers   = 4
+	DefaultQueueSize = 500
+
+	DefaultJobPollInterval = 2 * time.Second
+
+	DefaultIndexerPollInterval = 15 * time.Second
+
+	DefaultLogLevel  = "info"
+	DefaultLogFormat = "json"
+
+	DefaultTraceSampleRatio = 1.0
+
+	DefaultMaxBlockAge        = 5 * time.Minute
+	DefaultReadyCheckInterval = 15 * time.Second
+	DefaultReadyRequireChains = ReadyRequireAny
+
+	DefaultWebhookMaxAttempts  = 8
+	DefaultWebhookRetryBackoff = time.Second
+	DefaultConfirmations       = 1
+	DefaultConfirmPollInterval = 5 * time.Second
+	DefaultConfirmTimeout      = 30 * time.Minute
 
-	"github.com/joho/godotenv"
+	DefaultConfigReloadInterval = 10 * time.Second
+)
+
+// Values of READY_REQUIRE_CHAINS
+const (
+	ReadyRequireAny  = "any"
+	ReadyRequireAll  = "all"
+	ReadyRequireNone = "none"
 )
 
 type Config struct {
 	Username                string
 	Password                string
-	NodeURI                 string
 	Mnemonic                string
-	ContractAddress         string
+	DefaultChain            string
+	Chains                  map[string]*ChainConfig
 	MaxGoldBadgeTotalQty    int64
 	MaxGoldBadgeTransferQty int64
 	MaxPointTotalQty        int64
 	MaxPointTransferQty     int64
+	// Deadline of each RPC stage of a transfer before it is signed
+	RPCTimeout time.Duration
+	// Deadline of each attempt to submit a signed transaction
+	SendTimeout time.Duration
+	// How long GetToken waits for the transaction hash before answering
+	// with the request id
+	ResponseWait time.Duration
+	// Number of requests processed concurrently
+	Workers int
+	// Number of requests waiting for a worker before new ones are rejected
+	QueueSize int
+	// File where queued requests are saved on shutdown and restored from on
+	// startup. Queued requests are dropped on shutdown when empty.
+	PendingRequestsFile string
+	// Directory of the durable job queue. When set, requests are queued as
+	// jobs for the worker command instead of being processed by the server.
+	JobQueueDir string
+	// File keeping the admin controls, shared by the servers and the worker.
+	// Defaults to controls.json in JobQueueDir in async mode, and the
+	// controls are kept in memory when empty.
+	ControlsFile string
+	// How often the worker looks for new jobs
+	JobPollInterval time.Duration
+	// Directory of the transfer event index of each chain. The indexer
+	// only runs when it is set.
+	IndexerDir string
+	// How often the indexer looks for new blocks
+	IndexerPollInterval time.Duration
+	// IPFS gateways tried in order to fetch token metadata
+	MetadataGateways []string
+	// Local directory holding token metadata, tried before the gateways.
+	// Metadata is only resolved when it, CARDir or MetadataGateways is set.
+	MetadataDir string
+	// Directory of CAR archives served under /ipfs/ and used to resolve
+	// token metadata without a gateway
+	CARDir string
+	// Lowest level logged: debug, info, warn or error
+	LogLevel string
+	// Format of the log lines: json or text
+	LogFormat string
+	// host:port of the OTLP/HTTP collector receiving the traces. Traces
+	// are only recorded when it is set.
+	OTLPEndpoint string
+	// Send traces over plain HTTP rather than HTTPS
+	OTLPInsecure bool
+	// Share of the traces sampled, from 0 to 1
+	TraceSampleRatio float64
+	// Bearer token of the admin API, which is disabled when empty
+	AdminToken string
+	// File the admin actions are appended to, as JSON lines
+	AuditLogFile string
+	// Age of the latest block past which a node is considered out of sync
+	// and the server not ready. Not checked when 0.
+	MaxBlockAge time.Duration
+	// How long the outcome of the chain checks of the readiness probe is
+	// reused before the nodes are checked again
+	ReadyCheckInterval time.Duration
+	// Which chains must pass their checks for the server to be ready: any
+	// of them, all of them, or none to only report the checks
+	ReadyRequireChains string
+	// Endpoints notified of the transfer lifecycle events. Webhooks are
+	// disabled when empty.
+	WebhookURLs []string
+	// Key of the HMAC signature of the webhook deliveries
+	WebhookSecret string
+	// Event types sent to the webhooks, every type when empty
+	WebhookEvents []string
+	// Attempts of a delivery before it is dead-lettered
+	WebhookMaxAttempts int
+	// Wait before the first retry of a delivery, doubled after each retry
+	WebhookRetryBackoff time.Duration
+	// File the undelivered events are kept in until replayed. They are
+	// only kept in memory when empty.
+	WebhookDeadLetterFile string
+	// Blocks, the one holding a transaction included, after which it is
+	// considered confirmed
+	Confirmations int
+	// How often submitted transactions are checked until confirmed
+	ConfirmPollInterval time.Duration
+	// How long a submitted transaction is tracked before giving up
+	ConfirmTimeout time.Duration
+
+	// CSV files of the addresses refused on every chain, such as sanctions
+	// lists. They are read on startup.
+	BlocklistFiles []string
+
+	// How often the config files are checked for changes, to reload the
+	// limits. Not checked when 0, the limits are still reloaded on SIGHUP.
+	ConfigReloadInterval time.Duration
+
+	// settings are the values read and where they came from
+	settings []Setting
+	files    []string
 }
 
-func NewConfig(port *int) (*Config, error) {
-	if *port != -1 {
-		err := godotenv.Load(".env")
-		if err != nil {
-			return nil, err
-		}
-	}
-	maxGoldBadgeTotalQty, err := strconv.ParseInt(os.Getenv("MAX_GOLD_BADGE_TOTAL_QUANTITY"), 10, 64)
+// ChainConfig holds the settings of one chain the server can send tokens on
+type ChainConfig struct {
+	Name               string
+	Username           string
+	Password           string
+	NodeURIs           []string
+	ChainID            int64
+	FeeStrategy        string
+	GasPriceMultiplier float64
+	Mnemonic           string
+	ContractAddress    string
+	// First block scanned by the indexer, usually the contract deployment block
+	IndexerStartBlock uint64
+	// CSV files of the only addresses that can receive tokens on the chain,
+	// read on startup
+	AllowlistFiles []string
+	// Root of the Merkle tree of the addresses that can receive tokens on
+	// the chain, each request proving its recipient is in the tree
+	AllowlistMerkleRoot string
+	// Prefix of the variables the chain is read from, empty without CHAINS
+	EnvPrefix string
+}
+
+// Load reads the config from the sources, in order of precedence: the
+// overrides, the environment, the env file, then the config file. All the settings that
+// cannot be parsed are reported in the error. The settings are not
+// validated, see Validate.
+func Load(src Sources) (*Config, error) {
+	l, err := newLoader(src)
 	if err != nil {
 		return nil, err
 	}
-	maxGoldBadgeTransferQty, err := strconv.ParseInt(os.Getenv("MAX_GOLD_BADGE_TRANSFER_QUANTITY"), 10, 64)
-	if err != nil {
-		return nil, err
+	cfg := &Config{
+		Username:                l.string("USERNAME", ""),
+		Password:                l.string("PASSWORD", ""),
+		Mnemonic:                l.string("MNEMONIC", ""),
+		MaxGoldBadgeTotalQty:    l.limit("MAX_GOLD_BADGE_TOTAL_QUANTITY"),
+		MaxGoldBadgeTransferQty: l.limit("MAX_GOLD_BADGE_TRANSFER_QUANTITY"),
+		MaxPointTotalQty:        l.limit("MAX_POINT_TOTAL_QUANTITY"),
+		MaxPointTransferQty:     l.limit("MAX_POINT_TRANSFER_QUANTITY"),
+		RPCTimeout:              l.duration("RPC_TIMEOUT", DefaultRPCTimeout),
+		SendTimeout:             l.duration("SEND_TIMEOUT", DefaultSendTimeout),
+		ResponseWait:            l.duration("RESPONSE_WAIT", DefaultResponseWait),
+		Workers:                 l.int("WORKERS", DefaultWorkers),
+		QueueSize:               l.int("QUEUE_SIZE", DefaultQueueSize),
+		PendingRequestsFile:     l.string("PENDING_REQUESTS_FILE", ""),
+		JobQueueDir:             l.string("JOB_QUEUE_DIR", ""),
+		ControlsFile:            l.string("CONTROLS_FILE", ""),
+		JobPollInterval:         l.duration("JOB_POLL_INTERVAL", DefaultJobPollInterval),
+		IndexerDir:              l.string("INDEXER_DIR", ""),
+		IndexerPollInterval:     l.duration("INDEXER_POLL_INTERVAL", DefaultIndexerPollInterval),
+		MetadataGateways:        l.list("METADATA_GATEWAYS"),
+		MetadataDir:             l.string("METADATA_DIR", ""),
+		CARDir:                  l.string("IPFS_CAR_DIR", ""),
+		LogLevel:                l.string("LOG_LEVEL", DefaultLogLevel),
+		LogFormat:               l.string("LOG_FORMAT", DefaultLogFormat),
+		OTLPEndpoint:            l.string("OTLP_ENDPOINT", ""),
+		OTLPInsecure:            l.bool("OTLP_INSECURE", false),
+		TraceSampleRatio:        l.ratio("TRACE_SAMPLE_RATIO", DefaultTraceSampleRatio),
+		AdminToken:              l.string("ADMIN_TOKEN", ""),
+		AuditLogFile:            l.string("AUDIT_LOG_FILE", ""),
+		MaxBlockAge:             l.duration("READY_MAX_BLOCK_AGE", DefaultMaxBlockAge),
+		ReadyCheckInterval:      l.duration("READY_CHECK_INTERVAL", DefaultReadyCheckInterval),
+		ReadyRequireChains:      l.string("READY_REQUIRE_CHAINS", DefaultReadyRequireChains),
+		WebhookURLs:             l.list("WEBHOOK_URLS"),
+		WebhookSecret:           l.string("WEBHOOK_SECRET", ""),
+		WebhookEvents:           l.list("WEBHOOK_EVENTS"),
+		WebhookMaxAttempts:      l.int("WEBHOOK_MAX_ATTEMPTS", DefaultWebhookMaxAttempts),
+		WebhookRetryBackoff:     l.duration("WEBHOOK_RETRY_BACKOFF", DefaultWebhookRetryBackoff),
+		WebhookDeadLetterFile:   l.string("WEBHOOK_DEAD_LETTER_FILE", ""),
+		Confirmations:           l.int("CONFIRMATIONS", DefaultConfirmations),
+		ConfirmPollInterval:     l.duration("CONFIRM_POLL_INTERVAL", DefaultConfirmPollInterval),
+		ConfirmTimeout:          l.duration("CONFIRM_TIMEOUT", DefaultConfirmTimeout),
+		ConfigReloadInterval:    l.duration("CONFIG_RELOAD_INTERVAL", DefaultConfigReloadInterval),
+		BlocklistFiles:          l.list("BLOCKLIST_FILES"),
 	}
-	maxPointTotalQty, err := strconv.ParseInt(os.Getenv("MAX_POINT_TOTAL_QUANTITY"), 10, 64)
-	if err != nil {
-		return nil, err
+	if cfg.ControlsFile == "" && cfg.JobQueueDir != "" {
+		cfg.ControlsFile = filepath.Join(cfg.JobQueueDir, "controls.json")
 	}
-	maxPointTransferQty, err := strconv.ParseInt(os.Getenv("MAX_POINT_TRANSFER_QUANTITY"), 10, 64)
-	if err != nil {
-		return nil, err
+	cfg.loadChains(l)
+	l.checkUnknown()
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+	cfg.settings = l.settings
+	cfg.files = l.files
+	return cfg, nil
+}
+
+// loadChains builds the chain registry. CHAINS lists the chain names and
+// each chain reads its settings from variables prefixed with its upper-cased
+// name, e.g. POLYGON_NODE_URI. Without CHAINS a single chain is read from
+// the unprefixed variables.
+func (c *Config) loadChains(l *loader) {
+	c.Chains = make(map[string]*ChainConfig)
+	names := l.list("CHAINS")
+	if len(names) == 0 {
+		c.Chains[defaultChainName] = c.loadChain(l, defaultChainName, "")
+		c.DefaultChain = defaultChainName
+		return
+	}
+
+	for _, name := range names {
+		prefix := ChainPrefix(name)
+		c.Chains[name] = c.loadChain(l, name, prefix)
+	}
+	c.DefaultChain = l.string("DEFAULT_CHAIN", names[0])
+	if _, ok := c.Chains[c.DefaultChain]; !ok {
+		l.fail("DEFAULT_CHAIN", fmt.Errorf("chain %q is not listed in CHAINS", c.DefaultChain))
+	}
+}
+
+func (c *Config) loadChain(l *loader, name string, prefix string) *ChainConfig {
+	chainCfg := &ChainConfig{
+		Name:                name,
+		Username:            c.Username,
+		Password:            c.Password,
+		NodeURIs:            l.list(prefix + "NODE_URI"),
+		FeeStrategy:         l.string(prefix+"FEE_STRATEGY", FeeStrategyLegacy),
+		GasPriceMultiplier:  l.float(prefix+"GAS_PRICE_MULTIPLIER", defaultGasPriceMultiplier),
+		Mnemonic:            c.Mnemonic,
+		ContractAddress:     l.string(prefix+"CONTRACT_ADDRESS", ""),
+		ChainID:             l.int64(prefix+"CHAIN_ID", 0),
+		IndexerStartBlock:   l.uint64(prefix+"INDEXER_START_BLOCK", 0),
+		AllowlistFiles:      l.list(prefix + "ALLOWLIST_FILES"),
+		AllowlistMerkleRoot: l.string(prefix+"ALLOWLIST_MERKLE_ROOT", ""),
+		EnvPrefix:           prefix,
+	}
+	// The unprefixed credentials are already read by the single chain
+	if prefix != "" {
+		chainCfg.Username = l.string(prefix+"USERNAME", c.Username)
+		chainCfg.Password = l.string(prefix+"PASSWORD", c.Password)
+	}
+	if chainCfg.FeeStrategy != FeeStrategyLegacy && chainCfg.FeeStrategy != FeeStrategyEIP1559 {
+		l.fail(prefix+"FEE_STRATEGY", fmt.Errorf("unknown fee strategy %q, must be %s or %s", chainCfg.FeeStrategy, FeeStrategyLegacy, FeeStrategyEIP1559))
+	}
+	return chainCfg
+}
+
+// ChainPrefix returns the prefix of the settings of a chain
+func ChainPrefix(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// SplitList splits a comma separated list, dropping empty items
+func SplitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
 	}
-	return &Config{
-		Username:                os.Getenv("USERNAME"),
-		Password:                os.Getenv("PASSWORD"),
-		NodeURI:                 os.Getenv("NODE_URI"),
-		Mnemonic:                os.Getenv("MNEMONIC"),
-		ContractAddress:         os.Getenv("CONTRACT_ADDRESS"),
-		MaxGoldBadgeTotalQty:    maxGoldBadgeTotalQty,
-		MaxGoldBadgeTransferQty: maxGoldBadgeTransferQty,
-		MaxPointTotalQty:        maxPointTotalQty,
-		MaxPointTransferQty:     maxPointTransferQty,
-	}, nil
+	return items
 }
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// SetEnvFileValue sets key to value in the env file at path, replacing the
+// existing assignment or appending one. The file is created when missing.
+func SetEnvFileValue(path string, key string, value string) error {
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	line := key + "=" + value
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(b) == 0 {
+		lines = nil
+	}
+	found := false
+	for i, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), key+"=") {
+			lines[i] = line
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, line)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+}
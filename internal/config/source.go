@@ -0,0 +1,437 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnvFile = "env file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+
+	redacted = "[REDACTED]"
+)
+
+// Sources are where the settings are read from besides the environment
+type Sources struct {
+	// Env file read under the environment
+	EnvFile string
+	// Fail when EnvFile does not exist, rather than skipping it
+	EnvFileRequired bool
+	// YAML config file, whose keys are the lower-cased setting names. The
+	// settings of each chain are listed under chains, with their name and
+	// without the prefix. CONFIG_FILE is read when empty.
+	File string
+	// Settings overriding every other source, from the -set flag
+	Overrides map[string]string
+}
+
+// Setting is a value read and where it came from: the default, the config
+// file, the env file, the environment, a flag, or the file a secret was read
+// from
+type Setting struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// loader reads the settings from the sources, recording where each came
+// from and collecting the invalid ones so every problem is reported at once
+type loader struct {
+	overrides map[string]string
+	envFile   map[string]string
+	file      map[string]string
+	// files read, watched for changes
+	files    []string
+	read     map[string]bool
+	settings []Setting
+	recorded map[string]bool
+	errs     []error
+}
+
+func newLoader(src Sources) (*loader, error) {
+	l := &loader{
+		overrides: src.Overrides,
+		read:      make(map[string]bool),
+		recorded:  make(map[string]bool),
+	}
+	if src.EnvFile != "" {
+		var err error
+		l.envFile, err = godotenv.Read(src.EnvFile)
+		switch {
+		case err == nil:
+			l.files = append(l.files, src.EnvFile)
+		case src.EnvFileRequired || !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("error loading %s: %v", src.EnvFile, err)
+		}
+	}
+	path := src.File
+	if path == "" {
+		path, _, _ = l.lookup("CONFIG_FILE")
+	}
+	if path != "" {
+		var err error
+		l.file, err = readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		l.files = append(l.files, path)
+	}
+	return l, nil
+}
+
+// readFile flattens the YAML config file into settings named like the
+// environment variables
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	settings := make(map[string]string)
+	for key, val := range doc {
+		key = strings.ToUpper(key)
+		if key != "CHAINS" {
+			settings[key], err = fileValue(val)
+			if err != nil {
+				return nil, fmt.Errorf("config file %s: %s: %v", path, key, err)
+			}
+			continue
+		}
+		chains, ok := val.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config file %s: chains must be a list", path)
+		}
+		var names []string
+		for i, chain := range chains {
+			fields, ok := chain.(map[string]interface{})
+			name, _ := fields["name"].(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("config file %s: chain %d must have a name", path, i+1)
+			}
+			names = append(names, name)
+			for field, fieldVal := range fields {
+				if field == "name" {
+					continue
+				}
+				chainKey := ChainPrefix(name) + strings.ToUpper(field)
+				settings[chainKey], err = fileValue(fieldVal)
+				if err != nil {
+					return nil, fmt.Errorf("config file %s: chain %s: %s: %v", path, name, field, err)
+				}
+			}
+		}
+		settings["CHAINS"] = strings.Join(names, ",")
+	}
+	return settings, nil
+}
+
+// fileValue returns a scalar as is and a list as comma separated values
+func fileValue(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("must be a value or a list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func (l *loader) lookup(key string) (string, string, bool) {
+	l.read[key] = true
+	if val, ok := l.overrides[key]; ok {
+		return val, SourceFlag, true
+	}
+	if val, ok := os.LookupEnv(key); ok {
+		return val, SourceEnv, true
+	}
+	if val, ok := l.envFile[key]; ok {
+		return val, SourceEnvFile, true
+	}
+	if val, ok := l.file[key]; ok {
+		return val, SourceFile, true
+	}
+	return "", "", false
+}
+
+// get returns the value of key or, when it is not set, the content of the
+// file named by key_FILE, as used to pass secrets
+func (l *loader) get(key string) (string, bool) {
+	val, source, ok := l.lookup(key)
+	if !ok {
+		path, _, ok := l.lookup(key + "_FILE")
+		if !ok || path == "" {
+			return "", false
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			l.fail(key+"_FILE", err)
+			return "", false
+		}
+		val, source = strings.TrimRight(string(data), "\r\n"), path
+	}
+	l.record(key, val, source)
+	return val, true
+}
+
+func (l *loader) record(key string, val string, source string) {
+	if l.recorded[key] {
+		return
+	}
+	l.recorded[key] = true
+	l.settings = append(l.settings, Setting{Key: key, Value: val, Source: source})
+}
+
+func (l *loader) fail(key string, err error) {
+	l.errs = append(l.errs, fmt.Errorf("%s: %v", key, err))
+}
+
+// checkUnknown reports the settings of the config file and the overrides
+// that are never read, usually misspelled
+func (l *loader) checkUnknown() {
+	var unknown []string
+	for key := range l.file {
+		if !l.read[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	for key := range l.overrides {
+		if !l.read[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		l.fail(key, errors.New("unknown setting"))
+	}
+}
+
+func (l *loader) string(key string, fallback string) string {
+	if val, ok := l.get(key); ok {
+		return val
+	}
+	if fallback != "" {
+		l.record(key, fallback, SourceDefault)
+	}
+	return fallback
+}
+
+// value returns the value of key, or false when it is not set or empty
+func (l *loader) value(key string) (string, bool) {
+	val, ok := l.get(key)
+	return val, ok && val != ""
+}
+
+func (l *loader) list(key string) []string {
+	val, _ := l.value(key)
+	return SplitList(val)
+}
+
+// int reads a positive integer
+func (l *loader) int(key string, fallback int) int {
+	val, ok := l.value(key)
+	if !ok {
+		l.record(key, strconv.Itoa(fallback), SourceDefault)
+		return fallback
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 1 {
+		l.fail(key, errors.New("must be a positive integer"))
+	}
+	return i
+}
+
+// limit reads a required quantity limit
+func (l *loader) limit(key string) int64 {
+	val, ok := l.value(key)
+	if !ok {
+		l.fail(key, errors.New("required"))
+		return 0
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || i < 0 {
+		l.fail(key, errors.New("must be a non-negative integer"))
+	}
+	return i
+}
+
+func (l *loader) int64(key string, fallback int64) int64 {
+	val, ok := l.value(key)
+	if !ok {
+		return fallback
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || i < 0 {
+		l.fail(key, errors.New("must be a non-negative integer"))
+	}
+	return i
+}
+
+func (l *loader) uint64(key string, fallback uint64) uint64 {
+	val, ok := l.value(key)
+	if !ok {
+		return fallback
+	}
+	i, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		l.fail(key, errors.New("must be a non-negative integer"))
+	}
+	return i
+}
+
+func (l *loader) float(key string, fallback float64) float64 {
+	val, ok := l.value(key)
+	if !ok {
+		l.record(key, strconv.FormatFloat(fallback, 'g', -1, 64), SourceDefault)
+		return fallback
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f <= 0 {
+		l.fail(key, errors.New("must be a positive number"))
+	}
+	return f
+}
+
+// ratio reads a number from 0 to 1
+func (l *loader) ratio(key string, fallback float64) float64 {
+	val, ok := l.value(key)
+	if !ok {
+		l.record(key, strconv.FormatFloat(fallback, 'g', -1, 64), SourceDefault)
+		return fallback
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 || f > 1 {
+		l.fail(key, errors.New("must be a number from 0 to 1"))
+	}
+	return f
+}
+
+// duration reads a non-negative duration
+func (l *loader) duration(key string, fallback time.Duration) time.Duration {
+	val, ok := l.value(key)
+	if !ok {
+		l.record(key, fallback.String(), SourceDefault)
+		return fallback
+	}
+	d, err := time.ParseDuration(val)
+	switch {
+	case err != nil:
+		l.fail(key, err)
+	case d < 0:
+		l.fail(key, errors.New("must be a non-negative duration"))
+	}
+	return d
+}
+
+func (l *loader) bool(key string, fallback bool) bool {
+	val, ok := l.value(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		l.fail(key, err)
+	}
+	return b
+}
+
+// IsSecret reports whether the setting holds a credential, never printed.
+// The node URLs are secret as the node providers put the API key in their
+// path.
+func IsSecret(key string) bool {
+	for _, suffix := range []string{"PASSWORD", "MNEMONIC", "TOKEN", "SECRET", "NODE_URI"} {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Settings returns the settings read, in the order they were read, with the
+// values of the secrets and the credentials of the URLs redacted
+func (c *Config) Settings() []Setting {
+	settings := make([]Setting, len(c.settings))
+	for i, setting := range c.settings {
+		switch {
+		case setting.Value == "":
+		case IsSecret(setting.Key):
+			setting.Value = redacted
+		case strings.Contains(setting.Value, "://"):
+			setting.Value = redactURLs(setting.Value)
+		}
+		settings[i] = setting
+	}
+	return settings
+}
+
+// redactURLs redacts the user info and the query of the URLs of a comma
+// separated list, where webhooks and gateways carry their keys
+func redactURLs(val string) string {
+	items := strings.Split(val, ",")
+	for i, item := range items {
+		u, err := url.Parse(strings.TrimSpace(item))
+		if err != nil {
+			items[i] = redacted
+			continue
+		}
+		hasUser, hasQuery := u.User != nil, u.RawQuery != ""
+		u.User, u.RawQuery = nil, ""
+		item = u.String()
+		if hasUser {
+			item = strings.Replace(item, "://", "://"+redacted+"@", 1)
+		}
+		if hasQuery {
+			item += "?" + redacted
+		}
+		items[i] = item
+	}
+	return strings.Join(items, ",")
+}
+
+// Files returns the env and config files the config was read from
+func (c *Config) Files() []string {
+	return c.files
+}
+
+// String lists the settings with the secrets redacted, so printing the
+// config never leaks them
+func (c *Config) String() string {
+	var b strings.Builder
+	for _, setting := range c.Settings() {
+		fmt.Fprintf(&b, "%s=%s (%s)\n", setting.Key, setting.Value, setting.Source)
+	}
+	return b.String()
+}
+
+// String names the chain without its credentials
+func (c *ChainConfig) String() string {
+	return fmt.Sprintf("chain %s (contract %s)", c.Name, c.ContractAddress)
+}
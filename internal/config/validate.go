@@ -0,0 +1,136 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// Validate reports every setting the server cannot run with, naming each
+// problem after its setting
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	switch {
+	case c.Mnemonic == "":
+		fail("MNEMONIC", "required, or MNEMONIC_FILE")
+	case !bip39.IsMnemonicValid(c.Mnemonic):
+		fail("MNEMONIC", "not a valid BIP-39 mnemonic")
+	}
+	if c.MaxGoldBadgeTransferQty > c.MaxGoldBadgeTotalQty {
+		fail("MAX_GOLD_BADGE_TRANSFER_QUANTITY", "larger than MAX_GOLD_BADGE_TOTAL_QUANTITY")
+	}
+	if c.MaxPointTransferQty > c.MaxPointTotalQty {
+		fail("MAX_POINT_TRANSFER_QUANTITY", "larger than MAX_POINT_TOTAL_QUANTITY")
+	}
+	for _, d := range []struct {
+		key string
+		val time.Duration
+	}{
+		{"RPC_TIMEOUT", c.RPCTimeout},
+		{"RESPONSE_WAIT", c.ResponseWait},
+		{"READY_CHECK_INTERVAL", c.ReadyCheckInterval},
+	} {
+		if d.val < 0 {
+			fail(d.key, "must be a non-negative duration")
+		}
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("LOG_LEVEL", "unknown level %q, must be debug, info, warn or error", c.LogLevel)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		fail("LOG_FORMAT", "unknown format %q, must be json or text", c.LogFormat)
+	}
+	switch c.ReadyRequireChains {
+	case ReadyRequireAny, ReadyRequireAll, ReadyRequireNone:
+	default:
+		fail("READY_REQUIRE_CHAINS", "unknown value %q, must be any, all or none", c.ReadyRequireChains)
+	}
+	for _, gateway := range c.MetadataGateways {
+		if !isHTTPURL(gateway) {
+			fail("METADATA_GATEWAYS", "%q is not an http(s) URL", gateway)
+		}
+	}
+	for _, webhook := range c.WebhookURLs {
+		if !isHTTPURL(webhook) {
+			fail("WEBHOOK_URLS", "%q is not an http(s) URL", webhook)
+		}
+	}
+	if c.JobQueueDir != "" && os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		fail("JOB_QUEUE_DIR", "the job queue directory must be shared with the worker, which Lambda functions cannot do")
+	}
+	if len(c.WebhookURLs) > 0 && c.WebhookSecret == "" {
+		fail("WEBHOOK_SECRET", "required when WEBHOOK_URLS is set, to sign the deliveries")
+	}
+
+	names := make([]string, 0, len(c.Chains))
+	for name := range c.Chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		chainCfg := c.Chains[name]
+		prefix := chainCfg.EnvPrefix
+		if len(chainCfg.NodeURIs) == 0 {
+			fail(prefix+"NODE_URI", "required")
+		}
+		for _, uri := range chainCfg.NodeURIs {
+			if !isNodeURI(uri) {
+				fail(prefix+"NODE_URI", "%q is not a node URL", uri)
+			}
+		}
+		switch {
+		case chainCfg.ContractAddress == "":
+			fail(prefix+"CONTRACT_ADDRESS", "required, deploy the contract first")
+		case !common.IsHexAddress(chainCfg.ContractAddress):
+			fail(prefix+"CONTRACT_ADDRESS", "%q is not an address", chainCfg.ContractAddress)
+		}
+		switch root := chainCfg.AllowlistMerkleRoot; {
+		case root == "":
+		case len(chainCfg.AllowlistFiles) > 0:
+			fail(prefix+"ALLOWLIST_MERKLE_ROOT", "set either it or %sALLOWLIST_FILES", prefix)
+		case !isHash(root):
+			fail(prefix+"ALLOWLIST_MERKLE_ROOT", "%q is not a 32-byte hex hash", root)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isHash(val string) bool {
+	b, err := hexutil.Decode(val)
+	return err == nil && len(b) == common.HashLength
+}
+
+func isHTTPURL(val string) bool {
+	u, err := url.Parse(val)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isNodeURI accepts the node URLs, whose scheme defaults to https
+func isNodeURI(val string) bool {
+	if !strings.Contains(val, "://") {
+		val = "https://" + val
+	}
+	u, err := url.Parse(val)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+		return true
+	}
+	return false
+}
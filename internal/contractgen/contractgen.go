@@ -0,0 +1,181 @@
+// Package contractgen compiles RockSolidToken.sol with solc and generates
+// the Go binding from the ABI and bytecode. It is used by contract/gen.go to
+// write the contract files and by the contract tests to check they have not
+// drifted apart.
+package contractgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+const (
+	Source       = "RockSolidToken.sol"
+	contractName = "RockSolidToken"
+	// Name of the binding type, kept from the original abigen run
+	bindingType = "Contract"
+	bindingPkg  = "contract"
+
+	ABIFile     = "contract.abi"
+	BinFile     = "contract.bin"
+	BindingFile = "Contract.go"
+)
+
+// ErrNoSolc is returned when solc is not installed
+var ErrNoSolc = errors.New("solc not found")
+
+// Compiler settings contract.bin was built with. Changing them changes the
+// bytecode, so they are fixed here rather than taken from solc defaults.
+var settings = map[string]interface{}{
+	"optimizer":  map[string]interface{}{"enabled": true, "runs": 200},
+	"evmVersion": "london",
+	"outputSelection": map[string]interface{}{
+		"*": map[string]interface{}{"*": []string{"abi", "evm.bytecode.object"}},
+	},
+}
+
+var importPattern = regexp.MustCompile(`(?m)^\s*import\s+(?:[^"';]*\s+from\s+)?["']([^"']+)["']`)
+
+// SolcRequired reports whether solc must be installed to check the contract
+// files, which is the case in CI
+func SolcRequired() bool {
+	return os.Getenv("CI") != ""
+}
+
+// Compile runs solc in standard JSON mode on the source in dir and its
+// imports, read from dir or include, and returns the ABI, indented like the
+// committed one, and the creation bytecode
+func Compile(solc string, dir string, include string) (string, string, error) {
+	_, err := exec.LookPath(solc)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrNoSolc, err)
+	}
+	sources := make(map[string]interface{})
+	err = addSource(sources, dir, Source, include)
+	if err != nil {
+		return "", "", err
+	}
+	input, err := json.Marshal(map[string]interface{}{
+		"language": "Solidity",
+		"sources":  sources,
+		"settings": settings,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	cmd := exec.Command(solc, "--standard-json")
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("error running %s: %v", solc, err)
+	}
+	var output struct {
+		Errors []struct {
+			Severity         string `json:"severity"`
+			FormattedMessage string `json:"formattedMessage"`
+		} `json:"errors"`
+		Contracts map[string]map[string]struct {
+			ABI json.RawMessage `json:"abi"`
+			EVM struct {
+				Bytecode struct {
+					Object string `json:"object"`
+				} `json:"bytecode"`
+			} `json:"evm"`
+		} `json:"contracts"`
+	}
+	err = json.Unmarshal(out, &output)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid solc output: %v", err)
+	}
+	failed := false
+	for _, e := range output.Errors {
+		log.Print(e.FormattedMessage)
+		failed = failed || e.Severity == "error"
+	}
+	if failed {
+		return "", "", errors.New("compilation failed")
+	}
+	compiled, ok := output.Contracts[Source][contractName]
+	if !ok {
+		return "", "", fmt.Errorf("%s not found in solc output", contractName)
+	}
+
+	var compact, indented bytes.Buffer
+	err = json.Compact(&compact, compiled.ABI)
+	if err != nil {
+		return "", "", err
+	}
+	err = json.Indent(&indented, compact.Bytes(), "", "\t")
+	if err != nil {
+		return "", "", err
+	}
+	return indented.String(), compiled.EVM.Bytecode.Object, nil
+}
+
+// Bind generates the formatted Go binding of the contract
+func Bind(abiJSON string, bin string) (string, error) {
+	binding, err := bind.Bind(
+		[]string{bindingType},
+		[]string{abiJSON},
+		[]string{bin},
+		nil,
+		bindingPkg,
+		bind.LangGo,
+		nil,
+		nil,
+	)
+	if err != nil {
+		return "", fmt.Errorf("error generating binding: %v", err)
+	}
+	formatted, err := format.Source([]byte(binding))
+	if err != nil {
+		return "", fmt.Errorf("error formatting binding: %v", err)
+	}
+	return string(formatted), nil
+}
+
+// addSource adds the source unit and, recursively, its imports. Units are
+// named like solc does: relative imports are resolved against the importing
+// unit and other imports are taken as is, e.g. @openzeppelin/contracts/...
+func addSource(sources map[string]interface{}, dir string, unit string, include string) error {
+	if _, ok := sources[unit]; ok {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(unit)))
+	if errors.Is(err, os.ErrNotExist) {
+		if include == "" {
+			return fmt.Errorf("%s not found, set SOLC_INCLUDE_PATH or -include to the directory holding it", unit)
+		}
+		content, err = os.ReadFile(filepath.Join(include, filepath.FromSlash(unit)))
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", unit, err)
+	}
+	sources[unit] = map[string]string{"content": string(content)}
+
+	for _, match := range importPattern.FindAllStringSubmatch(string(content), -1) {
+		imported := match[1]
+		if strings.HasPrefix(imported, "./") || strings.HasPrefix(imported, "../") {
+			imported = path.Join(path.Dir(unit), imported)
+		}
+		err = addSource(sources, dir, imported, include)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package deploy deploys the token contract from the bytecode embedded in
+// the contract package, replacing the Truffle migrations.
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Backend is what deploying and checking the contract needs from the node
+type Backend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+}
+
+// Deploy sends the contract creation transaction signed by the treasury,
+// waits for it to be mined and checks the deployed contract
+func Deploy(
+	ctx context.Context,
+	backend Backend,
+	signer keystore.Signer,
+	chainId *big.Int,
+) (common.Address, error) {
+	opts := &bind.TransactOpts{
+		From:    *signer.Address(),
+		Context: ctx,
+		Signer: func(addr common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			return signer.Sign(chainId, tx)
+		},
+	}
+	// Gas price, nonce and gas limit are filled in from the node (ONLINE)
+	_, tx, _, err := contract.DeployContract(opts, backend)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("error sending deployment: %v", err)
+	}
+	slog.Info("Sent deployment", "tx_hash", tx.Hash().Hex(), "from", signer.Address().Hex())
+
+	addr, err := bind.WaitDeployed(ctx, backend, tx)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("error waiting for deployment %s: %v", tx.Hash().Hex(), err)
+	}
+	err = Verify(ctx, backend, addr, *signer.Address())
+	if err != nil {
+		return common.Address{}, err
+	}
+	return addr, nil
+}
+
+// Verify checks that addr holds the token contract with the expected token
+// ids, and that the treasury received the minted supply
+func Verify(ctx context.Context, backend bind.ContractBackend, addr common.Address, treasury common.Address) error {
+	caller, err := contract.NewContractCaller(addr, backend)
+	if err != nil {
+		return err
+	}
+	opts := &bind.CallOpts{Context: ctx}
+	for name, get := range map[string]func(*bind.CallOpts) (*big.Int, error){
+		"Points":    caller.Points,
+		"GoldBadge": caller.GoldBadge,
+	} {
+		id, err := get(opts)
+		if err != nil {
+			return fmt.Errorf("error calling %s: %v", name, err)
+		}
+		balance, err := caller.BalanceOf(opts, treasury, id)
+		if err != nil {
+			return fmt.Errorf("error calling BalanceOf: %v", err)
+		}
+		if balance.Sign() == 0 {
+			return fmt.Errorf("treasury holds no %s (id %v)", name, id)
+		}
+		slog.Info("Checked token", "name", name, "id", id, "treasury_balance", balance)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package deploy_test
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/deploy"
+	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// newSigner returns a signer for a new wallet
+func newSigner(t *testing.T) keystore.Signer {
+	t.Helper()
+	entropy, err := bip39.NewEntropy(128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := keystore.NewSigner(&config.ChainConfig{Name: simulated.ChainName, Mnemonic: mnemonic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newBackend returns a simulated chain mining every transaction, with the
+// funded accounts
+func newBackend(t *testing.T, funded ...common.Address) *simulated.Backend {
+	t.Helper()
+	alloc := core.GenesisAlloc{}
+	for _, addr := range funded {
+		alloc[addr] = core.GenesisAccount{Balance: new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))}
+	}
+	backend := &simulated.Backend{SimulatedBackend: backends.NewSimulatedBackend(alloc, 30_000_000)}
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+func TestDeployAndVerify(t *testing.T) {
+	ctx := context.Background()
+	treasury := newSigner(t)
+	backend := newBackend(t, *treasury.Address())
+	chainId, err := backend.ChainID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := deploy.Deploy(ctx, backend, treasury, chainId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := backend.CodeAt(ctx, addr, nil)
+	if err != nil || len(code) == 0 {
+		t.Fatalf("no code at %s: %v", addr.Hex(), err)
+	}
+	err = deploy.Verify(ctx, backend, addr, *treasury.Address())
+	if err != nil {
+		t.Errorf("Verify of the deployed contract = %v", err)
+	}
+
+	// Another account holds none of the supply
+	other := *newSigner(t).Address()
+	err = deploy.Verify(ctx, backend, addr, other)
+	if err == nil || !strings.Contains(err.Error(), "treasury holds no") {
+		t.Errorf("Verify with another treasury = %v, want an empty treasury", err)
+	}
+	// No contract is deployed there
+	err = deploy.Verify(ctx, backend, other, *treasury.Address())
+	if err == nil {
+		t.Error("Verify succeeded at an address without code")
+	}
+}
+
+func TestDeployFailsWithoutFunds(t *testing.T) {
+	ctx := context.Background()
+	treasury := newSigner(t)
+	backend := newBackend(t)
+	chainId, err := backend.ChainID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = deploy.Deploy(ctx, backend, treasury, chainId)
+	if err == nil {
+		t.Error("Deploy succeeded from an account without funds")
+	}
+}
@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ChainBackend is the part of the node API the handlers need: what the
+// contract bindings use plus the chain id checked at startup and the mined
+// nonce of the treasury. It is implemented by the node clients and by the
+// simulated chain of the end-to-end harness.
+type ChainBackend interface {
+	bind.ContractBackend
+	ChainID(ctx context.Context) (*big.Int, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
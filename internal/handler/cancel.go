@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Gas limit of a plain transfer of the native token
+const cancelGas = 21000
+
+// Nodes replace a pending transaction by one with the same nonce paying at
+// least 10% more. By default the cancel pays twice the fees of the stuck
+// transaction, or the current ones when they are higher.
+const (
+	MinCancelBump     = 1.1
+	DefaultCancelBump = 2.0
+)
+
+// ErrNonceNotPending is returned when cancelling a nonce that is already
+// mined or that no transaction of the treasury uses yet
+var ErrNonceNotPending = errors.New("no pending transaction at this nonce")
+
+// ErrNotReplaceable is returned when the transaction given to cancel is not
+// a transaction of the treasury at the nonce
+var ErrNotReplaceable = errors.New("transaction cannot be replaced")
+
+// txGetter reads the stuck transaction. It is implemented by
+// ethclient.Client, MultiClient and the simulated backend.
+type txGetter interface {
+	TransactionByHash(ctx context.Context, txHash common.Hash) (*types.Transaction, bool, error)
+}
+
+// CancelNonce replaces the transaction of the treasury stuck at nonce by a
+// 0-value transaction to itself and returns the hash of the replacement. Its
+// fees are bump times those of the stuck transaction, or the current fees
+// when higher. The stuck transaction is the one with txHash when set, else
+// the last one this process sent at the nonce; when neither is known, the
+// cancel pays bump times the current fees.
+func (h *TransactionHandler) CancelNonce(
+	ctx context.Context,
+	chainName string,
+	nonce uint64,
+	bump float64,
+	txHash string,
+) (string, error) {
+	chain, err := h.Chain(chainName)
+	if err != nil {
+		return "", err
+	}
+	if bump < MinCancelBump {
+		return "", fmt.Errorf("bump must be at least %v for the node to replace the transaction", MinCancelBump)
+	}
+
+	// Keep transfers from using the nonce stream while the cancel is sent
+	chain.sendMu.Lock()
+	defer chain.sendMu.Unlock()
+
+	err = checkPendingNonce(ctx, h.cfg, chain, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	feeCtx, cancel := withTimeout(ctx, h.cfg.RPCTimeout)
+	defer cancel()
+	stuck := chain.sentAt(nonce)
+	if txHash != "" {
+		stuck, err = stuckTx(feeCtx, chain, nonce, txHash)
+		if err != nil {
+			return "", err
+		}
+	}
+	if stuck == nil {
+		logging.FromContext(ctx).Warn("Fees of the stuck transaction unknown, bumping the current fees", "chain", chain.Name(), "nonce", nonce)
+	}
+
+	self := *chain.signer.Address()
+	var baseTx types.TxData
+	switch chain.cfg.FeeStrategy {
+	case config.FeeStrategyEIP1559:
+		gasTipCap, gasFeeCap, err := suggestDynamicFee(feeCtx, chain)
+		if err != nil {
+			return "", err
+		}
+		var stuckTipCap, stuckFeeCap *big.Int
+		if stuck != nil {
+			stuckTipCap, stuckFeeCap = stuck.GasTipCap(), stuck.GasFeeCap()
+		}
+		gasTipCap = replacementFee(stuckTipCap, gasTipCap, bump)
+		gasFeeCap = replacementFee(stuckFeeCap, gasFeeCap, bump)
+		if gasFeeCap.Cmp(gasTipCap) < 0 {
+			gasFeeCap = gasTipCap
+		}
+		baseTx = &types.DynamicFeeTx{
+			ChainID:   chain.ChainID(),
+			To:        &self,
+			Nonce:     nonce,
+			GasTipCap: gasTipCap,
+			GasFeeCap: gasFeeCap,
+			Gas:       cancelGas,
+			Value:     big.NewInt(0),
+		}
+	default:
+		gasPrice, err := suggestGasPrice(feeCtx, chain)
+		if err != nil {
+			return "", err
+		}
+		var stuckPrice *big.Int
+		if stuck != nil {
+			// GasPrice is the fee cap of a dynamic fee transaction
+			stuckPrice = stuck.GasPrice()
+		}
+		gasPrice = replacementFee(stuckPrice, gasPrice, bump)
+		baseTx = &types.LegacyTx{
+			To:       &self,
+			Nonce:    nonce,
+			GasPrice: gasPrice,
+			Gas:      cancelGas,
+			Value:    big.NewInt(0),
+		}
+	}
+
+	signedTx, err := h.signTx(ctx, chain, types.NewTx(baseTx))
+	if err != nil {
+		return "", err
+	}
+	err = h.submitTx(ctx, chain, signedTx)
+	if err != nil {
+		return "", fmt.Errorf("error submitting cancel transaction: %v", err)
+	}
+	// A later cancel of the nonce has to outbid this one
+	chain.addInFlight(signedTx, self, 0, 0)
+	return signedTx.Hash().Hex(), nil
+}
+
+// stuckTx reads the transaction with txHash and checks that the treasury
+// sent it at nonce
+func stuckTx(ctx context.Context, chain *Chain, nonce uint64, txHash string) (*types.Transaction, error) {
+	getter, ok := chain.client.(txGetter)
+	if !ok {
+		return nil, errors.New("transactions cannot be read with this node client")
+	}
+	tx, _, err := getter.TransactionByHash(ctx, common.HexToHash(txHash))
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, fmt.Errorf("%w: transaction %s not found", ErrNotReplaceable, txHash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting transaction %s: %v", txHash, err)
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(chain.ChainID()), tx)
+	if err != nil || from != *chain.signer.Address() || tx.Nonce() != nonce {
+		return nil, fmt.Errorf("%w: transaction %s is not the treasury transaction at nonce %d", ErrNotReplaceable, txHash, nonce)
+	}
+	return tx, nil
+}
+
+// replacementFee returns bump times the fee of the stuck transaction, or the
+// current fee when higher. When the stuck fee is unknown it returns bump
+// times the current fee.
+func replacementFee(stuck *big.Int, current *big.Int, bump float64) *big.Int {
+	if stuck == nil {
+		return scale(current, bump)
+	}
+	bumped := scale(stuck, bump)
+	if bumped.Cmp(current) < 0 {
+		return current
+	}
+	return bumped
+}
+
+// checkPendingNonce checks that nonce is used by a transaction not mined
+// yet: at or above the mined nonce, and below the pending nonce of the node
+// or the local nonce stream, which is ahead when the node dropped or has not
+// seen a transaction. A cancel past them would move the nonce stream and
+// leave a gap no transfer fills. The caller holds sendMu.
+func checkPendingNonce(ctx context.Context, cfg *config.Config, chain *Chain, nonce uint64) error {
+	ctx, cancel := withTimeout(ctx, cfg.RPCTimeout)
+	defer cancel()
+	address := *chain.signer.Address()
+	mined, err := chain.client.NonceAt(ctx, address, nil)
+	if err != nil {
+		return fmt.Errorf("error getting mined nonce: %v", err)
+	}
+	pending, err := chain.client.PendingNonceAt(ctx, address)
+	if err != nil {
+		return fmt.Errorf("error getting nonce: %v", err)
+	}
+	if next := chain.nextNonce.Load(); next > pending {
+		pending = next
+	}
+	if nonce < mined || nonce >= pending {
+		return fmt.Errorf("%w: nonce %d is not between the mined nonce %d and the pending nonce %d", ErrNonceNotPending, nonce, mined, pending)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestReplacementFee(t *testing.T) {
+	tests := []struct {
+		name    string
+		stuck   *big.Int
+		current int64
+		want    int64
+	}{
+		{"stuck unknown", nil, 100, 200},
+		{"stuck above current", big.NewInt(300), 100, 600},
+		{"bumped stuck below current", big.NewInt(30), 100, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := replacementFee(test.stuck, big.NewInt(test.current), DefaultCancelBump)
+			if got.Int64() != test.want {
+				t.Errorf("replacementFee(%v, %d) = %v, want %d", test.stuck, test.current, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/client"
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Chain holds the client, signer, validator and nonce stream used to send
+// transfers on one chain
+type Chain struct {
+	cfg            *config.ChainConfig
+	client         ChainBackend
+	signer         keystore.Signer
+	inputValidator *InputValidator
+	chainId        *big.Int
+
+	// sendMu serializes nonce assignment, signing and submission so
+	// transactions reach the node in nonce order. nextNonce is only changed
+	// under sendMu but can be read at any time.
+	sendMu    sync.Mutex
+	nextNonce atomic.Uint64
+	// inFlight are the transfers submitted and not known to be mined yet,
+	// counted against the ownership limit. Only used under sendMu.
+	inFlight []inFlightTransfer
+}
+
+type inFlightTransfer struct {
+	tx       *types.Transaction
+	nonce    uint64
+	to       common.Address
+	id       int64
+	quantity int64
+}
+
+// NewChain checks that the node serves the configured chain id. When no chain
+// id is configured the one reported by the node is used.
+func NewChain(
+	ctx context.Context,
+	cfg *config.ChainConfig,
+	backend ChainBackend,
+	signer keystore.Signer,
+	inputValidator *InputValidator,
+) (*Chain, error) {
+	// Getting ChainID (ONLINE)
+	spanCtx, span := tracing.Start(ctx, "ChainID", attribute.String("chain", cfg.Name))
+	chainId, err := backend.ChainID(spanCtx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("chain %s: error getting ChainID: %v", cfg.Name, err)
+	}
+	if cfg.ChainID != 0 && chainId.Cmp(big.NewInt(cfg.ChainID)) != 0 {
+		return nil, fmt.Errorf(
+			"chain %s: node reports chain id %v, expected %d",
+			cfg.Name,
+			chainId,
+			cfg.ChainID,
+		)
+	}
+
+	return &Chain{
+		cfg:            cfg,
+		client:         backend,
+		signer:         signer,
+		inputValidator: inputValidator,
+		chainId:        chainId,
+	}, nil
+}
+
+// Name returns the name of the chain in the config
+func (c *Chain) Name() string {
+	return c.cfg.Name
+}
+
+// Config returns the config of the chain
+func (c *Chain) Config() *config.ChainConfig {
+	return c.cfg
+}
+
+// Backend returns the node client of the chain
+func (c *Chain) Backend() ChainBackend {
+	return c.client
+}
+
+// PinnedBackend returns a node client sending every call to the same node,
+// for operations made of several calls that must see the same chain, such as
+// reading the head and then calling the contract at it
+func (c *Chain) PinnedBackend() ChainBackend {
+	if pinner, ok := c.client.(client.Pinner); ok {
+		return pinner.Pin()
+	}
+	return c.client
+}
+
+// Validator returns the input validator enforcing the limits of the chain
+func (c *Chain) Validator() *InputValidator {
+	return c.inputValidator
+}
+
+// Address returns the address of the treasury wallet sending the transfers
+func (c *Chain) Address() common.Address {
+	return *c.signer.Address()
+}
+
+// TokenIDs returns the ids of the tokens that can be transferred
+func (c *Chain) TokenIDs() []int64 {
+	limits := c.inputValidator.Limits()
+	ids := make([]int64, 0, len(limits))
+	for id := range limits {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// ChainID returns the chain id verified against the node
+func (c *Chain) ChainID() *big.Int {
+	return c.chainId
+}
+
+// reserveNonce returns the next nonce of the signer. The local stream is
+// preferred over the node's pending nonce when it is ahead, as the node may
+// not have seen our latest transaction yet. The caller holds sendMu.
+func (c *Chain) reserveNonce(ctx context.Context) (uint64, error) {
+	// Retrieve nonce for fromAddress (ONLINE)
+	ctx, span := tracing.Start(ctx, "PendingNonceAt")
+	pendingNonce, err := c.client.PendingNonceAt(ctx, *c.signer.Address())
+	tracing.End(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("error getting nonce: %v", err)
+	}
+	if pendingNonce > c.nextNonce.Load() {
+		c.nextNonce.Store(pendingNonce)
+	}
+	return c.nextNonce.Load(), nil
+}
+
+// commitNonce moves the nonce stream past a nonce used by a submitted
+// transaction. The caller holds sendMu.
+func (c *Chain) commitNonce(nonce uint64) {
+	if nonce+1 > c.nextNonce.Load() {
+		c.nextNonce.Store(nonce + 1)
+	}
+}
+
+// addInFlight records a submitted transaction until its nonce is mined. The
+// caller holds sendMu.
+func (c *Chain) addInFlight(tx *types.Transaction, to common.Address, id int64, quantity int64) {
+	c.inFlight = append(c.inFlight, inFlightTransfer{tx: tx, nonce: tx.Nonce(), to: to, id: id, quantity: quantity})
+}
+
+// sentAt returns the last transaction submitted with the nonce and not
+// known to be mined, or nil. The caller holds sendMu.
+func (c *Chain) sentAt(nonce uint64) *types.Transaction {
+	for i := len(c.inFlight) - 1; i >= 0; i-- {
+		if c.inFlight[i].nonce == nonce {
+			return c.inFlight[i].tx
+		}
+	}
+	return nil
+}
+
+// inFlightTo returns the quantity of token id sent to the address by
+// transfers submitted and not mined yet, forgetting the mined ones. It is
+// read before the balance of the recipient: a transfer mined in between is
+// counted twice, which refuses too much rather than too little. The caller
+// holds sendMu.
+func (c *Chain) inFlightTo(ctx context.Context, to common.Address, id int64) (int64, error) {
+	if len(c.inFlight) == 0 {
+		return 0, nil
+	}
+	ctx, span := tracing.Start(ctx, "NonceAt")
+	mined, err := c.client.NonceAt(ctx, *c.signer.Address(), nil)
+	tracing.End(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("error getting mined nonce: %v", err)
+	}
+	var quantity int64
+	pending := c.inFlight[:0]
+	for _, transfer := range c.inFlight {
+		if transfer.nonce < mined {
+			continue
+		}
+		pending = append(pending, transfer)
+		if transfer.to == to && transfer.id == id {
+			quantity += transfer.quantity
+		}
+	}
+	c.inFlight = pending
+	return quantity, nil
+}
+
+// NextNonce returns the nonce the next transfer will use unless the node
+// reports a higher pending nonce. It is 0 until the first transfer.
+func (c *Chain) NextNonce() uint64 {
+	return c.nextNonce.Load()
+}
@@ -0,0 +1,382 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	errPaused      = errors.New("transfers are paused")
+	errTokenPaused = errors.New("transfers of this token are paused")
+)
+
+// Controls are the switches operators flip at runtime through the admin
+// API: pausing transfers, restricting the recipients and overriding the
+// limits. The pauses and lists apply to every chain. The lists are checked
+// as the first Screener of every chain, the pauses by Check.
+//
+// When backed by a file, every change is written to it, and the changes
+// written by the other processes sharing it, such as the other servers and
+// the async worker, are read before the controls are checked. Like the job
+// queue, the file relies on atomic renames and file locks, so the processes
+// must run on the same host.
+type Controls struct {
+	mu   sync.RWMutex
+	file string
+	// info of the file the controls were last read from or written to,
+	// nil when they need to be read again
+	info os.FileInfo
+
+	paused       bool
+	pausedTokens map[int64]bool
+	blocklist    AddressList
+	// When not empty, only these addresses can receive tokens
+	allowlist AddressList
+	// Limits set at runtime, by chain and token id, in force instead of the
+	// configured ones
+	limits map[string]map[int64]Limits
+}
+
+// ControlsState is a snapshot of the controls, also the format of their file
+type ControlsState struct {
+	Paused         bool                        `json:"paused"`
+	PausedTokens   []int64                     `json:"pausedTokens"`
+	Blocklist      []string                    `json:"blocklist"`
+	Allowlist      []string                    `json:"allowlist"`
+	LimitOverrides map[string]map[int64]Limits `json:"limitOverrides"`
+}
+
+// NewControls returns controls kept in memory, which start with nothing
+// paused and no lists
+func NewControls() *Controls {
+	c := &Controls{}
+	c.reset()
+	return c
+}
+
+// OpenControls returns the controls kept in the file, or in memory when
+// file is empty. A missing file holds no controls.
+func OpenControls(file string) (*Controls, error) {
+	c := NewControls()
+	if file == "" {
+		return c, nil
+	}
+	c.file = file
+	err := c.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Controls) reset() {
+	c.paused = false
+	c.pausedTokens = make(map[int64]bool)
+	c.blocklist = make(AddressList)
+	c.allowlist = make(AddressList)
+	c.limits = make(map[string]map[int64]Limits)
+}
+
+// Check returns an error when transfers of token id are paused, or when the
+// controls cannot be read
+func (c *Controls) Check(id int64) error {
+	err := c.refresh()
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	switch {
+	case c.paused:
+		return errPaused
+	case c.pausedTokens[id]:
+		return errTokenPaused
+	}
+	return nil
+}
+
+// Screen refuses the addresses on the blocklist and, when the allowlist is
+// not empty, those not on it
+func (c *Controls) Screen(ctx context.Context, to common.Address) error {
+	err := c.refresh()
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	switch {
+	case c.blocklist[to]:
+		return errBlocklisted
+	case len(c.allowlist) > 0 && !c.allowlist[to]:
+		return errNotAllowlisted
+	}
+	return nil
+}
+
+// SetPaused pauses or resumes all transfers
+func (c *Controls) SetPaused(paused bool) error {
+	return c.update(func() error {
+		c.paused = paused
+		return nil
+	})
+}
+
+// SetTokenPaused pauses or resumes the transfers of one token id
+func (c *Controls) SetTokenPaused(id int64, paused bool) error {
+	return c.update(func() error {
+		if paused {
+			c.pausedTokens[id] = true
+		} else {
+			delete(c.pausedTokens, id)
+		}
+		return nil
+	})
+}
+
+// SetBlocklisted adds or removes an address from the blocklist
+func (c *Controls) SetBlocklisted(addr common.Address, listed bool) error {
+	return c.update(func() error {
+		setListed(c.blocklist, addr, listed)
+		return nil
+	})
+}
+
+// SetAllowlisted adds or removes an address from the allowlist
+func (c *Controls) SetAllowlisted(addr common.Address, listed bool) error {
+	return c.update(func() error {
+		setListed(c.allowlist, addr, listed)
+		return nil
+	})
+}
+
+// SetLimits overrides the limits of a token id on a chain
+func (c *Controls) SetLimits(chain string, id int64, limits Limits) error {
+	if limits.Transfer < 0 || limits.Ownership < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return c.update(func() error {
+		if c.limits[chain] == nil {
+			c.limits[chain] = make(map[int64]Limits)
+		}
+		c.limits[chain][id] = limits
+		return nil
+	})
+}
+
+// ClearLimits removes the override of the limits of a token id on a chain,
+// putting the configured limits back in force
+func (c *Controls) ClearLimits(chain string, id int64) error {
+	return c.update(func() error {
+		delete(c.limits[chain], id)
+		if len(c.limits[chain]) == 0 {
+			delete(c.limits, chain)
+		}
+		return nil
+	})
+}
+
+// LimitsOverride returns the limits of a token id on a chain set at
+// runtime, if any. The controls are read again by Check, which comes first.
+func (c *Controls) LimitsOverride(chain string, id int64) (Limits, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	limits, ok := c.limits[chain][id]
+	return limits, ok
+}
+
+func setListed(list AddressList, addr common.Address, listed bool) {
+	if listed {
+		list[addr] = true
+	} else {
+		delete(list, addr)
+	}
+}
+
+// State returns a snapshot of the controls, sorted
+func (c *Controls) State() (ControlsState, error) {
+	err := c.refresh()
+	if err != nil {
+		return ControlsState{}, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state(), nil
+}
+
+func (c *Controls) state() ControlsState {
+	state := ControlsState{
+		Paused:         c.paused,
+		PausedTokens:   []int64{},
+		Blocklist:      sortedAddresses(c.blocklist),
+		Allowlist:      sortedAddresses(c.allowlist),
+		LimitOverrides: make(map[string]map[int64]Limits, len(c.limits)),
+	}
+	for id := range c.pausedTokens {
+		state.PausedTokens = append(state.PausedTokens, id)
+	}
+	sort.Slice(state.PausedTokens, func(i, j int) bool { return state.PausedTokens[i] < state.PausedTokens[j] })
+	for chain, limits := range c.limits {
+		state.LimitOverrides[chain] = make(map[int64]Limits, len(limits))
+		for id, l := range limits {
+			state.LimitOverrides[chain][id] = l
+		}
+	}
+	return state
+}
+
+func sortedAddresses(list AddressList) []string {
+	addrs := make([]string, 0, len(list))
+	for addr := range list {
+		addrs = append(addrs, addr.Hex())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// refresh reads the file again when another process replaced it
+func (c *Controls) refresh() error {
+	if c.file == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked()
+}
+
+func (c *Controls) refreshLocked() error {
+	info, err := os.Stat(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		c.reset()
+		c.info = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading controls: %v", err)
+	}
+	if c.info != nil && os.SameFile(c.info, info) && c.info.ModTime().Equal(info.ModTime()) && c.info.Size() == info.Size() {
+		return nil
+	}
+
+	b, err := os.ReadFile(c.file)
+	if err != nil {
+		return fmt.Errorf("error reading controls: %v", err)
+	}
+	var state ControlsState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return fmt.Errorf("invalid controls file %s: %v", c.file, err)
+	}
+	c.reset()
+	c.paused = state.Paused
+	for _, id := range state.PausedTokens {
+		c.pausedTokens[id] = true
+	}
+	for _, addr := range state.Blocklist {
+		c.blocklist[common.HexToAddress(addr)] = true
+	}
+	for _, addr := range state.Allowlist {
+		c.allowlist[common.HexToAddress(addr)] = true
+	}
+	for chain, limits := range state.LimitOverrides {
+		c.limits[chain] = limits
+	}
+	c.info = info
+	return nil
+}
+
+// update applies a change to the latest controls and writes them, holding
+// the lock of the file so changes made by several processes are not lost
+func (c *Controls) update(change func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == "" {
+		return change()
+	}
+
+	unlock, err := lockControls(c.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = c.refreshLocked()
+	if err != nil {
+		return err
+	}
+	err = change()
+	if err == nil {
+		err = c.save()
+	}
+	if err != nil {
+		// Read the file again rather than keep a change it does not hold
+		c.info = nil
+		return err
+	}
+	return nil
+}
+
+// save writes the controls through a temporary file so readers never see
+// partial controls. The caller holds mu and the file lock.
+func (c *Controls) save() error {
+	b, err := json.MarshalIndent(c.state(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), ".controls-*")
+	if err != nil {
+		return fmt.Errorf("error writing controls: %v", err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing controls: %v", err)
+	}
+	c.info, err = os.Stat(c.file)
+	if err != nil {
+		c.info = nil
+	}
+	return nil
+}
+
+// lockControls takes the lock serializing the changes to the file
+func lockControls(file string) (func(), error) {
+	f, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error locking controls: %v", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking controls: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// IsControlled reports whether err comes from the controls refusing a
+// transfer: a pause, or a list through ErrScreened
+func IsControlled(err error) bool {
+	return errors.Is(err, errPaused) ||
+		errors.Is(err, errTokenPaused) ||
+		errors.Is(err, ErrScreened)
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func openControls(t *testing.T, file string) *Controls {
+	t.Helper()
+	c, err := OpenControls(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestControlsSharedThroughFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "controls.json")
+	addr := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	server := openControls(t, file)
+	// The worker of async mode opens the same file
+	worker := openControls(t, file)
+
+	err := server.SetBlocklisted(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.SetLimits("polygon", 2, Limits{Transfer: 1, Ownership: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = worker.Screen(context.Background(), addr)
+	if !errors.Is(err, ErrScreened) {
+		t.Errorf("worker Screen = %v, want the recipient blocklisted", err)
+	}
+	if limits, ok := worker.LimitsOverride("polygon", 2); !ok || limits != (Limits{Transfer: 1, Ownership: 3}) {
+		t.Errorf("worker limits override = %v %v, want the limits set by the server", limits, ok)
+	}
+
+	// Changes from both sides are kept
+	err = worker.SetTokenPaused(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := openControls(t, file)
+	state, err := restarted.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Blocklist) != 1 || len(state.PausedTokens) != 1 || state.PausedTokens[0] != 1 {
+		t.Errorf("controls after a restart = %+v, want the blocklisted address and paused token", state)
+	}
+
+	err = server.SetBlocklisted(addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = worker.Screen(context.Background(), addr)
+	if err != nil {
+		t.Errorf("worker Screen = %v after the address was removed from the blocklist", err)
+	}
+	if err = worker.Check(2); err != nil {
+		t.Errorf("Check = %v for a token not paused", err)
+	}
+	err = restarted.Check(1)
+	if !IsControlled(err) {
+		t.Errorf("Check = %v, want the token paused", err)
+	}
+}
+
+func TestControlsInMemory(t *testing.T) {
+	c := openControls(t, "")
+	addr := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	err := c.SetAllowlisted(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Screen(context.Background(), addr); err != nil {
+		t.Errorf("Screen = %v for an allowlisted address", err)
+	}
+	other := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	if err = c.Screen(context.Background(), other); !errors.Is(err, ErrScreened) {
+		t.Errorf("Screen = %v for an address not allowlisted, want %v", err, ErrScreened)
+	}
+	// The lists refuse with the errors of the screening files
+	list := &Allowlist{List: AddressList{addr: true}}
+	if want := list.Screen(context.Background(), other); err != want {
+		t.Errorf("Screen = %v, want the error of an allowlist file %v", err, want)
+	}
+}
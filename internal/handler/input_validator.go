@@ -2,15 +2,24 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
+	"sync"
 
 	"github.cbhq.net/engineering/sff-workshop/contract"
 	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+	"github.cbhq.net/engineering/sff-workshop/internal/metrics"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+var (
+	errUnknownToken           = errors.New("unrecognized token id")
+	errTransferLimitExceeded  = errors.New("transfer limit exceeded")
+	errOwnershipLimitExceeded = errors.New("ownership limit exceeded")
 )
 
 type limitSetting struct {
@@ -18,18 +27,40 @@ type limitSetting struct {
 	ownership int64
 }
 
+// Limits are the transfer and ownership limits of a token
+type Limits struct {
+	Transfer  int64 `json:"transfer"`
+	Ownership int64 `json:"ownership"`
+}
+
 type InputValidator struct {
 	contractInstance *contract.Contract
-	limits           map[int64]*limitSetting
+	goldBadgeID      int64
+	pointID          int64
+	// limitsMu guards limits, the configured limits, which config reloads
+	// change at runtime
+	limitsMu sync.RWMutex
+	limits   map[int64]*limitSetting
+	// overrides returns the limits of a token id set through the admin API,
+	// in force instead of the configured ones
+	overrides func(id int64) (Limits, bool)
+	// lists are the address lists of the controls, screening first
+	lists Screener
+	// screeners refuse recipients before their balance is checked: those
+	// set by the config, replaced on reload, then those added
+	screenersMu sync.RWMutex
+	screeners   []Screener
+	added       []Screener
 }
 
 func NewInputValidator(
 	ctx context.Context,
-	client *ethclient.Client,
+	backend ChainBackend,
 	cfg *config.Config,
+	chainCfg *config.ChainConfig,
 ) (*InputValidator, error) {
-	contractAddr := common.HexToAddress(cfg.ContractAddress)
-	contractInstance, err := contract.NewContract(contractAddr, client)
+	contractAddr := common.HexToAddress(chainCfg.ContractAddress)
+	contractInstance, err := contract.NewContract(contractAddr, backend)
 	if err != nil {
 		return nil, err
 	}
@@ -46,57 +77,236 @@ func NewInputValidator(
 		return nil, fmt.Errorf("error getting point id: %v", err)
 	}
 
-	limits := make(map[int64]*limitSetting)
-	limits[goldBadgeId.Int64()] = &limitSetting{
-		transfer:  cfg.MaxGoldBadgeTransferQty,
-		ownership: cfg.MaxGoldBadgeTotalQty,
-	}
-	limits[pointId.Int64()] = &limitSetting{
-		transfer:  cfg.MaxPointTransferQty,
-		ownership: cfg.MaxPointTotalQty,
+	metrics.RegisterTokenIDs(goldBadgeId.Int64(), pointId.Int64())
+
+	screeners, err := NewScreeners(cfg, chainCfg)
+	if err != nil {
+		return nil, err
 	}
 
-	return &InputValidator{
+	v := &InputValidator{
 		contractInstance: contractInstance,
-		limits:           limits,
-	}, nil
+		goldBadgeID:      goldBadgeId.Int64(),
+		pointID:          pointId.Int64(),
+		limits:           make(map[int64]*limitSetting),
+		screeners:        screeners,
+	}
+	for id, limits := range v.ConfiguredLimits(cfg) {
+		v.limits[id] = &limitSetting{transfer: limits.Transfer, ownership: limits.Ownership}
+	}
+	return v, nil
 }
 
-// Check if we exceed the ownership or transfer limit
-// and return error in such case
+// ConfiguredLimits returns the limits the config sets for each token id
+func (v *InputValidator) ConfiguredLimits(cfg *config.Config) map[int64]Limits {
+	return map[int64]Limits{
+		v.goldBadgeID: {Transfer: cfg.MaxGoldBadgeTransferQty, Ownership: cfg.MaxGoldBadgeTotalQty},
+		v.pointID:     {Transfer: cfg.MaxPointTransferQty, Ownership: cfg.MaxPointTotalQty},
+	}
+}
+
+// CanTransfer checks the token id, the transfer limit and the screeners. The
+// ownership limit is checked by CanOwn, once transfers to the recipient can
+// no longer be sent concurrently.
 func (v *InputValidator) CanTransfer(
 	ctx context.Context,
 	to string,
 	id int64,
 	quantity int64,
 ) error {
-	limitSetting, ok := v.limits[id]
+	err := v.canTransfer(ctx, to, id, quantity)
+	// Allowed transfers are counted by CanOwn
+	if err != nil {
+		observeValidation(ctx, id, err)
+	}
+	return err
+}
+
+// CanOwn checks that the recipient does not own more than the ownership
+// limit once the transfer and inFlight, the quantity sent to it by transfers
+// not mined yet, are added to its balance
+func (v *InputValidator) CanOwn(
+	ctx context.Context,
+	to string,
+	id int64,
+	quantity int64,
+	inFlight int64,
+) error {
+	err := v.canOwn(ctx, to, id, quantity, inFlight)
+	observeValidation(ctx, id, err)
+	return err
+}
+
+func observeValidation(ctx context.Context, id int64, err error) {
+	outcome := "allowed"
+	switch {
+	case errors.Is(err, errUnknownToken):
+		outcome = "unknown_token"
+	case errors.Is(err, errTransferLimitExceeded):
+		outcome = "transfer_limit"
+	case errors.Is(err, errOwnershipLimitExceeded):
+		outcome = "ownership_limit"
+	case errors.Is(err, ErrScreened):
+		outcome = "screened"
+	case err != nil:
+		outcome = "error"
+	}
+	metrics.Validations.WithLabelValues(metrics.TokenLabel(id), outcome).Inc()
+	if err != nil {
+		logging.FromContext(ctx).Info("Transfer not allowed", "reason", outcome, "error", err)
+	}
+}
+
+func (v *InputValidator) canTransfer(
+	ctx context.Context,
+	to string,
+	id int64,
+	quantity int64,
+) error {
+	limits, ok := v.limitsOf(id)
 	if !ok {
-		return fmt.Errorf("unrecognized token id")
+		return errUnknownToken
 	}
-	if quantity > limitSetting.transfer {
-		return fmt.Errorf("transfer limit exceeded")
+	if quantity > limits.Transfer {
+		return errTransferLimitExceeded
+	}
+	return v.screen(ctx, common.HexToAddress(to))
+}
+
+func (v *InputValidator) canOwn(
+	ctx context.Context,
+	to string,
+	id int64,
+	quantity int64,
+	inFlight int64,
+) error {
+	limits, ok := v.limitsOf(id)
+	if !ok {
+		return errUnknownToken
 	}
+	toAddr := common.HexToAddress(to)
+	spanCtx, span := tracing.Start(ctx, "BalanceOf")
 	callOpts := &bind.CallOpts{
 		Pending: false,
-		Context: ctx,
+		Context: spanCtx,
 	}
-	toAddr := common.HexToAddress(to)
 	balance, err := v.contractInstance.BalanceOf(
 		callOpts,
 		toAddr,
 		big.NewInt(id),
 	)
+	tracing.End(span, err)
 	if err != nil {
 		return fmt.Errorf("error calling BalanceOf: %v", err)
 	}
 
-	log.Printf("Balance: %v", balance)
 	newBal := &big.Int{}
-	newBal.Add(balance, big.NewInt(quantity))
-	log.Printf("New balance: %v", newBal)
-	if newBal.Cmp(big.NewInt(limitSetting.ownership)) > 0 {
-		return fmt.Errorf("ownership limit exceeded")
+	newBal.Add(balance, big.NewInt(quantity+inFlight))
+	logging.FromContext(ctx).Debug("Checked recipient balance", "balance", balance, "in_flight", inFlight, "new_balance", newBal)
+	if newBal.Cmp(big.NewInt(limits.Ownership)) > 0 {
+		return errOwnershipLimitExceeded
+	}
+	return nil
+}
+
+// screen runs the screeners in order, stopping at the first refusal
+func (v *InputValidator) screen(ctx context.Context, to common.Address) error {
+	var screeners []Screener
+	if v.lists != nil {
+		screeners = append(screeners, v.lists)
+	}
+	v.screenersMu.RLock()
+	screeners = append(screeners, v.screeners...)
+	screeners = append(screeners, v.added...)
+	v.screenersMu.RUnlock()
+	for _, screener := range screeners {
+		spanCtx, span := tracing.Start(ctx, "Screen")
+		err := screener.Screen(spanCtx, to)
+		tracing.End(span, err)
+		if errors.Is(err, ErrScreened) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("error screening recipient: %v", err)
+		}
+	}
+	return nil
+}
+
+// AddScreener adds a screener checked after those set by the config, such
+// as an external screening service
+func (v *InputValidator) AddScreener(screener Screener) {
+	v.screenersMu.Lock()
+	defer v.screenersMu.Unlock()
+	v.added = append(v.added, screener)
+}
+
+// ReplaceScreeners swaps in the screeners set by the config, keeping those
+// added
+func (v *InputValidator) ReplaceScreeners(screeners []Screener) {
+	v.screenersMu.Lock()
+	defer v.screenersMu.Unlock()
+	v.screeners = screeners
+}
+
+// Screen checks the recipient against the screeners, as CanTransfer does.
+// The proof given by WithAllowlistProof is read from ctx.
+func (v *InputValidator) Screen(ctx context.Context, to string) error {
+	return v.screen(ctx, common.HexToAddress(to))
+}
+
+// limitsOf returns the limits in force for a token id known to the contract
+func (v *InputValidator) limitsOf(id int64) (Limits, bool) {
+	v.limitsMu.RLock()
+	setting, ok := v.limits[id]
+	v.limitsMu.RUnlock()
+	if !ok {
+		return Limits{}, false
+	}
+	if v.overrides != nil {
+		if limits, ok := v.overrides(id); ok {
+			return limits, true
+		}
 	}
+	return Limits{Transfer: setting.transfer, Ownership: setting.ownership}, true
+}
+
+// ReplaceLimits swaps in the configured limits of every token id at once.
+// The limits are checked first and kept when any is invalid. The limits set
+// through the admin API stay in force.
+func (v *InputValidator) ReplaceLimits(limits map[int64]Limits) error {
+	settings := make(map[int64]*limitSetting, len(limits))
+	for id, l := range limits {
+		if l.Transfer < 0 || l.Ownership < 0 {
+			return fmt.Errorf("token %d: limits must not be negative", id)
+		}
+		settings[id] = &limitSetting{transfer: l.Transfer, ownership: l.Ownership}
+	}
+	v.limitsMu.Lock()
+	defer v.limitsMu.Unlock()
+	if len(settings) != len(v.limits) {
+		return fmt.Errorf("limits must be set for the %d token ids of the contract", len(v.limits))
+	}
+	for id := range settings {
+		if _, ok := v.limits[id]; !ok {
+			return fmt.Errorf("token %d: %v", id, errUnknownToken)
+		}
+	}
+	v.limits = settings
 	return nil
 }
+
+// Limits returns the limits in force for every token id
+func (v *InputValidator) Limits() map[int64]Limits {
+	v.limitsMu.RLock()
+	ids := make([]int64, 0, len(v.limits))
+	for id := range v.limits {
+		ids = append(ids, id)
+	}
+	v.limitsMu.RUnlock()
+	limits := make(map[int64]Limits, len(ids))
+	for _, id := range ids {
+		limits[id], _ = v.limitsOf(id)
+	}
+	return limits
+}
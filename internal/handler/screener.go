@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ErrScreened is wrapped by the errors of a Screener refusing a recipient,
+// as opposed to failing to screen it
+var ErrScreened = errors.New("recipient refused by screening")
+
+var (
+	errBlocklisted    = fmt.Errorf("%w: address is on the blocklist", ErrScreened)
+	errNotAllowlisted = fmt.Errorf("%w: address is not on the allowlist", ErrScreened)
+	errNoProof        = fmt.Errorf("%w: an allowlist proof is required", ErrScreened)
+	errWrongProof     = fmt.Errorf("%w: allowlist proof does not match the Merkle root", ErrScreened)
+	errProofFormat    = errors.New("proof must be comma separated 32-byte hex hashes")
+)
+
+// Screener decides whether an address may receive tokens. It is checked
+// before the balance of the recipient, so a sanctions list or an external
+// screening service can refuse it without any other call. Screen returns an
+// error wrapping ErrScreened to refuse the address, and any other error when
+// it cannot tell, which fails the transfer.
+type Screener interface {
+	Screen(ctx context.Context, to common.Address) error
+}
+
+// NewScreeners returns the screeners set by the config for the chain: the
+// blocklist files of every chain, then the allowlist files or the Merkle
+// root of the allowlist of the chain
+func NewScreeners(cfg *config.Config, chainCfg *config.ChainConfig) ([]Screener, error) {
+	var screeners []Screener
+	if len(cfg.BlocklistFiles) > 0 {
+		list, err := LoadAddressList(cfg.BlocklistFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("error loading blocklist: %v", err)
+		}
+		screeners = append(screeners, &Blocklist{list})
+	}
+	if len(chainCfg.AllowlistFiles) > 0 {
+		list, err := LoadAddressList(chainCfg.AllowlistFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: error loading allowlist: %v", chainCfg.Name, err)
+		}
+		screeners = append(screeners, &Allowlist{list})
+	}
+	if chainCfg.AllowlistMerkleRoot != "" {
+		screeners = append(screeners, &MerkleAllowlist{Root: common.HexToHash(chainCfg.AllowlistMerkleRoot)})
+	}
+	return screeners, nil
+}
+
+// AddressList is a set of addresses, such as those read from files
+type AddressList map[common.Address]bool
+
+// LoadAddressList reads the addresses of CSV files, such as the OFAC SDN
+// digital currency address lists. Every 0x-prefixed address of every column
+// is read, so headers, other columns and the addresses of other currencies
+// are skipped. Lines starting with # are comments.
+func LoadAddressList(paths ...string) (AddressList, error) {
+	list := make(AddressList)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comment = '#'
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		reader.TrimLeadingSpace = true
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			for _, field := range record {
+				field = strings.TrimSpace(field)
+				if strings.HasPrefix(field, "0x") && common.IsHexAddress(field) {
+					list[common.HexToAddress(field)] = true
+				}
+			}
+		}
+	}
+	return list, nil
+}
+
+// Blocklist refuses the listed addresses
+type Blocklist struct {
+	List AddressList
+}
+
+func (b *Blocklist) Screen(ctx context.Context, to common.Address) error {
+	if b.List[to] {
+		return errBlocklisted
+	}
+	return nil
+}
+
+// Allowlist refuses the addresses not listed
+type Allowlist struct {
+	List AddressList
+}
+
+func (a *Allowlist) Screen(ctx context.Context, to common.Address) error {
+	if !a.List[to] {
+		return errNotAllowlisted
+	}
+	return nil
+}
+
+// MerkleAllowlist refuses the addresses that do not come with a proof of
+// being in the Merkle tree of the allowlist, given with WithAllowlistProof.
+// The tree is built like OpenZeppelin's StandardMerkleTree of addresses, so
+// its proofs can be checked on chain too: each leaf is the double keccak256
+// of the ABI-encoded address, and pairs are hashed sorted.
+type MerkleAllowlist struct {
+	Root common.Hash
+}
+
+func (m *MerkleAllowlist) Screen(ctx context.Context, to common.Address) error {
+	proof, ok := ctx.Value(allowlistProofKey{}).([]common.Hash)
+	if !ok {
+		return errNoProof
+	}
+	if !VerifyMerkleProof(m.Root, MerkleLeaf(to), proof) {
+		return errWrongProof
+	}
+	return nil
+}
+
+// MerkleLeaf returns the leaf of an address in the allowlist Merkle tree
+func MerkleLeaf(addr common.Address) common.Hash {
+	encoded := common.LeftPadBytes(addr.Bytes(), 32)
+	return crypto.Keccak256Hash(crypto.Keccak256(encoded))
+}
+
+// VerifyMerkleProof reports whether proof leads from leaf to root
+func VerifyMerkleProof(root common.Hash, leaf common.Hash, proof []common.Hash) bool {
+	hash := leaf
+	for _, sibling := range proof {
+		if bytes.Compare(hash[:], sibling[:]) < 0 {
+			hash = crypto.Keccak256Hash(hash[:], sibling[:])
+		} else {
+			hash = crypto.Keccak256Hash(sibling[:], hash[:])
+		}
+	}
+	return hash == root
+}
+
+type allowlistProofKey struct{}
+
+// WithAllowlistProof returns a context whose transfer proves the recipient
+// is in the Merkle tree of the allowlist
+func WithAllowlistProof(ctx context.Context, proof []common.Hash) context.Context {
+	if proof == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, allowlistProofKey{}, proof)
+}
+
+// ParseProof parses an allowlist proof given as comma separated hashes. An
+// empty proof is nil.
+func ParseProof(val string) ([]common.Hash, error) {
+	var proof []common.Hash
+	for _, item := range config.SplitList(val) {
+		b, err := hexutil.Decode(item)
+		if err != nil || len(b) != common.HashLength {
+			return nil, errProofFormat
+		}
+		proof = append(proof, common.BytesToHash(b))
+	}
+	return proof, nil
+}
+
+// FormatProof returns the hashes of a proof as strings, to store them
+func FormatProof(proof []common.Hash) []string {
+	if proof == nil {
+		return nil
+	}
+	hashes := make([]string, len(proof))
+	for i, hash := range proof {
+		hashes[i] = hash.Hex()
+	}
+	return hashes
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// sendBackend answers the sends with the results of send, one per attempt
+type sendBackend struct {
+	ChainBackend
+	send     func(ctx context.Context, attempt int) error
+	attempts int
+}
+
+func (b *sendBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.attempts++
+	return b.send(ctx, b.attempts)
+}
+
+// rpcError is an error answered by the node
+type rpcError struct{ msg string }
+
+func (e rpcError) Error() string  { return e.msg }
+func (e rpcError) ErrorCode() int { return -32000 }
+
+// stall waits for the deadline of the attempt
+func stall(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSubmitTx(t *testing.T) {
+	tests := []struct {
+		name         string
+		send         func(ctx context.Context, attempt int) error
+		wantErr      error
+		wantAttempts int
+	}{
+		{"sent", func(context.Context, int) error { return nil }, nil, 1},
+		{"every attempt times out", func(ctx context.Context, _ int) error { return stall(ctx) }, context.DeadlineExceeded, sendAttempts},
+		{"retried after a timeout", func(ctx context.Context, attempt int) error {
+			if attempt == 1 {
+				return stall(ctx)
+			}
+			return nil
+		}, nil, 2},
+		{"already known after a timeout", func(ctx context.Context, attempt int) error {
+			if attempt == 1 {
+				return stall(ctx)
+			}
+			return errors.New("already known")
+		}, nil, 2},
+		{"rejected by the node", func(context.Context, int) error { return rpcError{"nonce too low"} }, rpcError{"nonce too low"}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &sendBackend{send: test.send}
+			chain := &Chain{cfg: &config.ChainConfig{Name: "test"}, client: backend}
+			h := &TransactionHandler{cfg: &config.Config{SendTimeout: 20 * time.Millisecond}}
+			tx := types.NewTransaction(7, common.Address{}, big.NewInt(0), TransferGas, big.NewInt(1), nil)
+
+			// The attempts outlive the request
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := h.submitTx(ctx, chain, tx)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("submitTx error = %v, want %v", err, test.wantErr)
+			}
+			if backend.attempts != test.wantAttempts {
+				t.Errorf("%d attempts, want %d", backend.attempts, test.wantAttempts)
+			}
+			wantNonce := uint64(0)
+			if test.wantErr == nil {
+				wantNonce = tx.Nonce() + 1
+			}
+			if chain.NextNonce() != wantNonce {
+				t.Errorf("next nonce = %d, want %d", chain.NextNonce(), wantNonce)
+			}
+		})
+	}
+}
@@ -2,99 +2,313 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
+	"sort"
+	"strings"
+	"time"
 
 	"github.cbhq.net/engineering/sff-workshop/contract"
 	"github.cbhq.net/engineering/sff-workshop/internal/config"
-	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+	"github.cbhq.net/engineering/sff-workshop/internal/metrics"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// Number of times a signed transaction is sent before giving up
+const sendAttempts = 3
+
+// Gas limit of a transfer transaction
+const TransferGas = 300000
+
 type TransactionHandler struct {
-	cfg            *config.Config
-	client         *ethclient.Client
-	signer         keystore.Signer
-	inputValidator *InputValidator
+	cfg      *config.Config
+	chains   map[string]*Chain
+	controls *Controls
 }
 
 func NewTransactionHandler(
 	ctx context.Context,
-	ethClient *ethclient.Client,
 	cfg *config.Config,
-	signer keystore.Signer,
-	inputValidator *InputValidator,
+	chains map[string]*Chain,
 ) (*TransactionHandler, error) {
+	if _, ok := chains[cfg.DefaultChain]; !ok {
+		return nil, fmt.Errorf("default chain %q is not configured", cfg.DefaultChain)
+	}
+	controls, err := OpenControls(cfg.ControlsFile)
+	if err != nil {
+		return nil, err
+	}
+	for name, chain := range chains {
+		name := name
+		chain.inputValidator.overrides = func(id int64) (Limits, bool) {
+			return controls.LimitsOverride(name, id)
+		}
+		chain.inputValidator.lists = controls
+	}
 	return &TransactionHandler{
-		cfg:            cfg,
-		client:         ethClient,
-		signer:         signer,
-		inputValidator: inputValidator,
+		cfg:      cfg,
+		chains:   chains,
+		controls: controls,
 	}, nil
 }
 
+// Controls returns the runtime controls checked before every transfer
+func (h *TransactionHandler) Controls() *Controls {
+	return h.controls
+}
+
+// ReloadScreeners reads the screening files of the config again and swaps in
+// the screeners it sets on every chain, or keeps them all when any fails
+func (h *TransactionHandler) ReloadScreeners(cfg *config.Config) error {
+	screeners := make(map[string][]Screener, len(h.chains))
+	for name := range h.chains {
+		chainCfg, ok := cfg.Chains[name]
+		if !ok {
+			return fmt.Errorf("chain %s is no longer configured", name)
+		}
+		var err error
+		screeners[name], err = NewScreeners(cfg, chainCfg)
+		if err != nil {
+			return err
+		}
+	}
+	for name, chain := range h.chains {
+		chain.inputValidator.ReplaceScreeners(screeners[name])
+	}
+	return nil
+}
+
+// Chain returns the named chain, or the default chain when name is empty
+func (h *TransactionHandler) Chain(name string) (*Chain, error) {
+	if name == "" {
+		name = h.cfg.DefaultChain
+	}
+	chain, ok := h.chains[name]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized chain %q", name)
+	}
+	return chain, nil
+}
+
+// Chains returns every chain, sorted by name
+func (h *TransactionHandler) Chains() []*Chain {
+	chains := make([]*Chain, 0, len(h.chains))
+	for _, chain := range h.chains {
+		chains = append(chains, chain)
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i].Name() < chains[j].Name() })
+	return chains
+}
+
+// Close closes the node clients of every chain
+func (h *TransactionHandler) Close() {
+	for _, chain := range h.chains {
+		if closer, ok := chain.client.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+}
+
+type onSignedKey struct{}
+
+// OnSigned returns a context whose transfer tells fn the hash of its
+// transaction once signed, before it is submitted
+func OnSigned(ctx context.Context, fn func(txHash string)) context.Context {
+	return context.WithValue(ctx, onSignedKey{}, fn)
+}
+
 // ERC1155Transfer handles ERC1155 transfer that sends the pre-minted tokens
 func (h *TransactionHandler) ERC1155Transfer(
 	ctx context.Context,
+	chainName string,
 	to string,
 	id int64,
 	quantity int64,
 ) (string, error) {
-	err := h.inputValidator.CanTransfer(ctx, to, id, quantity)
+	chain, err := h.Chain(chainName)
 	if err != nil {
 		return "", err
 	}
+	ctx = logging.WithAttrs(ctx, "chain", chain.Name())
+	ctx, span := tracing.Start(
+		ctx,
+		"ERC1155Transfer",
+		attribute.String("chain", chain.Name()),
+		attribute.String("to", to),
+		attribute.Int64("token.id", id),
+		attribute.Int64("quantity", quantity),
+	)
 
-	unsignedTx, err := h.constructUnsignedTx(ctx, to, id, quantity)
+	start := time.Now()
+	txHash, err := h.erc1155Transfer(ctx, chain, to, id, quantity)
+	outcome := metrics.OutcomeSubmitted
+	switch {
+	case IsRejected(err):
+		outcome = metrics.OutcomeRejected
+	case err != nil:
+		outcome = metrics.OutcomeFailed
+	}
+	tokenLabel := metrics.TokenLabel(id)
+	metrics.Transfers.WithLabelValues(chain.Name(), tokenLabel, outcome).Inc()
+	metrics.TransferDuration.WithLabelValues(chain.Name(), tokenLabel, outcome).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.String("outcome", outcome))
+	if txHash != "" {
+		span.SetAttributes(attribute.String("tx.hash", txHash))
+	}
+	tracing.End(span, err)
+	return txHash, err
+}
+
+func (h *TransactionHandler) erc1155Transfer(
+	ctx context.Context,
+	chain *Chain,
+	to string,
+	id int64,
+	quantity int64,
+) (string, error) {
+	// Requests queued before a pause are refused here, and before a
+	// blocklisting by the screening of CanTransfer
+	err := h.controls.Check(id)
+	if err != nil {
+		return "", err
+	}
+
+	validateCtx, cancel := withTimeout(ctx, h.cfg.RPCTimeout)
+	validateCtx, span := tracing.Start(validateCtx, "CanTransfer")
+	start := time.Now()
+	err = chain.inputValidator.CanTransfer(validateCtx, to, id, quantity)
+	tracing.End(span, err)
+	cancel()
+	metrics.ObserveStage(chain.Name(), metrics.StageValidate, start, err)
+	if err != nil {
+		if !IsRejected(err) {
+			metrics.RPCErrors.WithLabelValues(chain.Name(), metrics.StageValidate).Inc()
+		}
+		return "", err
+	}
+
+	// Transfers are validated concurrently, but from the ownership check to
+	// submission they go one at a time per chain, so concurrent transfers to
+	// a recipient cannot take it past the ownership limit together
+	chain.sendMu.Lock()
+	defer chain.sendMu.Unlock()
+
+	err = h.checkOwnership(ctx, chain, to, id, quantity)
+	if err != nil {
+		return "", err
+	}
+
+	unsignedTx, err := h.constructUnsignedTx(ctx, chain, to, id, quantity)
 	if err != nil {
 		return "", fmt.Errorf("error constructing transaction: %v", err)
 	}
 
-	signedTx, err := h.signTx(ctx, unsignedTx)
+	// Skip the transfer if the requester went away while it was built.
+	// Once signed, the transaction is submitted whatever happens to ctx.
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("request cancelled before signing: %v", ctx.Err())
+	}
+
+	start = time.Now()
+	signedTx, err := h.signTx(ctx, chain, unsignedTx)
+	metrics.ObserveStage(chain.Name(), metrics.StageSign, start, err)
 	if err != nil {
 		return "", fmt.Errorf("error signing transaction: %v", err)
 	}
+	if onSigned, ok := ctx.Value(onSignedKey{}).(func(string)); ok {
+		onSigned(signedTx.Hash().Hex())
+	}
 
-	// Submit transaction to Cloud Node (ONLINE)
-	err = h.client.SendTransaction(context.Background(), signedTx)
+	start = time.Now()
+	err = h.submitTx(ctx, chain, signedTx)
+	observeRPCStage(chain, metrics.StageSend, start, err)
 	if err != nil {
 		return "", fmt.Errorf("error submitting transaction: %v", err)
 	}
+	observeGas(chain, signedTx)
+	chain.addInFlight(signedTx, common.HexToAddress(to), id, quantity)
 
 	return signedTx.Hash().Hex(), nil
 }
 
+// checkOwnership checks the ownership limit of the recipient, counting the
+// transfers to it that are not mined yet. The caller holds sendMu.
+func (h *TransactionHandler) checkOwnership(ctx context.Context, chain *Chain, to string, id int64, quantity int64) error {
+	ctx, cancel := withTimeout(ctx, h.cfg.RPCTimeout)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "CanOwn")
+	start := time.Now()
+	inFlight, err := chain.inFlightTo(ctx, common.HexToAddress(to), id)
+	if err == nil {
+		err = chain.inputValidator.CanOwn(ctx, to, id, quantity, inFlight)
+	}
+	tracing.End(span, err)
+	metrics.ObserveStage(chain.Name(), metrics.StageValidate, start, err)
+	if err != nil && !IsRejected(err) {
+		metrics.RPCErrors.WithLabelValues(chain.Name(), metrics.StageValidate).Inc()
+	}
+	return err
+}
+
+// IsRejected reports whether the transfer was refused by the controls or
+// the input validator, as opposed to failing
+func IsRejected(err error) bool {
+	return IsControlled(err) ||
+		errors.Is(err, errUnknownToken) ||
+		errors.Is(err, errTransferLimitExceeded) ||
+		errors.Is(err, errOwnershipLimitExceeded) ||
+		errors.Is(err, ErrScreened)
+}
+
+// observeRPCStage records a stage made of node calls, counting its failures
+func observeRPCStage(chain *Chain, stage string, start time.Time, err error) {
+	metrics.ObserveStage(chain.Name(), stage, start, err)
+	if err != nil {
+		metrics.RPCErrors.WithLabelValues(chain.Name(), stage).Inc()
+	}
+}
+
+// observeGas records the price of a sent transaction and the most it can
+// spend on gas
+func observeGas(chain *Chain, tx *types.Transaction) {
+	gwei, _ := new(big.Float).Quo(new(big.Float).SetInt(tx.GasFeeCap()), big.NewFloat(1e9)).Float64()
+	metrics.GasPrice.WithLabelValues(chain.Name()).Observe(gwei)
+	maxFee, _ := new(big.Float).SetInt(new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas()))).Float64()
+	metrics.MaxGasFee.WithLabelValues(chain.Name()).Add(maxFee)
+}
+
 // constructUnsignedTx takes in input params and construct a raw unsigned transaction
 func (h *TransactionHandler) constructUnsignedTx(
 	ctx context.Context,
+	chain *Chain,
 	to string,
 	id int64,
 	quantity int64,
-) (*types.Transaction, error) {
-	fromAddr := *h.signer.Address()
-	toAddr := common.HexToAddress(to)
-	contractAddr := common.HexToAddress(h.cfg.ContractAddress)
-
-	// Retrieve nonce for fromAddress (ONLINE)
-	nonce, err := h.client.PendingNonceAt(ctx, fromAddr)
-	if err != nil {
-		return nil, fmt.Errorf("error getting nonce: %v", err)
-	}
+) (tx *types.Transaction, err error) {
+	ctx, span := tracing.Start(ctx, "constructUnsignedTx")
+	defer func() { tracing.End(span, err) }()
 
-	log.Printf("Retrieved nonce %d", nonce)
+	fromAddr := *chain.signer.Address()
+	toAddr := common.HexToAddress(to)
+	contractAddr := common.HexToAddress(chain.cfg.ContractAddress)
 
-	// Estimate Gas Price (ONLINE)
-	suggestedGasPrice, err := h.client.SuggestGasPrice(ctx)
+	nonceCtx, cancel := withTimeout(ctx, h.cfg.RPCTimeout)
+	defer cancel()
+	start := time.Now()
+	nonce, err := chain.reserveNonce(nonceCtx)
+	observeRPCStage(chain, metrics.StageNonce, start, err)
 	if err != nil {
-		return nil, fmt.Errorf("error suggesting gas price: %v", err)
+		return nil, err
 	}
-	gasPrice := big.NewInt(int64(float64(suggestedGasPrice.Int64()) * 1.5))
 
-	log.Printf("Suggested gas %d, used gas %d", suggestedGasPrice.Int64(), gasPrice.Int64())
+	logging.FromContext(ctx).Info("Retrieved nonce", "nonce", nonce)
 
 	// Getting the Contract ABI (OFFLINE)
 	contractAbi, err := contract.ContractMetaData.GetAbi()
@@ -117,34 +331,173 @@ func (h *TransactionHandler) constructUnsignedTx(
 	}
 
 	// Construct Transaction (OFFLINE)
-	baseTx := &types.LegacyTx{
-		To:       &contractAddr,
-		Nonce:    nonce,
-		GasPrice: gasPrice,       // in wei
-		Gas:      uint64(300000), // in unit
-		Value:    big.NewInt(0),
-		Data:     txData,
+	var baseTx types.TxData
+	switch chain.cfg.FeeStrategy {
+	case config.FeeStrategyEIP1559:
+		feeCtx, cancel := withTimeout(ctx, h.cfg.RPCTimeout)
+		defer cancel()
+		start := time.Now()
+		gasTipCap, gasFeeCap, err := suggestDynamicFee(feeCtx, chain)
+		observeRPCStage(chain, metrics.StageGasPrice, start, err)
+		if err != nil {
+			return nil, err
+		}
+		baseTx = &types.DynamicFeeTx{
+			ChainID:   chain.ChainID(),
+			To:        &contractAddr,
+			Nonce:     nonce,
+			GasTipCap: gasTipCap,   // in wei
+			GasFeeCap: gasFeeCap,   // in wei
+			Gas:       TransferGas, // in unit
+			Value:     big.NewInt(0),
+			Data:      txData,
+		}
+	default:
+		feeCtx, cancel := withTimeout(ctx, h.cfg.RPCTimeout)
+		defer cancel()
+		start := time.Now()
+		gasPrice, err := suggestGasPrice(feeCtx, chain)
+		observeRPCStage(chain, metrics.StageGasPrice, start, err)
+		if err != nil {
+			return nil, err
+		}
+		baseTx = &types.LegacyTx{
+			To:       &contractAddr,
+			Nonce:    nonce,
+			GasPrice: gasPrice,    // in wei
+			Gas:      TransferGas, // in unit
+			Value:    big.NewInt(0),
+			Data:     txData,
+		}
 	}
 	unsignedTx := types.NewTx(baseTx)
+	span.SetAttributes(attribute.Int64("nonce", int64(nonce)))
 
 	return unsignedTx, nil
 }
 
+// suggestGasPrice returns the node's gas price scaled by the chain's multiplier
+func suggestGasPrice(ctx context.Context, chain *Chain) (*big.Int, error) {
+	// Estimate Gas Price (ONLINE)
+	spanCtx, span := tracing.Start(ctx, "SuggestGasPrice")
+	suggestedGasPrice, err := chain.client.SuggestGasPrice(spanCtx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("error suggesting gas price: %v", err)
+	}
+	gasPrice := scale(suggestedGasPrice, chain.cfg.GasPriceMultiplier)
+
+	logging.FromContext(ctx).Debug("Suggested gas price", "suggested", suggestedGasPrice, "used", gasPrice)
+
+	return gasPrice, nil
+}
+
+// suggestDynamicFee returns the EIP-1559 tip and fee caps. The tip is scaled
+// by the chain's multiplier and the fee cap leaves room for the base fee to
+// double before the transaction gets stuck.
+func suggestDynamicFee(ctx context.Context, chain *Chain) (*big.Int, *big.Int, error) {
+	// Estimate Gas Tip (ONLINE)
+	spanCtx, span := tracing.Start(ctx, "SuggestGasTipCap")
+	suggestedGasTipCap, err := chain.client.SuggestGasTipCap(spanCtx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error suggesting gas tip cap: %v", err)
+	}
+	// Getting base fee (ONLINE)
+	spanCtx, span = tracing.Start(ctx, "HeaderByNumber")
+	head, err := chain.client.HeaderByNumber(spanCtx, nil)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting latest header: %v", err)
+	}
+	if head.BaseFee == nil {
+		return nil, nil, fmt.Errorf("chain %s does not support EIP-1559", chain.Name())
+	}
+	gasTipCap := scale(suggestedGasTipCap, chain.cfg.GasPriceMultiplier)
+	gasFeeCap := new(big.Int).Add(gasTipCap, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+
+	logging.FromContext(ctx).Debug(
+		"Suggested gas tip",
+		"suggested",
+		suggestedGasTipCap,
+		"used",
+		gasTipCap,
+		"fee_cap",
+		gasFeeCap,
+	)
+
+	return gasTipCap, gasFeeCap, nil
+}
+
+func scale(val *big.Int, multiplier float64) *big.Int {
+	scaled, _ := new(big.Float).Mul(new(big.Float).SetInt(val), big.NewFloat(multiplier)).Int(nil)
+	return scaled
+}
+
 // signTx signs the unsigned transaction using the signer
 func (h *TransactionHandler) signTx(
 	ctx context.Context,
+	chain *Chain,
 	unsignedTx *types.Transaction,
 ) (*types.Transaction, error) {
-	// Getting ChainID (ONLINE)
-	chainId, err := h.client.ChainID(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting ChainID")
-	}
-
-	signedTx, err := h.signer.Sign(chainId, unsignedTx)
+	// The chain id was read from the node, and checked, when the chain was set up
+	_, span := tracing.Start(ctx, "signTx", attribute.String("chain.id", chain.ChainID().String()))
+	signedTx, err := chain.signer.Sign(chain.ChainID(), unsignedTx)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("error signing transaction: %v", err)
 	}
 
 	return signedTx, nil
 }
+
+// submitTx sends the signed transaction with its own deadline, ignoring the
+// cancellation of the request context, so a signed transaction is never
+// abandoned. Sending the same transaction again is harmless, so attempts
+// that did not get an answer from the node are retried.
+func (h *TransactionHandler) submitTx(ctx context.Context, chain *Chain, signedTx *types.Transaction) error {
+	logger := logging.FromContext(ctx).With("nonce", signedTx.Nonce(), "tx_hash", signedTx.Hash().Hex())
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	for attempt := 1; attempt <= sendAttempts; attempt++ {
+		sendCtx, cancel := withTimeout(ctx, h.cfg.SendTimeout)
+		sendCtx, span := tracing.Start(
+			sendCtx,
+			"SendTransaction",
+			attribute.String("tx.hash", signedTx.Hash().Hex()),
+			attribute.Int("attempt", attempt),
+		)
+		// Submit transaction to Cloud Node (ONLINE)
+		err = chain.client.SendTransaction(sendCtx, signedTx)
+		tracing.End(span, err)
+		cancel()
+		if err == nil || isKnownTransaction(err) {
+			chain.commitNonce(signedTx.Nonce())
+			logger.Info("Submitted transaction", "attempt", attempt)
+			return nil
+		}
+		var rpcErr rpc.Error
+		if errors.As(err, &rpcErr) {
+			// The node answered and rejected the transaction
+			return err
+		}
+		logger.Warn("Error submitting transaction", "attempt", attempt, "error", err)
+	}
+	return err
+}
+
+// isKnownTransaction reports whether the node rejected the transaction
+// because an earlier attempt already delivered it
+func isKnownTransaction(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "already known") || strings.Contains(msg, "known transaction")
+}
+
+// withTimeout bounds ctx by timeout, or only makes it cancellable when no
+// timeout is set
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,138 @@
+package handler_test
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/server"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newHarness(t *testing.T) *simulated.Harness {
+	t.Helper()
+	h, err := simulated.New(context.Background(), simulated.Limits{
+		MaxGoldBadgeTotalQty:    3,
+		MaxGoldBadgeTransferQty: 2,
+		MaxPointTotalQty:        100,
+		MaxPointTransferQty:     50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// newChain sets up a chain named name on the simulated node of the harness
+func newChain(t *testing.T, h *simulated.Harness, name string, chainID int64) (*handler.Chain, error) {
+	t.Helper()
+	chainCfg := *h.Config.Chains[simulated.ChainName]
+	chainCfg.Name = name
+	chainCfg.ChainID = chainID
+	return server.NewChain(context.Background(), h.Config, &chainCfg, h.Backend)
+}
+
+func TestChainRegistryRoutesByName(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	defaultChain, err := newChain(t, h, simulated.ChainName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newChain(t, h, "other", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := *h.Config
+	transactionHandler, err := handler.NewTransactionHandler(ctx, &cfg, map[string]*handler.Chain{
+		simulated.ChainName: defaultChain,
+		"other":             other,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]*handler.Chain{"": defaultChain, simulated.ChainName: defaultChain, "other": other} {
+		chain, err := transactionHandler.Chain(name)
+		if err != nil || chain != want {
+			t.Errorf("Chain(%q) = %v, %v, want chain %s", name, chain, err, want.Name())
+		}
+	}
+	_, err = transactionHandler.Chain("missing")
+	if err == nil || !strings.Contains(err.Error(), "unrecognized chain") {
+		t.Errorf("Chain(missing) error = %v, want unrecognized chain", err)
+	}
+	chains := transactionHandler.Chains()
+	if len(chains) != 2 || chains[0] != other || chains[1] != defaultChain {
+		t.Errorf("Chains() = %v, want the chains sorted by name", chains)
+	}
+
+	// A transfer on the other chain uses its nonce stream
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	_, err = transactionHandler.ERC1155Transfer(ctx, "other", to.Hex(), 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.NextNonce() == 0 || defaultChain.NextNonce() != 0 {
+		t.Errorf("next nonces = %d on other, %d on the default chain, want only other moved", other.NextNonce(), defaultChain.NextNonce())
+	}
+	balance, err := h.BalanceOf(ctx, to, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Int64() != 5 {
+		t.Errorf("balance = %v, want 5", balance)
+	}
+	_, err = transactionHandler.ERC1155Transfer(ctx, "missing", to.Hex(), 1, 5)
+	if err == nil {
+		t.Error("ERC1155Transfer on an unknown chain succeeded")
+	}
+}
+
+func TestNewTransactionHandlerRequiresDefaultChain(t *testing.T) {
+	h := newHarness(t)
+	other, err := newChain(t, h, "other", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := *h.Config
+	_, err = handler.NewTransactionHandler(context.Background(), &cfg, map[string]*handler.Chain{"other": other})
+	if err == nil {
+		t.Error("NewTransactionHandler accepted chains without the default chain")
+	}
+}
+
+func TestNewChainChecksChainID(t *testing.T) {
+	h := newHarness(t)
+	nodeID, err := h.Backend.ChainID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := newChain(t, h, "configured", nodeID.Int64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain.ChainID().Cmp(nodeID) != 0 {
+		t.Errorf("ChainID() = %v, want %v", chain.ChainID(), nodeID)
+	}
+	_, err = newChain(t, h, "mismatched", nodeID.Int64()+1)
+	if err == nil || !strings.Contains(err.Error(), "node reports chain id") {
+		t.Errorf("NewChain error = %v, want the chain id mismatch", err)
+	}
+
+	// Without a configured chain id, the one reported by the node is used
+	h.Backend.ServeChainID(big.NewInt(8453))
+	chain, err = newChain(t, h, "unconfigured", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain.ChainID().Int64() != 8453 {
+		t.Errorf("ChainID() = %v, want the node chain id", chain.ChainID())
+	}
+}
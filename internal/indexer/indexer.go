@@ -0,0 +1,279 @@
+// Package indexer keeps a local copy of the TransferSingle and TransferBatch
+// events of the token contract. It backfills from a start block, then
+// follows new blocks and rolls back the blocks dropped by reorgs.
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/client"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// Number of blocks read per log query
+	batchSize = 2000
+	// Number of blocks from the head whose hashes are checked for reorgs
+	reorgDepth = 64
+)
+
+// Backend is the part of the node API the indexer needs. A backend spreading
+// calls over several nodes is pinned to one of them for each sync.
+type Backend interface {
+	bind.ContractFilterer
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+type Indexer struct {
+	name         string
+	backend      Backend
+	contractAddr common.Address
+	filterer     *contract.ContractFilterer
+	store        *Store
+	startBlock   uint64
+	pollInterval time.Duration
+}
+
+func NewIndexer(
+	name string,
+	backend Backend,
+	contractAddr common.Address,
+	store *Store,
+	startBlock uint64,
+	pollInterval time.Duration,
+) (*Indexer, error) {
+	filterer, err := contract.NewContractFilterer(contractAddr, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &Indexer{
+		name:         name,
+		backend:      backend,
+		contractAddr: contractAddr,
+		filterer:     filterer,
+		store:        store,
+		startBlock:   startBlock,
+		pollInterval: pollInterval,
+	}, nil
+}
+
+// Store returns the store holding the indexed transfers
+func (i *Indexer) Store() *Store {
+	return i.store
+}
+
+// Run indexes new blocks until ctx is done
+func (i *Indexer) Run(ctx context.Context) {
+	for {
+		err := i.Sync(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("Error indexing chain", "chain", i.name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(i.pollInterval):
+		}
+	}
+}
+
+// syncPass is the node a sync reads from. Every read of a sync goes to the
+// same node, which has the logs and headers of the head it reported.
+type syncPass struct {
+	backend  Backend
+	filterer *contract.ContractFilterer
+}
+
+// Sync rolls back reorged blocks and indexes every block up to the head
+func (i *Indexer) Sync(ctx context.Context) error {
+	pass := &syncPass{backend: i.backend, filterer: i.filterer}
+	if pinner, ok := i.backend.(client.Pinner); ok {
+		backend := pinner.Pin()
+		filterer, err := contract.NewContractFilterer(i.contractAddr, backend)
+		if err != nil {
+			return err
+		}
+		pass = &syncPass{backend: backend, filterer: filterer}
+	}
+
+	head, err := pass.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error getting head: %v", err)
+	}
+	headNumber := head.Number.Uint64()
+
+	err = i.handleReorg(ctx, pass, headNumber)
+	if err != nil {
+		return err
+	}
+
+	from := i.startBlock
+	if last, ok := i.store.LastBlock(); ok {
+		from = last + 1
+	}
+	for from <= headNumber {
+		to := from + batchSize - 1
+		if to > headNumber {
+			to = headNumber
+		}
+		err = i.indexRange(ctx, pass, from, to, headNumber)
+		if err != nil {
+			return err
+		}
+		from = to + 1
+	}
+	if headNumber > reorgDepth {
+		return i.store.PruneBlockHashes(headNumber - reorgDepth)
+	}
+	return nil
+}
+
+// handleReorg compares the recorded hashes of the recent blocks with the
+// chain, newest first, and rolls the store back to the highest block whose
+// hash still matches. Its ancestors are on the chain too, as each block
+// commits to its parent.
+func (i *Indexer) handleReorg(ctx context.Context, pass *syncPass, headNumber uint64) error {
+	numbers := i.store.BlockHashes(reorgWindowStart(headNumber))
+	if len(numbers) == 0 {
+		return nil
+	}
+	newest := numbers[len(numbers)-1]
+	for j := len(numbers) - 1; j >= 0; j-- {
+		number := numbers[j]
+		if number > headNumber {
+			continue
+		}
+		recorded, _ := i.store.BlockHash(number)
+		header, err := pass.backend.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		if err != nil {
+			return fmt.Errorf("error getting block %d: %v", number, err)
+		}
+		if header.Hash() != recorded {
+			continue
+		}
+		if number == newest {
+			return nil
+		}
+		slog.Warn("Reorg detected, rolling back", "chain", i.name, "block", number)
+		return i.store.Rollback(number)
+	}
+	// No recent block matches: the reorg is deeper than the recorded hashes
+	slog.Warn("Reorg deeper than the recorded blocks, rolling back", "chain", i.name, "block", numbers[0]-1)
+	return i.store.Rollback(numbers[0] - 1)
+}
+
+// reorgWindowStart returns the block after which blocks may still be
+// reorged, and whose hashes are recorded
+func reorgWindowStart(headNumber uint64) uint64 {
+	if headNumber > reorgDepth {
+		return headNumber - reorgDepth
+	}
+	return 0
+}
+
+// indexRange stores the transfers of the blocks from..to
+func (i *Indexer) indexRange(ctx context.Context, pass *syncPass, from uint64, to uint64, headNumber uint64) error {
+	end := to
+	opts := &bind.FilterOpts{Start: from, End: &end, Context: ctx}
+	var transfers []Transfer
+	hashes := make(map[uint64]common.Hash)
+
+	singles, err := pass.filterer.FilterTransferSingle(opts, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error filtering TransferSingle: %v", err)
+	}
+	for singles.Next() {
+		ev := singles.Event
+		transfers = append(transfers, newTransfer(ev.Raw, 0, ev.Operator, ev.From, ev.To, ev.Id, ev.Value))
+		hashes[ev.Raw.BlockNumber] = ev.Raw.BlockHash
+	}
+	err = singles.Error()
+	singles.Close()
+	if err != nil {
+		return fmt.Errorf("error reading TransferSingle: %v", err)
+	}
+
+	batches, err := pass.filterer.FilterTransferBatch(opts, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error filtering TransferBatch: %v", err)
+	}
+	for batches.Next() {
+		ev := batches.Event
+		for j := range ev.Ids {
+			transfers = append(transfers, newTransfer(ev.Raw, j, ev.Operator, ev.From, ev.To, ev.Ids[j], ev.Values[j]))
+		}
+		hashes[ev.Raw.BlockNumber] = ev.Raw.BlockHash
+	}
+	err = batches.Error()
+	batches.Close()
+	if err != nil {
+		return fmt.Errorf("error reading TransferBatch: %v", err)
+	}
+
+	// The hashes of every block of the range that may still be reorged let
+	// the next syncs find the last block still on the chain, with or without
+	// transfers. The last block is always recorded, so a reorg is noticed.
+	first := reorgWindowStart(headNumber) + 1
+	if first < from {
+		first = from
+	}
+	if first > to {
+		first = to
+	}
+	for number := first; number <= to; number++ {
+		header, err := pass.backend.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		if err != nil {
+			return fmt.Errorf("error getting block %d: %v", number, err)
+		}
+		if logHash, ok := hashes[number]; ok && logHash != header.Hash() {
+			return fmt.Errorf("block %d was reorged while being indexed", number)
+		}
+		hashes[number] = header.Hash()
+	}
+
+	sort.Slice(transfers, func(a, b int) bool {
+		if transfers[a].BlockNumber != transfers[b].BlockNumber {
+			return transfers[a].BlockNumber < transfers[b].BlockNumber
+		}
+		if transfers[a].LogIndex != transfers[b].LogIndex {
+			return transfers[a].LogIndex < transfers[b].LogIndex
+		}
+		return transfers[a].BatchIndex < transfers[b].BatchIndex
+	})
+	if len(transfers) > 0 {
+		slog.Info("Indexed transfers", "chain", i.name, "count", len(transfers), "from", from, "to", to)
+	}
+	return i.store.Append(transfers, hashes, to)
+}
+
+func newTransfer(
+	raw types.Log,
+	batchIndex int,
+	operator common.Address,
+	from common.Address,
+	to common.Address,
+	id *big.Int,
+	value *big.Int,
+) Transfer {
+	return Transfer{
+		BlockNumber: raw.BlockNumber,
+		BlockHash:   raw.BlockHash,
+		TxHash:      raw.TxHash,
+		LogIndex:    raw.Index,
+		BatchIndex:  batchIndex,
+		Operator:    operator,
+		From:        from,
+		To:          to,
+		TokenID:     id,
+		Value:       value,
+	}
+}
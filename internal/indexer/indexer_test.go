@@ -0,0 +1,136 @@
+package indexer_test
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/indexer"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const pointID = 1
+
+func newRecipient(t *testing.T) common.Address {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.PubkeyToAddress(key.PublicKey)
+}
+
+func transfer(t *testing.T, h *simulated.Harness, to common.Address) {
+	t.Helper()
+	code, body, err := h.GetToken(to, pointID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+}
+
+// transferOnBranch sends a transfer straight from the treasury, as the server
+// keeps track of the treasury nonce and does not expect it to go back
+func transferOnBranch(t *testing.T, h *simulated.Harness, to common.Address) {
+	t.Helper()
+	chainId, err := h.Backend.ChainID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &bind.TransactOpts{
+		From: *h.Signer.Address(),
+		Signer: func(_ common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			return h.Signer.Sign(chainId, tx)
+		},
+		Context: context.Background(),
+	}
+	_, err = h.Contract.SafeTransferFrom(opts, *h.Signer.Address(), to, big.NewInt(pointID), big.NewInt(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sync(t *testing.T, idx *indexer.Indexer) {
+	t.Helper()
+	err := idx.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertHistory(t *testing.T, store *indexer.Store, addr common.Address, want int) {
+	t.Helper()
+	history, err := store.History(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(history); got != want {
+		t.Errorf("%d transfers to %s indexed, want %d", got, addr.Hex(), want)
+	}
+}
+
+func TestIndexerRollsBackToLastBlockOnChain(t *testing.T) {
+	ctx := context.Background()
+	h, err := simulated.New(ctx, simulated.Limits{MaxPointTotalQty: 100, MaxPointTransferQty: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	store, err := indexer.OpenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := indexer.NewIndexer(simulated.ChainName, h.Backend, h.ContractAddress, store, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, reorged, added := newRecipient(t), newRecipient(t), newRecipient(t)
+	transfer(t, h, kept)
+	sync(t, idx)
+	fork := h.Backend.Blockchain().CurrentBlock()
+	// The block after the fork point has no transfer, the next one has
+	h.Backend.Commit()
+	transfer(t, h, reorged)
+	h.Backend.Commit()
+	sync(t, idx)
+	assertHistory(t, store, reorged, 1)
+
+	// The new branch has a transfer in its first block, right after the
+	// last block the index still shares with it, and outgrows the old one
+	err = h.Backend.Fork(ctx, fork.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferOnBranch(t, h, added)
+	for i := 0; i < 3; i++ {
+		h.Backend.Commit()
+	}
+	if head := h.Backend.Blockchain().CurrentBlock(); head.ParentHash() == fork.Hash() {
+		t.Fatal("the new branch is not canonical")
+	}
+	sync(t, idx)
+
+	assertHistory(t, store, kept, 1)
+	assertHistory(t, store, reorged, 0)
+	assertHistory(t, store, added, 1)
+	head := h.Backend.Blockchain().CurrentBlock().NumberU64()
+	if last, _ := store.LastBlock(); last != head {
+		t.Errorf("last indexed block = %d, want %d", last, head)
+	}
+	for number := fork.NumberU64() + 1; number <= head; number++ {
+		recorded, ok := store.BlockHash(number)
+		if !ok || recorded != h.Backend.Blockchain().GetBlockByNumber(number).Hash() {
+			t.Errorf("block %d hash recorded as %s, want the canonical hash", number, recorded.Hex())
+		}
+	}
+}
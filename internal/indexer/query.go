@@ -0,0 +1,107 @@
+package indexer
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Holder is an address holding a token and its balance
+type Holder struct {
+	Address common.Address
+	Balance *big.Int
+}
+
+// Holders returns the addresses holding a token, from the largest balance
+// to the smallest
+func (s *Store) Holders(tokenId *big.Int) ([]Holder, error) {
+	balances := make(map[common.Address]*big.Int)
+	err := s.Transfers(func(t *Transfer) {
+		if t.TokenID.Cmp(tokenId) != 0 {
+			return
+		}
+		applyTransfer(balances, t.From, t.To, t.Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	holders := make([]Holder, 0, len(balances))
+	for addr, balance := range balances {
+		if balance.Sign() > 0 {
+			holders = append(holders, Holder{Address: addr, Balance: balance})
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		if c := holders[i].Balance.Cmp(holders[j].Balance); c != 0 {
+			return c > 0
+		}
+		return bytes.Compare(holders[i].Address[:], holders[j].Address[:]) < 0
+	})
+	return holders, nil
+}
+
+// Balances returns the balance of every token the address ever held, by token id
+func (s *Store) Balances(addr common.Address) (map[string]*big.Int, error) {
+	balances := make(map[string]*big.Int)
+	err := s.Transfers(func(t *Transfer) {
+		if t.From != addr && t.To != addr {
+			return
+		}
+		key := t.TokenID.String()
+		balance, ok := balances[key]
+		if !ok {
+			balance = new(big.Int)
+			balances[key] = balance
+		}
+		// A self transfer leaves the balance unchanged
+		if t.From == addr {
+			balance.Sub(balance, t.Value)
+		}
+		if t.To == addr {
+			balance.Add(balance, t.Value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+// History returns the transfers from or to the address, most recent first
+func (s *Store) History(addr common.Address) ([]Transfer, error) {
+	var history []Transfer
+	err := s.Transfers(func(t *Transfer) {
+		if t.From == addr || t.To == addr {
+			history = append(history, *t)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
+
+func applyTransfer(balances map[common.Address]*big.Int, from common.Address, to common.Address, value *big.Int) {
+	// Mints come from and burns go to the zero address, which holds nothing
+	if from != (common.Address{}) {
+		balanceOf(balances, from).Sub(balanceOf(balances, from), value)
+	}
+	if to != (common.Address{}) {
+		balanceOf(balances, to).Add(balanceOf(balances, to), value)
+	}
+}
+
+func balanceOf(balances map[common.Address]*big.Int, addr common.Address) *big.Int {
+	balance, ok := balances[addr]
+	if !ok {
+		balance = new(big.Int)
+		balances[addr] = balance
+	}
+	return balance
+}
@@ -0,0 +1,266 @@
+package indexer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Transfer is one token movement of the contract. A TransferBatch event is
+// stored as one transfer per token id, sharing the same log index.
+type Transfer struct {
+	BlockNumber uint64         `json:"blockNumber"`
+	BlockHash   common.Hash    `json:"blockHash"`
+	TxHash      common.Hash    `json:"txHash"`
+	LogIndex    uint           `json:"logIndex"`
+	BatchIndex  int            `json:"batchIndex"`
+	Operator    common.Address `json:"operator"`
+	From        common.Address `json:"from"`
+	To          common.Address `json:"to"`
+	TokenID     *big.Int       `json:"tokenId"`
+	Value       *big.Int       `json:"value"`
+}
+
+// Keys of the database. The transfers are keyed by block number, log index
+// and batch index, big endian, so the keys iterate in chain order.
+var (
+	lastBlockKey      = []byte("lastBlock")
+	transferPrefix    = []byte("t")
+	blockHashPrefix   = []byte("h")
+	transferKeyLength = len(transferPrefix) + 8 + 4 + 4
+)
+
+func transferKey(t *Transfer) []byte {
+	key := make([]byte, 0, transferKeyLength)
+	key = append(key, transferPrefix...)
+	key = binary.BigEndian.AppendUint64(key, t.BlockNumber)
+	key = binary.BigEndian.AppendUint32(key, uint32(t.LogIndex))
+	return binary.BigEndian.AppendUint32(key, uint32(t.BatchIndex))
+}
+
+// blockKey returns the key of the first transfer or of the hash of a block
+func blockKey(prefix []byte, number uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, prefix...), number)
+}
+
+// Store keeps the indexed transfers in a LevelDB database, in chain order.
+// Each change only writes the transfers and hashes it adds or removes. The
+// last indexed block and the hashes of the recent blocks are also kept in
+// memory.
+type Store struct {
+	db *leveldb.DB
+
+	mu        sync.RWMutex
+	lastBlock uint64
+	// Hashes of the recent indexed blocks, used to detect reorgs
+	blockHashes map[uint64]common.Hash
+}
+
+// OpenStore opens the database in the directory at path, or an in-memory
+// database when path is empty. Only one process can open a database.
+func OpenStore(path string) (*Store, error) {
+	var db *leveldb.DB
+	var err error
+	if path == "" {
+		db, err = leveldb.Open(storage.NewMemStorage(), nil)
+	} else {
+		db, err = leveldb.OpenFile(path, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening index %s: %v", path, err)
+	}
+	s := &Store{
+		db:          db,
+		blockHashes: make(map[uint64]common.Hash),
+	}
+	err = s.load()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error reading index %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// load reads the last indexed block and the recorded block hashes
+func (s *Store) load() error {
+	last, err := s.db.Get(lastBlockKey, nil)
+	switch {
+	case err == leveldb.ErrNotFound:
+	case err != nil:
+		return err
+	case len(last) != 8:
+		return fmt.Errorf("invalid last block")
+	default:
+		s.lastBlock = binary.BigEndian.Uint64(last)
+	}
+
+	iter := s.db.NewIterator(util.BytesPrefix(blockHashPrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		number := binary.BigEndian.Uint64(iter.Key()[len(blockHashPrefix):])
+		s.blockHashes[number] = common.BytesToHash(iter.Value())
+	}
+	return iter.Error()
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// LastBlock returns the last indexed block, and false when nothing was indexed yet
+func (s *Store) LastBlock() (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastBlock, s.lastBlock != 0
+}
+
+// Append stores the transfers of the blocks up to lastBlock along with the
+// hashes of the blocks they were read from
+func (s *Store) Append(transfers []Transfer, hashes map[uint64]common.Hash, lastBlock uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	for i := range transfers {
+		value, err := json.Marshal(&transfers[i])
+		if err != nil {
+			return err
+		}
+		batch.Put(transferKey(&transfers[i]), value)
+	}
+	for number, hash := range hashes {
+		batch.Put(blockKey(blockHashPrefix, number), hash.Bytes())
+	}
+	batch.Put(lastBlockKey, binary.BigEndian.AppendUint64(nil, lastBlock))
+	err := s.db.Write(batch, nil)
+	if err != nil {
+		return fmt.Errorf("error writing index: %v", err)
+	}
+
+	for number, hash := range hashes {
+		s.blockHashes[number] = hash
+	}
+	s.lastBlock = lastBlock
+	return nil
+}
+
+// BlockHashes returns the recorded hashes of the blocks after the given one,
+// in ascending block order
+func (s *Store) BlockHashes(after uint64) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var numbers []uint64
+	for number := range s.blockHashes {
+		if number > after {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+// BlockHash returns the recorded hash of a block
+func (s *Store) BlockHash(number uint64) (common.Hash, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, ok := s.blockHashes[number]
+	return hash, ok
+}
+
+// Rollback removes everything indexed after the given block
+func (s *Store) Rollback(block uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(&util.Range{
+		Start: blockKey(transferPrefix, block+1),
+		Limit: util.BytesPrefix(transferPrefix).Limit,
+	}, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return fmt.Errorf("error reading index: %v", err)
+	}
+	for number := range s.blockHashes {
+		if number > block {
+			batch.Delete(blockKey(blockHashPrefix, number))
+		}
+	}
+	lastBlock := s.lastBlock
+	if lastBlock > block {
+		lastBlock = block
+	}
+	batch.Put(lastBlockKey, binary.BigEndian.AppendUint64(nil, lastBlock))
+	err = s.db.Write(batch, nil)
+	if err != nil {
+		return fmt.Errorf("error writing index: %v", err)
+	}
+
+	for number := range s.blockHashes {
+		if number > block {
+			delete(s.blockHashes, number)
+		}
+	}
+	s.lastBlock = lastBlock
+	return nil
+}
+
+// PruneBlockHashes forgets the hashes of blocks deep enough not to be reorged
+func (s *Store) PruneBlockHashes(before uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	for number := range s.blockHashes {
+		if number < before {
+			batch.Delete(blockKey(blockHashPrefix, number))
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	err := s.db.Write(batch, nil)
+	if err != nil {
+		return fmt.Errorf("error writing index: %v", err)
+	}
+	for number := range s.blockHashes {
+		if number < before {
+			delete(s.blockHashes, number)
+		}
+	}
+	return nil
+}
+
+// Transfers calls fn for every stored transfer in chain order, reading them
+// from a snapshot of the database
+func (s *Store) Transfers(fn func(t *Transfer)) error {
+	iter := s.db.NewIterator(util.BytesPrefix(transferPrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var t Transfer
+		err := json.Unmarshal(iter.Value(), &t)
+		if err != nil {
+			return fmt.Errorf("error reading index: %v", err)
+		}
+		fn(&t)
+	}
+	err := iter.Error()
+	if err != nil {
+		return fmt.Errorf("error reading index: %v", err)
+	}
+	return nil
+}
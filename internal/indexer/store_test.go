@@ -0,0 +1,129 @@
+package indexer_test
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/indexer"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newTransfer(block uint64, logIndex uint, batchIndex int, to common.Address) indexer.Transfer {
+	return indexer.Transfer{
+		BlockNumber: block,
+		LogIndex:    logIndex,
+		BatchIndex:  batchIndex,
+		To:          to,
+		TokenID:     big.NewInt(pointID),
+		Value:       big.NewInt(1),
+	}
+}
+
+func storedBlocks(t *testing.T, store *indexer.Store) []uint64 {
+	t.Helper()
+	var blocks []uint64
+	err := store.Transfers(func(tr *indexer.Transfer) {
+		blocks = append(blocks, tr.BlockNumber)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+func TestStoreKeepsTransfersAcrossReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := indexer.OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := newRecipient(t)
+	err = store.Append([]indexer.Transfer{
+		newTransfer(5, 0, 0, holder),
+		newTransfer(5, 1, 0, holder),
+		newTransfer(5, 1, 1, holder),
+	}, map[uint64]common.Hash{5: {5}}, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Append([]indexer.Transfer{newTransfer(12, 0, 0, holder)}, map[uint64]common.Hash{12: {12}}, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PruneBlockHashes(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = indexer.OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if last, ok := store.LastBlock(); !ok || last != 12 {
+		t.Errorf("last block = %d, want 12", last)
+	}
+	if got := storedBlocks(t, store); len(got) != 4 || got[3] != 12 {
+		t.Errorf("transfers of blocks %v, want 5, 5, 5, 12", got)
+	}
+	if _, ok := store.BlockHash(5); ok {
+		t.Error("pruned hash of block 5 read back")
+	}
+	if hash, ok := store.BlockHash(12); !ok || hash != (common.Hash{12}) {
+		t.Errorf("hash of block 12 = %s, want the recorded one", hash.Hex())
+	}
+	balances, err := store.Balances(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance := balances["1"]; balance == nil || balance.Int64() != 4 {
+		t.Errorf("balance = %v, want 4", balance)
+	}
+}
+
+func TestStoreRollsBackAfterBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := indexer.OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := newRecipient(t)
+	err = store.Append([]indexer.Transfer{
+		newTransfer(3, 0, 0, holder),
+		newTransfer(4, 0, 0, holder),
+		newTransfer(4, 2, 0, holder),
+		newTransfer(6, 0, 0, holder),
+	}, map[uint64]common.Hash{3: {3}, 4: {4}, 5: {5}, 6: {6}}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Rollback(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = indexer.OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if last, _ := store.LastBlock(); last != 3 {
+		t.Errorf("last block = %d, want 3", last)
+	}
+	if got := storedBlocks(t, store); len(got) != 1 || got[0] != 3 {
+		t.Errorf("transfers of blocks %v, want 3", got)
+	}
+	if got := store.BlockHashes(0); len(got) != 1 || got[0] != 3 {
+		t.Errorf("hashes of blocks %v, want 3", got)
+	}
+}
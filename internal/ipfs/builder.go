@@ -0,0 +1,206 @@
+package ipfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+const (
+	// Files are split in raw leaves of this size, like the ipfs and ipfs-car
+	// defaults, so the same content gets the same CID
+	chunkSize = 256 << 10
+	// Most links of a file node of the balanced layout
+	maxFileLinks = 174
+)
+
+// Link is a named entry of a UnixFS directory
+type Link struct {
+	Name string
+	CID  CID
+	// Total size of the linked DAG, blocks included
+	Size uint64
+}
+
+type builtBlock struct {
+	cid  CID
+	data []byte
+}
+
+// Builder builds UnixFS DAGs with CIDv1, raw leaves and the balanced file
+// layout, and writes them to a CAR archive
+type Builder struct {
+	blocks []builtBlock
+	seen   map[string]bool
+}
+
+func NewBuilder() *Builder {
+	return &Builder{seen: make(map[string]bool)}
+}
+
+// AddFile adds the blocks of a file and returns its root link, unnamed
+func (b *Builder) AddFile(content []byte) Link {
+	var leaves []fileNode
+	for start := 0; start == 0 || start < len(content); start += chunkSize {
+		end := start + chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := content[start:end]
+		cid := b.add(CodecRaw, chunk)
+		leaves = append(leaves, fileNode{
+			link:     Link{CID: cid, Size: uint64(len(chunk))},
+			fileSize: uint64(len(chunk)),
+		})
+	}
+	for len(leaves) > 1 {
+		var parents []fileNode
+		for start := 0; start < len(leaves); start += maxFileLinks {
+			end := start + maxFileLinks
+			if end > len(leaves) {
+				end = len(leaves)
+			}
+			parents = append(parents, b.addFileNode(leaves[start:end]))
+		}
+		leaves = parents
+	}
+	return leaves[0].link
+}
+
+type fileNode struct {
+	link     Link
+	fileSize uint64
+}
+
+func (b *Builder) addFileNode(children []fileNode) fileNode {
+	fsData := appendVarintField(nil, 1, unixfsFile)
+	var fileSize uint64
+	for _, child := range children {
+		fileSize += child.fileSize
+	}
+	fsData = appendVarintField(fsData, 3, fileSize)
+	links := make([]Link, len(children))
+	for i, child := range children {
+		fsData = appendVarintField(fsData, 4, child.fileSize)
+		links[i] = child.link
+	}
+	node := encodePBNode(links, fsData)
+	cid := b.add(CodecDagPB, node)
+	return fileNode{
+		link:     Link{CID: cid, Size: uint64(len(node)) + linksSize(links)},
+		fileSize: fileSize,
+	}
+}
+
+// AddDir adds a directory holding links and returns its root link, unnamed.
+// Entries are sorted by name as UnixFS requires.
+func (b *Builder) AddDir(links []Link) Link {
+	sorted := append([]Link(nil), links...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	node := encodePBNode(sorted, appendVarintField(nil, 1, unixfsDirectory))
+	cid := b.add(CodecDagPB, node)
+	return Link{CID: cid, Size: uint64(len(node)) + linksSize(sorted)}
+}
+
+func (b *Builder) add(codec uint64, data []byte) CID {
+	sum := sha256.Sum256(data)
+	cid := CID{
+		Version: 1,
+		Codec:   codec,
+		Hash:    append([]byte{hashSHA256, 32}, sum[:]...),
+	}
+	if !b.seen[cid.key()] {
+		b.seen[cid.key()] = true
+		b.blocks = append(b.blocks, builtBlock{cid: cid, data: data})
+	}
+	return cid
+}
+
+// WriteCAR writes every block added so far to a CARv1 archive with roots
+func (b *Builder) WriteCAR(w io.Writer, roots ...CID) error {
+	bw := bufio.NewWriter(w)
+	// dag-cbor {"roots": [...], "version": 1}, keys in canonical order
+	header := []byte{0xa2}
+	header = appendCBORString(header, "roots")
+	header = appendCBORHead(header, 4, uint64(len(roots)))
+	for _, root := range roots {
+		link := append([]byte{0}, root.Bytes()...)
+		header = appendCBORHead(header, 6, 42)
+		header = appendCBORHead(header, 2, uint64(len(link)))
+		header = append(header, link...)
+	}
+	header = appendCBORString(header, "version")
+	header = appendCBORHead(header, 0, 1)
+
+	err := writeSection(bw, header)
+	if err != nil {
+		return err
+	}
+	for _, block := range b.blocks {
+		err = writeSection(bw, append(block.cid.Bytes(), block.data...))
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeSection(w io.Writer, b []byte) error {
+	_, err := w.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func linksSize(links []Link) uint64 {
+	var size uint64
+	for _, link := range links {
+		size += link.Size
+	}
+	return size
+}
+
+// encodePBNode encodes a dag-pb node in canonical form: links first, then data
+func encodePBNode(links []Link, data []byte) []byte {
+	var node []byte
+	for _, link := range links {
+		var pbLink []byte
+		pbLink = appendBytesField(pbLink, 1, link.CID.Bytes())
+		pbLink = appendBytesField(pbLink, 2, []byte(link.Name))
+		pbLink = appendVarintField(pbLink, 3, link.Size)
+		node = appendBytesField(node, 2, pbLink)
+	}
+	return appendBytesField(node, 1, data)
+}
+
+func appendVarintField(b []byte, field uint64, val uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3)
+	return binary.AppendUvarint(b, val)
+}
+
+func appendBytesField(b []byte, field uint64, val []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(val)))
+	return append(b, val...)
+}
+
+func appendCBORHead(b []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(b, major<<5|byte(arg))
+	case arg <= 0xff:
+		return append(b, major<<5|24, byte(arg))
+	case arg <= 0xffff:
+		return append(b, major<<5|25, byte(arg>>8), byte(arg))
+	}
+	b = append(b, major<<5|26)
+	return binary.BigEndian.AppendUint32(b, uint32(arg))
+}
+
+func appendCBORString(b []byte, s string) []byte {
+	return append(appendCBORHead(b, 3, uint64(len(s))), s...)
+}
@@ -0,0 +1,60 @@
+package ipfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuilderMatchesKnownCIDs(t *testing.T) {
+	// CIDs computed by ipfs add --cid-version 1 --raw-leaves
+	tests := []struct {
+		name string
+		link func(b *Builder) Link
+		want string
+	}{
+		{"empty file", func(b *Builder) Link { return b.AddFile(nil) }, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{"empty directory", func(b *Builder) Link { return b.AddDir(nil) }, "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.link(NewBuilder()).CID.String(); got != test.want {
+				t.Errorf("CID = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuilderLayout(t *testing.T) {
+	b := NewBuilder()
+	// One more leaf than a node links, so the file takes two levels
+	content := bytes.Repeat([]byte{7}, (maxFileLinks+1)*chunkSize)
+	file := b.AddFile(content)
+	if file.CID.Codec != CodecDagPB {
+		t.Fatalf("codec = %x, want dag-pb", file.CID.Codec)
+	}
+	// Identical chunks are stored once
+	if len(b.blocks) != 4 {
+		t.Errorf("%d blocks, want the leaf, 2 nodes and the root", len(b.blocks))
+	}
+
+	var buf bytes.Buffer
+	err := b.WriteCAR(&buf, file.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := ReadCAR(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _, err := car.dagPBNode(file.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Links) != 2 {
+		t.Errorf("root has %d links, want a full node and the last leaf", len(node.Links))
+	}
+	got, err := car.ReadFile(file.CID)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadFile = %d bytes, %v, want the content", len(got), err)
+	}
+}
@@ -0,0 +1,215 @@
+package ipfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Largest CAR header and block read, well above what IPFS tools produce
+const maxSectionSize = 4 << 20
+
+// CAR is the content of a CARv1 archive, with every block verified
+type CAR struct {
+	Roots  []CID
+	blocks map[string][]byte
+}
+
+// OpenCAR reads the CARv1 archive at path
+func OpenCAR(path string) (*CAR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	car, err := ReadCAR(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return car, nil
+}
+
+// ReadCAR reads a CARv1 archive: a length-prefixed dag-cbor header holding
+// the roots, followed by length-prefixed sections of a CID and its block
+func ReadCAR(r io.Reader) (*CAR, error) {
+	br := bufio.NewReader(r)
+	header, err := readSection(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	if header == nil {
+		return nil, errors.New("empty archive")
+	}
+	roots, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	car := &CAR{Roots: roots, blocks: make(map[string][]byte)}
+	for {
+		section, err := readSection(br)
+		if err != nil {
+			return nil, fmt.Errorf("error reading block: %v", err)
+		}
+		if section == nil {
+			break
+		}
+		cid, n, err := decodeCID(section)
+		if err != nil {
+			return nil, fmt.Errorf("error reading block CID: %v", err)
+		}
+		data := section[n:]
+		err = cid.Verify(data)
+		if err != nil {
+			return nil, err
+		}
+		car.blocks[cid.key()] = data
+	}
+	return car, nil
+}
+
+// readSection reads a varint length-prefixed section, or returns nil at the
+// end of the archive
+func readSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 || size > maxSectionSize {
+		return nil, fmt.Errorf("invalid section length %d", size)
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func parseHeader(b []byte) ([]CID, error) {
+	v, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	header, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid header: not a map")
+	}
+	if version, _ := header["version"].(uint64); version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %v", header["version"])
+	}
+	links, _ := header["roots"].([]interface{})
+	roots := make([]CID, 0, len(links))
+	for _, link := range links {
+		cid, ok := link.(CID)
+		if !ok {
+			return nil, errors.New("invalid header: root is not a CID")
+		}
+		roots = append(roots, cid)
+	}
+	return roots, nil
+}
+
+// Get returns the block of a CID
+func (c *CAR) Get(cid CID) ([]byte, bool) {
+	b, ok := c.blocks[cid.key()]
+	return b, ok
+}
+
+// decodeCBOR decodes the subset of dag-cbor used by CAR headers: integers,
+// strings, arrays, maps and CID links (tag 42)
+func decodeCBOR(b []byte) (interface{}, int, error) {
+	if len(b) == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	arg, n, err := cborArg(b, info)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch major {
+	case 0:
+		return arg, n, nil
+	case 2, 3:
+		if uint64(len(b)-n) < arg {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		end := n + int(arg)
+		if major == 3 {
+			return string(b[n:end]), end, nil
+		}
+		return b[n:end], end, nil
+	case 4:
+		var items []interface{}
+		for i := uint64(0); i < arg; i++ {
+			item, m, err := decodeCBOR(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += m
+		}
+		return items, n, nil
+	case 5:
+		entries := make(map[string]interface{})
+		for i := uint64(0); i < arg; i++ {
+			key, m, err := decodeCBOR(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			n += m
+			val, m, err := decodeCBOR(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			n += m
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			entries[k] = val
+		}
+		return entries, n, nil
+	case 6:
+		val, m, err := decodeCBOR(b[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		link, ok := val.([]byte)
+		if arg != 42 || !ok || len(link) == 0 || link[0] != 0 {
+			return nil, 0, fmt.Errorf("unsupported tag %d", arg)
+		}
+		// CID links are prefixed with the identity multibase
+		cid, _, err := decodeCID(link[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return cid, n + m, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported CBOR major type %d", major)
+}
+
+// cborArg returns the argument of a CBOR item and the length of its head
+func cborArg(b []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < 1+size {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		var arg uint64
+		for _, c := range b[1 : 1+size] {
+			arg = arg<<8 | uint64(c)
+		}
+		return arg, 1 + size, nil
+	}
+	return 0, 0, fmt.Errorf("unsupported CBOR length %d", info)
+}
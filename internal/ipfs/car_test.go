@@ -0,0 +1,185 @@
+package ipfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// buildCAR returns an archive holding a directory with a small file, a file
+// of several chunks and a subdirectory, and the CID of the directory
+func buildCAR(t *testing.T, small, large []byte) ([]byte, CID) {
+	t.Helper()
+	b := NewBuilder()
+	smallLink := b.AddFile(small)
+	smallLink.Name = "small.json"
+	largeLink := b.AddFile(large)
+	largeLink.Name = "large.bin"
+	sub := b.AddDir([]Link{smallLink})
+	sub.Name = "sub"
+	root := b.AddDir([]Link{sub, largeLink, smallLink})
+
+	var buf bytes.Buffer
+	err := b.WriteCAR(&buf, root.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), root.CID
+}
+
+func TestCARRoundTrip(t *testing.T) {
+	small := []byte(`{"name":"Gold Badge"}`)
+	large := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/16*2+100)
+	archive, root := buildCAR(t, small, large)
+
+	car, err := ReadCAR(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(car.Roots) != 1 || car.Roots[0].String() != root.String() {
+		t.Fatalf("roots = %v, want [%s]", car.Roots, root)
+	}
+	if !car.IsDir(root) {
+		t.Errorf("root %s is not a directory", root)
+	}
+	for path, want := range map[string][]byte{
+		"small.json":      small,
+		"/sub/small.json": small,
+		"large.bin":       large,
+	} {
+		cid, err := car.Resolve(root, path)
+		if err != nil {
+			t.Fatalf("Resolve(%s) failed: %v", path, err)
+		}
+		got, err := car.ReadFile(cid)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed: %v", path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadFile(%s) returned %d bytes, want %d", path, len(got), len(want))
+		}
+	}
+	_, err = car.Resolve(root, "missing.json")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve of a missing file = %v, want ErrNotFound", err)
+	}
+	_, err = car.Resolve(root, "small.json/name")
+	if err == nil {
+		t.Error("Resolve walked into a file")
+	}
+	_, err = car.ReadFile(root)
+	if err == nil {
+		t.Error("ReadFile read a directory")
+	}
+}
+
+func TestBuilderIsDeterministic(t *testing.T) {
+	first, firstRoot := buildCAR(t, []byte("a"), []byte("b"))
+	second, secondRoot := buildCAR(t, []byte("a"), []byte("b"))
+	if firstRoot.String() != secondRoot.String() || !bytes.Equal(first, second) {
+		t.Error("the same content built different archives")
+	}
+}
+
+// section returns b prefixed with its varint length
+func section(b []byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(b))), b...)
+}
+
+func TestReadCARRejectsMalformed(t *testing.T) {
+	archive, _ := buildCAR(t, []byte("small"), []byte("large"))
+	headerLen, n := binary.Uvarint(archive)
+	header := archive[n : n+int(headerLen)]
+	blocks := archive[n+int(headerLen):]
+	blockLen, m := binary.Uvarint(blocks)
+	block := append([]byte(nil), blocks[m:m+int(blockLen)]...)
+	// The last byte of the first block, past its CID
+	corrupted := append([]byte(nil), block...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{"empty", nil},
+		{"truncated header length", []byte{0x80}},
+		{"overflowing header length", bytes.Repeat([]byte{0xff}, 11)},
+		{"zero header length", []byte{0}},
+		{"oversized header length", binary.AppendUvarint(nil, maxSectionSize+1)},
+		{"truncated header", archive[:n+int(headerLen)-1]},
+		{"header not CBOR", section([]byte{0xff})},
+		{"header not a map", section([]byte{0x01})},
+		{"header without version", section([]byte{0xa0})},
+		{"header with truncated string", section([]byte{0xa1, 0x65, 'r', 'o'})},
+		{"header with oversized string", section([]byte{0xa1, 0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})},
+		{"header with oversized array", section([]byte{0xa1, 0x65, 'r', 'o', 'o', 't', 's', 0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})},
+		{"truncated block length", append(append([]byte(nil), archive[:n+int(headerLen)]...), 0x80)},
+		{"oversized block length", append(section(header), binary.AppendUvarint(nil, maxSectionSize+1)...)},
+		{"truncated block", append(section(header), section(block)[:len(block)]...)},
+		{"block with a bad CID", append(section(header), section(append([]byte{1, CodecRaw, hashSHA256, 33}, make([]byte, 32)...))...)},
+		{"block not matching its CID", append(section(header), section(corrupted)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadCAR(bytes.NewReader(test.archive))
+			if err == nil {
+				t.Error("ReadCAR accepted a malformed archive")
+			}
+		})
+	}
+}
+
+func TestDecodePBNodeRejectsMalformed(t *testing.T) {
+	b := NewBuilder()
+	file := b.AddFile([]byte("content"))
+	file.Name = "file"
+	node := encodePBNode([]Link{file}, appendVarintField(nil, 1, unixfsDirectory))
+	_, err := decodePBNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		node []byte
+	}{
+		{"truncated tag", []byte{0x80}},
+		{"truncated varint", []byte{0x08, 0x80}},
+		{"truncated node", node[:len(node)-1]},
+		{"oversized length", []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"unsupported wire type", []byte{0x0d, 0, 0, 0, 0}},
+		{"link with a bad CID", appendBytesField(nil, 2, appendBytesField(nil, 1, []byte{1, CodecRaw, hashSHA256, 32}))},
+		{"link CID with trailing bytes", appendBytesField(nil, 2, appendBytesField(nil, 1, append(file.CID.Bytes(), 0)))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodePBNode(test.node)
+			if err == nil {
+				t.Error("decodePBNode accepted a malformed node")
+			}
+		})
+	}
+}
+
+func TestReadFileStopsOnDeepTrees(t *testing.T) {
+	b := NewBuilder()
+	link := b.AddFile([]byte("leaf"))
+	for i := 0; i <= maxFileDepth+1; i++ {
+		node := encodePBNode([]Link{link}, appendVarintField(nil, 1, unixfsFile))
+		link = Link{CID: b.add(CodecDagPB, node)}
+	}
+	var buf bytes.Buffer
+	err := b.WriteCAR(&buf, link.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := ReadCAR(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = car.ReadFile(link.CID)
+	if err == nil {
+		t.Error("ReadFile read a file tree deeper than maxFileDepth")
+	}
+}
@@ -0,0 +1,141 @@
+// Package ipfs reads IPFS content from CARv1 archives, so the token assets
+// can be served without a gateway. Every block is checked against its CID
+// when an archive is loaded.
+package ipfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// Multicodec codes of the content and hash types we handle
+const (
+	CodecRaw   = 0x55
+	CodecDagPB = 0x70
+
+	hashIdentity = 0x00
+	hashSHA256   = 0x12
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CID is a content identifier: the codec of a block and the multihash of
+// its bytes
+type CID struct {
+	Version uint64
+	Codec   uint64
+	// Multihash of the block, including its code and length prefix
+	Hash []byte
+}
+
+// ParseCID decodes a CIDv0 (base58btc, Qm...) or a CIDv1 in base32 (b...)
+func ParseCID(s string) (CID, error) {
+	var b []byte
+	switch {
+	case len(s) == 46 && strings.HasPrefix(s, "Qm"):
+		b = base58.Decode(s)
+	case strings.HasPrefix(s, "b"):
+		var err error
+		b, err = base32Encoding.DecodeString(strings.ToUpper(s[1:]))
+		if err != nil {
+			return CID{}, fmt.Errorf("invalid CID %q: %v", s, err)
+		}
+	default:
+		return CID{}, fmt.Errorf("unsupported CID encoding %q", s)
+	}
+	cid, n, err := decodeCID(b)
+	if err != nil {
+		return CID{}, fmt.Errorf("invalid CID %q: %v", s, err)
+	}
+	if n != len(b) {
+		return CID{}, fmt.Errorf("invalid CID %q: trailing bytes", s)
+	}
+	return cid, nil
+}
+
+// decodeCID reads a binary CID and returns it with its length
+func decodeCID(b []byte) (CID, int, error) {
+	// A CIDv0 is a bare sha2-256 multihash
+	if len(b) >= 34 && b[0] == hashSHA256 && b[1] == 32 {
+		return CID{Version: 0, Codec: CodecDagPB, Hash: b[:34]}, 34, nil
+	}
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != 1 {
+		return CID{}, 0, errors.New("unsupported CID version")
+	}
+	codec, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return CID{}, 0, errors.New("invalid codec")
+	}
+	n += m
+	hashLen, err := multihashLen(b[n:])
+	if err != nil {
+		return CID{}, 0, err
+	}
+	return CID{Version: 1, Codec: codec, Hash: b[n : n+hashLen]}, n + hashLen, nil
+}
+
+// multihashLen returns the length of the multihash at the start of b
+func multihashLen(b []byte) (int, error) {
+	_, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, errors.New("invalid multihash code")
+	}
+	digestLen, m := binary.Uvarint(b[n:])
+	if m <= 0 || uint64(len(b)-n-m) < digestLen {
+		return 0, errors.New("invalid multihash length")
+	}
+	return n + m + int(digestLen), nil
+}
+
+// Bytes returns the binary form of the CID
+func (c CID) Bytes() []byte {
+	if c.Version == 0 {
+		return c.Hash
+	}
+	b := binary.AppendUvarint(nil, c.Version)
+	b = binary.AppendUvarint(b, c.Codec)
+	return append(b, c.Hash...)
+}
+
+// String returns the CID in its usual text form: base58btc for CIDv0 and
+// base32 for CIDv1
+func (c CID) String() string {
+	if c.Version == 0 {
+		return base58.Encode(c.Hash)
+	}
+	return "b" + strings.ToLower(base32Encoding.EncodeToString(c.Bytes()))
+}
+
+// key identifies the block of the CID whatever its version
+func (c CID) key() string {
+	return string(c.Hash) + "/" + fmt.Sprint(c.Codec)
+}
+
+// Verify checks that data hashes to the CID
+func (c CID) Verify(data []byte) error {
+	code, n := binary.Uvarint(c.Hash)
+	digestLen, m := binary.Uvarint(c.Hash[n:])
+	digest := c.Hash[n+m:]
+	switch code {
+	case hashSHA256:
+		sum := sha256.Sum256(data)
+		if digestLen != 32 || !bytes.Equal(sum[:], digest) {
+			return fmt.Errorf("block does not match CID %s", c)
+		}
+	case hashIdentity:
+		if !bytes.Equal(data, digest) {
+			return fmt.Errorf("block does not match CID %s", c)
+		}
+	default:
+		return fmt.Errorf("unsupported hash function 0x%x in CID %s", code, c)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package ipfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestParseCIDRoundTrip(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	hash := append([]byte{hashSHA256, 32}, sum[:]...)
+	for _, cid := range []CID{
+		{Version: 0, Codec: CodecDagPB, Hash: hash},
+		{Version: 1, Codec: CodecDagPB, Hash: hash},
+		{Version: 1, Codec: CodecRaw, Hash: hash},
+	} {
+		parsed, err := ParseCID(cid.String())
+		if err != nil {
+			t.Fatalf("ParseCID(%s) failed: %v", cid, err)
+		}
+		if parsed.Version != cid.Version || parsed.Codec != cid.Codec || !bytes.Equal(parsed.Hash, cid.Hash) {
+			t.Errorf("ParseCID(%s) = %+v, want %+v", cid, parsed, cid)
+		}
+		if parsed.String() != cid.String() {
+			t.Errorf("ParseCID(%s).String() = %s", cid, parsed)
+		}
+		err = parsed.Verify([]byte("hello"))
+		if err != nil {
+			t.Errorf("Verify of %s failed: %v", cid, err)
+		}
+		if parsed.Verify([]byte("hello!")) == nil {
+			t.Errorf("Verify of %s accepted other content", cid)
+		}
+	}
+}
+
+func TestParseCIDRejectsMalformed(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	valid := CID{Version: 1, Codec: CodecRaw, Hash: append([]byte{hashSHA256, 32}, sum[:]...)}
+	b := valid.Bytes()
+	encode := func(b []byte) string {
+		return "b" + string(bytes.ToLower([]byte(base32Encoding.EncodeToString(b))))
+	}
+
+	tests := []struct {
+		name string
+		cid  string
+	}{
+		{"empty", ""},
+		{"unknown multibase", "z" + valid.String()[1:]},
+		{"invalid base32", "b0189"},
+		{"CIDv0 of the wrong length", "Qm" + valid.String()[2:]},
+		{"truncated version varint", encode([]byte{0x81})},
+		{"unsupported version", encode(append([]byte{2}, b[1:]...))},
+		{"truncated codec varint", encode([]byte{1, 0x81})},
+		{"truncated multihash", encode(b[:len(b)-1])},
+		{"oversized digest length", encode(append([]byte{1, CodecRaw, hashSHA256, 0xff, 0xff, 0x03}, sum[:]...))},
+		{"trailing bytes", encode(append(b, 0))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cid, err := ParseCID(test.cid)
+			if err == nil {
+				t.Errorf("ParseCID(%q) = %s, want an error", test.cid, cid)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnsupportedHash(t *testing.T) {
+	// 0x1b is keccak-256
+	cid := CID{Version: 1, Codec: CodecRaw, Hash: append([]byte{0x1b, 32}, make([]byte, 32)...)}
+	if cid.Verify(nil) == nil {
+		t.Error("Verify accepted an unsupported hash function")
+	}
+}
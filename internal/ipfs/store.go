@@ -0,0 +1,63 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store serves the content of the CAR archives of a directory
+type Store struct {
+	cars []*CAR
+}
+
+// OpenStore loads every .car file of dir
+func OpenStore(dir string) (*Store, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CAR directory: %v", err)
+	}
+	s := &Store{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".car") {
+			continue
+		}
+		car, err := OpenCAR(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.cars = append(s.cars, car)
+	}
+	return s, nil
+}
+
+// Resolve returns the archive holding the content at path under root, with
+// the CID of that content
+func (s *Store) Resolve(root CID, path string) (*CAR, CID, error) {
+	for _, car := range s.cars {
+		if _, ok := car.Get(root); !ok {
+			continue
+		}
+		cid, err := car.Resolve(root, path)
+		if err != nil {
+			return nil, CID{}, err
+		}
+		return car, cid, nil
+	}
+	return nil, CID{}, ErrNotFound
+}
+
+// Fetch returns the file at path under the root cid
+func (s *Store) Fetch(ctx context.Context, cid string, path string) ([]byte, error) {
+	root, err := ParseCID(cid)
+	if err != nil {
+		return nil, err
+	}
+	car, target, err := s.Resolve(root, path)
+	if err != nil {
+		return nil, err
+	}
+	return car.ReadFile(target)
+}
@@ -0,0 +1,219 @@
+package ipfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// UnixFS node types
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+)
+
+// Deepest file tree read, to stop on malicious archives
+const maxFileDepth = 32
+
+// ErrNotFound is returned for content missing from the archives
+var ErrNotFound = errors.New("content not found")
+
+type pbLink struct {
+	Hash CID
+	Name string
+}
+
+type pbNode struct {
+	Links []pbLink
+	Data  []byte
+}
+
+// unixfsData is the UnixFS message held in the Data of a dag-pb node
+type unixfsData struct {
+	Type uint64
+	Data []byte
+}
+
+// Resolve walks the UnixFS directories from root along path and returns the
+// CID found at its end
+func (c *CAR) Resolve(root CID, path string) (CID, error) {
+	cid := root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		node, fsData, err := c.dagPBNode(cid)
+		if err != nil {
+			return CID{}, err
+		}
+		if fsData.Type != unixfsDirectory {
+			return CID{}, fmt.Errorf("%s is not a directory", cid)
+		}
+		found := false
+		for _, link := range node.Links {
+			if link.Name == name {
+				cid = link.Hash
+				found = true
+				break
+			}
+		}
+		if !found {
+			return CID{}, ErrNotFound
+		}
+	}
+	return cid, nil
+}
+
+// ReadFile returns the content of a UnixFS file, concatenating its chunks
+func (c *CAR) ReadFile(cid CID) ([]byte, error) {
+	return c.readFile(cid, 0)
+}
+
+func (c *CAR) readFile(cid CID, depth int) ([]byte, error) {
+	if depth > maxFileDepth {
+		return nil, errors.New("file tree is too deep")
+	}
+	if cid.Codec == CodecRaw {
+		b, ok := c.Get(cid)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return b, nil
+	}
+	node, fsData, err := c.dagPBNode(cid)
+	if err != nil {
+		return nil, err
+	}
+	if fsData.Type != unixfsFile && fsData.Type != unixfsRaw {
+		return nil, fmt.Errorf("%s is not a file", cid)
+	}
+	content := append([]byte(nil), fsData.Data...)
+	for _, link := range node.Links {
+		chunk, err := c.readFile(link.Hash, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+	}
+	return content, nil
+}
+
+// IsDir reports whether the CID is a UnixFS directory
+func (c *CAR) IsDir(cid CID) bool {
+	if cid.Codec != CodecDagPB {
+		return false
+	}
+	_, fsData, err := c.dagPBNode(cid)
+	return err == nil && fsData.Type == unixfsDirectory
+}
+
+func (c *CAR) dagPBNode(cid CID) (*pbNode, *unixfsData, error) {
+	if cid.Codec != CodecDagPB {
+		return nil, nil, fmt.Errorf("%s is not a dag-pb node", cid)
+	}
+	b, ok := c.Get(cid)
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	node, err := decodePBNode(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid dag-pb node %s: %v", cid, err)
+	}
+	fsData, err := decodeUnixFSData(node.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid UnixFS node %s: %v", cid, err)
+	}
+	return node, fsData, nil
+}
+
+// decodePBNode decodes a dag-pb PBNode: Data is field 1 and the PBLink
+// messages are field 2, each with Hash as field 1 and Name as field 2
+func decodePBNode(b []byte) (*pbNode, error) {
+	node := &pbNode{}
+	err := decodeProto(b, func(field uint64, val []byte) error {
+		switch field {
+		case 1:
+			node.Data = val
+		case 2:
+			var link pbLink
+			err := decodeProto(val, func(field uint64, val []byte) error {
+				switch field {
+				case 1:
+					cid, n, err := decodeCID(val)
+					if err != nil {
+						return err
+					}
+					if n != len(val) {
+						return errors.New("trailing bytes after link CID")
+					}
+					link.Hash = cid
+				case 2:
+					link.Name = string(val)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			node.Links = append(node.Links, link)
+		}
+		return nil
+	})
+	return node, err
+}
+
+// decodeUnixFSData decodes the UnixFS Data message: Type is field 1 and the
+// inline content is field 2
+func decodeUnixFSData(b []byte) (*unixfsData, error) {
+	fsData := &unixfsData{}
+	err := decodeProto(b, func(field uint64, val []byte) error {
+		switch field {
+		case 1:
+			typ, n := binary.Uvarint(val)
+			if n <= 0 {
+				return errors.New("invalid type")
+			}
+			fsData.Type = typ
+		case 2:
+			fsData.Data = val
+		}
+		return nil
+	})
+	return fsData, err
+}
+
+// decodeProto calls fn with every field of a protobuf message. Varint values
+// are passed in their encoded form, length-delimited ones as their content.
+func decodeProto(b []byte, fn func(field uint64, val []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		b = b[n:]
+		var val []byte
+		switch tag & 0x7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			val, b = b[:n], b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errors.New("invalid length")
+			}
+			val, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&0x7)
+		}
+		err := fn(tag>>3, val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
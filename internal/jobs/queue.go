@@ -0,0 +1,355 @@
+// Package jobs queues transfers durably so they can be processed by a worker
+// process separate from the HTTP handler, which keeps the transfers of a
+// wallet in nonce order however many servers take requests. FileQueue, the
+// only Queue implemented, needs the servers and the worker on one host: it
+// does not work on serverless platforms, whose invocations each have their
+// own file system.
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	StatusQueued     = "queued"
+	StatusProcessing = "processing"
+	StatusSubmitted  = "submitted"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+)
+
+const (
+	pendingDir    = "pending"
+	processingDir = "processing"
+	doneDir       = "done"
+	lockFile      = "worker.lock"
+)
+
+var (
+	ErrNotFound   = errors.New("job not found")
+	ErrNotPending = errors.New("job is no longer pending")
+	ErrLocked     = errors.New("another worker holds the sender lock")
+)
+
+// Job is a transfer request waiting for or processed by a worker
+type Job struct {
+	ID        string    `json:"id"`
+	Chain     string    `json:"chain"`
+	To        string    `json:"to"`
+	TokenID   int64     `json:"tokenId"`
+	Quantity  int64     `json:"quantity"`
+	Proof     []string  `json:"proof,omitempty"`
+	Status    string    `json:"status"`
+	TxHash    string    `json:"txHash,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Queue is the durable job queue shared by the servers, which enqueue jobs,
+// and the worker, which processes them. FileQueue implements it; a queue
+// backed by a message queue or a database can be plugged in to share jobs
+// between hosts.
+type Queue interface {
+	// Enqueue stores a new job for the chain and returns it with its id set
+	Enqueue(chain string, to string, tokenId int64, quantity int64, proof []string) (*Job, error)
+	// Claim takes the oldest pending job of the chain, or returns nil when
+	// there is none. A job is claimed by one worker only.
+	Claim(chain string) (*Job, error)
+	// Finish records the outcome of a claimed job
+	Finish(job *Job, txHash string, jobErr error) error
+	// RecoverInterrupted fails the claimed jobs of the chain left unfinished
+	// by a worker that stopped
+	RecoverInterrupted(chain string) (int, error)
+	// Get returns the job with the given id in any state, or ErrNotFound
+	Get(id string) (*Job, error)
+	// Cancel records a pending job as cancelled with the reason so no worker
+	// claims it, or returns ErrNotPending once a worker claimed it
+	Cancel(id string, reason error) (*Job, error)
+	// Lock takes the lock of the chain's sender, or returns ErrLocked when
+	// another worker holds it
+	Lock(chain string) (func(), error)
+}
+
+var _ Queue = (*FileQueue)(nil)
+
+// FileQueue is a durable job queue kept in a directory, with one directory
+// per chain and one file per job. A job moves from pending/ to processing/
+// to done/ by renames, which are atomic, so concurrent workers never claim
+// the same job.
+//
+// FileQueue is for a single host, such as local development or servers and
+// a worker on one machine: claims rely on rename and the sender lock on
+// flock, which are not atomic or not shared across hosts on network file
+// systems. Servers on several hosts or on Lambda, where each invocation has
+// its own /tmp, need another Queue backed by a message queue or a database.
+type FileQueue struct {
+	dir string
+}
+
+func NewFileQueue(dir string) (*FileQueue, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating job queue: %v", err)
+	}
+	return &FileQueue{dir: dir}, nil
+}
+
+// Enqueue stores a new job for the chain and returns it with its id set
+func (q *FileQueue) Enqueue(chain string, to string, tokenId int64, quantity int64, proof []string) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        newJobID(now),
+		Chain:     chain,
+		To:        to,
+		TokenID:   tokenId,
+		Quantity:  quantity,
+		Proof:     proof,
+		Status:    StatusQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err := q.write(job, pendingDir)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Claim moves the oldest pending job of the chain to processing and returns
+// it, or returns nil when there is no pending job
+func (q *FileQueue) Claim(chain string) (*Job, error) {
+	pending := q.path(chain, pendingDir)
+	entries, err := os.ReadDir(pending)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	// Job ids start with their creation time
+	sort.Strings(names)
+
+	err = os.MkdirAll(q.path(chain, processingDir), 0o700)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		target := filepath.Join(q.path(chain, processingDir), name)
+		err = os.Rename(filepath.Join(pending, name), target)
+		if errors.Is(err, os.ErrNotExist) {
+			// Claimed by another worker
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		job, err := readJob(target)
+		if err != nil {
+			return nil, err
+		}
+		job.Status = StatusProcessing
+		job.UpdatedAt = time.Now().UTC()
+		return job, q.write(job, processingDir)
+	}
+	return nil, nil
+}
+
+// Finish records the outcome of a claimed job
+func (q *FileQueue) Finish(job *Job, txHash string, jobErr error) error {
+	job.UpdatedAt = time.Now().UTC()
+	if jobErr != nil {
+		job.Status = StatusFailed
+		job.Error = jobErr.Error()
+	} else {
+		job.Status = StatusSubmitted
+		job.TxHash = txHash
+	}
+	err := q.write(job, doneDir)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(q.path(job.Chain, processingDir), job.ID+".json"))
+}
+
+// RecoverInterrupted fails the jobs left in processing by a worker that
+// stopped mid-transfer. They are not retried as their transaction may
+// already have been sent.
+func (q *FileQueue) RecoverInterrupted(chain string) (int, error) {
+	entries, err := os.ReadDir(q.path(chain, processingDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	recovered := 0
+	for _, entry := range entries {
+		job, err := readJob(filepath.Join(q.path(chain, processingDir), entry.Name()))
+		if err != nil {
+			return recovered, err
+		}
+		err = q.Finish(job, "", errors.New("worker stopped while processing, check the chain before retrying"))
+		if err != nil {
+			return recovered, err
+		}
+		recovered++
+	}
+	return recovered, nil
+}
+
+// Get returns the job with the given id in any state
+func (q *FileQueue) Get(id string) (*Job, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, ErrNotFound
+	}
+	chains, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, chain := range chains {
+		if !chain.IsDir() {
+			continue
+		}
+		for _, state := range []string{doneDir, processingDir, pendingDir} {
+			job, err := readJob(filepath.Join(q.path(chain.Name(), state), id+".json"))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return job, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Cancel claims the pending job like a worker would, then records it as
+// cancelled. A job claimed first by a worker is left to it.
+func (q *FileQueue) Cancel(id string, reason error) (*Job, error) {
+	job, err := q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != StatusQueued {
+		return nil, ErrNotPending
+	}
+	err = os.MkdirAll(q.path(job.Chain, processingDir), 0o700)
+	if err != nil {
+		return nil, err
+	}
+	claimed := filepath.Join(q.path(job.Chain, processingDir), id+".json")
+	err = os.Rename(filepath.Join(q.path(job.Chain, pendingDir), id+".json"), claimed)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotPending
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.Status = StatusCancelled
+	job.Error = reason.Error()
+	job.UpdatedAt = time.Now().UTC()
+	err = q.write(job, doneDir)
+	if err != nil {
+		return nil, err
+	}
+	return job, os.Remove(claimed)
+}
+
+// Lock takes the lock of the chain's sender so that only one worker sends
+// transactions for it. The lock is released by the returned function or
+// when the process exits.
+func (q *FileQueue) Lock(chain string) (func(), error) {
+	err := os.MkdirAll(q.path(chain), 0o700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(q.path(chain, lockFile), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (q *FileQueue) path(chain string, elem ...string) string {
+	return filepath.Join(append([]string{q.dir, chain}, elem...)...)
+}
+
+// write stores the job in the given state directory through a temporary
+// file so readers never see a partial job
+func (q *FileQueue) write(job *Job, state string) error {
+	dir := q.path(job.Chain, state)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(q.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, job.ID+".json"))
+}
+
+func readJob(path string) (*Job, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	err = json.Unmarshal(b, job)
+	if err != nil {
+		return nil, fmt.Errorf("error reading job %s: %v", filepath.Base(path), err)
+	}
+	return job, nil
+}
+
+// newJobID returns an id that sorts by creation time
+func newJobID(now time.Time) string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(b))
+}
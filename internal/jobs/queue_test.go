@@ -0,0 +1,220 @@
+package jobs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func newQueue(t *testing.T) *FileQueue {
+	t.Helper()
+	q, err := NewFileQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func enqueue(t *testing.T, q Queue, chain string, quantity int64) *Job {
+	t.Helper()
+	job, err := q.Enqueue(chain, "0x0000000000000000000000000000000000000001", 1, quantity, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func getJob(t *testing.T, q Queue, id string) *Job {
+	t.Helper()
+	job, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestFileQueueJobLifecycle(t *testing.T) {
+	q := newQueue(t)
+	queued := enqueue(t, q, "base", 3)
+	if job := getJob(t, q, queued.ID); job.Status != StatusQueued || job.Quantity != 3 {
+		t.Fatalf("queued job = %+v", job)
+	}
+
+	claimed, err := q.Claim("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed == nil || claimed.ID != queued.ID {
+		t.Fatalf("claimed %+v, want job %s", claimed, queued.ID)
+	}
+	if job := getJob(t, q, queued.ID); job.Status != StatusProcessing {
+		t.Errorf("claimed job status = %s, want %s", job.Status, StatusProcessing)
+	}
+	if next, err := q.Claim("base"); next != nil || err != nil {
+		t.Errorf("Claim on an empty queue = %+v, %v, want nil", next, err)
+	}
+
+	err = q.Finish(claimed, "0xabc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := getJob(t, q, queued.ID); job.Status != StatusSubmitted || job.TxHash != "0xabc" {
+		t.Errorf("finished job = %+v, want submitted with its hash", job)
+	}
+}
+
+func TestFileQueueClaimsOldestFirstPerChain(t *testing.T) {
+	q := newQueue(t)
+	first := enqueue(t, q, "base", 1)
+	other := enqueue(t, q, "sepolia", 1)
+	second := enqueue(t, q, "base", 2)
+
+	for _, want := range []*Job{first, second} {
+		job, err := q.Claim("base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil || job.ID != want.ID {
+			t.Fatalf("claimed %+v, want job %s", job, want.ID)
+		}
+	}
+	job, err := q.Claim("sepolia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.ID != other.ID {
+		t.Errorf("claimed %+v on the other chain, want job %s", job, other.ID)
+	}
+}
+
+func TestFileQueueClaimsEachJobOnce(t *testing.T) {
+	q := newQueue(t)
+	const jobs = 20
+	for i := 0; i < jobs; i++ {
+		enqueue(t, q, "base", 1)
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := q.Claim("base")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != jobs {
+		t.Errorf("%d jobs claimed, want %d", len(claimed), jobs)
+	}
+	for id, count := range claimed {
+		if count != 1 {
+			t.Errorf("job %s claimed %d times", id, count)
+		}
+	}
+}
+
+func TestFileQueueRecoverInterruptedFailsClaimedJobs(t *testing.T) {
+	q := newQueue(t)
+	interrupted := enqueue(t, q, "base", 1)
+	waiting := enqueue(t, q, "base", 1)
+	_, err := q.Claim("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := q.RecoverInterrupted("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != 1 {
+		t.Errorf("recovered %d jobs, want 1", recovered)
+	}
+	if job := getJob(t, q, interrupted.ID); job.Status != StatusFailed || job.Error == "" {
+		t.Errorf("interrupted job = %+v, want failed", job)
+	}
+	if job := getJob(t, q, waiting.ID); job.Status != StatusQueued {
+		t.Errorf("waiting job status = %s, want %s", job.Status, StatusQueued)
+	}
+}
+
+func TestFileQueueCancelPendingJobsOnly(t *testing.T) {
+	q := newQueue(t)
+	claimed := enqueue(t, q, "base", 1)
+	pending := enqueue(t, q, "base", 2)
+	if job, err := q.Claim("base"); err != nil || job.ID != claimed.ID {
+		t.Fatalf("Claim = %+v, %v, want job %s", job, err, claimed.ID)
+	}
+
+	_, err := q.Cancel(claimed.ID, errors.New("cancelled"))
+	if !errors.Is(err, ErrNotPending) {
+		t.Errorf("Cancel of a claimed job = %v, want ErrNotPending", err)
+	}
+	cancelled, err := q.Cancel(pending.ID, errors.New("cancelled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Status != StatusCancelled || cancelled.Error != "cancelled" {
+		t.Errorf("cancelled job = %+v", cancelled)
+	}
+	if job := getJob(t, q, pending.ID); job.Status != StatusCancelled {
+		t.Errorf("cancelled job status = %s, want %s", job.Status, StatusCancelled)
+	}
+	if next, err := q.Claim("base"); next != nil || err != nil {
+		t.Errorf("Claim after the cancel = %+v, %v, want nil", next, err)
+	}
+	_, err = q.Cancel(pending.ID, errors.New("cancelled"))
+	if !errors.Is(err, ErrNotPending) {
+		t.Errorf("second Cancel = %v, want ErrNotPending", err)
+	}
+}
+
+func TestFileQueueGetUnknownJob(t *testing.T) {
+	q := newQueue(t)
+	enqueue(t, q, "base", 1)
+	for _, id := range []string{"", "missing", "../base/pending/x"} {
+		_, err := q.Get(id)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, want %v", id, err, ErrNotFound)
+		}
+	}
+}
+
+func TestFileQueueLock(t *testing.T) {
+	q := newQueue(t)
+	unlock, err := q.Lock("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.Lock("base")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("second Lock error = %v, want %v", err, ErrLocked)
+	}
+	unlockOther, err := q.Lock("sepolia")
+	if err != nil {
+		t.Errorf("Lock of another chain: %v", err)
+	} else {
+		unlockOther()
+	}
+
+	unlock()
+	unlock, err = q.Lock("base")
+	if err != nil {
+		t.Fatalf("Lock after unlock: %v", err)
+	}
+	unlock()
+}
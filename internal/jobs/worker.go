@@ -0,0 +1,169 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Transferer sends a transfer and returns its transaction hash
+type Transferer interface {
+	ERC1155Transfer(ctx context.Context, chain string, to string, id int64, quantity int64) (string, error)
+	Close()
+}
+
+// Observer is told the outcome of every job processed
+type Observer interface {
+	JobFinished(job *Job, txHash string, err error)
+	// Resume is called once the worker holds the lock of the chain, to pick
+	// up what the observer left unfinished in a previous run
+	Resume(chain string)
+	// Wait returns once the observer finished with the jobs of the chain,
+	// or when ctx is done. Run calls it before returning in once mode.
+	Wait(ctx context.Context, chain string)
+	// Close is called when the worker is closed
+	Close()
+}
+
+// Worker processes the queued jobs. Jobs of a chain are processed one at a
+// time under the lock of the chain's sender, so nonces are assigned by a
+// single process however many servers enqueue jobs.
+type Worker struct {
+	queue        Queue
+	transferer   Transferer
+	chains       []string
+	pollInterval time.Duration
+	observer     Observer
+}
+
+func NewWorker(queue Queue, transferer Transferer, chains []string, pollInterval time.Duration) *Worker {
+	return &Worker{
+		queue:        queue,
+		transferer:   transferer,
+		chains:       chains,
+		pollInterval: pollInterval,
+	}
+}
+
+// SetObserver sets the observer told the outcome of the jobs
+func (w *Worker) SetObserver(observer Observer) {
+	w.observer = observer
+}
+
+// Run processes jobs until ctx is done. When once is set it returns as soon
+// as every chain has no pending job and the observer is done with the jobs
+// processed, which suits scheduled invocations.
+func (w *Worker) Run(ctx context.Context, once bool) error {
+	errs := make(chan error, len(w.chains))
+	var wg sync.WaitGroup
+	for _, chain := range w.chains {
+		wg.Add(1)
+		go func(chain string) {
+			defer wg.Done()
+			err := w.runChain(ctx, chain, once)
+			if err != nil {
+				errs <- fmt.Errorf("chain %s: %v", chain, err)
+			}
+		}(chain)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (w *Worker) runChain(ctx context.Context, chain string, once bool) error {
+	unlock, err := w.queue.Lock(chain)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	recovered, err := w.queue.RecoverInterrupted(chain)
+	if err != nil {
+		return err
+	}
+	if recovered > 0 {
+		slog.Warn("Failed jobs interrupted by a stopped worker", "chain", chain, "count", recovered)
+	}
+	if w.observer != nil {
+		w.observer.Resume(chain)
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		job, err := w.queue.Claim(chain)
+		if err != nil {
+			slog.Error("Error claiming job", "chain", chain, "error", err)
+		}
+		if job == nil {
+			if once && err == nil {
+				// The lock is held meanwhile, so the next run does not
+				// resume the same work
+				if w.observer != nil {
+					w.observer.Wait(ctx, chain)
+				}
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(w.pollInterval):
+			}
+			continue
+		}
+		w.process(job)
+	}
+}
+
+// process sends the job's transfer. The transfer does not use the worker's
+// context: a stopping worker finishes the job it claimed.
+func (w *Worker) process(job *Job) {
+	ctx := logging.WithAttrs(
+		context.Background(),
+		"job_id", job.ID,
+		"to", job.To,
+		"id", job.TokenID,
+		"quantity", job.Quantity,
+	)
+	logger := logging.FromContext(ctx)
+	logger.Info("Processing job")
+	ctx = context.WithValue(ctx, jobKey{}, job)
+	ctx, span := tracing.Start(ctx, "ProcessJob", attribute.String("job.id", job.ID))
+	txHash, err := w.transferer.ERC1155Transfer(ctx, job.Chain, job.To, job.TokenID, job.Quantity)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("Job failed", "error", err)
+	}
+	finishErr := w.queue.Finish(job, txHash, err)
+	if finishErr != nil {
+		logger.Error("Error recording outcome of job", "error", finishErr)
+	}
+	if w.observer != nil {
+		w.observer.JobFinished(job, txHash, err)
+	}
+}
+
+type jobKey struct{}
+
+// JobFromContext returns the job the worker sends a transfer for
+func JobFromContext(ctx context.Context) (*Job, bool) {
+	job, ok := ctx.Value(jobKey{}).(*Job)
+	return job, ok
+}
+
+// Close closes the observer and the node clients
+func (w *Worker) Close() {
+	if w.observer != nil {
+		w.observer.Close()
+	}
+	w.transferer.Close()
+}
@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransferer records the transfers sent and fails those of the
+// quantity set in fail
+type fakeTransferer struct {
+	mu      sync.Mutex
+	fail    int64
+	sent    []*Job
+	closed  bool
+	running bool
+	overlap bool
+}
+
+func (f *fakeTransferer) ERC1155Transfer(ctx context.Context, chain string, to string, id int64, quantity int64) (string, error) {
+	job, ok := JobFromContext(ctx)
+	if !ok {
+		return "", errors.New("no job in context")
+	}
+	f.mu.Lock()
+	if f.running {
+		f.overlap = true
+	}
+	f.running = true
+	f.mu.Unlock()
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running = false
+	if quantity == f.fail {
+		return "", errors.New("transfer failed")
+	}
+	f.sent = append(f.sent, job)
+	return fmt.Sprintf("0x%d", len(f.sent)), nil
+}
+
+func (f *fakeTransferer) Close() {
+	f.closed = true
+}
+
+type finishedJob struct {
+	job    *Job
+	txHash string
+	err    error
+}
+
+type fakeObserver struct {
+	mu       sync.Mutex
+	finished []finishedJob
+	closed   bool
+}
+
+func (o *fakeObserver) JobFinished(job *Job, txHash string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.finished = append(o.finished, finishedJob{job, txHash, err})
+}
+
+func (o *fakeObserver) Resume(chain string) {}
+
+func (o *fakeObserver) Wait(ctx context.Context, chain string) {}
+
+func (o *fakeObserver) Close() {
+	o.closed = true
+}
+
+func TestWorkerRunOnceProcessesQueuedJobs(t *testing.T) {
+	q := newQueue(t)
+	first := enqueue(t, q, "base", 1)
+	failing := enqueue(t, q, "base", 9)
+	second := enqueue(t, q, "base", 2)
+	transferer := &fakeTransferer{fail: 9}
+	observer := &fakeObserver{}
+	w := NewWorker(q, transferer, []string{"base"}, time.Millisecond)
+	w.SetObserver(observer)
+
+	err := w.Run(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if len(transferer.sent) != 2 || transferer.sent[0].ID != first.ID || transferer.sent[1].ID != second.ID {
+		t.Errorf("sent %v, want jobs %s and %s in order", transferer.sent, first.ID, second.ID)
+	}
+	if transferer.overlap {
+		t.Error("transfers of a chain overlapped")
+	}
+	if job := getJob(t, q, first.ID); job.Status != StatusSubmitted || job.TxHash != "0x1" {
+		t.Errorf("first job = %+v, want submitted", job)
+	}
+	if job := getJob(t, q, failing.ID); job.Status != StatusFailed || job.Error != "transfer failed" {
+		t.Errorf("failing job = %+v, want failed", job)
+	}
+	if len(observer.finished) != 3 || observer.finished[1].err == nil {
+		t.Errorf("observer told %v, want the 3 jobs with the failure", observer.finished)
+	}
+	if !observer.closed || !transferer.closed {
+		t.Error("Close did not close the observer and the transferer")
+	}
+}
+
+func TestWorkerFailsInterruptedJobs(t *testing.T) {
+	q := newQueue(t)
+	interrupted := enqueue(t, q, "base", 1)
+	_, err := q.Claim("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferer := &fakeTransferer{}
+	w := NewWorker(q, transferer, []string{"base"}, time.Millisecond)
+
+	err = w.Run(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transferer.sent) != 0 {
+		t.Errorf("interrupted job sent again")
+	}
+	if job := getJob(t, q, interrupted.ID); job.Status != StatusFailed {
+		t.Errorf("interrupted job status = %s, want %s", job.Status, StatusFailed)
+	}
+}
+
+func TestWorkerNeedsTheSenderLock(t *testing.T) {
+	q := newQueue(t)
+	enqueue(t, q, "base", 1)
+	unlock, err := q.Lock("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	transferer := &fakeTransferer{}
+	w := NewWorker(q, transferer, []string{"base"}, time.Millisecond)
+
+	err = w.Run(context.Background(), true)
+	if err == nil || !strings.Contains(err.Error(), ErrLocked.Error()) {
+		t.Errorf("Run error = %v, want %v", err, ErrLocked)
+	}
+	if len(transferer.sent) != 0 {
+		t.Errorf("sent %d transfers without the lock", len(transferer.sent))
+	}
+}
+
+func TestWorkerRunStopsWithContext(t *testing.T) {
+	q := newQueue(t)
+	transferer := &fakeTransferer{}
+	w := NewWorker(q, transferer, []string{"base"}, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx, false)
+	}()
+
+	job := enqueue(t, q, "base", 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// The job may be missed while it moves between states
+		got, err := q.Get(job.ID)
+		if err == nil && got.Status == StatusSubmitted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job queued while running not processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once the context was done")
+	}
+}
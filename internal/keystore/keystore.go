@@ -25,7 +25,7 @@ type signer struct {
 	address    *common.Address
 }
 
-func NewSigner(cfg *config.Config) (Signer, error) {
+func NewSigner(cfg *config.ChainConfig) (Signer, error) {
 	seed := bip39.NewSeed(cfg.Mnemonic, "")
 
 	masterKey, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
@@ -86,7 +86,7 @@ func NewSigner(cfg *config.Config) (Signer, error) {
 
 // Sign the transaction (OFFLINE)
 func (s *signer) Sign(chainId *big.Int, unsignedTx *types.Transaction) (*types.Transaction, error) {
-	signedTx, err := types.SignTx(unsignedTx, types.NewEIP155Signer(chainId), s.privateKey)
+	signedTx, err := types.SignTx(unsignedTx, types.LatestSignerForChainID(chainId), s.privateKey)
 	if err != nil {
 		return nil, fmt.Errorf("error signing transaction: %v", err)
 	}
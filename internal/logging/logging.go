@@ -0,0 +1,158 @@
+// Package logging sets up the structured logger and carries the fields of a
+// request, such as its id, through its context so every line logged while
+// processing the request can be tied back to it.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+const redacted = "[REDACTED]"
+
+// Shortest value registered as a secret
+const minSecretLength = 6
+
+// Attributes whose value is always redacted, whatever it holds
+var secretKeys = map[string]bool{
+	"mnemonic":    true,
+	"password":    true,
+	"private_key": true,
+	"secret":      true,
+}
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// Setup makes a logger writing to stderr at level, in format, the default
+// logger of both slog and the log package
+func Setup(level string, format string) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	opts := &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, expected %s or %s", format, FormatJSON, FormatText)
+	}
+	slog.SetDefault(slog.New(&redactingHandler{handler}))
+	return nil
+}
+
+// RegisterSecrets declares values, such as the mnemonic or node password,
+// that are replaced wherever they appear in a log line, as is or escaped as
+// in a URL. Values shorter than minSecretLength are not registered, as they
+// would redact common words.
+func RegisterSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	known := make(map[string]bool, len(secrets))
+	for _, secret := range secrets {
+		known[secret] = true
+	}
+	for _, val := range values {
+		if len(val) < minSecretLength {
+			continue
+		}
+		// The password of a URL user info has its own escaping
+		userInfo := strings.TrimPrefix(url.UserPassword("", val).String(), ":")
+		for _, form := range []string{val, url.QueryEscape(val), url.PathEscape(val), userInfo} {
+			if !known[form] {
+				known[form] = true
+				secrets = append(secrets, form)
+			}
+		}
+	}
+	// Longest first, so a secret holding another is redacted whole
+	sort.SliceStable(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replaces the registered secrets in s
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		// Errors and other values are logged through their string form
+		if v, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(v.Error()))
+		}
+		if v, ok := a.Value.Any().(fmt.Stringer); ok {
+			return slog.String(a.Key, Redact(v.String()))
+		}
+	}
+	return a
+}
+
+// redactingHandler redacts the message, which ReplaceAttr does not see
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	record := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		record.AddAttrs(a)
+		return true
+	})
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &redactingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{h.Handler.WithGroup(name)}
+}
+
+type loggerKey struct{}
+
+// WithAttrs returns a context whose logger adds args, as alternating keys
+// and values, to every line
+func WithAttrs(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, FromContext(ctx).With(args...))
+}
+
+// FromContext returns the logger of a request, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,86 @@
+// Package metadata resolves the ERC-1155 metadata of the tokens: it calls the
+// contract's uri method, fetches the JSON from a local copy or an IPFS
+// gateway and checks it against the ERC-1155 metadata JSON schema.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// Metadata is a token metadata document with the fields the API uses
+type Metadata struct {
+	URI         string          `json:"uri"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Image       string          `json:"image,omitempty"`
+	Document    json.RawMessage `json:"document"`
+}
+
+// ExpandURI substitutes the {id} placeholder of an ERC-1155 uri with the
+// token id as 64 lower-case hex digits. URIs without the placeholder, like
+// the ones built by our contract with the decimal id, are returned as is.
+func ExpandURI(uri string, id *big.Int) string {
+	return strings.ReplaceAll(uri, "{id}", fmt.Sprintf("%064x", id))
+}
+
+// Parse validates a metadata document against the ERC-1155 metadata JSON
+// schema and returns it
+func Parse(uri string, doc []byte) (*Metadata, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(doc, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("metadata is not a JSON object: %v", err)
+	}
+
+	m := &Metadata{URI: uri, Document: json.RawMessage(doc)}
+	for field, dst := range map[string]*string{
+		"name":        &m.Name,
+		"description": &m.Description,
+		"image":       &m.Image,
+	} {
+		raw, ok := fields[field]
+		if !ok {
+			continue
+		}
+		err = json.Unmarshal(raw, dst)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s must be a string", field)
+		}
+	}
+	if m.Image != "" {
+		imageURL, err := url.Parse(m.Image)
+		if err != nil || imageURL.Scheme == "" {
+			return nil, fmt.Errorf("metadata image %q is not a URI", m.Image)
+		}
+	}
+	if raw, ok := fields["decimals"]; ok {
+		var decimals uint8
+		err = json.Unmarshal(raw, &decimals)
+		if err != nil {
+			return nil, fmt.Errorf("metadata decimals must be a non-negative integer")
+		}
+	}
+	if raw, ok := fields["properties"]; ok {
+		var properties map[string]json.RawMessage
+		err = json.Unmarshal(raw, &properties)
+		if err != nil || properties == nil {
+			return nil, fmt.Errorf("metadata properties must be an object")
+		}
+	}
+	if raw, ok := fields["localization"]; ok {
+		var localization struct {
+			URI     *string   `json:"uri"`
+			Default *string   `json:"default"`
+			Locales *[]string `json:"locales"`
+		}
+		err = json.Unmarshal(raw, &localization)
+		if err != nil || localization.URI == nil || localization.Default == nil || localization.Locales == nil {
+			return nil, fmt.Errorf("metadata localization must have uri, default and locales")
+		}
+	}
+	return m, nil
+}
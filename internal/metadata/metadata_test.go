@@ -0,0 +1,276 @@
+package metadata_test
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+	"github.cbhq.net/engineering/sff-workshop/internal/metadata"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+const goldBadge = `{"name":"Gold Badge","description":"For the best","image":"ipfs://bafy/gold.png","decimals":0,"properties":{"rarity":"gold"}}`
+
+func TestExpandURI(t *testing.T) {
+	got := metadata.ExpandURI("https://example.com/{id}.json", big.NewInt(314))
+	if want := "https://example.com/000000000000000000000000000000000000000000000000000000000000013a.json"; got != want {
+		t.Errorf("ExpandURI = %s, want %s", got, want)
+	}
+	if got := metadata.ExpandURI("ipfs://bafy/2.json", big.NewInt(2)); got != "ipfs://bafy/2.json" {
+		t.Errorf("ExpandURI changed a uri without placeholder to %s", got)
+	}
+}
+
+func TestParseIPFS(t *testing.T) {
+	tests := []struct {
+		uri      string
+		cid      string
+		path     string
+		wantIPFS bool
+	}{
+		{"ipfs://bafycid/metadata/1.json", "bafycid", "metadata/1.json", true},
+		{"ipfs://bafycid", "bafycid", "", true},
+		{"https://ipfs.io/ipfs/bafycid/1.json", "bafycid", "1.json", true},
+		{"https://bafycid.ipfs.dweb.link/1.json", "bafycid", "1.json", true},
+		{"https://example.com/1.json", "", "", false},
+		{"https://ipfs.io/ipfs/", "", "", false},
+		{"ipfs://", "", "", false},
+		{"ftp://ipfs.io/ipfs/bafycid", "", "", false},
+	}
+	for _, test := range tests {
+		cid, path, ok := metadata.ParseIPFS(test.uri)
+		if ok != test.wantIPFS || cid != test.cid || path != test.path {
+			t.Errorf("ParseIPFS(%s) = %q, %q, %v, want %q, %q, %v", test.uri, cid, path, ok, test.cid, test.path, test.wantIPFS)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	m, err := metadata.Parse("ipfs://bafy/2.json", []byte(goldBadge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "Gold Badge" || m.Description != "For the best" || m.Image != "ipfs://bafy/gold.png" || string(m.Document) != goldBadge {
+		t.Errorf("Parse = %+v", m)
+	}
+
+	invalid := []struct {
+		name string
+		doc  string
+	}{
+		{"not JSON", `gold`},
+		{"not an object", `["gold"]`},
+		{"name not a string", `{"name":1}`},
+		{"image not a URI", `{"image":"gold.png"}`},
+		{"negative decimals", `{"decimals":-1}`},
+		{"properties not an object", `{"properties":[]}`},
+		{"null properties", `{"properties":null}`},
+		{"incomplete localization", `{"localization":{"uri":"ipfs://bafy/{locale}.json"}}`},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := metadata.Parse("ipfs://bafy/2.json", []byte(test.doc))
+			if err == nil {
+				t.Errorf("Parse(%s) accepted an invalid document", test.doc)
+			}
+		})
+	}
+}
+
+// fakeSource returns its content, or its error
+type fakeSource struct {
+	content []byte
+	err     error
+	calls   int
+}
+
+func (s *fakeSource) Fetch(ctx context.Context, cid string, path string) ([]byte, error) {
+	s.calls++
+	return s.content, s.err
+}
+
+func TestFetcherTriesSourcesInOrder(t *testing.T) {
+	ctx := context.Background()
+	missing := &fakeSource{err: metadata.ErrNotFound}
+	holding := &fakeSource{content: []byte(goldBadge)}
+	last := &fakeSource{content: []byte("{}")}
+	b, err := metadata.NewFetcher(missing, holding, last).Fetch(ctx, "ipfs://bafy/2.json")
+	if err != nil || string(b) != goldBadge {
+		t.Fatalf("Fetch = %s, %v, want the document of the second source", b, err)
+	}
+	if missing.calls != 1 || last.calls != 0 {
+		t.Errorf("sources called %d and %d times, want 1 and 0", missing.calls, last.calls)
+	}
+
+	_, err = metadata.NewFetcher(missing, missing).Fetch(ctx, "ipfs://bafy/2.json")
+	if !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch from sources without the content = %v, want ErrNotFound", err)
+	}
+	failing := &fakeSource{err: errors.New("gateway timeout")}
+	_, err = metadata.NewFetcher(failing, missing).Fetch(ctx, "ipfs://bafy/2.json")
+	if err == nil || errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch with a failing source = %v, want its error", err)
+	}
+}
+
+func TestGatewaySource(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ipfs/bafy/2.json":
+			w.Write([]byte(goldBadge))
+		case "/ipfs/bafy/broken.json":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gateway.Close()
+	source := metadata.NewGatewaySource(gateway.URL + "/")
+	ctx := context.Background()
+
+	b, err := source.Fetch(ctx, "bafy", "2.json")
+	if err != nil || string(b) != goldBadge {
+		t.Errorf("Fetch = %s, %v, want the document", b, err)
+	}
+	_, err = source.Fetch(ctx, "bafy", "1.json")
+	if !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch of a missing document = %v, want ErrNotFound", err)
+	}
+	_, err = source.Fetch(ctx, "bafy", "broken.json")
+	if err == nil || errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch from a failing gateway = %v, want its status", err)
+	}
+}
+
+func TestDirSource(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bafy/2.json": goldBadge,
+		"1.json":      `{"name":"Point"}`,
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(content), 0o600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := metadata.NewDirSource(dir)
+	ctx := context.Background()
+
+	for _, test := range []struct{ cid, path, want string }{
+		{"bafy", "2.json", goldBadge},
+		{"other", "1.json", `{"name":"Point"}`},
+	} {
+		b, err := source.Fetch(ctx, test.cid, test.path)
+		if err != nil || string(b) != test.want {
+			t.Errorf("Fetch(%s, %s) = %s, %v, want %s", test.cid, test.path, b, err, test.want)
+		}
+	}
+	_, err := source.Fetch(ctx, "bafy", "3.json")
+	if !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch of a missing file = %v, want ErrNotFound", err)
+	}
+	// The path cannot leave the directory
+	_, err = metadata.NewDirSource(filepath.Join(dir, "bafy")).Fetch(ctx, "x", "../1.json")
+	if !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch outside the directory = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCARSource(t *testing.T) {
+	b := ipfs.NewBuilder()
+	file := b.AddFile([]byte(goldBadge))
+	file.Name = "2.json"
+	root := b.AddDir([]ipfs.Link{file})
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "metadata.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.WriteCAR(f, root.CID)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := ipfs.OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := metadata.NewCARSource(store)
+	ctx := context.Background()
+
+	doc, err := source.Fetch(ctx, root.CID.String(), "2.json")
+	if err != nil || string(doc) != goldBadge {
+		t.Errorf("Fetch = %s, %v, want the document", doc, err)
+	}
+	_, err = source.Fetch(ctx, root.CID.String(), "1.json")
+	if !errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch of a missing file = %v, want ErrNotFound", err)
+	}
+	_, err = source.Fetch(ctx, "not-a-cid", "2.json")
+	if err == nil || errors.Is(err, metadata.ErrNotFound) {
+		t.Errorf("Fetch with an invalid CID = %v, want an error", err)
+	}
+}
+
+// uriCaller answers uri with a fixed uri, or fails
+type uriCaller struct {
+	uri   string
+	err   error
+	calls int
+}
+
+func (c *uriCaller) Uri(opts *bind.CallOpts, id *big.Int) (string, error) {
+	c.calls++
+	return c.uri, c.err
+}
+
+func TestResolverCachesMetadata(t *testing.T) {
+	ctx := context.Background()
+	caller := &uriCaller{uri: "ipfs://bafy/{id}.json"}
+	source := &fakeSource{content: []byte(goldBadge)}
+	resolver := metadata.NewResolver(caller, metadata.NewFetcher(source))
+
+	for i := 0; i < 2; i++ {
+		m, err := resolver.Resolve(ctx, big.NewInt(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Name != "Gold Badge" || m.URI != "ipfs://bafy/0000000000000000000000000000000000000000000000000000000000000002.json" {
+			t.Errorf("Resolve = %+v, want the gold badge at the expanded uri", m)
+		}
+	}
+	if caller.calls != 1 || source.calls != 1 {
+		t.Errorf("uri called %d times and source %d times, want once each", caller.calls, source.calls)
+	}
+
+	// Failures are not cached
+	source.content = []byte(`{"image":"gold.png"}`)
+	_, err := resolver.Resolve(ctx, big.NewInt(1))
+	if err == nil {
+		t.Fatal("Resolve accepted invalid metadata")
+	}
+	source.content = []byte(`{"name":"Point"}`)
+	m, err := resolver.Resolve(ctx, big.NewInt(1))
+	if err != nil || m.Name != "Point" {
+		t.Errorf("Resolve after a failure = %+v, %v, want the fixed metadata", m, err)
+	}
+
+	caller.err = errors.New("execution reverted")
+	_, err = resolver.Resolve(ctx, big.NewInt(3))
+	if err == nil {
+		t.Error("Resolve succeeded without the uri")
+	}
+}
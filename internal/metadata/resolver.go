@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+// How long resolved metadata is reused before uri is called again
+const cacheTTL = time.Hour
+
+// URICaller is the uri method of the token contract
+type URICaller interface {
+	Uri(opts *bind.CallOpts, id *big.Int) (string, error)
+}
+
+// Fetcher fetches the documents IPFS URIs point to from its sources, in
+// order, and other URIs over HTTP
+type Fetcher struct {
+	sources []Source
+	client  *http.Client
+}
+
+func NewFetcher(sources ...Source) *Fetcher {
+	return &Fetcher{
+		sources: sources,
+		client:  http.DefaultClient,
+	}
+}
+
+// Fetch returns the document at uri
+func (f *Fetcher) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	cid, path, ok := ParseIPFS(uri)
+	if !ok {
+		return fetchURL(ctx, f.client, uri)
+	}
+	var lastErr error
+	for _, source := range f.sources {
+		b, err := source.Fetch(ctx, cid, path)
+		if err == nil {
+			return b, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			lastErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("error fetching %s: %v", uri, lastErr)
+	}
+	return nil, fmt.Errorf("error fetching %s: %w", uri, ErrNotFound)
+}
+
+type cachedMetadata struct {
+	metadata   *Metadata
+	resolvedAt time.Time
+}
+
+// Resolver resolves and caches the metadata of the tokens of one contract
+type Resolver struct {
+	caller  URICaller
+	fetcher *Fetcher
+
+	mu    sync.Mutex
+	cache map[string]cachedMetadata
+}
+
+func NewResolver(caller URICaller, fetcher *Fetcher) *Resolver {
+	return &Resolver{
+		caller:  caller,
+		fetcher: fetcher,
+		cache:   make(map[string]cachedMetadata),
+	}
+}
+
+// Resolve returns the metadata of a token. Failures are not cached.
+func (r *Resolver) Resolve(ctx context.Context, id *big.Int) (*Metadata, error) {
+	key := id.String()
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Since(cached.resolvedAt) < cacheTTL {
+		return cached.metadata, nil
+	}
+
+	// Getting token uri (ONLINE)
+	uri, err := r.caller.Uri(&bind.CallOpts{Context: ctx}, id)
+	if err != nil {
+		return nil, fmt.Errorf("error calling uri: %v", err)
+	}
+	uri = ExpandURI(uri, id)
+	doc, err := r.fetcher.Fetch(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(uri, doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata at %s: %v", uri, err)
+	}
+
+	r.mu.Lock()
+	r.cache[key] = cachedMetadata{metadata: m, resolvedAt: time.Now()}
+	r.mu.Unlock()
+	return m, nil
+}
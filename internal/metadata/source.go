@@ -0,0 +1,131 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+)
+
+// Largest metadata document fetched
+const maxDocumentSize = 1 << 20
+
+// ErrNotFound is returned by a source that does not hold the content
+var ErrNotFound = errors.New("content not found")
+
+// Source gives the content at a path of an IPFS directory
+type Source interface {
+	Fetch(ctx context.Context, cid string, path string) ([]byte, error)
+}
+
+// DirSource reads content from a local directory, either as <dir>/<cid>/<path>
+// or, for a directory holding a copy of a single IPFS directory like
+// assets/metadata, as <dir>/<path>
+type DirSource struct {
+	dir string
+}
+
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{dir: dir}
+}
+
+func (s *DirSource) Fetch(ctx context.Context, cid string, name string) ([]byte, error) {
+	name = path.Clean("/" + name)
+	for _, p := range []string{
+		filepath.Join(s.dir, cid, filepath.FromSlash(name)),
+		filepath.Join(s.dir, filepath.FromSlash(name)),
+	} {
+		b, err := os.ReadFile(p)
+		if err == nil {
+			return b, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CARSource reads content from local CAR archives
+type CARSource struct {
+	store *ipfs.Store
+}
+
+func NewCARSource(store *ipfs.Store) *CARSource {
+	return &CARSource{store: store}
+}
+
+func (s *CARSource) Fetch(ctx context.Context, cid string, name string) ([]byte, error) {
+	b, err := s.store.Fetch(ctx, cid, name)
+	if errors.Is(err, ipfs.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+// GatewaySource fetches content through an IPFS HTTP gateway
+type GatewaySource struct {
+	gateway string
+	client  *http.Client
+}
+
+func NewGatewaySource(gateway string) *GatewaySource {
+	return &GatewaySource{
+		gateway: strings.TrimSuffix(gateway, "/"),
+		client:  http.DefaultClient,
+	}
+}
+
+func (s *GatewaySource) Fetch(ctx context.Context, cid string, name string) ([]byte, error) {
+	return fetchURL(ctx, s.client, s.gateway+"/ipfs/"+cid+path.Clean("/"+name))
+}
+
+func fetchURL(ctx context.Context, client *http.Client, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("GET %s: %w", rawURL, ErrNotFound)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", rawURL, res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxDocumentSize))
+}
+
+// ParseIPFS returns the CID and path of an IPFS URI. ipfs://<cid>/<path>,
+// path gateway URLs like https://ipfs.io/ipfs/<cid>/<path> and subdomain
+// gateway URLs like https://<cid>.ipfs.dweb.link/<path> are recognized.
+func ParseIPFS(uri string) (string, string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", false
+	}
+	switch {
+	case u.Scheme == "ipfs":
+		return u.Host, strings.TrimPrefix(u.Path, "/"), u.Host != ""
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", "", false
+	case strings.HasPrefix(u.Path, "/ipfs/"):
+		cid, rest, _ := strings.Cut(strings.TrimPrefix(u.Path, "/ipfs/"), "/")
+		return cid, rest, cid != ""
+	}
+	if cid, _, ok := strings.Cut(u.Hostname(), ".ipfs."); ok {
+		return cid, strings.TrimPrefix(u.Path, "/"), true
+	}
+	return "", "", false
+}
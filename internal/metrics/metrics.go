@@ -0,0 +1,148 @@
+// Package metrics defines the Prometheus metrics of the airdrop pipeline,
+// from the HTTP request down to each node call of a transfer.
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "airdrop"
+
+// Outcomes of a GetToken request
+const (
+	OutcomeSubmitted  = "submitted"
+	OutcomeFailed     = "failed"
+	OutcomeAccepted   = "accepted"
+	OutcomeRejected   = "rejected"
+	OutcomeInvalid    = "invalid"
+	OutcomeQueued     = "queued"
+	OutcomeClientGone = "client_gone"
+)
+
+// Stages of a transfer
+const (
+	StageValidate = "validate"
+	StageNonce    = "nonce"
+	StageGasPrice = "gas_price"
+	StageSign     = "sign"
+	StageSend     = "send"
+)
+
+// Buckets from 5ms to about 40s, covering node calls and full transfers
+var latencyBuckets = prometheus.ExponentialBuckets(0.005, 2, 14)
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "GetToken requests by token id and outcome.",
+	}, []string{"token_id", "outcome"})
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to answer GetToken requests, by token id and outcome.",
+		Buckets:   latencyBuckets,
+	}, []string{"token_id", "outcome"})
+
+	QueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time requests spend in the queue before a worker takes them.",
+		Buckets:   latencyBuckets,
+	})
+	Skipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_total",
+		Help:      "Requests dropped by the workers because their client went away, by token id.",
+	}, []string{"token_id"})
+	InFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "transfers_in_flight",
+		Help:      "Transfers being processed by the workers.",
+	})
+
+	Transfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfers_total",
+		Help:      "Transfers processed, by chain, token id and outcome.",
+	}, []string{"chain", "token_id", "outcome"})
+	TransferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transfer_duration_seconds",
+		Help:      "Time from validation to submission of transfers, by chain, token id and outcome.",
+		Buckets:   latencyBuckets,
+	}, []string{"chain", "token_id", "outcome"})
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transfer_stage_duration_seconds",
+		Help:      "Time spent in each stage of a transfer, by chain, stage and outcome.",
+		Buckets:   latencyBuckets,
+	}, []string{"chain", "stage", "outcome"})
+	RPCErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed node calls, by chain and transfer stage.",
+	}, []string{"chain", "stage"})
+
+	Validations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "validations_total",
+		Help:      "Transfer validations, by token id and outcome.",
+	}, []string{"token_id", "outcome"})
+
+	GasPrice = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gas_price_gwei",
+		Help:      "Gas price, or fee cap with EIP-1559, of the transactions sent.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"chain"})
+	MaxGasFee = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "max_gas_fee_wei_total",
+		Help:      "Gas limit times gas price of the transactions sent, an upper bound of the gas spent.",
+	}, []string{"chain"})
+	GasSpent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gas_spent_wei_total",
+		Help:      "Gas used times effective gas price of the mined transactions, from their receipts.",
+	}, []string{"chain"})
+)
+
+// ObserveStage records the duration and outcome of a transfer stage
+func ObserveStage(chain string, stage string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	StageDuration.WithLabelValues(chain, stage, outcome).Observe(time.Since(start).Seconds())
+}
+
+var (
+	tokenIDsMu sync.RWMutex
+	tokenIDs   = make(map[int64]bool)
+)
+
+// RegisterTokenIDs declares the token ids of the contract. Other ids, which
+// come from user input, are labelled "other" to bound the label values.
+func RegisterTokenIDs(ids ...int64) {
+	tokenIDsMu.Lock()
+	defer tokenIDsMu.Unlock()
+	for _, id := range ids {
+		tokenIDs[id] = true
+	}
+}
+
+// TokenLabel returns the token_id label value of a token id
+func TokenLabel(id int64) string {
+	tokenIDsMu.RLock()
+	defer tokenIDsMu.RUnlock()
+	if !tokenIDs[id] {
+		return "other"
+	}
+	return strconv.FormatInt(id, 10)
+}
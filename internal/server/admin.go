@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/audit"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/jobs"
+	"github.cbhq.net/engineering/sff-workshop/internal/webhook"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var (
+	errAdminDisabled    = errors.New("admin API is disabled, set ADMIN_TOKEN to enable it")
+	errUnauthorized     = errors.New("missing or invalid admin token")
+	errRequestCancelled = errors.New("request cancelled by an admin")
+	// errInvalidAdminParam marks the admin action errors due to the
+	// request, answered with 400 rather than 500
+	errInvalidAdminParam = errors.New("invalid parameter")
+)
+
+// adminOnly serves next to requests bearing the ADMIN_TOKEN in an
+// Authorization: Bearer header
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			writeError(w, http.StatusNotFound, errAdminDisabled)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type chainDiagnostics struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Nonce the next transfer uses unless the node reports a higher one,
+	// 0 until the first transfer
+	LocalNextNonce uint64 `json:"localNextNonce"`
+	// Nonce after the transactions known to the node, mined or not
+	PendingNonce uint64 `json:"pendingNonce"`
+	// Nonce after the mined transactions
+	MinedNonce uint64 `json:"minedNonce"`
+	// Transactions sent but not mined yet
+	PendingTransactions uint64 `json:"pendingTransactions"`
+	// Transactions submitted by this server that the node does not report,
+	// dropped from its pool or sent to another node
+	MissingTransactions uint64 `json:"missingTransactions"`
+	Error               string `json:"error,omitempty"`
+}
+
+type diagnosticsResponse struct {
+	Queue  statsResponse      `json:"queue"`
+	Chains []chainDiagnostics `json:"chains"`
+}
+
+// GetDiagnostics reports the queue and the nonce state of the treasury of
+// every chain, as seen by this server and by the node
+func (s *Server) GetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	res := diagnosticsResponse{Queue: s.currentStats()}
+	for _, chain := range s.transactionHandler.Chains() {
+		res.Chains = append(res.Chains, s.chainDiagnostics(r.Context(), chain))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) chainDiagnostics(ctx context.Context, chain *handler.Chain) chainDiagnostics {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RPCTimeout)
+	defer cancel()
+	res := chainDiagnostics{
+		Name:           chain.Name(),
+		Address:        chain.Address().Hex(),
+		LocalNextNonce: chain.NextNonce(),
+	}
+
+	var err error
+	res.PendingNonce, err = chain.Backend().PendingNonceAt(ctx, chain.Address())
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if res.LocalNextNonce > res.PendingNonce {
+		res.MissingTransactions = res.LocalNextNonce - res.PendingNonce
+	}
+	reader, ok := chain.Backend().(accountReader)
+	if !ok {
+		res.Error = "mined nonce not available from this node client"
+		return res
+	}
+	res.MinedNonce, err = reader.NonceAt(ctx, chain.Address(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if res.PendingNonce > res.MinedNonce {
+		res.PendingTransactions = res.PendingNonce - res.MinedNonce
+	}
+	return res
+}
+
+// adminActionFunc performs an admin action and returns its result
+type adminActionFunc func(r *http.Request) (interface{}, error)
+
+// adminAction serves an action changing the server state. The action only
+// runs on POST and is recorded in the audit log, whether it succeeds or not.
+func (s *Server) adminAction(name string, action adminActionFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, errors.New("admin actions must be sent with POST"))
+			return
+		}
+		query := r.URL.Query()
+		entry := audit.Entry{
+			Time:   time.Now(),
+			Actor:  adminActor(r),
+			Action: name,
+			Params: make(map[string]string, len(query)),
+		}
+		for key := range query {
+			entry.Params[key] = query.Get(key)
+		}
+
+		result, err := action(r)
+		entry.Result = result
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		auditErr := s.audit.Record(entry)
+		if auditErr != nil {
+			slog.Error("Error recording admin action", "action", name, "error", auditErr)
+		}
+
+		switch {
+		case errors.Is(err, errInvalidAdminParam):
+			writeError(w, http.StatusBadRequest, err)
+		case errors.Is(err, jobs.ErrLocked):
+			writeError(w, http.StatusConflict, err)
+		case err != nil:
+			handleError(w, err)
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "result": result})
+		}
+	}
+}
+
+// adminActor names who sent an admin request: the X-Admin-Actor header,
+// which the token holder sets to tell operators apart, or the client address
+func adminActor(r *http.Request) string {
+	if actor := r.Header.Get("X-Admin-Actor"); actor != "" {
+		return actor
+	}
+	return r.RemoteAddr
+}
+
+type controlsResponse struct {
+	handler.ControlsState
+	// Limits of each token id, by chain
+	Limits map[string]map[int64]handler.Limits `json:"limits"`
+}
+
+// GetControls reports the pauses, address lists and limits in force
+func (s *Server) GetControls(w http.ResponseWriter, r *http.Request) {
+	state, err := s.transactionHandler.Controls().State()
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res := controlsResponse{
+		ControlsState: state,
+		Limits:        make(map[string]map[int64]handler.Limits),
+	}
+	for _, chain := range s.transactionHandler.Chains() {
+		res.Limits[chain.Name()] = chain.Validator().Limits()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// GetAudit returns the latest admin actions, newest first
+func (s *Server) GetAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	_, limit, err := getPage(&query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.audit.Recent(limit))
+}
+
+// pause pauses all transfers, or those of the token id when set
+func (s *Server) pause(r *http.Request) (interface{}, error) {
+	return s.setPaused(r, true)
+}
+
+// resume resumes all transfers, or those of the token id when set
+func (s *Server) resume(r *http.Request) (interface{}, error) {
+	return s.setPaused(r, false)
+}
+
+func (s *Server) setPaused(r *http.Request, paused bool) (interface{}, error) {
+	query := r.URL.Query()
+	controls := s.transactionHandler.Controls()
+	if query.Get("id") == "" {
+		err := controls.SetPaused(paused)
+		if err != nil {
+			return nil, err
+		}
+		return controls.State()
+	}
+	id, err := getAdminInt64(&query, "id")
+	if err != nil {
+		return nil, err
+	}
+	err = controls.SetTokenPaused(id, paused)
+	if err != nil {
+		return nil, err
+	}
+	return controls.State()
+}
+
+// setLimits changes the transfer and ownership limits of a token id, or
+// puts the configured ones back with clear=true
+func (s *Server) setLimits(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	chain, err := s.transactionHandler.Chain(query.Get("chain"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAdminParam, err)
+	}
+	id, err := getAdminInt64(&query, "id")
+	if err != nil {
+		return nil, err
+	}
+	limits, ok := chain.Validator().Limits()[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unrecognized token id %d", errInvalidAdminParam, id)
+	}
+	if val := query.Get("clear"); val != "" {
+		clear, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid clear: %v", errInvalidAdminParam, err)
+		}
+		if clear {
+			err = s.transactionHandler.Controls().ClearLimits(chain.Name(), id)
+			if err != nil {
+				return nil, err
+			}
+			return chain.Validator().Limits()[id], nil
+		}
+	}
+	// Limits left out of the request are kept
+	if query.Get("transfer") != "" {
+		limits.Transfer, err = getAdminInt64(&query, "transfer")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if query.Get("ownership") != "" {
+		limits.Ownership, err = getAdminInt64(&query, "ownership")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limits.Transfer < 0 || limits.Ownership < 0 {
+		return nil, fmt.Errorf("%w: limits must not be negative", errInvalidAdminParam)
+	}
+	err = s.transactionHandler.Controls().SetLimits(chain.Name(), id, limits)
+	if err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// blocklist adds the address to the blocklist, or removes it with remove=true
+func (s *Server) blocklist(r *http.Request) (interface{}, error) {
+	addr, listed, err := getListedAddress(r)
+	if err != nil {
+		return nil, err
+	}
+	controls := s.transactionHandler.Controls()
+	err = controls.SetBlocklisted(addr, listed)
+	if err != nil {
+		return nil, err
+	}
+	return controls.State()
+}
+
+// allowlist adds the address to the allowlist, or removes it with
+// remove=true. Once the allowlist has an address, only listed addresses
+// receive tokens.
+func (s *Server) allowlist(r *http.Request) (interface{}, error) {
+	addr, listed, err := getListedAddress(r)
+	if err != nil {
+		return nil, err
+	}
+	controls := s.transactionHandler.Controls()
+	err = controls.SetAllowlisted(addr, listed)
+	if err != nil {
+		return nil, err
+	}
+	return controls.State()
+}
+
+func getListedAddress(r *http.Request) (common.Address, bool, error) {
+	query := r.URL.Query()
+	addr := query.Get("address")
+	if !common.IsHexAddress(addr) {
+		return common.Address{}, false, fmt.Errorf("%w: invalid address %q", errInvalidAdminParam, addr)
+	}
+	remove := false
+	if val := query.Get("remove"); val != "" {
+		var err error
+		remove, err = strconv.ParseBool(val)
+		if err != nil {
+			return common.Address{}, false, fmt.Errorf("%w: invalid remove: %v", errInvalidAdminParam, err)
+		}
+	}
+	return common.HexToAddress(addr), !remove, nil
+}
+
+// cancelRequest drops a queued request before a worker takes it, and
+// answers its client with an error. In async mode it cancels a job still
+// pending in the queue.
+func (s *Server) cancelRequest(r *http.Request) (interface{}, error) {
+	requestID := r.URL.Query().Get("id")
+	if s.jobs != nil {
+		return s.cancelJob(r, requestID)
+	}
+	s.pendingMu.Lock()
+	req, ok := s.pending[requestID]
+	delete(s.pending, requestID)
+	s.pendingMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: request %q is not queued", errInvalidAdminParam, requestID)
+	}
+
+	s.requests.set(requestID, statusCancelled, "", errRequestCancelled)
+	req.cancel()
+	req.resChannel <- &getTokenResponse{err: errRequestCancelled}
+	s.notifier.finished(s.transferEvent(req), "", errRequestCancelled)
+	status, _ := s.requests.get(requestID)
+	return status, nil
+}
+
+func (s *Server) cancelJob(r *http.Request, jobID string) (interface{}, error) {
+	job, err := s.jobs.Cancel(jobID, errRequestCancelled)
+	if errors.Is(err, jobs.ErrNotFound) || errors.Is(err, jobs.ErrNotPending) {
+		return nil, fmt.Errorf("%w: job %q is not queued", errInvalidAdminParam, jobID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.notifier.finished(webhook.Event{
+		JobID:    job.ID,
+		Chain:    job.Chain,
+		To:       job.To,
+		TokenID:  job.TokenID,
+		Quantity: job.Quantity,
+	}, "", errRequestCancelled)
+	return s.jobResponse(r.Context(), job), nil
+}
+
+// cancelNonce replaces the treasury transaction stuck at a nonce by a
+// 0-value transaction to itself. In async mode it takes the sender lock of
+// the chain in the queue, so it fails while a worker runs for the chain
+// rather than race it for the nonce.
+func (s *Server) cancelNonce(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	nonce, err := strconv.ParseUint(query.Get("nonce"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid nonce: %v", errInvalidAdminParam, err)
+	}
+	bump := handler.DefaultCancelBump
+	if val := query.Get("bump"); val != "" {
+		bump, err = strconv.ParseFloat(val, 64)
+		if err != nil || bump < handler.MinCancelBump {
+			return nil, fmt.Errorf("%w: invalid bump, must be at least %v", errInvalidAdminParam, handler.MinCancelBump)
+		}
+	}
+	stuckTx := query.Get("tx")
+	if stuckTx != "" && !isTxHash(stuckTx) {
+		return nil, fmt.Errorf("%w: invalid tx %q", errInvalidAdminParam, stuckTx)
+	}
+	if s.jobs != nil {
+		chain, err := s.transactionHandler.Chain(query.Get("chain"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidAdminParam, err)
+		}
+		unlock, err := s.jobs.Lock(chain.Name())
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	txHash, err := s.transactionHandler.CancelNonce(r.Context(), query.Get("chain"), nonce, bump, stuckTx)
+	if errors.Is(err, handler.ErrNonceNotPending) || errors.Is(err, handler.ErrNotReplaceable) {
+		return nil, fmt.Errorf("%w: %v", errInvalidAdminParam, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"txHash": txHash}, nil
+}
+
+// isTxHash tells whether val is a 0x prefixed transaction hash
+func isTxHash(val string) bool {
+	b, err := hexutil.Decode(val)
+	return err == nil && len(b) == common.HashLength
+}
+
+func getAdminInt64(query *url.Values, field string) (int64, error) {
+	val, err := getInt64(query, field)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s: %v", errInvalidAdminParam, field, err)
+	}
+	return val, nil
+}
@@ -0,0 +1,186 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/jobs"
+	"github.cbhq.net/engineering/sff-workshop/internal/server"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+)
+
+const adminToken = "test-admin-token"
+
+func postAdmin(t *testing.T, h *simulated.Harness, path string) (int, string) {
+	t.Helper()
+	return postAdminTo(t, h.HTTP.URL, path)
+}
+
+func postAdminTo(t *testing.T, serverURL string, path string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, serverURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestCancelNonceRejectsNonceNotPending(t *testing.T) {
+	h := newHarness(t)
+	h.Config.AdminToken = adminToken
+	to := newRecipient(t)
+
+	code, body := getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+	// The deployment and the transfer are mined
+	next, err := h.Backend.PendingNonceAt(context.Background(), *h.Signer.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nonce := range []uint64{0, next - 1, next, next + 10} {
+		code, body = postAdmin(t, h, fmt.Sprintf("/api/admin/nonces/cancel?nonce=%d", nonce))
+		if code != http.StatusBadRequest {
+			t.Errorf("cancel of nonce %d = %d %q, want 400", nonce, code, body)
+		}
+	}
+	// A transfer fails with an invalid nonce if a cancel moved the stream
+	code, body = getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Errorf("GetToken after the refused cancels = %d %q", code, body)
+	}
+}
+
+// newAsyncServer starts a server of the harness chain in async mode, queueing
+// the transfers as jobs in the returned queue
+func newAsyncServer(t *testing.T, h *simulated.Harness) (*httptest.Server, *jobs.FileQueue) {
+	t.Helper()
+	ctx := context.Background()
+	cfg := *h.Config
+	cfg.AdminToken = adminToken
+	cfg.JobQueueDir = t.TempDir()
+	cfg.JobPollInterval = 10 * time.Millisecond
+	chain, err := server.NewChain(ctx, &cfg, cfg.Chains[simulated.ChainName], h.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewServerWithChains(ctx, &cfg, map[string]*handler.Chain{simulated.ChainName: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close(ctx)
+	})
+	queue, err := jobs.NewFileQueue(cfg.JobQueueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, queue
+}
+
+func TestCancelRequestCancelsQueuedJob(t *testing.T) {
+	h := newHarness(t)
+	srv, queue := newAsyncServer(t, h)
+
+	res, err := http.Get(fmt.Sprintf("%s/api/gettoken?to=%s&id=%d&quantity=1", srv.URL, newRecipient(t).Hex(), goldBadgeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job jobs.Job
+	err = json.NewDecoder(res.Body).Decode(&job)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("GetToken = %d, %v, want 202 with the job", res.StatusCode, err)
+	}
+
+	code, body := postAdminTo(t, srv.URL, "/api/admin/requests/cancel?id="+job.ID)
+	if code != http.StatusOK || !strings.Contains(body, jobs.StatusCancelled) {
+		t.Fatalf("cancel = %d %q, want 200 with the cancelled job", code, body)
+	}
+	if claimed, err := queue.Claim(simulated.ChainName); claimed != nil || err != nil {
+		t.Errorf("Claim after the cancel = %+v, %v, want no job", claimed, err)
+	}
+	code, body = postAdminTo(t, srv.URL, "/api/admin/requests/cancel?id="+job.ID)
+	if code != http.StatusBadRequest {
+		t.Errorf("second cancel = %d %q, want 400", code, body)
+	}
+}
+
+func TestCancelNonceWaitsForWorkerLock(t *testing.T) {
+	h := newHarness(t)
+	srv, queue := newAsyncServer(t, h)
+	unlock, err := queue.Lock(simulated.ChainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	code, body := postAdminTo(t, srv.URL, "/api/admin/nonces/cancel?nonce=0")
+	if code != http.StatusConflict || !strings.Contains(body, jobs.ErrLocked.Error()) {
+		t.Errorf("cancel while a worker runs = %d %q, want 409", code, body)
+	}
+	code, body = postAdminTo(t, srv.URL, "/api/admin/nonces/cancel?nonce=0&tx=0x1234")
+	if code != http.StatusBadRequest {
+		t.Errorf("cancel with an invalid tx = %d %q, want 400", code, body)
+	}
+}
+
+func TestGetTokenRefusesBlocklistedRecipientsBeforeQueueing(t *testing.T) {
+	h := newHarness(t)
+	h.Config.AdminToken = adminToken
+	to := newRecipient(t)
+	code, body := postAdmin(t, h, "/api/admin/blocklist?address="+to.Hex())
+	if code != http.StatusOK {
+		t.Fatalf("blocklist = %d %q", code, body)
+	}
+
+	code, body = getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusForbidden || !strings.Contains(body, handler.ErrScreened.Error()) {
+		t.Errorf("GetToken = %d %q, want 403 refused by screening", code, body)
+	}
+	res, err := http.Get(h.HTTP.URL + "/api/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var stats struct {
+		Processed int64 `json:"processed"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Processed != 0 {
+		t.Errorf("%d requests processed, want the refused one never queued", stats.Processed)
+	}
+
+	code, body = postAdmin(t, h, "/api/admin/blocklist?remove=true&address="+to.Hex())
+	if code != http.StatusOK {
+		t.Fatalf("blocklist removal = %d %q", code, body)
+	}
+	code, body = getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Errorf("GetToken = %d %q after the removal from the blocklist", code, body)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestBalanceCacheExpiresAndPrunes(t *testing.T) {
+	c := newBalanceCache()
+	key := balanceKey{chain: "test", block: 1, addr: common.Address{1}, id: "1"}
+	c.set(key, big.NewInt(5))
+	if balance, ok := c.get(key); !ok || balance.Int64() != 5 {
+		t.Fatalf("get = %v %v, want the balance set", balance, ok)
+	}
+	if _, ok := c.get(balanceKey{chain: "test", block: 2, addr: common.Address{1}, id: "1"}); ok {
+		t.Error("the balance at another block is cached")
+	}
+
+	// An expired balance is not returned, and dropped by the next set
+	c.balances[key] = cachedBalance{balance: big.NewInt(5), cachedAt: time.Now().Add(-2 * balanceCacheTTL)}
+	c.prunedAt = time.Now().Add(-2 * balanceCacheTTL)
+	if _, ok := c.get(key); ok {
+		t.Error("an expired balance is returned")
+	}
+	other := balanceKey{chain: "test", block: 1, addr: common.Address{2}, id: "1"}
+	c.set(other, big.NewInt(1))
+	if _, ok := c.balances[key]; ok || len(c.balances) != 1 {
+		t.Errorf("cache holds %d balances after pruning, want only the new one", len(c.balances))
+	}
+}
+
+func TestBalanceCacheStopsAtMaxSize(t *testing.T) {
+	c := newBalanceCache()
+	c.prunedAt = time.Now()
+	for i := 0; i < maxCachedBalances; i++ {
+		c.balances[balanceKey{block: uint64(i)}] = cachedBalance{balance: big.NewInt(1), cachedAt: time.Now()}
+	}
+	c.set(balanceKey{block: maxCachedBalances}, big.NewInt(1))
+	if _, ok := c.get(balanceKey{block: maxCachedBalances}); ok {
+		t.Error("a balance was cached past maxCachedBalances")
+	}
+	// Cached balances can still be updated
+	c.set(balanceKey{block: 0}, big.NewInt(2))
+	if balance, ok := c.get(balanceKey{block: 0}); !ok || balance.Int64() != 2 {
+		t.Errorf("get = %v %v, want the updated balance", balance, ok)
+	}
+}
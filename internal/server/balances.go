@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// Largest number of addresses and token ids in one balances request
+	maxBalanceAddresses = 1000
+	maxBalanceIds       = 20
+	// Number of (address, id) pairs sent in one balanceOfBatch call
+	balanceBatchSize = 200
+	// How long the balances at a block are cached
+	balanceCacheTTL = 30 * time.Second
+	// Largest number of balances cached, past which new ones are not
+	maxCachedBalances = 100_000
+)
+
+type accountBalances struct {
+	Address string `json:"address"`
+	// Balances by token id
+	Balances map[string]string `json:"balances"`
+}
+
+type batchBalancesResponse struct {
+	BlockNumber uint64            `json:"blockNumber"`
+	Accounts    []accountBalances `json:"accounts"`
+}
+
+type balanceKey struct {
+	chain string
+	block uint64
+	addr  common.Address
+	id    string
+}
+
+type cachedBalance struct {
+	balance  *big.Int
+	cachedAt time.Time
+}
+
+// balanceCache keeps the balances read at a block for a short time, as the
+// frontend polls the same accounts. Balances at a given block never change.
+type balanceCache struct {
+	mu       sync.Mutex
+	balances map[balanceKey]cachedBalance
+	// Expired balances are dropped at most once per balanceCacheTTL
+	prunedAt time.Time
+}
+
+func newBalanceCache() *balanceCache {
+	return &balanceCache{
+		balances: make(map[balanceKey]cachedBalance),
+	}
+}
+
+func (c *balanceCache) get(key balanceKey) (*big.Int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.balances[key]
+	if !ok || time.Since(cached.cachedAt) > balanceCacheTTL {
+		return nil, false
+	}
+	return cached.balance, true
+}
+
+func (c *balanceCache) set(key balanceKey, balance *big.Int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.prunedAt) > balanceCacheTTL {
+		c.prune(now)
+	}
+	if _, ok := c.balances[key]; !ok && len(c.balances) >= maxCachedBalances {
+		return
+	}
+	c.balances[key] = cachedBalance{balance: balance, cachedAt: now}
+}
+
+// prune drops the expired balances. The caller holds mu.
+func (c *balanceCache) prune(now time.Time) {
+	for k, cached := range c.balances {
+		if now.Sub(cached.cachedAt) > balanceCacheTTL {
+			delete(c.balances, k)
+		}
+	}
+	c.prunedAt = now
+}
+
+// GetBalances returns the balance of every token id for every address, read
+// with balanceOfBatch at the latest block or at the block query param
+func (s *Server) GetBalances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	addresses := config.SplitList(query.Get("addresses"))
+	ids := config.SplitList(query.Get("ids"))
+	if len(addresses) == 0 || len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("addresses and ids are required"))
+		return
+	}
+	if len(addresses) > maxBalanceAddresses || len(ids) > maxBalanceIds {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			fmt.Errorf("at most %d addresses and %d ids are allowed", maxBalanceAddresses, maxBalanceIds),
+		)
+		return
+	}
+	accounts := make([]common.Address, len(addresses))
+	for i, addr := range addresses {
+		if !common.IsHexAddress(addr) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid address %q", addr))
+			return
+		}
+		accounts[i] = common.HexToAddress(addr)
+	}
+	tokenIds := make([]*big.Int, len(ids))
+	for i, id := range ids {
+		tokenId, ok := new(big.Int).SetString(id, 10)
+		if !ok || tokenId.Sign() < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid token id %q", id))
+			return
+		}
+		tokenIds[i] = tokenId
+	}
+	chain, err := s.transactionHandler.Chain(query.Get("chain"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RPCTimeout)
+	defer cancel()
+	// The balances are read from the node the head is read from, which knows
+	// the block
+	backend := chain.PinnedBackend()
+	var block uint64
+	if val := query.Get("block"); val != "" {
+		block, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid block %q", val))
+			return
+		}
+	} else {
+		// Getting latest block (ONLINE)
+		head, err := backend.HeaderByNumber(ctx, nil)
+		if err != nil {
+			handleError(w, fmt.Errorf("error getting latest header: %v", err))
+			return
+		}
+		block = head.Number.Uint64()
+	}
+
+	balances, err := s.balancesAt(ctx, chain, backend, block, accounts, tokenIds)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	res := batchBalancesResponse{
+		BlockNumber: block,
+		Accounts:    make([]accountBalances, len(accounts)),
+	}
+	for i, addr := range accounts {
+		res.Accounts[i] = accountBalances{
+			Address:  addr.Hex(),
+			Balances: make(map[string]string, len(tokenIds)),
+		}
+		for j, tokenId := range tokenIds {
+			res.Accounts[i].Balances[tokenId.String()] = balances[i*len(tokenIds)+j].String()
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// balancesAt returns the balances of every (account, token id) pair, account
+// major. Pairs missing from the cache are read from backend in chunks of
+// balanceBatchSize.
+func (s *Server) balancesAt(
+	ctx context.Context,
+	chain *handler.Chain,
+	backend handler.ChainBackend,
+	block uint64,
+	accounts []common.Address,
+	tokenIds []*big.Int,
+) ([]*big.Int, error) {
+	caller, err := contract.NewContractCaller(common.HexToAddress(chain.Config().ContractAddress), backend)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([]*big.Int, len(accounts)*len(tokenIds))
+	var missing []int
+	for i, addr := range accounts {
+		for j, tokenId := range tokenIds {
+			key := balanceKey{chain: chain.Name(), block: block, addr: addr, id: tokenId.String()}
+			balance, ok := s.balances.get(key)
+			if ok {
+				balances[i*len(tokenIds)+j] = balance
+				continue
+			}
+			missing = append(missing, i*len(tokenIds)+j)
+		}
+	}
+
+	opts := &bind.CallOpts{Context: ctx, BlockNumber: new(big.Int).SetUint64(block)}
+	for start := 0; start < len(missing); start += balanceBatchSize {
+		end := start + balanceBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		chunk := missing[start:end]
+		batchAccounts := make([]common.Address, len(chunk))
+		batchIds := make([]*big.Int, len(chunk))
+		for k, pos := range chunk {
+			batchAccounts[k] = accounts[pos/len(tokenIds)]
+			batchIds[k] = tokenIds[pos%len(tokenIds)]
+		}
+		// Getting balances (ONLINE)
+		result, err := caller.BalanceOfBatch(opts, batchAccounts, batchIds)
+		if err != nil {
+			return nil, fmt.Errorf("error calling BalanceOfBatch: %v", err)
+		}
+		for k, pos := range chunk {
+			balances[pos] = result[k]
+			key := balanceKey{chain: chain.Name(), block: block, addr: batchAccounts[k], id: batchIds[k].String()}
+			s.balances.set(key, result[k])
+		}
+	}
+	return balances, nil
+}
@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type batchBalances struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	Accounts    []struct {
+		Address  string            `json:"address"`
+		Balances map[string]string `json:"balances"`
+	} `json:"accounts"`
+}
+
+func TestGetBalances(t *testing.T) {
+	h := newHarness(t)
+	first, second := newRecipient(t), newRecipient(t)
+	code, body := getToken(t, h, first, pointID, 4)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+	code, body = getToken(t, h, second, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+
+	var res batchBalances
+	code = getJSON(t, fmt.Sprintf("%s/api/balances?addresses=%s,%s&ids=%d,%d", h.HTTP.URL, first.Hex(), second.Hex(), pointID, goldBadgeID), &res)
+	if code != http.StatusOK || len(res.Accounts) != 2 {
+		t.Fatalf("balances = %d %+v, want both accounts", code, res)
+	}
+	if head := h.Backend.Blockchain().CurrentBlock().NumberU64(); res.BlockNumber != head {
+		t.Errorf("block = %d, want the head %d", res.BlockNumber, head)
+	}
+	for i, want := range []struct {
+		address       string
+		points, badge string
+	}{{first.Hex(), "4", "0"}, {second.Hex(), "0", "1"}} {
+		got := res.Accounts[i]
+		if got.Address != want.address || got.Balances["1"] != want.points || got.Balances["2"] != want.badge {
+			t.Errorf("account %d = %+v, want %s with %s points and %s badges", i, got, want.address, want.points, want.badge)
+		}
+	}
+
+	// The simulated chain only answers calls at its head
+	head := res.BlockNumber
+	code = getJSON(t, fmt.Sprintf("%s/api/balances?addresses=%s&ids=%d&block=%d", h.HTTP.URL, second.Hex(), goldBadgeID, head), &res)
+	if code != http.StatusOK || res.BlockNumber != head || res.Accounts[0].Balances["2"] != "1" {
+		t.Errorf("balances at block %d = %d %+v, want the badge", head, code, res)
+	}
+}
+
+func TestGetBalancesInSeveralBatches(t *testing.T) {
+	h := newHarness(t)
+	holder := newRecipient(t)
+	code, body := getToken(t, h, holder, pointID, 2)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+	// More pairs than one balanceOfBatch call reads, the holder last
+	addresses := make([]string, 0, 300)
+	for i := 0; i < 299; i++ {
+		addresses = append(addresses, newRecipient(t).Hex())
+	}
+	addresses = append(addresses, holder.Hex())
+
+	var res batchBalances
+	code = getJSON(t, fmt.Sprintf("%s/api/balances?addresses=%s&ids=%d", h.HTTP.URL, strings.Join(addresses, ","), pointID), &res)
+	if code != http.StatusOK || len(res.Accounts) != len(addresses) {
+		t.Fatalf("balances = %d with %d accounts, want %d", code, len(res.Accounts), len(addresses))
+	}
+	for i, account := range res.Accounts {
+		want := "0"
+		if i == len(addresses)-1 {
+			want = "2"
+		}
+		if account.Address != addresses[i] || account.Balances["1"] != want {
+			t.Fatalf("account %d = %+v, want %s with %s points", i, account, addresses[i], want)
+		}
+	}
+}
+
+func TestGetBalancesRejectsInvalidRequests(t *testing.T) {
+	h := newHarness(t)
+	addr := newRecipient(t).Hex()
+	tooManyIds := strings.TrimSuffix(strings.Repeat("1,", 21), ",")
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"no addresses", "ids=1"},
+		{"no ids", "addresses=" + addr},
+		{"too many ids", "addresses=" + addr + "&ids=" + tooManyIds},
+		{"invalid address", "addresses=0x12&ids=1"},
+		{"invalid token id", "addresses=" + addr + "&ids=one"},
+		{"negative token id", "addresses=" + addr + "&ids=-1"},
+		{"invalid block", "addresses=" + addr + "&ids=1&block=latest"},
+		{"unknown chain", "addresses=" + addr + "&ids=1&chain=missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := getJSON(t, h.HTTP.URL+"/api/balances?"+test.query, nil); code != http.StatusBadRequest {
+				t.Errorf("balances?%s = %d, want 400", test.query, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+)
+
+// ConfigReloader applies reloaded configs to a server like its config
+// watcher, without reading the config files
+type ConfigReloader struct {
+	w *configWatcher
+}
+
+func NewConfigReloader(s *Server, cfg *config.Config) *ConfigReloader {
+	return &ConfigReloader{w: &configWatcher{
+		handler: s.transactionHandler,
+		stamps:  stampFiles(watchedFiles(cfg)),
+		limits:  configuredLimits(s.transactionHandler, cfg),
+	}}
+}
+
+// Reload applies cfg, then watches its files
+func (r *ConfigReloader) Reload(cfg *config.Config) error {
+	err := r.w.apply(slog.Default(), cfg)
+	if err != nil {
+		return err
+	}
+	r.w.stamps = stampFiles(watchedFiles(cfg))
+	return nil
+}
+
+// FilesChanged reports whether the watcher would reload the config
+func (r *ConfigReloader) FilesChanged() bool {
+	return r.w.filesChanged()
+}
@@ -0,0 +1,275 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/metrics"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	pointID     = 1
+	goldBadgeID = 2
+)
+
+var testLimits = simulated.Limits{
+	MaxGoldBadgeTotalQty:    3,
+	MaxGoldBadgeTransferQty: 2,
+	MaxPointTotalQty:        100,
+	MaxPointTransferQty:     50,
+}
+
+func newHarness(t *testing.T) *simulated.Harness {
+	t.Helper()
+	h, err := simulated.New(context.Background(), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func newRecipient(t *testing.T) common.Address {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.PubkeyToAddress(key.PublicKey)
+}
+
+func assertBalance(t *testing.T, h *simulated.Harness, owner common.Address, id int64, want int64) {
+	t.Helper()
+	balance, err := h.BalanceOf(context.Background(), owner, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Int64() != want {
+		t.Errorf("balance of token %d = %v, want %d", id, balance, want)
+	}
+}
+
+func getToken(t *testing.T, h *simulated.Harness, to common.Address, id int64, quantity int64) (int, string) {
+	t.Helper()
+	code, body, err := h.GetToken(to, id, quantity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, body
+}
+
+func TestGetTokenTransfers(t *testing.T) {
+	h := newHarness(t)
+	to := newRecipient(t)
+
+	code, body := getToken(t, h, to, goldBadgeID, 2)
+	if code != http.StatusOK || !strings.HasPrefix(body, "0x") {
+		t.Fatalf("GetToken = %d %q, want 200 with the transaction hash", code, body)
+	}
+	receipt, err := h.Backend.TransactionReceipt(context.Background(), common.HexToHash(body))
+	if err != nil {
+		t.Fatalf("no receipt for %s: %v", body, err)
+	}
+	if receipt.Status != 1 {
+		t.Errorf("transaction status = %d, want 1", receipt.Status)
+	}
+	assertBalance(t, h, to, goldBadgeID, 2)
+	assertBalance(t, h, to, pointID, 0)
+}
+
+func TestGetTokenCountsTransfersInFlight(t *testing.T) {
+	h := newHarness(t)
+	to := newRecipient(t)
+	h.Backend.HoldBlocks(true)
+
+	code, body := getToken(t, h, to, goldBadgeID, 2)
+	if code != http.StatusOK {
+		t.Fatalf("first GetToken = %d %q", code, body)
+	}
+	// The first transfer is not mined, so the balance is still 0
+	assertBalance(t, h, to, goldBadgeID, 0)
+	code, body = getToken(t, h, to, goldBadgeID, 2)
+	if code == http.StatusOK || !strings.Contains(body, "ownership limit exceeded") {
+		t.Fatalf("second GetToken = %d %q, want the ownership limit exceeded", code, body)
+	}
+
+	h.Backend.HoldBlocks(false)
+	h.Backend.Commit()
+	assertBalance(t, h, to, goldBadgeID, 2)
+	code, body = getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken after mining = %d %q, want 200", code, body)
+	}
+	assertBalance(t, h, to, goldBadgeID, 3)
+}
+
+func TestGetTokenConcurrentTransfersKeepOwnershipLimit(t *testing.T) {
+	h := newHarness(t)
+	to := newRecipient(t)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code, _, err := h.GetToken(to, goldBadgeID, 2)
+			if err != nil {
+				t.Error(err)
+			}
+			codes[i] = code
+		}(i)
+	}
+	wg.Wait()
+
+	sent := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			sent++
+		}
+	}
+	if sent != 1 {
+		t.Errorf("%d transfers sent, want 1 as the limit is %d", sent, testLimits.MaxGoldBadgeTotalQty)
+	}
+	assertBalance(t, h, to, goldBadgeID, 2)
+}
+
+func TestGetTokenRefusals(t *testing.T) {
+	tests := []struct {
+		name     string
+		owned    int64
+		id       int64
+		quantity int64
+		wantErr  string
+	}{
+		{"transfer limit", 0, goldBadgeID, 3, "transfer limit exceeded"},
+		{"ownership limit", 2, goldBadgeID, 2, "ownership limit exceeded"},
+		{"unknown token", 0, 7, 1, "unrecognized token id"},
+	}
+	h := newHarness(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			to := newRecipient(t)
+			if test.owned > 0 {
+				code, body := getToken(t, h, to, goldBadgeID, test.owned)
+				if code != http.StatusOK {
+					t.Fatalf("first GetToken = %d %q", code, body)
+				}
+			}
+
+			rejected := metrics.Requests.WithLabelValues(metrics.TokenLabel(test.id), metrics.OutcomeRejected)
+			before := testutil.ToFloat64(rejected)
+			code, body := getToken(t, h, to, test.id, test.quantity)
+			if code == http.StatusOK || !strings.Contains(body, test.wantErr) {
+				t.Errorf("GetToken = %d %q, want an error containing %q", code, body, test.wantErr)
+			}
+			if counted := testutil.ToFloat64(rejected) - before; counted != 1 {
+				t.Errorf("%v requests counted as rejected, want 1", counted)
+			}
+			assertBalance(t, h, to, goldBadgeID, test.owned)
+		})
+	}
+}
+
+// requestStatus is the status of a request as returned by the API
+type requestStatus struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	TxHash    string `json:"txHash"`
+	Error     string `json:"error"`
+}
+
+// waitForStatus polls the status of a request until done accepts it
+func waitForStatus(t *testing.T, h *simulated.Harness, requestID string, done func(requestStatus) bool) requestStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(h.HTTP.URL + "/api/gettoken/status?id=" + requestID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status requestStatus
+		err = json.NewDecoder(res.Body).Decode(&status)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request %s still %+v", requestID, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetTokenAnswersSlowNodeWithRequestID(t *testing.T) {
+	h := newHarness(t)
+	to := newRecipient(t)
+	h.Config.ResponseWait = 50 * time.Millisecond
+	latency := time.Second
+	h.Backend.SetSendLatency(latency)
+
+	start := time.Now()
+	code, body := getToken(t, h, to, pointID, 5)
+	if elapsed := time.Since(start); elapsed >= latency {
+		t.Errorf("GetToken answered after %v, want after RESPONSE_WAIT", elapsed)
+	}
+	if code != http.StatusAccepted {
+		t.Fatalf("GetToken = %d %q, want 202", code, body)
+	}
+	var accepted requestStatus
+	err := json.Unmarshal([]byte(body), &accepted)
+	if err != nil || accepted.RequestID == "" {
+		t.Fatalf("GetToken body %q, want the status with the request id", body)
+	}
+
+	status := waitForStatus(t, h, accepted.RequestID, func(status requestStatus) bool { return status.TxHash != "" && status.Status != "signed" })
+	if status.Error != "" {
+		t.Fatalf("request %+v, want it submitted", status)
+	}
+	assertBalance(t, h, to, pointID, 5)
+}
+
+func TestGetTokenFailsWhenEverySendTimesOut(t *testing.T) {
+	h := newHarness(t)
+	to := newRecipient(t)
+	ctx := context.Background()
+	nonce, err := h.Backend.NonceAt(ctx, *h.Signer.Address(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Config.SendTimeout = 50 * time.Millisecond
+	h.Backend.SetSendLatency(time.Hour)
+
+	code, body := getToken(t, h, to, pointID, 5)
+	if code != http.StatusInternalServerError || !strings.Contains(body, context.DeadlineExceeded.Error()) {
+		t.Fatalf("GetToken = %d %q, want the send deadline exceeded", code, body)
+	}
+
+	// The nonce of the transaction never sent is used again
+	h.Backend.SetSendLatency(0)
+	code, body = getToken(t, h, to, pointID, 5)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken once the node answers = %d %q, want 200", code, body)
+	}
+	tx, _, err := h.Backend.TransactionByHash(ctx, common.HexToHash(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Nonce() != nonce {
+		t.Errorf("nonce = %d, want %d as the first transaction was never sent", tx.Nonce(), nonce)
+	}
+	assertBalance(t, h, to, pointID, 5)
+}
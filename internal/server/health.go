@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// readyCheck is the outcome of one readiness check
+type readyCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// chainReadiness is the outcome of the checks of a chain at a given time
+type chainReadiness struct {
+	Ready     bool                  `json:"ready"`
+	CheckedAt time.Time             `json:"checkedAt"`
+	Checks    map[string]readyCheck `json:"checks"`
+}
+
+type readyResponse struct {
+	Ready  bool                      `json:"ready"`
+	Queue  readyCheck                `json:"queue"`
+	Chains map[string]chainReadiness `json:"chains"`
+}
+
+// chainHealth caches the outcome of the chain checks, so that probes do not
+// each make several node calls per chain
+type chainHealth struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	chains    map[string]chainReadiness
+}
+
+// GetHealth answers as long as the process serves requests
+func (s *Server) GetHealth(w http.ResponseWriter, r *http.Request) {
+	_, err := w.Write([]byte("ok"))
+	if err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
+
+// GetReady answers 503 when the queue has no room or the server is shutting
+// down, or when the chains required by READY_REQUIRE_CHAINS fail their
+// checks: by default when no chain passes them, as requests to the other
+// chains can still be served
+func (s *Server) GetReady(w http.ResponseWriter, r *http.Request) {
+	res := readyResponse{
+		Queue:  s.checkQueue(),
+		Chains: s.checkChains(),
+	}
+	res.Ready = res.Queue.OK && chainsReady(s.cfg.ReadyRequireChains, res.Chains)
+	code := http.StatusOK
+	if !res.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, res)
+}
+
+// checkChains checks every chain, at most once per READY_CHECK_INTERVAL.
+// Probes arriving during the checks wait for them rather than making their
+// own node calls.
+func (s *Server) checkChains() map[string]chainReadiness {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if s.health.chains != nil && time.Since(s.health.checkedAt) < s.cfg.ReadyCheckInterval {
+		return s.health.chains
+	}
+
+	chains := make(map[string]chainReadiness)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, chain := range s.transactionHandler.Chains() {
+		wg.Add(1)
+		go func(chain *handler.Chain) {
+			defer wg.Done()
+			// Not the context of the probe, whose cancellation would be cached
+			checks := s.checkChain(context.Background(), chain)
+			readiness := chainReadiness{Ready: true, CheckedAt: time.Now(), Checks: checks}
+			for _, check := range checks {
+				readiness.Ready = readiness.Ready && check.OK
+			}
+			mu.Lock()
+			chains[chain.Name()] = readiness
+			mu.Unlock()
+		}(chain)
+	}
+	wg.Wait()
+	s.health.chains = chains
+	s.health.checkedAt = time.Now()
+	return chains
+}
+
+// chainsReady tells whether the chains required are ready
+func chainsReady(require string, chains map[string]chainReadiness) bool {
+	ready := 0
+	for _, chain := range chains {
+		if chain.Ready {
+			ready++
+		}
+	}
+	switch require {
+	case config.ReadyRequireNone:
+		return true
+	case config.ReadyRequireAll:
+		return ready == len(chains)
+	default:
+		return ready > 0
+	}
+}
+
+func (s *Server) checkQueue() readyCheck {
+	if s.jobs != nil {
+		return readyCheck{OK: true, Detail: "async mode, transfers are queued as jobs"}
+	}
+	s.closeMu.RLock()
+	closed := s.closed
+	s.closeMu.RUnlock()
+	if closed {
+		return readyCheck{Error: errShuttingDown.Error()}
+	}
+	detail := fmt.Sprintf("%d of %d queued", len(s.queue), cap(s.queue))
+	if len(s.queue) >= cap(s.queue) {
+		return readyCheck{Detail: detail, Error: errQueueFull.Error()}
+	}
+	return readyCheck{OK: true, Detail: detail}
+}
+
+// checkChain checks the node of a chain: that it answers, serves the chain
+// id verified at startup and is in sync, that the contract is deployed, and
+// that the treasury can pay for the gas of a transfer
+func (s *Server) checkChain(ctx context.Context, chain *handler.Chain) map[string]readyCheck {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RPCTimeout)
+	defer cancel()
+	backend := chain.Backend()
+	checks := make(map[string]readyCheck)
+
+	head, err := backend.HeaderByNumber(ctx, nil)
+	checks["node"] = newReadyCheck(err, func() string {
+		return fmt.Sprintf("latest block %d", head.Number)
+	})
+	if err == nil && s.cfg.MaxBlockAge > 0 {
+		age := time.Since(time.Unix(int64(head.Time), 0)).Round(time.Second)
+		var err error
+		if age > s.cfg.MaxBlockAge {
+			err = fmt.Errorf("latest block is %s old, more than %s", age, s.cfg.MaxBlockAge)
+		}
+		checks["sync"] = newReadyCheck(err, func() string {
+			return fmt.Sprintf("latest block is %s old", age)
+		})
+	}
+
+	chainId, err := backend.ChainID(ctx)
+	if err == nil && chainId.Cmp(chain.ChainID()) != 0 {
+		err = fmt.Errorf("node reports chain id %v, expected %v", chainId, chain.ChainID())
+	}
+	checks["chainId"] = newReadyCheck(err, func() string {
+		return chainId.String()
+	})
+
+	contractAddr := common.HexToAddress(chain.Config().ContractAddress)
+	code, err := backend.CodeAt(ctx, contractAddr, nil)
+	if err == nil && len(code) == 0 {
+		err = fmt.Errorf("no contract code at %s", contractAddr.Hex())
+	}
+	checks["contract"] = newReadyCheck(err, func() string {
+		return contractAddr.Hex()
+	})
+
+	checks["gasBalance"] = checkGasBalance(ctx, chain)
+	return checks
+}
+
+// checkGasBalance checks that the treasury holds enough of the native token
+// to pay for one transfer at the current gas price
+func checkGasBalance(ctx context.Context, chain *handler.Chain) readyCheck {
+	reader, ok := chain.Backend().(accountReader)
+	if !ok {
+		return readyCheck{OK: true, Detail: "balance not available from this node client"}
+	}
+	balance, err := reader.BalanceAt(ctx, chain.Address(), nil)
+	if err != nil {
+		return newReadyCheck(err, nil)
+	}
+	gasPrice, err := chain.Backend().SuggestGasPrice(ctx)
+	if err != nil {
+		return newReadyCheck(err, nil)
+	}
+	needed := new(big.Int).Mul(gasPrice, big.NewInt(handler.TransferGas))
+	if balance.Cmp(needed) < 0 {
+		err = errors.New("balance too low to pay for a transfer")
+	}
+	return newReadyCheck(err, func() string {
+		return fmt.Sprintf("%v wei, %v wei needed per transfer", balance, needed)
+	})
+}
+
+// newReadyCheck reports err, or detail when there is no error
+func newReadyCheck(err error, detail func() string) readyCheck {
+	if err != nil {
+		return readyCheck{Error: err.Error()}
+	}
+	check := readyCheck{OK: true}
+	if detail != nil {
+		check.Detail = detail()
+	}
+	return check
+}
@@ -0,0 +1,161 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type readyChain struct {
+	Ready     bool      `json:"ready"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Checks    map[string]struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	} `json:"checks"`
+}
+
+func getReady(t *testing.T, h *simulated.Harness) (int, readyChain) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.Server.GetReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var res struct {
+		Ready  bool                  `json:"ready"`
+		Chains map[string]readyChain `json:"chains"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("invalid /readyz response %q: %v", rec.Body.String(), err)
+	}
+	chain, ok := res.Chains[simulated.ChainName]
+	if !ok {
+		t.Fatalf("/readyz does not report %s: %q", simulated.ChainName, rec.Body.String())
+	}
+	return rec.Code, chain
+}
+
+func TestGetReadyCachesChainChecks(t *testing.T) {
+	h := newHarness(t)
+	h.Config.ReadyCheckInterval = time.Hour
+
+	code, first := getReady(t, h)
+	if code != http.StatusOK || !first.Ready {
+		t.Fatalf("/readyz = %d with chain ready %v, want 200 with the chain ready", code, first.Ready)
+	}
+	// The simulated blocks are older than that, failing the sync check once
+	// the chain is checked again
+	h.Config.MaxBlockAge = time.Nanosecond
+	_, cached := getReady(t, h)
+	if !cached.Ready || !cached.CheckedAt.Equal(first.CheckedAt) {
+		t.Errorf("chain checked again within READY_CHECK_INTERVAL")
+	}
+
+	h.Config.ReadyCheckInterval = 0
+	code, checked := getReady(t, h)
+	if checked.Ready || !checked.CheckedAt.After(first.CheckedAt) {
+		t.Errorf("chain ready %v checked at %v, want it checked again and not ready", checked.Ready, checked.CheckedAt)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %d with the only chain not ready, want 503", code)
+	}
+}
+
+// drainTreasury sends the whole native balance of the treasury away
+func drainTreasury(t *testing.T, h *simulated.Harness) {
+	t.Helper()
+	ctx := context.Background()
+	treasury := *h.Signer.Address()
+	balance, err := h.Backend.BalanceAt(ctx, treasury, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := h.Backend.PendingNonceAt(ctx, treasury)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gasPrice, err := h.Backend.SuggestGasPrice(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fee := new(big.Int).Mul(gasPrice, big.NewInt(21000))
+	tx := types.NewTransaction(nonce, common.Address{1}, new(big.Int).Sub(balance, fee), 21000, gasPrice, nil)
+	chainID, err := h.Backend.ChainID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := h.Signer.Sign(chainID, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.Backend.SendTransaction(ctx, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetReadyFailsOnChainChecks(t *testing.T) {
+	tests := []struct {
+		check string
+		fail  func(h *simulated.Harness)
+	}{
+		{
+			check: "node",
+			fail:  func(h *simulated.Harness) { h.Backend.SetUnreachable(true) },
+		},
+		{
+			check: "sync",
+			// The simulated blocks are older than that
+			fail: func(h *simulated.Harness) { h.Config.MaxBlockAge = time.Nanosecond },
+		},
+		{
+			check: "chainId",
+			fail:  func(h *simulated.Harness) { h.Backend.ServeChainID(big.NewInt(5)) },
+		},
+		{
+			check: "contract",
+			fail: func(h *simulated.Harness) {
+				h.Config.Chains[simulated.ChainName].ContractAddress = common.Address{2}.Hex()
+			},
+		},
+		{
+			check: "gasBalance",
+			fail:  func(h *simulated.Harness) { drainTreasury(t, h) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.check, func(t *testing.T) {
+			h := newHarness(t)
+			h.Config.ReadyCheckInterval = 0
+			code, chain := getReady(t, h)
+			if code != http.StatusOK || !chain.Ready {
+				t.Fatalf("/readyz = %d with the chain ready %v, want 200 before the failure", code, chain.Ready)
+			}
+
+			tt.fail(h)
+			code, chain = getReady(t, h)
+			if code != http.StatusServiceUnavailable || chain.Ready {
+				t.Errorf("/readyz = %d with the chain ready %v, want 503", code, chain.Ready)
+			}
+			if check := chain.Checks[tt.check]; check.OK || check.Error == "" {
+				t.Errorf("%s check = %+v, want it failed", tt.check, check)
+			}
+
+			// Only reported
+			h.Config.ReadyRequireChains = config.ReadyRequireNone
+			code, chain = getReady(t, h)
+			if code != http.StatusOK || chain.Ready {
+				t.Errorf("/readyz = %d with the chain ready %v, want 200 reporting the chain not ready", code, chain.Ready)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/indexer"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type holderResponse struct {
+	Address string `json:"address"`
+	Balance string `json:"balance"`
+}
+
+type holdersResponse struct {
+	TokenID   string           `json:"tokenId"`
+	LastBlock uint64           `json:"lastBlock"`
+	Total     int              `json:"total"`
+	Offset    int              `json:"offset"`
+	Holders   []holderResponse `json:"holders"`
+}
+
+type balanceResponse struct {
+	TokenID string `json:"tokenId"`
+	Balance string `json:"balance"`
+	// Balance returned by balanceOfBatch at the last indexed block, when verified
+	OnChainBalance string `json:"onChainBalance,omitempty"`
+}
+
+type balancesResponse struct {
+	Address   string            `json:"address"`
+	LastBlock uint64            `json:"lastBlock"`
+	Verified  bool              `json:"verified"`
+	Balances  []balanceResponse `json:"balances"`
+}
+
+type transferResponse struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	TxHash      string `json:"txHash"`
+	LogIndex    uint   `json:"logIndex"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	TokenID     string `json:"tokenId"`
+	Value       string `json:"value"`
+}
+
+type historyResponse struct {
+	Address   string             `json:"address"`
+	LastBlock uint64             `json:"lastBlock"`
+	Total     int                `json:"total"`
+	Offset    int                `json:"offset"`
+	Transfers []transferResponse `json:"transfers"`
+}
+
+// GetTokens serves /api/tokens/{id}/holders and /api/tokens/{id}/metadata
+func (s *Server) GetTokens(w http.ResponseWriter, r *http.Request) {
+	parts := pathParts(r.URL.Path, "/api/tokens/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tokenId, ok := new(big.Int).SetString(parts[0], 10)
+	if !ok || tokenId.Sign() < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid token id"))
+		return
+	}
+	switch parts[1] {
+	case "holders":
+		s.getTokenHolders(w, r, tokenId)
+	case "metadata":
+		s.getTokenMetadata(w, r, tokenId)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) getTokenHolders(w http.ResponseWriter, r *http.Request, tokenId *big.Int) {
+	query := r.URL.Query()
+	store, err := s.indexStore(query.Get("chain"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	offset, limit, err := getPage(&query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	lastBlock, _ := store.LastBlock()
+	holders, err := store.Holders(tokenId)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res := holdersResponse{
+		TokenID:   tokenId.String(),
+		LastBlock: lastBlock,
+		Total:     len(holders),
+		Offset:    offset,
+		Holders:   []holderResponse{},
+	}
+	for _, holder := range page(holders, offset, limit) {
+		res.Holders = append(res.Holders, holderResponse{
+			Address: holder.Address.Hex(),
+			Balance: holder.Balance.String(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// GetAccount serves /api/accounts/{address}/balances and
+// /api/accounts/{address}/history
+func (s *Server) GetAccount(w http.ResponseWriter, r *http.Request) {
+	parts := pathParts(r.URL.Path, "/api/accounts/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !common.IsHexAddress(parts[0]) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid address"))
+		return
+	}
+	addr := common.HexToAddress(parts[0])
+	switch parts[1] {
+	case "balances":
+		s.getAccountBalances(w, r, addr)
+	case "history":
+		s.getAccountHistory(w, r, addr)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// getAccountBalances returns the indexed balances of an account. With
+// verify=true they are checked against balanceOfBatch at the last indexed block.
+func (s *Server) getAccountBalances(w http.ResponseWriter, r *http.Request, addr common.Address) {
+	query := r.URL.Query()
+	store, err := s.indexStore(query.Get("chain"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	lastBlock, _ := store.LastBlock()
+	balances, err := store.Balances(addr)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res := balancesResponse{
+		Address:   addr.Hex(),
+		LastBlock: lastBlock,
+		Balances:  []balanceResponse{},
+	}
+	for tokenId, balance := range balances {
+		res.Balances = append(res.Balances, balanceResponse{
+			TokenID: tokenId,
+			Balance: balance.String(),
+		})
+	}
+	sort.Slice(res.Balances, func(i, j int) bool {
+		return compareDecimal(res.Balances[i].TokenID, res.Balances[j].TokenID) < 0
+	})
+
+	if query.Get("verify") == "true" && len(res.Balances) > 0 {
+		err = s.verifyBalances(r, query.Get("chain"), addr, lastBlock, res.Balances)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		res.Verified = true
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) verifyBalances(
+	r *http.Request,
+	chainName string,
+	addr common.Address,
+	block uint64,
+	balances []balanceResponse,
+) error {
+	chain, err := s.transactionHandler.Chain(chainName)
+	if err != nil {
+		return err
+	}
+	caller, err := contract.NewContractCaller(common.HexToAddress(chain.Config().ContractAddress), chain.Backend())
+	if err != nil {
+		return err
+	}
+	accounts := make([]common.Address, len(balances))
+	ids := make([]*big.Int, len(balances))
+	for i, balance := range balances {
+		accounts[i] = addr
+		ids[i], _ = new(big.Int).SetString(balance.TokenID, 10)
+	}
+	onChain, err := caller.BalanceOfBatch(&bind.CallOpts{
+		Context:     r.Context(),
+		BlockNumber: new(big.Int).SetUint64(block),
+	}, accounts, ids)
+	if err != nil {
+		return fmt.Errorf("error calling BalanceOfBatch: %v", err)
+	}
+	for i := range balances {
+		balances[i].OnChainBalance = onChain[i].String()
+	}
+	return nil
+}
+
+func (s *Server) getAccountHistory(w http.ResponseWriter, r *http.Request, addr common.Address) {
+	query := r.URL.Query()
+	store, err := s.indexStore(query.Get("chain"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	offset, limit, err := getPage(&query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	lastBlock, _ := store.LastBlock()
+	history, err := store.History(addr)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	res := historyResponse{
+		Address:   addr.Hex(),
+		LastBlock: lastBlock,
+		Total:     len(history),
+		Offset:    offset,
+		Transfers: []transferResponse{},
+	}
+	for _, t := range page(history, offset, limit) {
+		res.Transfers = append(res.Transfers, transferResponse{
+			BlockNumber: t.BlockNumber,
+			TxHash:      t.TxHash.Hex(),
+			LogIndex:    t.LogIndex,
+			From:        t.From.Hex(),
+			To:          t.To.Hex(),
+			TokenID:     t.TokenID.String(),
+			Value:       t.Value.String(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// indexStore returns the transfer index of the named chain
+func (s *Server) indexStore(chainName string) (*indexer.Store, error) {
+	if s.indexers == nil {
+		return nil, fmt.Errorf("the transfer index is not enabled")
+	}
+	chain, err := s.transactionHandler.Chain(chainName)
+	if err != nil {
+		return nil, err
+	}
+	return s.indexers[chain.Name()].Store(), nil
+}
+
+// pathParts returns the path segments after prefix
+func pathParts(path string, prefix string) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(path, prefix), "/"), "/")
+}
+
+func getPage(query *url.Values) (int, int, error) {
+	offset, limit := 0, defaultPageSize
+	var err error
+	if val := query.Get("offset"); val != "" {
+		offset, err = strconv.Atoi(val)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset")
+		}
+	}
+	if val := query.Get("limit"); val != "" {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid limit, must be between 1 and %d", maxPageSize)
+		}
+	}
+	return offset, limit, nil
+}
+
+func page[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end]
+}
+
+// compareDecimal compares two non-negative decimal strings numerically
+func compareDecimal(a string, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
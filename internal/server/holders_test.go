@@ -0,0 +1,208 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/server"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// newIndexedServer returns a server indexing the transfers of the harness
+// chain
+func newIndexedServer(t *testing.T, h *simulated.Harness) *httptest.Server {
+	t.Helper()
+	ctx := context.Background()
+	cfg := *h.Config
+	cfg.IndexerDir = t.TempDir()
+	cfg.IndexerPollInterval = 10 * time.Millisecond
+	chain, err := server.NewChain(ctx, &cfg, cfg.Chains[simulated.ChainName], h.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewServerWithChains(ctx, &cfg, map[string]*handler.Chain{simulated.ChainName: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close(ctx)
+	})
+	return srv
+}
+
+// getJSON decodes the response to a GET of path into v, and returns its
+// status code
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK && v != nil {
+		err = json.NewDecoder(res.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+type holdersPage struct {
+	TokenID   string `json:"tokenId"`
+	LastBlock uint64 `json:"lastBlock"`
+	Total     int    `json:"total"`
+	Offset    int    `json:"offset"`
+	Holders   []struct {
+		Address string `json:"address"`
+		Balance string `json:"balance"`
+	} `json:"holders"`
+}
+
+// waitForIndex waits for the index to reach the head of the chain
+func waitForIndex(t *testing.T, h *simulated.Harness, srv *httptest.Server) {
+	t.Helper()
+	head := h.Backend.Blockchain().CurrentBlock().NumberU64()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var res holdersPage
+		getJSON(t, fmt.Sprintf("%s/api/tokens/%d/holders", srv.URL, pointID), &res)
+		if res.LastBlock >= head {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("index at block %d, want %d", res.LastBlock, head)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenHoldersFromIndex(t *testing.T) {
+	h := newHarness(t)
+	srv := newIndexedServer(t, h)
+	small, large := newRecipient(t), newRecipient(t)
+	for to, quantity := range map[common.Address]int64{small: 3, large: 40} {
+		code, body := getToken(t, h, to, pointID, quantity)
+		if code != http.StatusOK {
+			t.Fatalf("GetToken = %d %q", code, body)
+		}
+	}
+	waitForIndex(t, h, srv)
+
+	var res holdersPage
+	code := getJSON(t, fmt.Sprintf("%s/api/tokens/%d/holders", srv.URL, pointID), &res)
+	if code != http.StatusOK {
+		t.Fatalf("holders = %d", code)
+	}
+	// The treasury holds the rest of the supply
+	if res.TokenID != "1" || res.Total != 3 || len(res.Holders) != 3 {
+		t.Fatalf("holders = %+v, want the treasury and both recipients", res)
+	}
+	if res.Holders[1].Address != large.Hex() || res.Holders[1].Balance != "40" ||
+		res.Holders[2].Address != small.Hex() || res.Holders[2].Balance != "3" {
+		t.Errorf("holders = %+v, want them from the largest balance down", res.Holders)
+	}
+
+	code = getJSON(t, fmt.Sprintf("%s/api/tokens/%d/holders?offset=2&limit=1", srv.URL, pointID), &res)
+	if code != http.StatusOK || res.Total != 3 || res.Offset != 2 || len(res.Holders) != 1 || res.Holders[0].Address != small.Hex() {
+		t.Errorf("second page = %d %+v, want the smallest holder", code, res)
+	}
+	code = getJSON(t, fmt.Sprintf("%s/api/tokens/%d/holders?offset=5", srv.URL, pointID), &res)
+	if code != http.StatusOK || len(res.Holders) != 0 {
+		t.Errorf("page past the end = %d %+v, want no holders", code, res)
+	}
+}
+
+func TestAccountBalancesAndHistoryFromIndex(t *testing.T) {
+	h := newHarness(t)
+	srv := newIndexedServer(t, h)
+	to := newRecipient(t)
+	var txHashes []string
+	for _, transfer := range []struct{ id, quantity int64 }{{pointID, 5}, {goldBadgeID, 1}, {pointID, 2}} {
+		code, body := getToken(t, h, to, transfer.id, transfer.quantity)
+		if code != http.StatusOK {
+			t.Fatalf("GetToken = %d %q", code, body)
+		}
+		txHashes = append(txHashes, body)
+	}
+	waitForIndex(t, h, srv)
+
+	var balances struct {
+		Address  string `json:"address"`
+		Verified bool   `json:"verified"`
+		Balances []struct {
+			TokenID        string `json:"tokenId"`
+			Balance        string `json:"balance"`
+			OnChainBalance string `json:"onChainBalance"`
+		} `json:"balances"`
+	}
+	code := getJSON(t, fmt.Sprintf("%s/api/accounts/%s/balances?verify=true", srv.URL, to.Hex()), &balances)
+	if code != http.StatusOK || !balances.Verified || len(balances.Balances) != 2 {
+		t.Fatalf("balances = %d %+v, want both tokens verified", code, balances)
+	}
+	for i, want := range []struct{ id, balance string }{{"1", "7"}, {"2", "1"}} {
+		got := balances.Balances[i]
+		if got.TokenID != want.id || got.Balance != want.balance || got.OnChainBalance != want.balance {
+			t.Errorf("balance %d = %+v, want token %s with %s indexed and on chain", i, got, want.id, want.balance)
+		}
+	}
+
+	var history struct {
+		Total     int `json:"total"`
+		Transfers []struct {
+			TxHash  string `json:"txHash"`
+			From    string `json:"from"`
+			To      string `json:"to"`
+			TokenID string `json:"tokenId"`
+			Value   string `json:"value"`
+		} `json:"transfers"`
+	}
+	code = getJSON(t, fmt.Sprintf("%s/api/accounts/%s/history?limit=2", srv.URL, to.Hex()), &history)
+	if code != http.StatusOK || history.Total != 3 || len(history.Transfers) != 2 {
+		t.Fatalf("history = %d %+v, want the first 2 of 3 transfers", code, history)
+	}
+	latest := history.Transfers[0]
+	if latest.TxHash != txHashes[2] || latest.From != h.Signer.Address().Hex() || latest.To != to.Hex() ||
+		latest.TokenID != "1" || latest.Value != "2" {
+		t.Errorf("latest transfer = %+v, want the last one sent", latest)
+	}
+}
+
+func TestIndexRoutesRejectInvalidRequests(t *testing.T) {
+	h := newHarness(t)
+	srv := newIndexedServer(t, h)
+	addr := newRecipient(t).Hex()
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"invalid token id", srv.URL + "/api/tokens/x/holders", http.StatusBadRequest},
+		{"negative token id", srv.URL + "/api/tokens/-1/holders", http.StatusBadRequest},
+		{"unknown token route", srv.URL + "/api/tokens/1/owners", http.StatusNotFound},
+		{"invalid limit", srv.URL + "/api/tokens/1/holders?limit=0", http.StatusBadRequest},
+		{"limit too large", srv.URL + "/api/tokens/1/holders?limit=501", http.StatusBadRequest},
+		{"negative offset", srv.URL + "/api/tokens/1/holders?offset=-1", http.StatusBadRequest},
+		{"unknown chain", srv.URL + "/api/tokens/1/holders?chain=missing", http.StatusNotFound},
+		{"invalid address", srv.URL + "/api/accounts/0x12/balances", http.StatusBadRequest},
+		{"unknown account route", srv.URL + "/api/accounts/" + addr + "/tokens", http.StatusNotFound},
+		{"index disabled", h.HTTP.URL + "/api/accounts/" + addr + "/history", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := getJSON(t, test.url, nil); code != test.want {
+				t.Errorf("GET %s = %d, want %d", test.url, code, test.want)
+			}
+		})
+	}
+}
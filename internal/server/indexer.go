@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/indexer"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// startIndexers starts indexing the transfer events of every chain, each in
+// its own database in INDEXER_DIR
+func (s *Server) startIndexers(chains map[string]*handler.Chain) error {
+	err := os.MkdirAll(s.cfg.IndexerDir, 0o700)
+	if err != nil {
+		return err
+	}
+	s.indexers = make(map[string]*indexer.Indexer)
+	for name, chain := range chains {
+		store, err := indexer.OpenStore(filepath.Join(s.cfg.IndexerDir, name+".db"))
+		if err != nil {
+			s.closeIndexers()
+			return err
+		}
+		idx, err := indexer.NewIndexer(
+			name,
+			chain.Backend(),
+			common.HexToAddress(chain.Config().ContractAddress),
+			store,
+			chain.Config().IndexerStartBlock,
+			s.cfg.IndexerPollInterval,
+		)
+		if err != nil {
+			store.Close()
+			s.closeIndexers()
+			return err
+		}
+		s.indexers[name] = idx
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopIndexers = cancel
+	for _, idx := range s.indexers {
+		s.background.Add(1)
+		go func(idx *indexer.Indexer) {
+			defer s.background.Done()
+			idx.Run(ctx)
+		}(idx)
+	}
+	return nil
+}
+
+// closeIndexers closes the databases of the indexers, once they stopped
+func (s *Server) closeIndexers() {
+	for name, idx := range s.indexers {
+		err := idx.Store().Close()
+		if err != nil {
+			slog.Warn("Error closing transfer index", "chain", name, "error", err)
+		}
+	}
+}
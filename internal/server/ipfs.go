@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+)
+
+// GetIPFS serves /ipfs/{cid}/{path} from the local CAR archives, like a
+// path gateway
+func (s *Server) GetIPFS(w http.ResponseWriter, r *http.Request) {
+	if s.ipfs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	cidStr, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/")
+	root, err := ipfs.ParseCID(cidStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	car, cid, err := s.ipfs.Resolve(root, name)
+	if errors.Is(err, ipfs.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if car.IsDir(cid) {
+		writeError(w, http.StatusNotFound, errors.New("directory listings are not served"))
+		return
+	}
+	content, err := car.ReadFile(cid)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	w.Header().Set("Content-Type", contentType)
+	// Content addressed data never changes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Etag", `"`+cid.String()+`"`)
+	_, err = w.Write(content)
+	if err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/jobs"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+	"github.cbhq.net/engineering/sff-workshop/internal/webhook"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// enqueueJob stores the transfer in the durable queue and answers with the
+// job id, leaving the transfer to the worker command
+func (s *Server) enqueueJob(
+	ctx context.Context,
+	w http.ResponseWriter,
+	chainName string,
+	to string,
+	id int64,
+	quantity int64,
+	proof []common.Hash,
+) {
+	chain, err := s.transactionHandler.Chain(chainName)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	job, err := s.jobs.Enqueue(chain.Name(), to, id, quantity, handler.FormatProof(proof))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	logging.FromContext(ctx).Info(
+		"Queued job",
+		"job_id", job.ID,
+		"chain", job.Chain,
+		"to", to,
+		"id", id,
+		"quantity", quantity,
+	)
+	s.notifier.queued(webhook.Event{
+		JobID:    job.ID,
+		Chain:    job.Chain,
+		To:       to,
+		TokenID:  id,
+		Quantity: quantity,
+	})
+	writeJSON(w, http.StatusAccepted, s.jobResponse(ctx, job))
+}
+
+// GetJob returns the status of a job queued in async mode
+func (s *Server) GetJob(w http.ResponseWriter, r *http.Request) {
+	if s.jobs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	job, err := s.jobs.Get(r.URL.Query().Get("id"))
+	if errors.Is(err, jobs.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.jobResponse(r.Context(), job))
+}
+
+// finalJobStatus reports whether a job in the status changes no more. The
+// worker tracks the transaction of a submitted job and reports its outcome
+// to the webhooks only, so a submitted job is final for the server.
+func finalJobStatus(status string) bool {
+	switch status {
+	case jobs.StatusSubmitted, jobs.StatusFailed, jobs.StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// subscribeJob returns the status of a job queued in async mode and a
+// channel receiving its next statuses until unsubscribe is called. The
+// worker runs apart, so the job is read from the queue every
+// JOB_POLL_INTERVAL. The channel is closed after the final status, or when
+// the job is no longer found.
+func (s *Server) subscribeJob(ctx context.Context, jobID string) (requestStatus, <-chan requestStatus, func(), error) {
+	job, err := s.jobs.Get(jobID)
+	if err != nil {
+		return requestStatus{}, nil, nil, err
+	}
+	token := s.tokenSummary(ctx, job.Chain, job.TokenID)
+	status := jobStatus(job, token)
+	ch := make(chan requestStatus, subscriberBuffer)
+	if finalJobStatus(job.Status) {
+		close(ch)
+		return status, ch, func() {}, nil
+	}
+
+	interval := s.cfg.JobPollInterval
+	if interval <= 0 {
+		interval = config.DefaultJobPollInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := status.Status
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			job, err := s.jobs.Get(jobID)
+			if errors.Is(err, jobs.ErrNotFound) {
+				return
+			}
+			if err != nil {
+				logging.FromContext(ctx).Warn("Error reading job", "job_id", jobID, "error", err)
+				continue
+			}
+			if job.Status == last {
+				continue
+			}
+			last = job.Status
+			select {
+			case ch <- jobStatus(job, token):
+			case <-done:
+				return
+			}
+			if finalJobStatus(job.Status) {
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() { close(done) })
+	}
+	return status, ch, unsubscribe, nil
+}
+
+// jobStatus returns the status of a job in the form of a request status,
+// with the job id as request id
+func jobStatus(job *jobs.Job, token *tokenSummary) requestStatus {
+	return requestStatus{
+		RequestID: job.ID,
+		Status:    job.Status,
+		TxHash:    job.TxHash,
+		Error:     job.Error,
+		UpdatedAt: job.UpdatedAt,
+		Token:     token,
+	}
+}
+
+type jobResponse struct {
+	*jobs.Job
+	Token *tokenSummary `json:"token,omitempty"`
+}
+
+func (s *Server) jobResponse(ctx context.Context, job *jobs.Job) jobResponse {
+	return jobResponse{
+		Job:   job,
+		Token: s.tokenSummary(ctx, job.Chain, job.TokenID),
+	}
+}
+
+// trackedJobTx is a transaction of a job followed until it is final
+type trackedJobTx struct {
+	Event       webhook.Event `json:"event"`
+	TxHash      string        `json:"txHash"`
+	SubmittedAt time.Time     `json:"submittedAt"`
+}
+
+// jobObserver notifies the webhooks of the outcome of the jobs processed by
+// the worker and tracks their transactions. The transactions still tracked
+// are kept in a file of each chain in the job queue directory, so a worker
+// stopped first, as in once mode, leaves them for the next one to resume.
+type jobObserver struct {
+	handler  *handler.TransactionHandler
+	notifier *transferNotifier
+	tracker  *txTracker
+	dir      string
+
+	mu sync.Mutex
+	// tracked holds the transactions tracked by chain and job id
+	tracked map[string]map[string]trackedJobTx
+	// tracking counts the transactions tracked by chain
+	tracking map[string]*sync.WaitGroup
+}
+
+func newJobObserver(
+	transactionHandler *handler.TransactionHandler,
+	notifier *transferNotifier,
+	tracker *txTracker,
+	dir string,
+) *jobObserver {
+	return &jobObserver{
+		handler:  transactionHandler,
+		notifier: notifier,
+		tracker:  tracker,
+		dir:      dir,
+		tracked:  make(map[string]map[string]trackedJobTx),
+		tracking: make(map[string]*sync.WaitGroup),
+	}
+}
+
+func (o *jobObserver) JobFinished(job *jobs.Job, txHash string, err error) {
+	event := webhook.Event{
+		JobID:    job.ID,
+		Chain:    job.Chain,
+		To:       job.To,
+		TokenID:  job.TokenID,
+		Quantity: job.Quantity,
+	}
+	o.notifier.finished(event, txHash, err)
+	if err != nil {
+		return
+	}
+	o.track(trackedJobTx{Event: event, TxHash: txHash, SubmittedAt: time.Now().UTC()})
+}
+
+// Resume tracks again the transactions a previous worker left unfinished
+func (o *jobObserver) Resume(chainName string) {
+	b, err := os.ReadFile(o.trackedFile(chainName))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var txs []trackedJobTx
+	if err == nil {
+		err = json.Unmarshal(b, &txs)
+	}
+	if err != nil {
+		slog.Error("Error reading tracked transactions", "chain", chainName, "error", err)
+		return
+	}
+	if len(txs) > 0 {
+		slog.Info("Resuming tracked transactions", "chain", chainName, "count", len(txs))
+	}
+	for _, tx := range txs {
+		o.track(tx)
+	}
+}
+
+func (o *jobObserver) track(tx trackedJobTx) {
+	chainName := tx.Event.Chain
+	chain, err := o.handler.Chain(chainName)
+	if err != nil {
+		return
+	}
+	o.mu.Lock()
+	if o.tracked[chainName] == nil {
+		o.tracked[chainName] = make(map[string]trackedJobTx)
+		o.tracking[chainName] = &sync.WaitGroup{}
+	}
+	o.tracked[chainName][tx.Event.JobID] = tx
+	o.saveTracked(chainName)
+	tracking := o.tracking[chainName]
+	tracking.Add(1)
+	o.mu.Unlock()
+
+	stopped := o.tracker.track(chain, tx.TxHash, tx.SubmittedAt, func(update txUpdate) {
+		o.notifier.mined(tx.Event, tx.TxHash, update)
+	})
+	go func() {
+		defer tracking.Done()
+		err := <-stopped
+		// Kept for the next worker when this one stops first
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.tracked[chainName], tx.Event.JobID)
+		o.saveTracked(chainName)
+	}()
+}
+
+// saveTracked writes the transactions tracked on the chain. The caller holds mu.
+func (o *jobObserver) saveTracked(chainName string) {
+	txs := make([]trackedJobTx, 0, len(o.tracked[chainName]))
+	for _, tx := range o.tracked[chainName] {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].SubmittedAt.Before(txs[j].SubmittedAt) })
+	b, err := json.Marshal(txs)
+	if err == nil {
+		err = writeFileAtomic(o.trackedFile(chainName), b)
+	}
+	if err != nil {
+		slog.Error("Error saving tracked transactions", "chain", chainName, "error", err)
+	}
+}
+
+func (o *jobObserver) trackedFile(chainName string) string {
+	return filepath.Join(o.dir, "tracked-"+chainName+".json")
+}
+
+// Wait returns once the transactions tracked on the chain are final or
+// given up on, or when ctx is done
+func (o *jobObserver) Wait(ctx context.Context, chainName string) {
+	o.mu.Lock()
+	tracking := o.tracking[chainName]
+	o.mu.Unlock()
+	if tracking == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		tracking.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (o *jobObserver) Close() {
+	o.tracker.Close()
+	o.notifier.Close()
+}
@@ -0,0 +1,236 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/jobs"
+	"github.cbhq.net/engineering/sff-workshop/internal/server"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+	"github.cbhq.net/engineering/sff-workshop/internal/webhook"
+)
+
+// webhookReceiver records the events delivered to it
+type webhookReceiver struct {
+	mu     sync.Mutex
+	events []webhook.Event
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, string) {
+	rec := &webhookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Errorf("invalid webhook event: %v", err)
+		}
+		rec.mu.Lock()
+		rec.events = append(rec.events, event)
+		rec.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv.URL
+}
+
+func (rec *webhookReceiver) types() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	types := make([]string, 0, len(rec.events))
+	for _, event := range rec.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// runWorkerOnce runs a worker in once mode on the harness chain until the
+// jobs are processed and their transactions final, or until timeout
+func runWorkerOnce(t *testing.T, h *simulated.Harness, cfg *config.Config, timeout time.Duration) {
+	t.Helper()
+	ctx := context.Background()
+	chain, err := server.NewChain(ctx, cfg, cfg.Chains[simulated.ChainName], h.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker, err := server.NewJobWorkerWithChains(ctx, cfg, map[string]*handler.Chain{simulated.ChainName: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = worker.Run(ctx, true)
+	worker.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerOnceResumesTrackedTransactions(t *testing.T) {
+	h := newHarness(t)
+	rec, url := newWebhookReceiver(t)
+	cfg := *h.Config
+	cfg.JobQueueDir = t.TempDir()
+	cfg.WebhookURLs = []string{url}
+	cfg.WebhookSecret = "secret"
+	cfg.WebhookRetryBackoff = time.Millisecond
+	cfg.Confirmations = 2
+	cfg.ConfirmPollInterval = 10 * time.Millisecond
+	queue, err := jobs.NewFileQueue(cfg.JobQueueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := queue.Enqueue(simulated.ChainName, newRecipient(t).Hex(), goldBadgeID, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction is mined in a block of its own, so it has one
+	// confirmation of the two required when the run stops
+	runWorkerOnce(t, h, &cfg, 200*time.Millisecond)
+	if types := rec.types(); len(types) != 1 || types[0] != webhook.EventSubmitted {
+		t.Fatalf("events after the first run = %v, want only %s", types, webhook.EventSubmitted)
+	}
+	tracked, err := os.ReadFile(filepath.Join(cfg.JobQueueDir, "tracked-"+simulated.ChainName+".json"))
+	if err != nil {
+		t.Fatalf("tracked transactions not saved: %v", err)
+	}
+
+	h.Backend.Commit()
+	runWorkerOnce(t, h, &cfg, 5*time.Second)
+	types := rec.types()
+	if len(types) != 2 || types[1] != webhook.EventConfirmed {
+		t.Fatalf("events after the second run = %v, want %s then %s (tracked %s)", types, webhook.EventSubmitted, webhook.EventConfirmed, tracked)
+	}
+	rec.mu.Lock()
+	confirmed := rec.events[1]
+	rec.mu.Unlock()
+	if confirmed.JobID != job.ID || confirmed.BlockNumber == 0 {
+		t.Errorf("confirmed event = %+v, want the job and its block", confirmed)
+	}
+	tracked, err = os.ReadFile(filepath.Join(cfg.JobQueueDir, "tracked-"+simulated.ChainName+".json"))
+	if err != nil || string(tracked) != "[]" {
+		t.Errorf("tracked transactions = %s, %v after the confirmation, want none", tracked, err)
+	}
+}
+
+// queueJob asks the async server for a token and returns the job queued
+func queueJob(t *testing.T, srvURL string, id int64) jobs.Job {
+	t.Helper()
+	res, err := http.Get(fmt.Sprintf("%s/api/gettoken?to=%s&id=%d&quantity=1", srvURL, newRecipient(t).Hex(), id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var job jobs.Job
+	err = json.NewDecoder(res.Body).Decode(&job)
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("GetToken = %d, %v, want 202 with the job", res.StatusCode, err)
+	}
+	return job
+}
+
+// streamEvents sends the names of the events of a status stream, and
+// closes the channel when the stream ends
+func streamEvents(t *testing.T, url string) <-chan string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		t.Fatalf("GET %s = %d, want a stream", url, res.StatusCode)
+	}
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				events <- name
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent returns the next event of a stream, or "" when it ended
+func nextEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case name := <-events:
+		return name
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status event")
+		return ""
+	}
+}
+
+func TestGetTokenEventsFollowsJob(t *testing.T) {
+	h := newHarness(t)
+	srv, queue := newAsyncServer(t, h)
+
+	job := queueJob(t, srv.URL, goldBadgeID)
+	events := streamEvents(t, srv.URL+"/api/gettoken/events?id="+job.ID)
+	if got := nextEvent(t, events); got != jobs.StatusQueued {
+		t.Fatalf("first event = %s, want %s", got, jobs.StatusQueued)
+	}
+	claimed, err := queue.Claim(simulated.ChainName)
+	if err != nil || claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("Claim = %+v, %v, want the job", claimed, err)
+	}
+	if got := nextEvent(t, events); got != jobs.StatusProcessing {
+		t.Fatalf("event after the claim = %s, want %s", got, jobs.StatusProcessing)
+	}
+	err = queue.Finish(claimed, "0x01", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nextEvent(t, events); got != jobs.StatusSubmitted {
+		t.Errorf("event after the submission = %s, want %s", got, jobs.StatusSubmitted)
+	}
+	if got := nextEvent(t, events); got != "" {
+		t.Errorf("event %s after the final status, want the stream ended", got)
+	}
+
+	// A cancelled job is final
+	job = queueJob(t, srv.URL, goldBadgeID)
+	events = streamEvents(t, srv.URL+"/api/gettoken/events?id="+job.ID)
+	if got := nextEvent(t, events); got != jobs.StatusQueued {
+		t.Fatalf("first event = %s, want %s", got, jobs.StatusQueued)
+	}
+	code, body := postAdminTo(t, srv.URL, "/api/admin/requests/cancel?id="+job.ID)
+	if code != http.StatusOK {
+		t.Fatalf("cancel = %d %q", code, body)
+	}
+	if got := nextEvent(t, events); got != jobs.StatusCancelled {
+		t.Errorf("event after the cancel = %s, want %s", got, jobs.StatusCancelled)
+	}
+	if got := nextEvent(t, events); got != "" {
+		t.Errorf("event %s after the final status, want the stream ended", got)
+	}
+	// The stream of a final job ends after its status
+	events = streamEvents(t, srv.URL+"/api/gettoken/events?id="+job.ID)
+	if got := nextEvent(t, events); got != jobs.StatusCancelled {
+		t.Errorf("event of the cancelled job = %s, want %s", got, jobs.StatusCancelled)
+	}
+	if got := nextEvent(t, events); got != "" {
+		t.Errorf("event %s after the final status, want the stream ended", got)
+	}
+
+	if code := getJSON(t, srv.URL+"/api/gettoken/events?id=missing", nil); code != http.StatusNotFound {
+		t.Errorf("events of an unknown job = %d, want 404", code)
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// pendingRequest is a queued request saved on shutdown and re-queued on startup
+type pendingRequest struct {
+	RequestID string        `json:"requestId"`
+	Chain     string        `json:"chain"`
+	To        string        `json:"to"`
+	ID        int64         `json:"id"`
+	Quantity  int64         `json:"quantity"`
+	Proof     []common.Hash `json:"proof,omitempty"`
+}
+
+// Close shuts the server down. It stops accepting requests and lets the
+// workers finish the queued transfers until ctx is done. After that no new
+// transfer is started: the transfers in progress are waited for, as they may
+// already be signed, and the requests left in the queue are saved to
+// PENDING_REQUESTS_FILE when set. Finally the indexers, status streams,
+// transaction tracking and webhooks are stopped and the node clients are
+// closed. Reloading the config stops too.
+func (s *Server) Close(ctx context.Context) error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.closeMu.Unlock()
+	slog.Info("Draining queued requests", "queue_depth", len(s.queue))
+
+	drained := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		slog.Warn("Shutdown deadline reached, waiting for the transfers in progress", "in_flight", s.stats.inFlight.Load())
+		close(s.stopping)
+		<-drained
+		err = s.persistPendingRequests()
+	}
+
+	if s.stopIndexers != nil {
+		s.stopIndexers()
+	}
+	s.background.Wait()
+	s.closeIndexers()
+	s.watcher.Stop()
+	s.StopStreams()
+	s.tracker.Close()
+	s.notifier.Close()
+	s.transactionHandler.Close()
+	return err
+}
+
+// persistPendingRequests saves the requests left in the closed queue so the
+// next server instance can process them, and answers their clients with the
+// request id. When they cannot be saved, they fail instead.
+func (s *Server) persistPendingRequests() error {
+	var pending []*getTokenRequest
+	for req := range s.queue {
+		if s.takePending(req.requestID) {
+			pending = append(pending, req)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := s.savePendingRequests(pending)
+	for _, req := range pending {
+		req.cancel()
+		if err != nil {
+			s.requests.set(req.requestID, statusFailed, "", errShuttingDown)
+			req.resChannel <- &getTokenResponse{err: errShuttingDown}
+			continue
+		}
+		// Still queued, by the next server instance
+		req.resChannel <- &getTokenResponse{accepted: true}
+	}
+	if err != nil {
+		return fmt.Errorf("dropped %d queued requests: %v", len(pending), err)
+	}
+	slog.Info("Saved queued requests", "count", len(pending), "file", s.cfg.PendingRequestsFile)
+	return nil
+}
+
+// savePendingRequests appends the requests to PENDING_REQUESTS_FILE, all of
+// them or none
+func (s *Server) savePendingRequests(pending []*getTokenRequest) error {
+	if s.cfg.PendingRequestsFile == "" {
+		return errors.New("PENDING_REQUESTS_FILE is not set")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, req := range pending {
+		err := enc.Encode(pendingRequest{
+			RequestID: req.requestID,
+			Chain:     req.chain,
+			To:        req.to,
+			ID:        req.id,
+			Quantity:  req.quantity,
+			Proof:     req.proof,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.cfg.PendingRequestsFile, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Drop what was written, as the clients are told the requests failed
+		if truncErr := f.Truncate(size); truncErr != nil {
+			slog.Error("Error truncating pending requests", "error", truncErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// restorePendingRequests queues the requests saved by the previous shutdown.
+// The file is removed once all of them are queued, otherwise it is left
+// holding those that were not, to be queued by the next start.
+func (s *Server) restorePendingRequests() {
+	if s.cfg.PendingRequestsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(s.cfg.PendingRequestsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Error("Error reading pending requests", "error", err)
+		return
+	}
+
+	restored := 0
+	var left [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		err = s.restorePendingRequest(line)
+		if err != nil {
+			slog.Warn("Error restoring pending request", "error", err)
+			left = append(left, line)
+			continue
+		}
+		restored++
+	}
+	slog.Info("Restored pending requests", "count", restored, "file", s.cfg.PendingRequestsFile)
+	if len(left) == 0 {
+		err = os.Remove(s.cfg.PendingRequestsFile)
+		if err != nil {
+			slog.Error("Error removing pending requests", "error", err)
+		}
+		return
+	}
+	err = writeFileAtomic(s.cfg.PendingRequestsFile, append(bytes.Join(left, []byte("\n")), '\n'))
+	if err != nil {
+		slog.Error("Error saving pending requests", "error", err)
+		return
+	}
+	slog.Warn("Kept pending requests not queued", "count", len(left), "file", s.cfg.PendingRequestsFile)
+}
+
+// restorePendingRequest queues a request saved by the previous shutdown
+func (s *Server) restorePendingRequest(line []byte) error {
+	var pending pendingRequest
+	err := json.Unmarshal(line, &pending)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(requestContext(pending.RequestID, pending.To, pending.ID, pending.Quantity, pending.Proof))
+	req := &getTokenRequest{
+		ctx:        ctx,
+		cancel:     cancel,
+		requestID:  pending.RequestID,
+		chain:      pending.Chain,
+		to:         pending.To,
+		id:         pending.ID,
+		quantity:   pending.Quantity,
+		proof:      pending.Proof,
+		resChannel: make(chan *getTokenResponse, 1),
+		enqueuedAt: time.Now(),
+	}
+	err = s.enqueue(req)
+	if err != nil {
+		return fmt.Errorf("request %s: %v", pending.RequestID, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file with data, so that it is never left
+// partly written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
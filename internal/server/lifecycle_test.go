@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+)
+
+// newQueueServer returns a server with a queue of the given size and no
+// workers, so requests stay queued
+func newQueueServer(pendingFile string, queueSize int) *Server {
+	return &Server{
+		cfg:      &config.Config{PendingRequestsFile: pendingFile},
+		queue:    make(chan *getTokenRequest, queueSize),
+		requests: newRequestStore(),
+		stats:    &processorStats{},
+		stopping: make(chan struct{}),
+		pending:  make(map[string]*getTokenRequest),
+	}
+}
+
+func queueRequest(t *testing.T, s *Server, requestID string) *getTokenRequest {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := &getTokenRequest{
+		ctx:        ctx,
+		cancel:     cancel,
+		requestID:  requestID,
+		to:         "0x0000000000000000000000000000000000000001",
+		id:         1,
+		quantity:   1,
+		resChannel: make(chan *getTokenResponse, 1),
+		enqueuedAt: time.Now(),
+	}
+	err := s.enqueue(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// closeQueue closes the queue as Close does before persisting it
+func closeQueue(s *Server) {
+	s.closeMu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.closeMu.Unlock()
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestPersistPendingRequestsAnswersWithRequestID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.jsonl")
+	s := newQueueServer(path, 2)
+	reqs := []*getTokenRequest{queueRequest(t, s, "a"), queueRequest(t, s, "b")}
+	closeQueue(s)
+
+	err := s.persistPendingRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range reqs {
+		res := <-req.resChannel
+		if !res.accepted || res.err != nil {
+			t.Errorf("request %s answered with %+v, want accepted", req.requestID, res)
+		}
+		if status, _ := s.requests.get(req.requestID); status.Status != statusQueued {
+			t.Errorf("request %s is %s, want %s", req.requestID, status.Status, statusQueued)
+		}
+	}
+	if lines := countLines(t, path); lines != 2 {
+		t.Errorf("%d requests saved, want 2", lines)
+	}
+}
+
+func TestPersistPendingRequestsFailsWithoutFile(t *testing.T) {
+	s := newQueueServer("", 1)
+	req := queueRequest(t, s, "a")
+	closeQueue(s)
+
+	err := s.persistPendingRequests()
+	if err == nil {
+		t.Fatal("persistPendingRequests succeeded without PENDING_REQUESTS_FILE")
+	}
+	res := <-req.resChannel
+	if res.accepted || !errors.Is(res.err, errShuttingDown) {
+		t.Errorf("request answered with %+v, want %v", res, errShuttingDown)
+	}
+	if status, _ := s.requests.get("a"); status.Status != statusFailed {
+		t.Errorf("request is %s, want %s", status.Status, statusFailed)
+	}
+}
+
+func TestRestorePendingRequestsKeepsThoseNotQueued(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.jsonl")
+	saved := newQueueServer(path, 3)
+	for _, id := range []string{"a", "b", "c"} {
+		queueRequest(t, saved, id)
+	}
+	closeQueue(saved)
+	err := saved.persistPendingRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue has room for two of the three requests
+	s := newQueueServer(path, 2)
+	s.restorePendingRequests()
+	if len(s.queue) != 2 {
+		t.Fatalf("%d requests queued, want 2", len(s.queue))
+	}
+	if lines := countLines(t, path); lines != 1 {
+		t.Fatalf("%d requests kept, want 1", lines)
+	}
+
+	<-s.queue
+	<-s.queue
+	s.restorePendingRequests()
+	req := <-s.queue
+	if req.requestID != "c" {
+		t.Errorf("restored request %s, want c", req.requestID)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pending requests file left once all were queued: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+	"github.cbhq.net/engineering/sff-workshop/internal/metadata"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// tokenSummary is the part of the token metadata added to transfer responses
+type tokenSummary struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+// newMetadataResolvers creates the metadata resolver of each chain. The
+// local directory and CAR archives are tried before the gateways.
+func newMetadataResolvers(
+	dir string,
+	cars *ipfs.Store,
+	gateways []string,
+	chains map[string]*handler.Chain,
+) (map[string]*metadata.Resolver, error) {
+	var sources []metadata.Source
+	if dir != "" {
+		sources = append(sources, metadata.NewDirSource(dir))
+	}
+	if cars != nil {
+		sources = append(sources, metadata.NewCARSource(cars))
+	}
+	for _, gateway := range gateways {
+		sources = append(sources, metadata.NewGatewaySource(gateway))
+	}
+	fetcher := metadata.NewFetcher(sources...)
+
+	resolvers := make(map[string]*metadata.Resolver)
+	for name, chain := range chains {
+		caller, err := contract.NewContractCaller(common.HexToAddress(chain.Config().ContractAddress), chain.Backend())
+		if err != nil {
+			return nil, err
+		}
+		resolvers[name] = metadata.NewResolver(caller, fetcher)
+	}
+	return resolvers, nil
+}
+
+func (s *Server) getTokenMetadata(w http.ResponseWriter, r *http.Request, tokenId *big.Int) {
+	if s.metadata == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("token metadata is not enabled"))
+		return
+	}
+	chain, err := s.transactionHandler.Chain(r.URL.Query().Get("chain"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RPCTimeout)
+	defer cancel()
+	m, err := s.metadata[chain.Name()].Resolve(ctx, tokenId)
+	if errors.Is(err, metadata.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// resolveTokenSummary adds the name and image of the token to the status of
+// the request once they are resolved, so gateways never hold up the response
+func (s *Server) resolveTokenSummary(requestID string, chainName string, id int64) {
+	if s.metadata == nil {
+		return
+	}
+	go func() {
+		if token := s.tokenSummary(context.Background(), chainName, id); token != nil {
+			s.requests.setToken(requestID, token)
+		}
+	}()
+}
+
+// tokenSummary returns the name and image of a token for transfer responses.
+// Metadata is informational, so failures are logged and nil is returned.
+func (s *Server) tokenSummary(ctx context.Context, chainName string, id int64) *tokenSummary {
+	if s.metadata == nil {
+		return nil
+	}
+	chain, err := s.transactionHandler.Chain(chainName)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RPCTimeout)
+	defer cancel()
+	m, err := s.metadata[chain.Name()].Resolve(ctx, big.NewInt(id))
+	if err != nil {
+		slog.Warn("Error resolving token metadata", "chain", chain.Name(), "id", id, "error", err)
+		return nil
+	}
+	return &tokenSummary{ID: id, Name: m.Name, Image: m.Image}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// accountReader is the part of the node API read for the treasury gauges.
+// It is implemented by ethclient.Client, MultiClient and the simulated backend.
+type accountReader interface {
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+var (
+	treasuryBalanceDesc = prometheus.NewDesc(
+		"airdrop_treasury_balance_wei",
+		"Native balance of the treasury wallet, paying for gas.",
+		[]string{"chain"},
+		nil,
+	)
+	treasuryTokenBalanceDesc = prometheus.NewDesc(
+		"airdrop_treasury_token_balance",
+		"Tokens left in the treasury wallet, by token id.",
+		[]string{"chain", "token_id"},
+		nil,
+	)
+	pendingTransactionsDesc = prometheus.NewDesc(
+		"airdrop_pending_transactions",
+		"Transactions of the treasury sent but not yet mined, according to the node.",
+		[]string{"chain"},
+		nil,
+	)
+)
+
+// treasuryCollector reads the treasury balances and pending transaction
+// count of every chain from the nodes when metrics are scraped, at most once
+// per READY_CHECK_INTERVAL like the readiness checks. Scrapes in between get
+// the metrics last read.
+type treasuryCollector struct {
+	chains   map[string]*handler.Chain
+	timeout  time.Duration
+	interval time.Duration
+
+	mu          sync.Mutex
+	collectedAt time.Time
+	metrics     []prometheus.Metric
+}
+
+func (c *treasuryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- treasuryBalanceDesc
+	ch <- treasuryTokenBalanceDesc
+	ch <- pendingTransactionsDesc
+}
+
+func (c *treasuryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metrics == nil || time.Since(c.collectedAt) >= c.interval {
+		c.metrics = c.collect()
+		c.collectedAt = time.Now()
+	}
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+}
+
+// collect reads the metrics of every chain. A chain failing one of its reads
+// only has the metrics read before it until the next collection.
+func (c *treasuryCollector) collect() []prometheus.Metric {
+	metrics := []prometheus.Metric{}
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+	}()
+	for name, chain := range c.chains {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err := collectTreasury(ctx, ch, name, chain)
+		cancel()
+		if err != nil {
+			slog.Warn("Error collecting treasury metrics", "chain", name, "error", err)
+		}
+	}
+	close(ch)
+	<-done
+	return metrics
+}
+
+func collectTreasury(ctx context.Context, ch chan<- prometheus.Metric, name string, chain *handler.Chain) error {
+	treasury := chain.Address()
+	if reader, ok := chain.Backend().(accountReader); ok {
+		balance, err := reader.BalanceAt(ctx, treasury, nil)
+		if err != nil {
+			return err
+		}
+		wei, _ := new(big.Float).SetInt(balance).Float64()
+		ch <- prometheus.MustNewConstMetric(treasuryBalanceDesc, prometheus.GaugeValue, wei, name)
+
+		minedNonce, err := reader.NonceAt(ctx, treasury, nil)
+		if err != nil {
+			return err
+		}
+		pendingNonce, err := chain.Backend().PendingNonceAt(ctx, treasury)
+		if err != nil {
+			return err
+		}
+		pending := 0.0
+		if pendingNonce > minedNonce {
+			pending = float64(pendingNonce - minedNonce)
+		}
+		ch <- prometheus.MustNewConstMetric(pendingTransactionsDesc, prometheus.GaugeValue, pending, name)
+	}
+
+	caller, err := contract.NewContractCaller(common.HexToAddress(chain.Config().ContractAddress), chain.Backend())
+	if err != nil {
+		return err
+	}
+	ids := chain.TokenIDs()
+	accounts := make([]common.Address, len(ids))
+	tokenIds := make([]*big.Int, len(ids))
+	for i, id := range ids {
+		accounts[i] = treasury
+		tokenIds[i] = big.NewInt(id)
+	}
+	balances, err := caller.BalanceOfBatch(&bind.CallOpts{Context: ctx}, accounts, tokenIds)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		balance, _ := new(big.Float).SetInt(balances[i]).Float64()
+		ch <- prometheus.MustNewConstMetric(
+			treasuryTokenBalanceDesc,
+			prometheus.GaugeValue,
+			balance,
+			name,
+			strconv.FormatInt(id, 10),
+		)
+	}
+	return nil
+}
+
+// newMetricsRegistry registers the metrics specific to this server. The
+// pipeline metrics of the metrics package live in the default registry.
+func (s *Server) newMetricsRegistry(chains map[string]*handler.Chain) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "airdrop_queue_depth",
+			Help: "Requests waiting for a worker.",
+		}, func() float64 {
+			return float64(len(s.queue))
+		}),
+		&treasuryCollector{chains: chains, timeout: s.cfg.RPCTimeout, interval: s.cfg.ReadyCheckInterval},
+	)
+	return registry
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func (s *Server) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(
+		prometheus.Gatherers{prometheus.DefaultGatherer, s.metrics},
+		promhttp.HandlerOpts{},
+	)
+}
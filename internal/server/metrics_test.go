@@ -0,0 +1,100 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// scrape returns the value of a metric of the simulated chain, and false
+// when /metrics does not have it
+func scrape(t *testing.T, h *simulated.Harness, name string) (float64, bool) {
+	t.Helper()
+	res, err := http.Get(h.HTTP.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	prefix := name + `{chain="` + simulated.ChainName + `"} `
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), prefix); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid %s value %q", name, value)
+			}
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+func TestTreasuryMetricsReadOncePerInterval(t *testing.T) {
+	h := newHarness(t)
+
+	balance, ok := scrape(t, h, "airdrop_treasury_balance_wei")
+	if !ok || balance == 0 {
+		t.Fatalf("treasury balance = %v, %v, want the balance of the treasury", balance, ok)
+	}
+	// The next scrape within READY_CHECK_INTERVAL does not call the node
+	h.Backend.SetUnreachable(true)
+	cached, ok := scrape(t, h, "airdrop_treasury_balance_wei")
+	if !ok || cached != balance {
+		t.Errorf("treasury balance = %v, %v after the node failed, want the %v read before", cached, ok, balance)
+	}
+}
+
+func TestGasSpentFromReceipts(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	before, _ := scrape(t, h, "airdrop_gas_spent_wei_total")
+
+	code, body := getToken(t, h, newRecipient(t), goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+	receipt, err := h.Backend.TransactionReceipt(ctx, common.HexToHash(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _, err := h.Backend.TransactionByHash(ctx, receipt.TxHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := h.Backend.HeaderByNumber(ctx, receipt.BlockNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := tx.EffectiveGasTip(header.BaseFee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	price := new(big.Int).Add(header.BaseFee, tip)
+	want, _ := new(big.Float).SetInt(new(big.Int).Mul(price, new(big.Int).SetUint64(receipt.GasUsed))).Float64()
+	if maxFee := new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas())); big.NewFloat(want).Cmp(new(big.Float).SetInt(maxFee)) >= 0 {
+		t.Fatalf("expected gas spent %v not below the fee cap %v", want, maxFee)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after, _ := scrape(t, h, "airdrop_gas_spent_wei_total")
+		// The counter is shared by the tests, and large enough to round
+		if math.Abs(after-before-want) <= want*1e-9 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gas spent grew by %v, want %v", after-before, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+	"github.cbhq.net/engineering/sff-workshop/internal/metrics"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
+	"github.cbhq.net/engineering/sff-workshop/internal/webhook"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errQueueFull    = errors.New("too many pending requests, try again later")
+	errShuttingDown = errors.New("server is shutting down, try again later")
+)
+
+// processorStats are the counters behind the stats endpoint. Durations are
+// accumulated in nanoseconds.
+type processorStats struct {
+	dequeued       atomic.Int64
+	processed      atomic.Int64
+	rejected       atomic.Int64
+	inFlight       atomic.Int64
+	totalWait      atomic.Int64
+	totalProcessed atomic.Int64
+}
+
+type statsResponse struct {
+	QueueDepth      int     `json:"queueDepth"`
+	QueueCapacity   int     `json:"queueCapacity"`
+	Workers         int     `json:"workers"`
+	InFlight        int64   `json:"inFlight"`
+	Processed       int64   `json:"processed"`
+	Rejected        int64   `json:"rejected"`
+	AvgWaitMs       float64 `json:"avgWaitMs"`
+	AvgProcessingMs float64 `json:"avgProcessingMs"`
+}
+
+// enqueue hands the request to the workers without waiting for room in the queue
+func (s *Server) enqueue(req *getTokenRequest) error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		req.cancel()
+		s.requests.set(req.requestID, statusFailed, "", errShuttingDown)
+		return errShuttingDown
+	}
+
+	s.requests.set(req.requestID, statusQueued, "", nil)
+	s.addPending(req)
+	select {
+	case s.queue <- req:
+		return nil
+	default:
+		s.takePending(req.requestID)
+		req.cancel()
+		s.stats.rejected.Add(1)
+		s.requests.set(req.requestID, statusFailed, "", errQueueFull)
+		return errQueueFull
+	}
+}
+
+// startTransactionProcessor starts the workers taking requests off the queue
+func (s *Server) startTransactionProcessor(queue chan *getTokenRequest) {
+	for i := 0; i < s.cfg.Workers; i++ {
+		s.workers.Add(1)
+		go s.processRequests(queue)
+	}
+}
+
+// processRequests runs until the queue is closed and drained, or until the
+// server stops taking requests off the queue on shutdown
+func (s *Server) processRequests(queue chan *getTokenRequest) {
+	defer s.workers.Done()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		default:
+		}
+
+		var req *getTokenRequest
+		select {
+		case <-s.stopping:
+			return
+		case next, ok := <-queue:
+			if !ok {
+				return
+			}
+			req = next
+		}
+		if !s.takePending(req.requestID) {
+			// Cancelled by an admin, who answered the client
+			continue
+		}
+
+		dequeuedAt := time.Now()
+		wait := dequeuedAt.Sub(req.enqueuedAt)
+		metrics.QueueWait.Observe(wait.Seconds())
+		// The request is processed in a trace of its own, linked to the
+		// HTTP request, as it may outlive it
+		ctx, span := tracing.StartLinked(
+			req.ctx,
+			"ProcessRequest",
+			req.spanContext,
+			trace.WithTimestamp(req.enqueuedAt),
+			trace.WithAttributes(attribute.String("request.id", req.requestID)),
+		)
+		tracing.Record(ctx, "QueueWait", req.enqueuedAt, dequeuedAt)
+		s.stats.dequeued.Add(1)
+		s.stats.totalWait.Add(int64(wait))
+		logger := logging.FromContext(req.ctx)
+		logger.Info("Received request from queue", "wait", wait.String(), "queue_depth", len(queue))
+		if req.ctx.Err() != nil {
+			logger.Info("Skipping request, client went away")
+			metrics.Skipped.WithLabelValues(metrics.TokenLabel(req.id)).Inc()
+			span.AddEvent("skipped")
+			tracing.End(span, nil)
+			s.requests.set(req.requestID, statusSkipped, "", req.ctx.Err())
+			req.cancel()
+			continue
+		}
+
+		s.stats.inFlight.Add(1)
+		metrics.InFlight.Inc()
+		s.requests.set(req.requestID, statusProcessing, "", nil)
+		start := time.Now()
+		ctx = handler.OnSigned(ctx, func(txHash string) {
+			s.requests.set(req.requestID, statusSigned, txHash, nil)
+		})
+		txHash, err := s.transactionHandler.ERC1155Transfer(ctx, req.chain, req.to, req.id, req.quantity)
+		tracing.End(span, err)
+		elapsed := time.Since(start)
+		s.stats.inFlight.Add(-1)
+		metrics.InFlight.Dec()
+		s.stats.processed.Add(1)
+		s.stats.totalProcessed.Add(int64(elapsed))
+		if err != nil {
+			logger.Warn("Request failed", "duration", elapsed.String(), "error", err)
+			s.requests.set(req.requestID, statusFailed, "", err)
+		} else {
+			logger.Info("Request processed", "duration", elapsed.String(), "tx_hash", txHash)
+			s.requests.set(req.requestID, statusSubmitted, txHash, nil)
+		}
+		event := s.transferEvent(req)
+		s.notifier.finished(event, txHash, err)
+		if err == nil {
+			s.trackRequest(req.requestID, event, txHash)
+		}
+		req.cancel()
+		req.resChannel <- &getTokenResponse{
+			res: txHash,
+			err: err,
+		}
+	}
+}
+
+// transferEvent is the webhook event of a request, to which the lifecycle
+// details are added
+func (s *Server) transferEvent(req *getTokenRequest) webhook.Event {
+	event := webhook.Event{
+		RequestID: req.requestID,
+		Chain:     req.chain,
+		To:        req.to,
+		TokenID:   req.id,
+		Quantity:  req.quantity,
+	}
+	// The default chain is named so the transaction can be watched
+	if chain, err := s.transactionHandler.Chain(req.chain); err == nil {
+		event.Chain = chain.Name()
+	}
+	return event
+}
+
+// trackRequest follows the transaction of a submitted request, recording its
+// progress for the status endpoints and notifying the webhooks once it is final
+func (s *Server) trackRequest(requestID string, event webhook.Event, txHash string) {
+	chain, err := s.transactionHandler.Chain(event.Chain)
+	if err != nil {
+		return
+	}
+	s.tracker.track(chain, txHash, time.Now(), func(update txUpdate) {
+		s.requests.setMined(requestID, update)
+		s.notifier.mined(event, txHash, update)
+	})
+}
+
+func (s *Server) addPending(req *getTokenRequest) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.pending[req.requestID] = req
+}
+
+// takePending removes a request from the pending requests, and reports
+// whether it was still there, that is whether the caller now owns it
+func (s *Server) takePending(requestID string) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	_, ok := s.pending[requestID]
+	delete(s.pending, requestID)
+	return ok
+}
+
+// GetStats reports the queue depth and the average wait and processing time
+func (s *Server) GetStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.currentStats())
+}
+
+func (s *Server) currentStats() statsResponse {
+	res := statsResponse{
+		QueueDepth:    len(s.queue),
+		QueueCapacity: cap(s.queue),
+		Workers:       s.cfg.Workers,
+		InFlight:      s.stats.inFlight.Load(),
+		Processed:     s.stats.processed.Load(),
+		Rejected:      s.stats.rejected.Load(),
+	}
+	if dequeued := s.stats.dequeued.Load(); dequeued > 0 {
+		res.AvgWaitMs = msPerRequest(s.stats.totalWait.Load(), dequeued)
+	}
+	if res.Processed > 0 {
+		res.AvgProcessingMs = msPerRequest(s.stats.totalProcessed.Load(), res.Processed)
+	}
+	return res
+}
+
+func msPerRequest(total int64, count int64) float64 {
+	return float64(total) / float64(count) / float64(time.Millisecond)
+}
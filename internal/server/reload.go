@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+)
+
+// configWatcher reloads the config on SIGHUP and when its files or the
+// screening files change, and applies the limits whose configured values
+// changed and the screening files. The other settings only apply after a
+// restart.
+type configWatcher struct {
+	src     config.Sources
+	handler *handler.TransactionHandler
+
+	// mu serializes reloads
+	mu sync.Mutex
+	// settings of the config in force, to log what a reload changes
+	settings []config.Setting
+	stamps   map[string]fileStamp
+	// configured limits of the config in force, by chain
+	limits map[string]map[int64]handler.Limits
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// reloadedSettings are applied by a reload, the others need a restart
+var reloadedSettings = map[string]bool{
+	"MAX_GOLD_BADGE_TOTAL_QUANTITY":    true,
+	"MAX_GOLD_BADGE_TRANSFER_QUANTITY": true,
+	"MAX_POINT_TOTAL_QUANTITY":         true,
+	"MAX_POINT_TRANSFER_QUANTITY":      true,
+	"BLOCKLIST_FILES":                  true,
+}
+
+// reloadedChainSettings are the settings of every chain applied by a
+// reload, without the prefix of the chain
+var reloadedChainSettings = []string{"ALLOWLIST_FILES", "ALLOWLIST_MERKLE_ROOT"}
+
+func reloaded(key string) bool {
+	if reloadedSettings[key] {
+		return true
+	}
+	for _, suffix := range reloadedChainSettings {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileStamp tells when a file changed
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func startConfigWatcher(src config.Sources, cfg *config.Config, transactionHandler *handler.TransactionHandler) *configWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &configWatcher{
+		src:      src,
+		handler:  transactionHandler,
+		settings: cfg.Settings(),
+		stamps:   stampFiles(watchedFiles(cfg)),
+		limits:   configuredLimits(transactionHandler, cfg),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go w.run(ctx, cfg.ConfigReloadInterval)
+	return w
+}
+
+func (w *configWatcher) run(ctx context.Context, interval time.Duration) {
+	defer close(w.done)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			w.reload("SIGHUP")
+		case <-poll:
+			if w.filesChanged() {
+				w.reload("file change")
+			}
+		}
+	}
+}
+
+func (w *configWatcher) filesChanged() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path, stamp := range w.stamps {
+		if stampFile(path) != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads and validates the config, then swaps in the screeners and
+// the limits of every chain. An invalid config, or screening files that
+// cannot be read, are rejected and the screeners and limits in force kept.
+func (w *configWatcher) reload(trigger string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	logger := slog.With("trigger", trigger)
+
+	cfg, err := config.Load(w.src)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil {
+		err = w.apply(logger, cfg)
+	}
+	if err != nil {
+		logger.Error("Config reload rejected, keeping the config in force", "error", err)
+		// Not retried until the files change again
+		for path := range w.stamps {
+			w.stamps[path] = stampFile(path)
+		}
+		return
+	}
+
+	for _, change := range diffSettings(w.settings, cfg.Settings()) {
+		if !reloaded(change.key) {
+			logger.Warn("Setting changed, restart to apply", "key", change.key, "old", change.old, "new", change.new)
+		}
+	}
+	w.settings = cfg.Settings()
+	w.stamps = stampFiles(watchedFiles(cfg))
+	logger.Info("Config reloaded")
+}
+
+// apply swaps in the screeners, read first as their files may be invalid,
+// then the limits
+func (w *configWatcher) apply(logger *slog.Logger, cfg *config.Config) error {
+	err := w.handler.ReloadScreeners(cfg)
+	if err != nil {
+		return err
+	}
+	return w.applyLimits(logger, cfg)
+}
+
+// watchedFiles are the files of the config and the screening files it lists
+func watchedFiles(cfg *config.Config) []string {
+	files := append([]string{}, cfg.Files()...)
+	files = append(files, cfg.BlocklistFiles...)
+	for _, chainCfg := range cfg.Chains {
+		files = append(files, chainCfg.AllowlistFiles...)
+	}
+	return files
+}
+
+// configuredLimits returns the limits set by the config, by chain
+func configuredLimits(transactionHandler *handler.TransactionHandler, cfg *config.Config) map[string]map[int64]handler.Limits {
+	limits := make(map[string]map[int64]handler.Limits)
+	for _, chain := range transactionHandler.Chains() {
+		limits[chain.Name()] = chain.Validator().ConfiguredLimits(cfg)
+	}
+	return limits
+}
+
+// applyLimits swaps in the configured limits of every chain, logging those
+// that changed. Limits set through the admin API stay in force, unless the
+// configured limits of the token changed since: the config, edited last,
+// then wins.
+func (w *configWatcher) applyLimits(logger *slog.Logger, cfg *config.Config) error {
+	newLimits := configuredLimits(w.handler, cfg)
+	chains := w.handler.Chains()
+	for _, chain := range chains {
+		err := chain.Validator().ReplaceLimits(newLimits[chain.Name()])
+		if err != nil {
+			return fmt.Errorf("chain %s: %v", chain.Name(), err)
+		}
+	}
+
+	controls := w.handler.Controls()
+	state, err := controls.State()
+	if err != nil {
+		// The limits are swapped in already
+		logger.Error("Error reading the limits set through the admin API", "error", err)
+	}
+	for _, chain := range chains {
+		oldLimits := w.limits[chain.Name()]
+		ids := make([]int64, 0, len(newLimits[chain.Name()]))
+		for id := range newLimits[chain.Name()] {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		for _, id := range ids {
+			old, new := oldLimits[id], newLimits[chain.Name()][id]
+			if old == new {
+				continue
+			}
+			logger.Info(
+				"Limits changed",
+				"chain", chain.Name(),
+				"token_id", id,
+				"transfer", fmt.Sprintf("%d -> %d", old.Transfer, new.Transfer),
+				"ownership", fmt.Sprintf("%d -> %d", old.Ownership, new.Ownership),
+			)
+			if _, ok := state.LimitOverrides[chain.Name()][id]; !ok {
+				continue
+			}
+			err := controls.ClearLimits(chain.Name(), id)
+			if err != nil {
+				logger.Error("Error clearing limits set through the admin API", "chain", chain.Name(), "token_id", id, "error", err)
+				continue
+			}
+			logger.Warn("Limits set through the admin API replaced by the config", "chain", chain.Name(), "token_id", id)
+		}
+	}
+	w.limits = newLimits
+	return nil
+}
+
+type settingChange struct {
+	key string
+	old string
+	new string
+}
+
+// diffSettings lists the settings whose value changed, appeared or
+// disappeared, by key
+func diffSettings(old []config.Setting, new []config.Setting) []settingChange {
+	oldValues := make(map[string]string, len(old))
+	for _, setting := range old {
+		oldValues[setting.Key] = setting.Value
+	}
+	var changes []settingChange
+	for _, setting := range new {
+		if oldVal, ok := oldValues[setting.Key]; !ok || oldVal != setting.Value {
+			changes = append(changes, settingChange{key: setting.Key, old: oldVal, new: setting.Value})
+		}
+		delete(oldValues, setting.Key)
+	}
+	for key, oldVal := range oldValues {
+		changes = append(changes, settingChange{key: key, old: oldVal})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].key < changes[j].key })
+	return changes
+}
+
+func stampFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		stamps[path] = stampFile(path)
+	}
+	return stamps
+}
+
+// stampFile returns the zero stamp when the file cannot be read, which
+// differs from the stamp of a readable file
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// Stop stops watching the config
+func (w *configWatcher) Stop() {
+	if w == nil {
+		return
+	}
+	w.cancel()
+	<-w.done
+}
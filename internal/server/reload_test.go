@@ -0,0 +1,141 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/server"
+	"github.cbhq.net/engineering/sff-workshop/internal/simulated"
+)
+
+func limitsInForce(t *testing.T, h *simulated.Harness, id int64) handler.Limits {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, h.HTTP.URL+"/api/admin/controls", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var controls struct {
+		Limits map[string]map[int64]handler.Limits `json:"limits"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&controls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return controls.Limits[simulated.ChainName][id]
+}
+
+func TestReloadKeepsAdminLimitsUnlessConfigured(t *testing.T) {
+	h := newHarness(t)
+	h.Config.AdminToken = adminToken
+	reloader := server.NewConfigReloader(h.Server, h.Config)
+	code, body := postAdmin(t, h, "/api/admin/limits?id=2&transfer=1")
+	if code != http.StatusOK {
+		t.Fatalf("set limits = %d %q", code, body)
+	}
+	override := handler.Limits{Transfer: 1, Ownership: testLimits.MaxGoldBadgeTotalQty}
+
+	// Only the limits of the points changed in the file
+	cfg := *h.Config
+	cfg.MaxPointTransferQty++
+	err := reloader.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := limitsInForce(t, h, goldBadgeID); got != override {
+		t.Errorf("gold badge limits = %+v after an unrelated reload, want the admin ones %+v", got, override)
+	}
+	if got := limitsInForce(t, h, pointID); got.Transfer != cfg.MaxPointTransferQty {
+		t.Errorf("point limits = %+v, want the transfer limit reloaded to %d", got, cfg.MaxPointTransferQty)
+	}
+	// Reloading the same config changes nothing
+	err = reloader.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := limitsInForce(t, h, goldBadgeID); got != override {
+		t.Errorf("gold badge limits = %+v after a second reload, want the admin ones %+v", got, override)
+	}
+
+	// The configured limits of the gold badge changed after the admin ones
+	cfg.MaxGoldBadgeTransferQty++
+	err = reloader.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured := handler.Limits{Transfer: cfg.MaxGoldBadgeTransferQty, Ownership: cfg.MaxGoldBadgeTotalQty}
+	if got := limitsInForce(t, h, goldBadgeID); got != configured {
+		t.Errorf("gold badge limits = %+v, want the reloaded ones %+v", got, configured)
+	}
+
+	code, body = postAdmin(t, h, "/api/admin/limits?id=2&ownership=1")
+	if code != http.StatusOK {
+		t.Fatalf("set limits = %d %q", code, body)
+	}
+	code, body = postAdmin(t, h, "/api/admin/limits?id=2&clear=true")
+	if code != http.StatusOK {
+		t.Fatalf("clear limits = %d %q", code, body)
+	}
+	if got := limitsInForce(t, h, goldBadgeID); got != configured {
+		t.Errorf("gold badge limits = %+v after clearing, want the configured ones %+v", got, configured)
+	}
+}
+
+func TestReloadReadsBlocklistFilesAgain(t *testing.T) {
+	h := newHarness(t)
+	to := newRecipient(t)
+	file := filepath.Join(t.TempDir(), "blocklist.csv")
+	writeBlocklist := func(addrs ...string) {
+		t.Helper()
+		err := os.WriteFile(file, []byte("address\n"+strings.Join(addrs, "\n")+"\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBlocklist(to.Hex())
+	reloader := server.NewConfigReloader(h.Server, h.Config)
+	cfg := *h.Config
+	cfg.BlocklistFiles = []string{file}
+	err := reloader.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusForbidden {
+		t.Errorf("GetToken = %d %q, want 403 for an address of the blocklist file", code, body)
+	}
+
+	writeBlocklist()
+	if !reloader.FilesChanged() {
+		t.Fatal("change of the blocklist file not seen")
+	}
+	err = reloader.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Errorf("GetToken = %d %q after the address was removed from the file", code, body)
+	}
+
+	// A file that cannot be read is rejected, keeping the screeners
+	writeBlocklist(to.Hex())
+	cfg.BlocklistFiles = []string{file, filepath.Join(t.TempDir(), "missing.csv")}
+	if err = reloader.Reload(&cfg); err == nil {
+		t.Error("reload with a missing blocklist file accepted")
+	}
+	code, body = getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Errorf("GetToken = %d %q, want the screeners in force kept", code, body)
+	}
+}
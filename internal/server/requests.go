@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// How long the outcome of a request stays available to the status endpoint
+const requestRetention = time.Hour
+
+const (
+	statusQueued     = "queued"
+	statusProcessing = "processing"
+	statusSigned     = "signed"
+	statusSubmitted  = "submitted"
+	statusMined      = "mined"
+	statusConfirmed  = "confirmed"
+	statusReverted   = "reverted"
+	statusReplaced   = "replaced"
+	statusFailed     = "failed"
+	statusSkipped    = "skipped"
+	statusCancelled  = "cancelled"
+	// The transaction was not final after CONFIRM_TIMEOUT
+	statusTimeout = "timeout"
+	// The transaction is no longer tracked, or the request was forgotten
+	statusUnknown = "unknown"
+)
+
+// Updates buffered for each subscriber, past which a slow subscriber misses
+// the oldest updates, though never the final status
+const subscriberBuffer = 32
+
+// finalStatus reports whether a request in the status changes no more
+func finalStatus(status string) bool {
+	switch status {
+	case statusConfirmed, statusReverted, statusReplaced, statusFailed, statusSkipped, statusCancelled,
+		statusTimeout, statusUnknown:
+		return true
+	}
+	return false
+}
+
+type requestStatus struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	TxHash    string `json:"txHash,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Block the transaction was mined in and the blocks since, itself included
+	BlockNumber   uint64    `json:"blockNumber,omitempty"`
+	Confirmations uint64    `json:"confirmations,omitempty"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	// Name and image of the token, when metadata is enabled
+	Token *tokenSummary `json:"token,omitempty"`
+}
+
+// requestStore keeps the status of recent requests so clients that got a
+// request id instead of a transaction hash can look up the outcome, or
+// subscribe to its updates
+type requestStore struct {
+	mu       sync.Mutex
+	requests map[string]*requestStatus
+	// byTx maps the transaction hashes to their request
+	byTx        map[string]string
+	subscribers map[string]map[chan requestStatus]struct{}
+}
+
+func newRequestStore() *requestStore {
+	return &requestStore{
+		requests:    make(map[string]*requestStatus),
+		byTx:        make(map[string]string),
+		subscribers: make(map[string]map[chan requestStatus]struct{}),
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestContext returns the context of a request, whose logger adds the
+// request fields to every line logged while processing it
+func requestContext(requestID string, to string, id int64, quantity int64, proof []common.Hash) context.Context {
+	ctx := logging.WithAttrs(
+		context.Background(),
+		"request_id", requestID,
+		"to", to,
+		"id", id,
+		"quantity", quantity,
+	)
+	return handler.WithAllowlistProof(ctx, proof)
+}
+
+func (s *requestStore) set(requestID string, status string, txHash string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	prev, ok := s.requests[requestID]
+	if !ok {
+		s.prune(now)
+	}
+	req := &requestStatus{
+		RequestID: requestID,
+		Status:    status,
+		TxHash:    txHash,
+		UpdatedAt: now,
+	}
+	if err != nil {
+		req.Error = err.Error()
+	}
+	if prev != nil {
+		req.Token = prev.Token
+	}
+	s.store(req)
+}
+
+// setMined records the progress of the transaction of a submitted request
+func (s *requestStore) setMined(requestID string, update txUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.requests[requestID]
+	if !ok {
+		return
+	}
+	if finalStatus(prev.Status) {
+		return
+	}
+	req := *prev
+	req.Status = update.Status
+	req.UpdatedAt = time.Now()
+	switch update.Status {
+	case statusTimeout:
+		// The block of a transaction mined without enough confirmations is kept
+		req.Error = "transaction not final after CONFIRM_TIMEOUT"
+	case statusUnknown:
+		req.Error = "transaction no longer tracked"
+	default:
+		req.BlockNumber = update.BlockNumber
+		req.Confirmations = update.Confirmations
+	}
+	if update.Status == statusReverted {
+		req.Error = "transaction reverted"
+	}
+	s.store(&req)
+}
+
+// store saves the status and sends it to the subscribers of the request. A
+// final status is the last one sent: the subscriptions are then closed.
+func (s *requestStore) store(req *requestStatus) {
+	s.requests[req.RequestID] = req
+	if req.TxHash != "" {
+		s.byTx[strings.ToLower(req.TxHash)] = req.RequestID
+	}
+	final := finalStatus(req.Status)
+	for ch := range s.subscribers[req.RequestID] {
+		select {
+		case ch <- *req:
+		default:
+			if !final {
+				continue
+			}
+			// Make room for the final status by dropping the oldest
+			// update. The store is the only sender, so the send succeeds.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- *req
+		}
+	}
+	if final {
+		s.closeSubscribers(req.RequestID)
+	}
+}
+
+// closeSubscribers ends the subscriptions to the request
+func (s *requestStore) closeSubscribers(requestID string) {
+	for ch := range s.subscribers[requestID] {
+		close(ch)
+	}
+	delete(s.subscribers, requestID)
+}
+
+// subscribe returns the status of a known request and a channel receiving
+// its next statuses until unsubscribe is called. The channel is closed after
+// the final status, or when the request is forgotten before.
+func (s *requestStore) subscribe(requestID string) (requestStatus, <-chan requestStatus, func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.requests[requestID]
+	if !ok {
+		return requestStatus{}, nil, nil, false
+	}
+	ch := make(chan requestStatus, subscriberBuffer)
+	if finalStatus(req.Status) {
+		close(ch)
+		return *req, ch, func() {}, true
+	}
+	if s.subscribers[requestID] == nil {
+		s.subscribers[requestID] = make(map[chan requestStatus]struct{})
+	}
+	s.subscribers[requestID][ch] = struct{}{}
+	unsubscribe := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers[requestID], ch)
+		if len(s.subscribers[requestID]) == 0 {
+			delete(s.subscribers, requestID)
+		}
+	}
+	return *req, ch, unsubscribe, true
+}
+
+// requestByTx returns the id of the request that sent a transaction
+func (s *requestStore) requestByTx(txHash string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requestID, ok := s.byTx[strings.ToLower(txHash)]
+	return requestID, ok
+}
+
+// setToken adds the token summary to a known request
+func (s *requestStore) setToken(requestID string, token *tokenSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req, ok := s.requests[requestID]; ok {
+		req.Token = token
+	}
+}
+
+func (s *requestStore) get(requestID string) (requestStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.requests[requestID]
+	if !ok {
+		return requestStatus{}, false
+	}
+	return *req, true
+}
+
+func (s *requestStore) prune(now time.Time) {
+	for id, req := range s.requests {
+		if now.Sub(req.UpdatedAt) > requestRetention {
+			delete(s.requests, id)
+			delete(s.byTx, strings.ToLower(req.TxHash))
+			s.closeSubscribers(id)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveAll reads the statuses sent until the channel is closed
+func receiveAll(t *testing.T, updates <-chan requestStatus) []requestStatus {
+	t.Helper()
+	var statuses []requestStatus
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case status, ok := <-updates:
+			if !ok {
+				return statuses
+			}
+			statuses = append(statuses, status)
+		case <-timeout:
+			t.Fatalf("subscription not closed after %d statuses", len(statuses))
+		}
+	}
+}
+
+func TestRequestStoreNeverDropsFinalStatus(t *testing.T) {
+	store := newRequestStore()
+	store.set("r1", statusSubmitted, "0x01", nil)
+	_, updates, unsubscribe, ok := store.subscribe("r1")
+	if !ok {
+		t.Fatal("request not found")
+	}
+	defer unsubscribe()
+
+	// The subscriber is not reading meanwhile
+	for i := uint64(1); i <= 2*subscriberBuffer; i++ {
+		store.setMined("r1", txUpdate{Status: statusMined, BlockNumber: 10, Confirmations: i})
+	}
+	store.setMined("r1", txUpdate{Status: statusConfirmed, BlockNumber: 10, Confirmations: 100})
+
+	statuses := receiveAll(t, updates)
+	if len(statuses) != subscriberBuffer {
+		t.Errorf("received %d statuses, want a full buffer of %d", len(statuses), subscriberBuffer)
+	}
+	if last := statuses[len(statuses)-1]; last.Status != statusConfirmed {
+		t.Errorf("last status = %s, want %s", last.Status, statusConfirmed)
+	}
+}
+
+func TestRequestStoreClosesSubscriptionsOfForgottenRequests(t *testing.T) {
+	store := newRequestStore()
+	store.set("r1", statusSubmitted, "0x01", nil)
+	_, updates, unsubscribe, _ := store.subscribe("r1")
+	defer unsubscribe()
+
+	store.mu.Lock()
+	store.prune(time.Now().Add(2 * requestRetention))
+	store.mu.Unlock()
+	if statuses := receiveAll(t, updates); len(statuses) != 0 {
+		t.Errorf("received %v, want the subscription closed", statuses)
+	}
+}
+
+// readEvents returns the names of the events of a status stream until it ends
+func readEvents(t *testing.T, url string, afterFirst func()) []string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var events []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, name)
+			if len(events) == 1 {
+				afterFirst()
+			}
+		}
+	}
+	return events
+}
+
+func TestGetTokenEventsEndWhenTrackingStops(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(store *requestStore)
+		want string
+	}{
+		{
+			name: "timeout",
+			stop: func(store *requestStore) {
+				store.setMined("r1", txUpdate{Status: statusTimeout})
+			},
+			want: statusTimeout,
+		},
+		{
+			name: "tracker closed",
+			stop: func(store *requestStore) {
+				store.setMined("r1", txUpdate{Status: statusUnknown})
+			},
+			want: statusUnknown,
+		},
+		{
+			name: "request forgotten",
+			stop: func(store *requestStore) {
+				store.mu.Lock()
+				defer store.mu.Unlock()
+				store.prune(time.Now().Add(2 * requestRetention))
+			},
+			want: statusUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{requests: newRequestStore(), streamsDone: make(chan struct{})}
+			srv := httptest.NewServer(http.HandlerFunc(s.GetTokenEvents))
+			defer srv.Close()
+			s.requests.set("r1", statusSubmitted, "0x01", nil)
+
+			done := make(chan []string)
+			go func() {
+				done <- readEvents(t, srv.URL+"?id=r1", func() { tt.stop(s.requests) })
+			}()
+			select {
+			case events := <-done:
+				if len(events) != 2 || events[0] != statusSubmitted || events[1] != tt.want {
+					t.Errorf("events = %v, want %s then %s", events, statusSubmitted, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("status stream did not end")
+			}
+		})
+	}
+}
@@ -2,77 +2,402 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.cbhq.net/engineering/sff-workshop/internal/audit"
 	"github.cbhq.net/engineering/sff-workshop/internal/client"
 	"github.cbhq.net/engineering/sff-workshop/internal/config"
 	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/indexer"
+	"github.cbhq.net/engineering/sff-workshop/internal/ipfs"
+	"github.cbhq.net/engineering/sff-workshop/internal/jobs"
 	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+	"github.cbhq.net/engineering/sff-workshop/internal/metadata"
+	"github.cbhq.net/engineering/sff-workshop/internal/metrics"
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type getTokenRequest struct {
+	// ctx is cancelled when the client goes away before getting an answer
 	ctx        context.Context
+	cancel     context.CancelFunc
+	requestID  string
+	chain      string
 	to         string
 	id         int64
 	quantity   int64
+	proof      []common.Hash
 	resChannel chan *getTokenResponse
+	enqueuedAt time.Time
+	// span of the HTTP request, linked to by the span processing the request
+	spanContext trace.SpanContext
 }
 
 type getTokenResponse struct {
 	res string
 	err error
+	// accepted is set when the request was saved on shutdown to be processed
+	// by the next server instance
+	accepted bool
 }
 
 type Server struct {
+	cfg                *config.Config
 	transactionHandler *handler.TransactionHandler
-	inputValidator     *handler.InputValidator
 	queue              chan *getTokenRequest
+	requests           *requestStore
+	stats              *processorStats
+	balances           *balanceCache
+	health             *chainHealth
+	metrics            *prometheus.Registry
+	audit              *audit.Log
+	notifier           *transferNotifier
+	tracker            *txTracker
+	// reloads the limits, when started by NewServer
+	watcher *configWatcher
+	// closed when the server stops, to end the status streams
+	streamsDone chan struct{}
+	stopStreams sync.Once
+	// jobs is the durable queue used instead of queue in async mode
+	jobs jobs.Queue
+	// indexers of the transfer events of each chain, when enabled
+	indexers map[string]*indexer.Indexer
+	// metadata resolvers of each chain, when enabled
+	metadata map[string]*metadata.Resolver
+	// content of the local CAR archives, when enabled
+	ipfs         *ipfs.Store
+	stopIndexers context.CancelFunc
+	background   sync.WaitGroup
+
+	// closeMu guards queue against sends after Close closed it
+	closeMu  sync.RWMutex
+	closed   bool
+	stopping chan struct{}
+	workers  sync.WaitGroup
+
+	// pending holds the queued requests by id so they can be cancelled
+	pendingMu sync.Mutex
+	pending   map[string]*getTokenRequest
 }
 
-func NewServer(port *int) (*Server, error) {
+func NewServer(src config.Sources) (*Server, error) {
 	ctx := context.Background()
-	cfg, err := config.NewConfig(port)
+	cfg, err := loadConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	err = setupLogging(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = tracing.Setup(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	evmClient, err := client.NewEVMClient(ctx, cfg)
+	chains, err := connectChains(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	signer, err := keystore.NewSigner(cfg)
+	s, err := NewServerWithChains(ctx, cfg, chains)
 	if err != nil {
 		return nil, err
 	}
+	s.watcher = startConfigWatcher(src, cfg, s.transactionHandler)
+	return s, nil
+}
 
-	inputValidator, err := handler.NewInputValidator(ctx, evmClient, cfg)
+// NewJobWorker creates the worker processing the jobs queued in JOB_QUEUE_DIR
+func NewJobWorker(src config.Sources) (*jobs.Worker, error) {
+	ctx := context.Background()
+	cfg, err := loadConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	err = setupLogging(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = tracing.Setup(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.JobQueueDir == "" {
+		return nil, fmt.Errorf("JOB_QUEUE_DIR is not set")
+	}
 
-	transactionHandler, err := handler.NewTransactionHandler(ctx, evmClient, cfg, signer, inputValidator)
+	chains, err := connectChains(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	worker, transferer, err := newJobWorker(ctx, cfg, chains)
 	if err != nil {
 		return nil, err
 	}
+	transferer.watcher = startConfigWatcher(src, cfg, transferer.TransactionHandler)
+	return worker, nil
+}
+
+// NewJobWorkerWithChains creates the worker processing the jobs queued in
+// JOB_QUEUE_DIR on already connected chains
+func NewJobWorkerWithChains(
+	ctx context.Context,
+	cfg *config.Config,
+	chains map[string]*handler.Chain,
+) (*jobs.Worker, error) {
+	worker, _, err := newJobWorker(ctx, cfg, chains)
+	return worker, err
+}
 
-	queue := make(chan *getTokenRequest, 500)
+func newJobWorker(
+	ctx context.Context,
+	cfg *config.Config,
+	chains map[string]*handler.Chain,
+) (*jobs.Worker, *workerTransferer, error) {
+	queue, err := jobs.NewFileQueue(cfg.JobQueueDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	transactionHandler, err := handler.NewTransactionHandler(ctx, cfg, chains)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notifier, err := newTransferNotifier(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chainNames := make([]string, 0, len(chains))
+	for name := range chains {
+		chainNames = append(chainNames, name)
+	}
+	transferer := &workerTransferer{TransactionHandler: transactionHandler}
+	worker := jobs.NewWorker(queue, transferer, chainNames, cfg.JobPollInterval)
+	// The worker only tracks its transactions to notify the webhooks
+	if notifier != nil {
+		worker.SetObserver(newJobObserver(transactionHandler, notifier, newTxTracker(cfg), cfg.JobQueueDir))
+	}
+	return worker, transferer, nil
+}
+
+// workerTransferer stops reloading the config when the worker closes
+type workerTransferer struct {
+	*handler.TransactionHandler
+	watcher *configWatcher
+}
+
+// ERC1155Transfer sends the transfer of a job with its allowlist proof
+func (t *workerTransferer) ERC1155Transfer(ctx context.Context, chain string, to string, id int64, quantity int64) (string, error) {
+	if job, ok := jobs.JobFromContext(ctx); ok {
+		proof, err := handler.ParseProof(strings.Join(job.Proof, ","))
+		if err != nil {
+			return "", err
+		}
+		ctx = handler.WithAllowlistProof(ctx, proof)
+	}
+	return t.TransactionHandler.ERC1155Transfer(ctx, chain, to, id, quantity)
+}
+
+func (t *workerTransferer) Close() {
+	t.watcher.Stop()
+	t.TransactionHandler.Close()
+}
+
+// loadConfig reads the config and refuses to start with invalid settings
+func loadConfig(src config.Sources) (*config.Config, error) {
+	cfg, err := config.Load(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config:\n%v", err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config:\n%v", err)
+	}
+	return cfg, nil
+}
+
+// setupLogging configures the logger and keeps the credentials of the
+// config out of the logs
+func setupLogging(cfg *config.Config) error {
+	logging.RegisterSecrets(cfg.Password, cfg.Mnemonic, cfg.AdminToken, cfg.WebhookSecret)
+	for _, chainCfg := range cfg.Chains {
+		logging.RegisterSecrets(chainCfg.Password, chainCfg.Mnemonic)
+	}
+	return logging.Setup(cfg.LogLevel, cfg.LogFormat)
+}
+
+func connectChains(ctx context.Context, cfg *config.Config) (map[string]*handler.Chain, error) {
+	chains := make(map[string]*handler.Chain)
+	for name, chainCfg := range cfg.Chains {
+		evmClient, err := client.NewEVMClient(ctx, chainCfg)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := NewChain(ctx, cfg, chainCfg, evmClient)
+		if err != nil {
+			return nil, err
+		}
+		chains[name] = chain
+	}
+	return chains, nil
+}
+
+// NewServerWithChains creates a server sending transfers on already
+// connected chains
+func NewServerWithChains(
+	ctx context.Context,
+	cfg *config.Config,
+	chains map[string]*handler.Chain,
+) (*Server, error) {
+	transactionHandler, err := handler.NewTransactionHandler(ctx, cfg, chains)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := make(chan *getTokenRequest, cfg.QueueSize)
 	s := &Server{
+		cfg:                cfg,
 		transactionHandler: transactionHandler,
-		inputValidator:     inputValidator,
 		queue:              queue,
+		requests:           newRequestStore(),
+		stats:              &processorStats{},
+		balances:           newBalanceCache(),
+		health:             &chainHealth{},
+		audit:              audit.NewLog(cfg.AuditLogFile),
+		stopping:           make(chan struct{}),
+		pending:            make(map[string]*getTokenRequest),
+		tracker:            newTxTracker(cfg),
+		streamsDone:        make(chan struct{}),
+	}
+	s.metrics = s.newMetricsRegistry(chains)
+	s.notifier, err = newTransferNotifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CARDir != "" {
+		s.ipfs, err = ipfs.OpenStore(cfg.CARDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MetadataDir != "" || s.ipfs != nil || len(cfg.MetadataGateways) > 0 {
+		s.metadata, err = newMetadataResolvers(cfg.MetadataDir, s.ipfs, cfg.MetadataGateways, chains)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JobQueueDir != "" {
+		s.jobs, err = jobs.NewFileQueue(cfg.JobQueueDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.IndexerDir != "" {
+		err = s.startIndexers(chains)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.jobs == nil {
+		s.startTransactionProcessor(queue)
+		s.restorePendingRequests()
 	}
-	go s.startTransactionProcessor(queue)
 
 	return s, nil
 }
 
+// NewChain sets up the signer and input validator of a chain on top of its backend
+func NewChain(
+	ctx context.Context,
+	cfg *config.Config,
+	chainCfg *config.ChainConfig,
+	backend handler.ChainBackend,
+) (*handler.Chain, error) {
+	signer, err := keystore.NewSigner(chainCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	inputValidator, err := handler.NewInputValidator(ctx, backend, cfg, chainCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler.NewChain(ctx, chainCfg, backend, signer, inputValidator)
+}
+
+// Handler returns the routes served by the server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/gettoken", s.GetToken)
+	mux.HandleFunc("/api/gettoken/status", s.GetTokenStatus)
+	mux.HandleFunc("/api/gettoken/events", s.GetTokenEvents)
+	mux.HandleFunc("/api/stats", s.GetStats)
+	mux.HandleFunc("/api/jobs", s.GetJob)
+	mux.HandleFunc("/api/balances", s.GetBalances)
+	mux.HandleFunc("/api/tokens/", s.GetTokens)
+	mux.HandleFunc("/api/accounts/", s.GetAccount)
+	mux.HandleFunc("/ipfs/", s.GetIPFS)
+	mux.Handle("/metrics", s.metricsHandler())
+	mux.HandleFunc("/healthz", s.GetHealth)
+	mux.HandleFunc("/readyz", s.GetReady)
+	mux.HandleFunc("/api/admin/diagnostics", s.adminOnly(s.GetDiagnostics))
+	mux.HandleFunc("/api/admin/controls", s.adminOnly(s.GetControls))
+	mux.HandleFunc("/api/admin/audit", s.adminOnly(s.GetAudit))
+	mux.HandleFunc("/api/admin/pause", s.adminOnly(s.adminAction("pause", s.pause)))
+	mux.HandleFunc("/api/admin/resume", s.adminOnly(s.adminAction("resume", s.resume)))
+	mux.HandleFunc("/api/admin/limits", s.adminOnly(s.adminAction("set_limits", s.setLimits)))
+	mux.HandleFunc("/api/admin/blocklist", s.adminOnly(s.adminAction("blocklist", s.blocklist)))
+	mux.HandleFunc("/api/admin/allowlist", s.adminOnly(s.adminAction("allowlist", s.allowlist)))
+	mux.HandleFunc("/api/admin/requests/cancel", s.adminOnly(s.adminAction("cancel_request", s.cancelRequest)))
+	mux.HandleFunc("/api/admin/nonces/cancel", s.adminOnly(s.adminAction("cancel_nonce", s.cancelNonce)))
+	mux.HandleFunc("/api/admin/webhooks/dead-letters", s.adminOnly(s.GetWebhookDeadLetters))
+	mux.HandleFunc("/api/admin/webhooks/replay", s.adminOnly(s.adminAction("replay_webhooks", s.replayWebhooks)))
+	// Spans are named after the route rather than the path, which holds ids
+	return otelhttp.NewHandler(
+		mux,
+		"http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, pattern := mux.Handler(r)
+			return r.Method + " " + pattern
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/metrics", "/healthz", "/readyz":
+				return false
+			}
+			return true
+		}),
+	)
+}
+
 func (s *Server) GetToken(w http.ResponseWriter, r *http.Request) {
-	log.Println("Received GetToken request")
+	start := time.Now()
+	span := trace.SpanFromContext(r.Context())
+	tokenLabel, outcome := "other", metrics.OutcomeInvalid
+	defer func() {
+		span.SetAttributes(attribute.String("outcome", outcome))
+		metrics.Requests.WithLabelValues(tokenLabel, outcome).Inc()
+		metrics.RequestDuration.WithLabelValues(tokenLabel, outcome).Observe(time.Since(start).Seconds())
+	}()
 	query := r.URL.Query()
 
 	to := query.Get("to")
@@ -81,31 +406,164 @@ func (s *Server) GetToken(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err)
 		return
 	}
+	tokenLabel = metrics.TokenLabel(id)
 	quantity, err := getInt64(&query, "quantity")
 	if err != nil {
 		handleError(w, err)
 		return
 	}
+	err = s.transactionHandler.Controls().Check(id)
+	if handler.IsControlled(err) {
+		outcome = metrics.OutcomeRejected
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	proof, err := handler.ParseProof(query.Get("proof"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Refused recipients are not queued. They are screened again before
+	// the transfer, as the lists may change meanwhile.
+	chain, err := s.transactionHandler.Chain(query.Get("chain"))
+	if err == nil {
+		err = chain.Validator().Screen(handler.WithAllowlistProof(r.Context(), proof), to)
+	}
+	if errors.Is(err, handler.ErrScreened) {
+		outcome = metrics.OutcomeRejected
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	if s.jobs != nil {
+		outcome = metrics.OutcomeQueued
+		s.enqueueJob(r.Context(), w, query.Get("chain"), to, id, quantity, proof)
+		return
+	}
 
+	// The request gets its own context so it can outlive the HTTP request
+	// once the client has been given the request id
+	requestID := newRequestID()
+	w.Header().Set("X-Request-Id", requestID)
+	ctx, cancel := context.WithCancel(requestContext(requestID, to, id, quantity, proof))
+	logger := logging.FromContext(ctx)
+	span.SetAttributes(
+		attribute.String("request.id", requestID),
+		attribute.String("to", to),
+		attribute.Int64("token.id", id),
+		attribute.Int64("quantity", quantity),
+	)
+	logger.Info("Received GetToken request")
 	resChannel := make(chan *getTokenResponse, 1)
 	req := &getTokenRequest{
-		ctx:        r.Context(),
-		to:         to,
-		id:         id,
-		quantity:   quantity,
-		resChannel: resChannel,
-	}
-	s.queue <- req
-	result := <-resChannel
-	if result.err != nil {
-		handleError(w, result.err)
+		ctx:         ctx,
+		cancel:      cancel,
+		requestID:   requestID,
+		chain:       query.Get("chain"),
+		to:          to,
+		id:          id,
+		quantity:    quantity,
+		proof:       proof,
+		resChannel:  resChannel,
+		enqueuedAt:  time.Now(),
+		spanContext: span.SpanContext(),
+	}
+	err = s.enqueue(req)
+	if err != nil {
+		logger.Warn("Rejecting request", "error", err)
+		outcome = metrics.OutcomeRejected
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, writeErr := w.Write([]byte(err.Error()))
+		if writeErr != nil {
+			logger.Error("Error writing error response", "error", writeErr)
+		}
 		return
 	}
-	res := result.res
-	log.Println(res)
-	_, writeErr := w.Write([]byte(res))
-	if writeErr != nil {
-		log.Printf("Error writing response %v", writeErr)
+
+	s.notifier.queued(s.transferEvent(req))
+
+	s.resolveTokenSummary(requestID, req.chain, id)
+
+	timer := time.NewTimer(s.cfg.ResponseWait)
+	defer timer.Stop()
+	select {
+	case result := <-resChannel:
+		if result.accepted {
+			logger.Info("Request saved for the next server instance, answering with its id")
+			outcome = metrics.OutcomeAccepted
+			status, _ := s.requests.get(requestID)
+			writeJSON(w, http.StatusAccepted, status)
+			return
+		}
+		if errors.Is(result.err, errShuttingDown) {
+			outcome = metrics.OutcomeRejected
+			w.Header().Set("Retry-After", "5")
+			writeError(w, http.StatusServiceUnavailable, result.err)
+			return
+		}
+		if result.err != nil {
+			outcome = metrics.OutcomeFailed
+			if handler.IsRejected(result.err) {
+				outcome = metrics.OutcomeRejected
+			}
+			handleError(w, result.err)
+			return
+		}
+		outcome = metrics.OutcomeSubmitted
+		res := result.res
+		logger.Info("Answering with transaction hash", "tx_hash", res)
+		if wantsJSON(r) {
+			status, _ := s.requests.get(requestID)
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+		_, writeErr := w.Write([]byte(res))
+		if writeErr != nil {
+			logger.Error("Error writing response", "error", writeErr)
+		}
+	case <-r.Context().Done():
+		logger.Info("Client went away")
+		outcome = metrics.OutcomeClientGone
+		req.cancel()
+	case <-timer.C:
+		logger.Info("Request still processing, answering with its id")
+		outcome = metrics.OutcomeAccepted
+		status, _ := s.requests.get(requestID)
+		writeJSON(w, http.StatusAccepted, status)
+	}
+}
+
+// GetTokenStatus returns the status of a request answered with 202
+func (s *Server) GetTokenStatus(w http.ResponseWriter, r *http.Request) {
+	status, ok := s.requests.get(r.URL.Query().Get("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// wantsJSON reports whether the client asked for a JSON response rather than
+// the plain transaction hash
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("Error writing response", "error", err)
 	}
 }
 
@@ -115,21 +573,17 @@ func getInt64(query *url.Values, field string) (int64, error) {
 }
 
 func handleError(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	_, writeErr := w.Write([]byte(fmt.Sprintf("%v", err)))
-	if writeErr != nil {
-		log.Printf("Error writing error response %v", writeErr)
+	if handler.IsControlled(err) {
+		writeError(w, http.StatusForbidden, err)
+		return
 	}
+	writeError(w, http.StatusInternalServerError, err)
 }
 
-func (s *Server) startTransactionProcessor(queue chan *getTokenRequest) {
-	for {
-		req := <-queue
-		log.Printf("Received request from queue %v", req)
-		txHash, err := s.transactionHandler.ERC1155Transfer(req.ctx, req.to, req.id, req.quantity)
-		req.resChannel <- &getTokenResponse{
-			res: txHash,
-			err: err,
-		}
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	_, writeErr := w.Write([]byte(fmt.Sprintf("%v", err)))
+	if writeErr != nil {
+		slog.Error("Error writing error response", "error", writeErr)
 	}
 }
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/jobs"
+	"github.cbhq.net/engineering/sff-workshop/internal/logging"
+)
+
+// How often a comment is sent on an idle status stream, so proxies keep it open
+const streamHeartbeat = 15 * time.Second
+
+// GetTokenEvents streams the statuses of a request, given by its id or by the
+// hash of its transaction, as Server-Sent Events. The current status is sent
+// first, then each update until the status is final: queued, processing,
+// signed, submitted, mined with its confirmations, then confirmed, or
+// reverted, replaced, failed, skipped or cancelled, or else timeout when the
+// transaction was not final in time and unknown when it is no longer tracked.
+// The id of a job of async mode streams queued, processing, then submitted,
+// failed or cancelled, as read from the job queue.
+func (s *Server) GetTokenEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	requestID := query.Get("id")
+	if txHash := query.Get("tx"); requestID == "" && txHash != "" {
+		requestID, _ = s.requests.requestByTx(txHash)
+	}
+	final := finalStatus
+	status, updates, unsubscribe, ok := s.requests.subscribe(requestID)
+	if !ok && s.jobs != nil && requestID != "" {
+		var err error
+		status, updates, unsubscribe, err = s.subscribeJob(r.Context(), requestID)
+		if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+			handleError(w, err)
+			return
+		}
+		ok = err == nil
+		final = finalJobStatus
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer unsubscribe()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	logger := logging.FromContext(r.Context()).With("request_id", requestID)
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		err := writeStatusEvent(w, status)
+		if err != nil {
+			logger.Info("Status stream closed", "error", err)
+			return
+		}
+		flusher.Flush()
+		if final(status.Status) {
+			return
+		}
+
+		status, ok = s.nextStatus(r, status, updates, heartbeat, w, flusher)
+		if !ok {
+			return
+		}
+	}
+}
+
+// nextStatus waits for the update following last, sending heartbeats meanwhile, and
+// reports false when the client or the server went away
+func (s *Server) nextStatus(
+	r *http.Request,
+	last requestStatus,
+	updates <-chan requestStatus,
+	heartbeat *time.Ticker,
+	w http.ResponseWriter,
+	flusher http.Flusher,
+) (requestStatus, bool) {
+	for {
+		select {
+		case status, ok := <-updates:
+			if !ok {
+				// The request was forgotten before its status was final
+				last.Status = statusUnknown
+				last.Error = "request no longer tracked"
+				last.UpdatedAt = time.Now()
+				return last, true
+			}
+			return status, true
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return requestStatus{}, false
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return requestStatus{}, false
+		case <-s.streamsDone:
+			return requestStatus{}, false
+		}
+	}
+}
+
+func writeStatusEvent(w http.ResponseWriter, status requestStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", status.Status, data)
+	return err
+}
+
+// StopStreams ends the status streams, which would otherwise hold the HTTP
+// server open on shutdown
+func (s *Server) StopStreams() {
+	s.stopStreams.Do(func() {
+		close(s.streamsDone)
+	})
+}
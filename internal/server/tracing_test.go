@@ -0,0 +1,113 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanTree indexes the exported spans by name and by span id
+type spanTree struct {
+	byName map[string]tracetest.SpanStub
+	byID   map[trace.SpanID]tracetest.SpanStub
+}
+
+func newSpanTree(spans tracetest.SpanStubs) spanTree {
+	tree := spanTree{
+		byName: make(map[string]tracetest.SpanStub),
+		byID:   make(map[trace.SpanID]tracetest.SpanStub),
+	}
+	for _, span := range spans {
+		tree.byName[span.Name] = span
+		tree.byID[span.SpanContext.SpanID()] = span
+	}
+	return tree
+}
+
+func (tree spanTree) span(t *testing.T, name string) tracetest.SpanStub {
+	t.Helper()
+	span, ok := tree.byName[name]
+	if !ok {
+		t.Fatalf("no %s span", name)
+	}
+	return span
+}
+
+// parent returns the name of the parent of a span, empty for a root span
+func (tree spanTree) parent(t *testing.T, name string) string {
+	t.Helper()
+	span := tree.span(t, name)
+	if !span.Parent.IsValid() {
+		return ""
+	}
+	return tree.byID[span.Parent.SpanID()].Name
+}
+
+func TestGetTokenTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.Install(exporter, 1)
+	t.Cleanup(func() {
+		tracing.Shutdown(context.Background())
+	})
+	h := newHarness(t)
+	to := newRecipient(t)
+
+	code, body := getToken(t, h, to, goldBadgeID, 1)
+	if code != http.StatusOK {
+		t.Fatalf("GetToken = %d %q", code, body)
+	}
+	// The HTTP span ends once the handler returned, possibly after the
+	// client got the response
+	var tree spanTree
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := tracing.ForceFlush(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree = newSpanTree(exporter.GetSpans())
+		if _, ok := tree.byName["GET /api/gettoken"]; ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	httpSpan := tree.span(t, "GET /api/gettoken")
+	process := tree.span(t, "ProcessRequest")
+	if process.Parent.IsValid() || process.SpanContext.TraceID() == httpSpan.SpanContext.TraceID() {
+		t.Error("ProcessRequest is not the root of a trace of its own")
+	}
+	if len(process.Links) != 1 || process.Links[0].SpanContext.SpanID() != httpSpan.SpanContext.SpanID() {
+		t.Errorf("ProcessRequest links = %v, want the HTTP request span", process.Links)
+	}
+	if process.SpanKind != trace.SpanKindConsumer {
+		t.Errorf("ProcessRequest kind = %v, want %v", process.SpanKind, trace.SpanKindConsumer)
+	}
+
+	parents := map[string]string{
+		"QueueWait":           "ProcessRequest",
+		"ERC1155Transfer":     "ProcessRequest",
+		"CanTransfer":         "ERC1155Transfer",
+		"CanOwn":              "ERC1155Transfer",
+		"BalanceOf":           "CanOwn",
+		"constructUnsignedTx": "ERC1155Transfer",
+		"PendingNonceAt":      "constructUnsignedTx",
+		"SuggestGasPrice":     "constructUnsignedTx",
+		"signTx":              "ERC1155Transfer",
+		"SendTransaction":     "ERC1155Transfer",
+	}
+	for name, want := range parents {
+		if got := tree.parent(t, name); got != want {
+			t.Errorf("%s span is a child of %q, want %q", name, got, want)
+		}
+		if span := tree.span(t, name); span.SpanContext.TraceID() != process.SpanContext.TraceID() {
+			t.Errorf("%s span is not in the trace of ProcessRequest", name)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/metrics"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// txReader is the part of the node API read to follow a transaction until it
+// is mined. It is implemented by ethclient.Client, MultiClient and the
+// simulated backend.
+type txReader interface {
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	TransactionByHash(ctx context.Context, txHash common.Hash) (*types.Transaction, bool, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// txUpdate is the state of a submitted transaction: mined with fewer
+// confirmations than required, confirmed, reverted or replaced by another
+// transaction with its nonce, or else timeout or unknown when the tracking
+// stopped before one of those
+type txUpdate struct {
+	Status        string
+	BlockNumber   uint64
+	Confirmations uint64
+}
+
+// txTracker follows the submitted transactions until they are confirmed,
+// reverted or replaced
+type txTracker struct {
+	pollInterval  time.Duration
+	timeout       time.Duration
+	confirmations uint64
+
+	// ctx is cancelled on close, which stops the tracking
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newTxTracker(cfg *config.Config) *txTracker {
+	confirmations := cfg.Confirmations
+	if confirmations < 1 {
+		confirmations = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &txTracker{
+		pollInterval:  cfg.ConfirmPollInterval,
+		timeout:       cfg.ConfirmTimeout,
+		confirmations: uint64(confirmations),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// track follows the transaction submitted at submittedAt in the background,
+// for up to CONFIRM_TIMEOUT since then, telling onUpdate each time its state
+// changes, the last time with a final state. The returned channel receives
+// nil once the state is final, or why the tracking stopped before:
+// context.Canceled when the tracker is closed.
+func (t *txTracker) track(chain *handler.Chain, txHash string, submittedAt time.Time, onUpdate func(txUpdate)) <-chan error {
+	stopped := make(chan error, 1)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ctx, cancel := context.WithDeadline(t.ctx, submittedAt.Add(t.timeout))
+		defer cancel()
+		err := t.follow(ctx, chain, common.HexToHash(txHash), onUpdate)
+		if err != nil {
+			slog.Warn("Stopped tracking transaction", "chain", chain.Name(), "tx_hash", txHash, "error", err)
+			status := statusUnknown
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = statusTimeout
+			}
+			onUpdate(txUpdate{Status: status})
+		}
+		stopped <- err
+	}()
+	return stopped
+}
+
+// follow polls the node until the transaction has enough confirmations or
+// reverted, or until another transaction of the treasury is mined with its
+// nonce
+func (t *txTracker) follow(ctx context.Context, chain *handler.Chain, txHash common.Hash, onUpdate func(txUpdate)) error {
+	reader, ok := chain.Backend().(txReader)
+	if !ok {
+		return errors.New("transactions cannot be tracked with this node client")
+	}
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	var last txUpdate
+	var nonce uint64
+	knownNonce := false
+	spentRecorded := false
+	for {
+		receipt, err := reader.TransactionReceipt(ctx, txHash)
+		switch {
+		case err == nil:
+			if !spentRecorded {
+				err = observeGasSpent(ctx, chain, reader, receipt)
+				if err != nil {
+					slog.Debug("Error getting gas spent", "tx_hash", txHash.Hex(), "error", err)
+				}
+				spentRecorded = err == nil
+			}
+			update, err := t.minedUpdate(ctx, chain, receipt)
+			if err != nil {
+				slog.Debug("Error getting latest block", "tx_hash", txHash.Hex(), "error", err)
+				break
+			}
+			if update != last {
+				last = update
+				onUpdate(update)
+			}
+			if update.Status != statusMined {
+				return nil
+			}
+		case !errors.Is(err, ethereum.NotFound):
+			slog.Debug("Error getting receipt", "tx_hash", txHash.Hex(), "error", err)
+		case !knownNonce:
+			// The nonce is looked up while the transaction is still known
+			// to the node, to tell when it is replaced
+			tx, _, err := reader.TransactionByHash(ctx, txHash)
+			if err == nil {
+				nonce, knownNonce = tx.Nonce(), true
+			}
+		default:
+			mined, err := reader.NonceAt(ctx, chain.Address(), nil)
+			if err == nil && mined > nonce {
+				// Check the receipt again, as the transaction may have been
+				// mined since
+				_, err = reader.TransactionReceipt(ctx, txHash)
+				if errors.Is(err, ethereum.NotFound) {
+					onUpdate(txUpdate{Status: statusReplaced})
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// observeGasSpent records the gas paid by a mined transaction: the gas used
+// times the effective gas price, which is the base fee of its block plus the
+// tip it paid with EIP-1559, else its gas price
+func observeGasSpent(ctx context.Context, chain *handler.Chain, reader txReader, receipt *types.Receipt) error {
+	tx, _, err := reader.TransactionByHash(ctx, receipt.TxHash)
+	if err != nil {
+		return err
+	}
+	price := tx.GasPrice()
+	if tx.Type() == types.DynamicFeeTxType {
+		header, err := chain.Backend().HeaderByNumber(ctx, receipt.BlockNumber)
+		if err != nil {
+			return err
+		}
+		if header.BaseFee != nil {
+			tip, err := tx.EffectiveGasTip(header.BaseFee)
+			if err != nil {
+				return err
+			}
+			price = new(big.Int).Add(header.BaseFee, tip)
+		}
+	}
+	spent, _ := new(big.Float).SetInt(new(big.Int).Mul(price, new(big.Int).SetUint64(receipt.GasUsed))).Float64()
+	metrics.GasSpent.WithLabelValues(chain.Name()).Add(spent)
+	return nil
+}
+
+func (t *txTracker) minedUpdate(ctx context.Context, chain *handler.Chain, receipt *types.Receipt) (txUpdate, error) {
+	update := txUpdate{Status: statusMined, BlockNumber: receipt.BlockNumber.Uint64()}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		update.Status = statusReverted
+		return update, nil
+	}
+	head, err := chain.Backend().HeaderByNumber(ctx, nil)
+	if err != nil {
+		return txUpdate{}, err
+	}
+	if latest := head.Number.Uint64(); latest >= update.BlockNumber {
+		update.Confirmations = latest - update.BlockNumber + 1
+	}
+	if update.Confirmations >= t.confirmations {
+		update.Status = statusConfirmed
+	}
+	return update, nil
+}
+
+// Close stops the tracking
+func (t *txTracker) Close() {
+	t.cancel()
+	t.wg.Wait()
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/webhook"
+)
+
+// transferNotifier sends the lifecycle events of the transfers to the
+// webhooks. A nil notifier, used when no webhook is configured, does nothing.
+type transferNotifier struct {
+	dispatcher *webhook.Dispatcher
+}
+
+func newTransferNotifier(cfg *config.Config) (*transferNotifier, error) {
+	if len(cfg.WebhookURLs) == 0 {
+		return nil, nil
+	}
+	for _, eventType := range cfg.WebhookEvents {
+		if !validEventType(eventType) {
+			return nil, fmt.Errorf("unrecognized webhook event %q", eventType)
+		}
+	}
+	subs := make([]webhook.Subscription, 0, len(cfg.WebhookURLs))
+	for _, url := range cfg.WebhookURLs {
+		subs = append(subs, webhook.Subscription{
+			URL:    url,
+			Secret: cfg.WebhookSecret,
+			Events: cfg.WebhookEvents,
+		})
+	}
+	dispatcher, err := webhook.NewDispatcher(subs, cfg.WebhookMaxAttempts, cfg.WebhookRetryBackoff, cfg.WebhookDeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+	return &transferNotifier{dispatcher: dispatcher}, nil
+}
+
+func validEventType(eventType string) bool {
+	for _, t := range webhook.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *transferNotifier) queued(event webhook.Event) {
+	if n == nil {
+		return
+	}
+	event.Type = webhook.EventQueued
+	n.dispatcher.Notify(event)
+}
+
+// finished notifies the outcome of sending the transfer
+func (n *transferNotifier) finished(event webhook.Event, txHash string, err error) {
+	if n == nil {
+		return
+	}
+	if err != nil {
+		event.Type = webhook.EventFailed
+		event.Error = err.Error()
+	} else {
+		event.Type = webhook.EventSubmitted
+		event.TxHash = txHash
+	}
+	n.dispatcher.Notify(event)
+}
+
+// mined notifies the final state of the transaction of a submitted transfer
+func (n *transferNotifier) mined(submitted webhook.Event, txHash string, update txUpdate) {
+	if n == nil {
+		return
+	}
+	event := submitted
+	event.TxHash = txHash
+	event.BlockNumber = update.BlockNumber
+	switch update.Status {
+	case statusConfirmed:
+		event.Type = webhook.EventConfirmed
+	case statusReverted:
+		event.Type = webhook.EventFailed
+		event.Error = "transaction reverted"
+	case statusReplaced:
+		event.Type = webhook.EventReplaced
+	default:
+		return
+	}
+	n.dispatcher.Notify(event)
+}
+
+// Close stops the delivery retries. The events not delivered yet are
+// dead-lettered.
+func (n *transferNotifier) Close() {
+	if n == nil {
+		return
+	}
+	n.dispatcher.Close()
+}
+
+// GetWebhookDeadLetters lists the webhook events that could not be delivered
+func (s *Server) GetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.notifier == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.notifier.dispatcher.DeadLetters())
+}
+
+// replayWebhooks delivers the dead letter given by id again, or all of them
+// when id is not set
+func (s *Server) replayWebhooks(r *http.Request) (interface{}, error) {
+	if s.notifier == nil {
+		return nil, fmt.Errorf("%w: webhooks are not configured", errInvalidAdminParam)
+	}
+	replayed, err := s.notifier.dispatcher.Replay(r.URL.Query().Get("id"))
+	if errors.Is(err, webhook.ErrNotFound) || errors.Is(err, webhook.ErrUnsubscribed) {
+		return nil, fmt.Errorf("%w: %v", errInvalidAdminParam, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"replayed": replayed}, nil
+}
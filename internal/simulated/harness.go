@@ -0,0 +1,281 @@
+// Package simulated runs the server end to end against an in-memory chain.
+// The token contract is deployed on go-ethereum's simulated backend and the
+// HTTP API is served by an httptest server, so transfers can be checked
+// against real balance changes without a node.
+package simulated
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/contract"
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+	"github.cbhq.net/engineering/sff-workshop/internal/deploy"
+	"github.cbhq.net/engineering/sff-workshop/internal/handler"
+	"github.cbhq.net/engineering/sff-workshop/internal/keystore"
+	"github.cbhq.net/engineering/sff-workshop/internal/server"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/tyler-smith/go-bip39"
+)
+
+const (
+	ChainName = "simulated"
+	gasLimit  = uint64(30_000_000)
+)
+
+// ErrUnreachable is returned by the calls to a Backend set unreachable
+var ErrUnreachable = errors.New("simulated node unreachable")
+
+// Backend is a simulated chain that mines a block for every transaction it
+// receives, like an instant-sealing dev node, unless blocks are held
+type Backend struct {
+	*backends.SimulatedBackend
+	hold        atomic.Bool
+	unreachable atomic.Bool
+	chainID     atomic.Pointer[big.Int]
+	sendLatency atomic.Int64
+}
+
+var _ handler.ChainBackend = (*Backend)(nil)
+
+// ChainID returns the chain id of the simulated chain. It is missing from
+// SimulatedBackend, which always uses the chain config it was created with.
+func (b *Backend) ChainID(ctx context.Context) (*big.Int, error) {
+	if b.unreachable.Load() {
+		return nil, ErrUnreachable
+	}
+	if id := b.chainID.Load(); id != nil {
+		return id, nil
+	}
+	return b.Blockchain().Config().ChainID, nil
+}
+
+// SetUnreachable makes the node calls of the readiness checks fail, or
+// answer again
+func (b *Backend) SetUnreachable(unreachable bool) {
+	b.unreachable.Store(unreachable)
+}
+
+// ServeChainID makes the node report another chain id, as a node of another
+// chain would
+func (b *Backend) ServeChainID(id *big.Int) {
+	b.chainID.Store(id)
+}
+
+func (b *Backend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if b.unreachable.Load() {
+		return nil, ErrUnreachable
+	}
+	return b.SimulatedBackend.HeaderByNumber(ctx, number)
+}
+
+func (b *Backend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	if b.unreachable.Load() {
+		return nil, ErrUnreachable
+	}
+	return b.SimulatedBackend.CodeAt(ctx, contract, blockNumber)
+}
+
+func (b *Backend) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	if b.unreachable.Load() {
+		return nil, ErrUnreachable
+	}
+	return b.SimulatedBackend.BalanceAt(ctx, account, blockNumber)
+}
+
+func (b *Backend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	if b.unreachable.Load() {
+		return nil, ErrUnreachable
+	}
+	return b.SimulatedBackend.SuggestGasPrice(ctx)
+}
+
+// SetSendLatency makes SendTransaction answer after latency, as a slow node
+// would, or fail when its context ends first
+func (b *Backend) SetSendLatency(latency time.Duration) {
+	b.sendLatency.Store(int64(latency))
+}
+
+// SendTransaction adds the transaction to the pending block and mines it
+func (b *Backend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if latency := time.Duration(b.sendLatency.Load()); latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	err := b.SimulatedBackend.SendTransaction(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if !b.hold.Load() {
+		b.Commit()
+	}
+	return nil
+}
+
+// HoldBlocks keeps the transactions received pending until Commit is
+// called, or mines them as they come again
+func (b *Backend) HoldBlocks(hold bool) {
+	b.hold.Store(hold)
+}
+
+// Harness is a server wired to a simulated chain holding a freshly
+// deployed token contract
+type Harness struct {
+	Backend         *Backend
+	Config          *config.Config
+	Signer          keystore.Signer
+	ContractAddress common.Address
+	Contract        *contract.Contract
+	Server          *server.Server
+	HTTP            *httptest.Server
+}
+
+// Limits are the transfer and ownership limits the harness server enforces
+type Limits struct {
+	MaxGoldBadgeTotalQty    int64
+	MaxGoldBadgeTransferQty int64
+	MaxPointTotalQty        int64
+	MaxPointTransferQty     int64
+}
+
+// New funds a new wallet, deploys the token contract from it and starts
+// the server with that wallet as the treasury
+func New(ctx context.Context, limits Limits) (*Harness, error) {
+	entropy, err := bip39.NewEntropy(128)
+	if err != nil {
+		return nil, err
+	}
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config.Config{
+		Mnemonic:                mnemonic,
+		DefaultChain:            ChainName,
+		MaxGoldBadgeTotalQty:    limits.MaxGoldBadgeTotalQty,
+		MaxGoldBadgeTransferQty: limits.MaxGoldBadgeTransferQty,
+		MaxPointTotalQty:        limits.MaxPointTotalQty,
+		MaxPointTransferQty:     limits.MaxPointTransferQty,
+		RPCTimeout:              config.DefaultRPCTimeout,
+		SendTimeout:             config.DefaultSendTimeout,
+		ResponseWait:            config.DefaultResponseWait,
+		Workers:                 config.DefaultWorkers,
+		QueueSize:               config.DefaultQueueSize,
+		WebhookMaxAttempts:      config.DefaultWebhookMaxAttempts,
+		WebhookRetryBackoff:     config.DefaultWebhookRetryBackoff,
+		Confirmations:           config.DefaultConfirmations,
+		ConfirmPollInterval:     config.DefaultConfirmPollInterval,
+		ConfirmTimeout:          config.DefaultConfirmTimeout,
+		ReadyCheckInterval:      config.DefaultReadyCheckInterval,
+		ReadyRequireChains:      config.DefaultReadyRequireChains,
+	}
+	chainCfg := &config.ChainConfig{
+		Name:               ChainName,
+		FeeStrategy:        config.FeeStrategyLegacy,
+		GasPriceMultiplier: 1.5,
+		Mnemonic:           mnemonic,
+	}
+	cfg.Chains = map[string]*config.ChainConfig{ChainName: chainCfg}
+
+	signer, err := keystore.NewSigner(chainCfg)
+	if err != nil {
+		return nil, err
+	}
+	balance := new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))
+	backend := &Backend{SimulatedBackend: backends.NewSimulatedBackend(
+		core.GenesisAlloc{*signer.Address(): {Balance: balance}},
+		gasLimit,
+	)}
+
+	chainId, err := backend.ChainID(ctx)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	contractAddr, err := deploy.Deploy(ctx, backend, signer, chainId)
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("error deploying contract: %v", err)
+	}
+	chainCfg.ContractAddress = contractAddr.Hex()
+	contractInstance, err := contract.NewContract(contractAddr, backend)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	chain, err := server.NewChain(ctx, cfg, chainCfg, backend)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	s, err := server.NewServerWithChains(ctx, cfg, map[string]*handler.Chain{ChainName: chain})
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	return &Harness{
+		Backend:         backend,
+		Config:          cfg,
+		Signer:          signer,
+		ContractAddress: contractAddr,
+		Contract:        contractInstance,
+		Server:          s,
+		HTTP:            httptest.NewServer(s.Handler()),
+	}, nil
+}
+
+// GetToken calls the gettoken API and returns the status code and body
+func (h *Harness) GetToken(to common.Address, id int64, quantity int64) (int, string, error) {
+	query := url.Values{}
+	query.Set("to", to.Hex())
+	query.Set("id", strconv.FormatInt(id, 10))
+	query.Set("quantity", strconv.FormatInt(quantity, 10))
+	res, err := http.Get(h.HTTP.URL + "/api/gettoken?" + query.Encode())
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return res.StatusCode, string(body), nil
+}
+
+// BalanceOf returns the on-chain balance of a token
+func (h *Harness) BalanceOf(ctx context.Context, owner common.Address, id int64) (*big.Int, error) {
+	return h.Contract.BalanceOf(&bind.CallOpts{Context: ctx}, owner, big.NewInt(id))
+}
+
+// Close stops the HTTP server, drains the server queue and stops the
+// simulated chain
+func (h *Harness) Close() {
+	h.HTTP.Close()
+	err := h.Server.Close(context.Background())
+	if err != nil {
+		slog.Error("Error closing server", "error", err)
+	}
+	h.Backend.Close()
+}
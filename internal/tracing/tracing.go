@@ -0,0 +1,114 @@
+// Package tracing sets up the OpenTelemetry tracer provider and starts the
+// spans of the airdrop pipeline, from the HTTP request to each node call.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.cbhq.net/engineering/sff-workshop/internal/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.cbhq.net/engineering/sff-workshop"
+	serviceName         = "airdrop"
+)
+
+var provider *sdktrace.TracerProvider
+
+// Setup installs a tracer provider exporting spans to the OTLP endpoint of
+// the config. Without an endpoint spans are not recorded.
+func Setup(ctx context.Context, cfg *config.Config) error {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("error creating OTLP exporter: %v", err)
+	}
+	Install(exporter, cfg.TraceSampleRatio)
+	return nil
+}
+
+// Install makes a tracer provider sending a ratio of the traces to exporter
+// the global one. Tests install an in-memory exporter this way.
+func Install(exporter sdktrace.SpanExporter, sampleRatio float64) {
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// Shutdown exports the spans not sent yet and stops the tracer provider
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// ForceFlush exports the spans not sent yet
+func ForceFlush(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.ForceFlush(ctx)
+}
+
+// Start starts a span, child of the span of ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Record records a span of work that already happened, such as the time a
+// request spent in the queue
+func Record(ctx context.Context, name string, start time.Time, end time.Time) {
+	_, span := otel.Tracer(instrumentationName).Start(ctx, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
+
+// StartLinked starts the root span of work handed over by another trace,
+// such as a queued request, linked to the span that handed it over
+func StartLinked(
+	ctx context.Context,
+	name string,
+	link trace.SpanContext,
+	opts ...trace.SpanStartOption,
+) (context.Context, trace.Span) {
+	opts = append(opts, trace.WithNewRoot(), trace.WithSpanKind(trace.SpanKindConsumer))
+	// Requests restored after a restart have no span to link to
+	if link.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+	}
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,198 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// deadLetterStore keeps the dead letters in memory and, when path is set, in
+// a JSON file so they survive restarts. The file is shared by the processes
+// notifying the same webhooks, such as the server and the worker of async
+// mode: the letters they wrote are read again before every read and, under
+// the lock of the file, before every change.
+type deadLetterStore struct {
+	mu      sync.Mutex
+	path    string
+	letters []DeadLetter
+	// info of the file the letters were last read from or written to, nil
+	// when they need to be read again
+	info os.FileInfo
+}
+
+func loadDeadLetters(path string) (*deadLetterStore, error) {
+	store := &deadLetterStore{path: path, letters: []DeadLetter{}}
+	err := store.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *deadLetterStore) add(letter DeadLetter) error {
+	return s.update(func() error {
+		s.letters = append(s.letters, letter)
+		return nil
+	})
+}
+
+func (s *deadLetterStore) list() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		// The letters last read are listed
+		s.info = nil
+	}
+	return append([]DeadLetter{}, s.letters...)
+}
+
+// take removes and returns the dead letter with the given id, or all of them
+// when id is empty, keeping those replayable refuses
+func (s *deadLetterStore) take(id string, replayable func(DeadLetter) bool) ([]DeadLetter, error) {
+	var taken []DeadLetter
+	err := s.update(func() error {
+		kept := []DeadLetter{}
+		found := false
+		for _, letter := range s.letters {
+			if id == "" || letter.ID == id {
+				found = true
+				if replayable(letter) {
+					taken = append(taken, letter)
+					continue
+				}
+			}
+			kept = append(kept, letter)
+		}
+		if id != "" && !found {
+			return ErrNotFound
+		}
+		if id != "" && len(taken) == 0 {
+			return ErrUnsubscribed
+		}
+		s.letters = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// refresh reads the file again when another process replaced it. The caller
+// holds mu.
+func (s *deadLetterStore) refresh() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.letters = []DeadLetter{}
+		s.info = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading webhook dead letters: %v", err)
+	}
+	if s.info != nil && os.SameFile(s.info, info) && s.info.ModTime().Equal(info.ModTime()) && s.info.Size() == info.Size() {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("error reading webhook dead letters: %v", err)
+	}
+	letters := []DeadLetter{}
+	err = json.Unmarshal(data, &letters)
+	if err != nil {
+		return fmt.Errorf("error parsing webhook dead letters: %v", err)
+	}
+	s.letters = letters
+	s.info = info
+	return nil
+}
+
+// update applies a change to the latest letters and writes them, holding
+// the lock of the file so the letters of the other processes are not lost
+func (s *deadLetterStore) update(change func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return change()
+	}
+
+	unlock, err := lockDeadLetters(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+	err = change()
+	if err != nil {
+		return err
+	}
+	err = s.save()
+	if err != nil {
+		// Read the file again rather than keep a change it does not hold
+		s.info = nil
+		return err
+	}
+	return nil
+}
+
+// save writes the letters to a temporary file renamed over the previous one,
+// so a crash never leaves a truncated file. The caller holds mu and the file
+// lock.
+func (s *deadLetterStore) save() error {
+	data, err := json.MarshalIndent(s.letters, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".dead-letters-*")
+	if err != nil {
+		return fmt.Errorf("error writing webhook dead letters: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing webhook dead letters: %v", err)
+	}
+	s.info, err = os.Stat(s.path)
+	if err != nil {
+		s.info = nil
+	}
+	return nil
+}
+
+// lockDeadLetters takes the lock serializing the changes to the file
+func lockDeadLetters(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error locking webhook dead letters: %v", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking webhook dead letters: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
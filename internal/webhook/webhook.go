@@ -0,0 +1,316 @@
+// Package webhook notifies subscribers of the lifecycle of transfers with
+// signed JSON POSTs, retried with exponential backoff. Events that could not
+// be delivered are kept as dead letters until replayed.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventQueued    = "transfer.queued"
+	EventSubmitted = "transfer.submitted"
+	EventConfirmed = "transfer.confirmed"
+	EventFailed    = "transfer.failed"
+	EventReplaced  = "transfer.replaced"
+)
+
+// EventTypes are the events a subscription can filter on
+var EventTypes = []string{EventQueued, EventSubmitted, EventConfirmed, EventFailed, EventReplaced}
+
+const (
+	// Headers of each delivery. The signature is
+	// t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderSignature = "X-Webhook-Signature"
+
+	deliveryTimeout = 10 * time.Second
+	maxBackoff      = 5 * time.Minute
+)
+
+var (
+	ErrNotFound     = errors.New("dead letter not found")
+	ErrUnsubscribed = errors.New("dead letter URL is no longer subscribed")
+)
+
+// Event is the body of a delivery
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	JobID     string    `json:"jobId,omitempty"`
+	Chain     string    `json:"chain"`
+	To        string    `json:"to"`
+	TokenID   int64     `json:"tokenId"`
+	Quantity  int64     `json:"quantity"`
+	TxHash    string    `json:"txHash,omitempty"`
+	// Block the transaction was mined in, for confirmed and failed events
+	BlockNumber uint64 `json:"blockNumber,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Subscription is an endpoint receiving the events of the listed types, or
+// of every type when Events is empty
+type Subscription struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"-"`
+	Events []string `json:"events,omitempty"`
+}
+
+func (s Subscription) wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, t := range s.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DeadLetter is an event that could not be delivered to a subscription
+type DeadLetter struct {
+	// ID of the delivery, sent in the delivery header and used to replay it
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Event     Event     `json:"event"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError"`
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+type delivery struct {
+	id    string
+	sub   Subscription
+	event Event
+}
+
+// permanentError is a response that retrying will not change
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Dispatcher delivers events to the subscriptions
+type Dispatcher struct {
+	subs        []Subscription
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	deadLetters *deadLetterStore
+
+	// ctx is cancelled on Close, which stops the retries
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher delivers to subs, trying each delivery up to maxAttempts
+// times and waiting backoff, doubled after each attempt, in between. Dead
+// letters are saved to deadLetterFile when it is set.
+func NewDispatcher(subs []Subscription, maxAttempts int, backoff time.Duration, deadLetterFile string) (*Dispatcher, error) {
+	if maxAttempts < 1 {
+		return nil, errors.New("webhook attempts must be at least 1")
+	}
+	for _, sub := range subs {
+		if sub.Secret == "" {
+			return nil, fmt.Errorf("webhook %s has no secret to sign its deliveries", sub.URL)
+		}
+	}
+	store, err := loadDeadLetters(deadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		subs:        subs,
+		client:      &http.Client{Timeout: deliveryTimeout},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		deadLetters: store,
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+// Notify delivers the event in the background to every subscription of its type
+func (d *Dispatcher) Notify(event Event) {
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	for _, sub := range d.subs {
+		if sub.wants(event.Type) {
+			d.start(delivery{id: newID(), sub: sub, event: event})
+		}
+	}
+}
+
+func (d *Dispatcher) start(del delivery) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(del)
+	}()
+}
+
+// deliver tries the delivery until it succeeds, fails permanently, runs out
+// of attempts or the dispatcher is closed, and dead-letters it unless it
+// succeeded
+func (d *Dispatcher) deliver(del delivery) {
+	logger := slog.With("delivery_id", del.id, "event", del.event.Type, "event_id", del.event.ID, "url", del.sub.URL)
+	wait := d.backoff
+	var err error
+	attempts := 0
+	for attempts < d.maxAttempts {
+		attempts++
+		err = d.post(del)
+		if err == nil {
+			logger.Debug("Delivered webhook", "attempts", attempts)
+			return
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempts == d.maxAttempts {
+			break
+		}
+		logger.Info("Retrying webhook", "attempt", attempts, "retry_in", wait.String(), "error", err)
+		select {
+		case <-d.ctx.Done():
+			err = fmt.Errorf("not retried on shutdown: %v", err)
+		case <-time.After(wait):
+		}
+		if d.ctx.Err() != nil {
+			break
+		}
+		wait *= 2
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+
+	logger.Warn("Webhook dead-lettered", "attempts", attempts, "error", err)
+	storeErr := d.deadLetters.add(DeadLetter{
+		ID:        del.id,
+		URL:       del.sub.URL,
+		Event:     del.event,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now().UTC(),
+	})
+	if storeErr != nil {
+		logger.Error("Error saving dead letter", "error", storeErr)
+	}
+}
+
+func (d *Dispatcher) post(del delivery) error {
+	body, err := json.Marshal(del.event)
+	if err != nil {
+		return permanentError{err}
+	}
+	// Deliveries stop with the dispatcher, but the attempt in progress finishes
+	req, err := http.NewRequestWithContext(context.WithoutCancel(d.ctx), http.MethodPost, del.sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, del.event.Type)
+	req.Header.Set(HeaderDelivery, del.id)
+	req.Header.Set(HeaderSignature, Sign(del.sub.Secret, time.Now().Unix(), body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusRequestTimeout,
+		res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= 500:
+		return fmt.Errorf("receiver answered %s", res.Status)
+	default:
+		return permanentError{fmt.Errorf("receiver answered %s", res.Status)}
+	}
+}
+
+// DeadLetters returns the events that could not be delivered, oldest first
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	return d.deadLetters.list()
+}
+
+// Replay removes the dead letter with the given id, or every dead letter when
+// id is empty, and delivers it again. It returns the number replayed. Dead
+// letters to URLs no longer subscribed are not replayed and are kept: the
+// one given by id is refused with ErrUnsubscribed.
+func (d *Dispatcher) Replay(id string) (int, error) {
+	letters, err := d.deadLetters.take(id, func(letter DeadLetter) bool {
+		_, ok := d.subscription(letter.URL)
+		return ok
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, letter := range letters {
+		sub, _ := d.subscription(letter.URL)
+		d.start(delivery{id: letter.ID, sub: sub, event: letter.Event})
+	}
+	return len(letters), nil
+}
+
+func (d *Dispatcher) subscription(url string) (Subscription, bool) {
+	for _, sub := range d.subs {
+		if sub.URL == url {
+			return sub, true
+		}
+	}
+	return Subscription{}, false
+}
+
+// Close stops the retries, dead-lettering the events not delivered yet, and
+// waits for the attempts in progress
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Sign returns the signature header of a body sent at timestamp. Receivers
+// recompute the HMAC over "<timestamp>.<body>" and should reject timestamps
+// too far in the past.
+func Sign(secret string, timestamp int64, body []byte) string {
+	ts := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,290 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// receiver is a webhook endpoint answering each delivery with the next
+// status of its script, then with the last one
+type receiver struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	statuses   []int
+	attempts   map[string]int
+	delivered  []Event
+	deliveries chan string
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	rec := &receiver{
+		t:          t,
+		statuses:   statuses,
+		attempts:   make(map[string]int),
+		deliveries: make(chan string, 16),
+	}
+	rec.server = httptest.NewServer(http.HandlerFunc(rec.serve))
+	t.Cleanup(rec.server.Close)
+	return rec
+}
+
+func (rec *receiver) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rec.t.Error(err)
+		return
+	}
+	if !validSignature(r.Header.Get(HeaderSignature), body) {
+		rec.t.Errorf("invalid signature %q", r.Header.Get(HeaderSignature))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var event Event
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		rec.t.Errorf("invalid event %q: %v", body, err)
+	}
+	if got := r.Header.Get(HeaderEvent); got != event.Type {
+		rec.t.Errorf("%s = %q, want %q", HeaderEvent, got, event.Type)
+	}
+
+	rec.mu.Lock()
+	id := r.Header.Get(HeaderDelivery)
+	rec.attempts[id]++
+	status := rec.statuses[0]
+	if len(rec.statuses) > 1 {
+		rec.statuses = rec.statuses[1:]
+	}
+	if status == http.StatusOK {
+		rec.delivered = append(rec.delivered, event)
+	}
+	rec.mu.Unlock()
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		rec.deliveries <- id
+	}
+}
+
+// validSignature checks the signature header like a receiver should
+func validSignature(header string, body []byte) bool {
+	ts, _, ok := strings.Cut(strings.TrimPrefix(header, "t="), ",")
+	if !ok {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		return false
+	}
+	return hmac.Equal([]byte(header), []byte(Sign(testSecret, timestamp, body)))
+}
+
+func (rec *receiver) setStatuses(statuses ...int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.statuses = statuses
+}
+
+func (rec *receiver) waitDelivery(t *testing.T) string {
+	t.Helper()
+	select {
+	case id := <-rec.deliveries:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+		return ""
+	}
+}
+
+func (rec *receiver) attemptsOf(id string) int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.attempts[id]
+}
+
+func newTestDispatcher(t *testing.T, url string, maxAttempts int, deadLetterFile string) *Dispatcher {
+	t.Helper()
+	d, err := NewDispatcher(
+		[]Subscription{{URL: url, Secret: testSecret}},
+		maxAttempts,
+		time.Millisecond,
+		deadLetterFile,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+func waitDeadLetters(t *testing.T, d *Dispatcher, n int) []DeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters := d.DeadLetters()
+		if len(letters) == n {
+			return letters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dead letters, want %d", len(letters), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcherRetriesSignedDeliveries(t *testing.T) {
+	rec := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	d := newTestDispatcher(t, rec.server.URL, 3, "")
+
+	d.Notify(Event{Type: EventSubmitted, RequestID: "r1", TxHash: "0x01"})
+	id := rec.waitDelivery(t)
+	if got := rec.attemptsOf(id); got != 3 {
+		t.Errorf("delivered after %d attempts, want 3", got)
+	}
+	if rec.delivered[0].RequestID != "r1" || rec.delivered[0].ID == "" {
+		t.Errorf("delivered %+v, want the event with its id set", rec.delivered[0])
+	}
+	if letters := d.DeadLetters(); len(letters) != 0 {
+		t.Errorf("dead letters = %v after a delivery", letters)
+	}
+}
+
+func TestDispatcherDeadLettersAndReplays(t *testing.T) {
+	rec := newReceiver(t, http.StatusInternalServerError)
+	file := filepath.Join(t.TempDir(), "dead-letters.json")
+	d := newTestDispatcher(t, rec.server.URL, 2, file)
+
+	d.Notify(Event{Type: EventFailed, RequestID: "r1"})
+	letters := waitDeadLetters(t, d, 1)
+	if letters[0].Attempts != 2 || letters[0].URL != rec.server.URL || letters[0].Event.RequestID != "r1" {
+		t.Errorf("dead letter = %+v, want the event after 2 attempts", letters[0])
+	}
+	if got := rec.attemptsOf(letters[0].ID); got != 2 {
+		t.Errorf("receiver got %d attempts, want 2", got)
+	}
+
+	// Not retried: the receiver refused the delivery
+	rec.setStatuses(http.StatusBadRequest)
+	d.Notify(Event{Type: EventFailed, RequestID: "r2"})
+	letters = waitDeadLetters(t, d, 2)
+	if letters[1].Attempts != 1 {
+		t.Errorf("refused delivery attempted %d times, want 1", letters[1].Attempts)
+	}
+
+	rec.setStatuses(http.StatusOK)
+	replayed, err := d.Replay(letters[0].ID)
+	if err != nil || replayed != 1 {
+		t.Fatalf("Replay = %d, %v", replayed, err)
+	}
+	if id := rec.waitDelivery(t); id != letters[0].ID {
+		t.Errorf("replayed delivery %s, want the id of the dead letter %s", id, letters[0].ID)
+	}
+	// The remaining dead letter survives a restart
+	d.Close()
+	restarted := newTestDispatcher(t, rec.server.URL, 2, file)
+	remaining := restarted.DeadLetters()
+	if len(remaining) != 1 || remaining[0].ID != letters[1].ID {
+		t.Fatalf("dead letters after a restart = %+v, want the one not replayed", remaining)
+	}
+	replayed, err = restarted.Replay("")
+	if err != nil || replayed != 1 {
+		t.Fatalf("Replay = %d, %v", replayed, err)
+	}
+	rec.waitDelivery(t)
+	if letters := restarted.DeadLetters(); len(letters) != 0 {
+		t.Errorf("dead letters = %v after the replay", letters)
+	}
+	_, err = restarted.Replay("unknown")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Replay of an unknown id = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDispatcherKeepsDeadLettersOfUnsubscribedURLs(t *testing.T) {
+	old := newReceiver(t, http.StatusInternalServerError)
+	file := filepath.Join(t.TempDir(), "dead-letters.json")
+	d := newTestDispatcher(t, old.server.URL, 1, file)
+	d.Notify(Event{Type: EventQueued, RequestID: "r1"})
+	letter := waitDeadLetters(t, d, 1)[0]
+	d.Close()
+
+	// The URL was removed from the subscriptions
+	rec := newReceiver(t, http.StatusOK)
+	d = newTestDispatcher(t, rec.server.URL, 1, file)
+	_, err := d.Replay(letter.ID)
+	if !errors.Is(err, ErrUnsubscribed) {
+		t.Errorf("Replay = %v, want %v", err, ErrUnsubscribed)
+	}
+	replayed, err := d.Replay("")
+	if err != nil || replayed != 0 {
+		t.Errorf("Replay of all = %d, %v, want none replayed", replayed, err)
+	}
+	if letters := d.DeadLetters(); len(letters) != 1 || letters[0].ID != letter.ID {
+		t.Errorf("dead letters = %+v, want the unsubscribed one kept", letters)
+	}
+	if got := old.attemptsOf(letter.ID); got != 1 {
+		t.Errorf("unsubscribed URL got %d attempts, want only the original one", got)
+	}
+}
+
+func TestNewDispatcherRequiresSecret(t *testing.T) {
+	_, err := NewDispatcher([]Subscription{{URL: "https://example.com/hook"}}, 1, time.Second, "")
+	if err == nil {
+		t.Error("dispatcher created for a subscription without secret")
+	}
+}
+
+func TestDeadLettersSharedThroughFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead-letters.json")
+	server, err := loadDeadLetters(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The worker of async mode opens the same file
+	worker, err := loadDeadLetters(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, store := range []*deadLetterStore{server, worker, server} {
+		err = store.add(DeadLetter{ID: strconv.Itoa(i), Event: Event{RequestID: strconv.Itoa(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, store := range map[string]*deadLetterStore{"server": server, "worker": worker} {
+		if letters := store.list(); len(letters) != 3 {
+			t.Errorf("%s lists %d dead letters, want the 3 of both", name, len(letters))
+		}
+	}
+
+	all := func(DeadLetter) bool { return true }
+	taken, err := server.take("1", all)
+	if err != nil || len(taken) != 1 {
+		t.Fatalf("take of the worker's letter = %v, %v", taken, err)
+	}
+	_, err = worker.take("1", all)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("second take = %v, want %v", err, ErrNotFound)
+	}
+	restarted, err := loadDeadLetters(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := restarted.list()
+	if len(letters) != 2 || letters[0].ID != "0" || letters[1].ID != "2" {
+		t.Errorf("dead letters after a restart = %+v, want those not taken", letters)
+	}
+}
@@ -1,6 +0,0 @@
-const Migrations = artifacts.require("Migrations");
-
-module.exports = function (deployer) {
-    deployer.deploy(Migrations)
-    
-}
\ No newline at end of file
@@ -1,5 +0,0 @@
-const RockSolidToken = artifacts.require("RockSolidToken");
-
-module.exports = function (deployer) {
-    deployer.deploy(RockSolidToken);
-}
\ No newline at end of file